@@ -1,39 +1,29 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"io"
-	"log"
 	"os"
-	"strings"
+	"os/signal"
+	"syscall"
 
 	"github.com/shi0rik0/ssync/internal/cli"
-	"github.com/sirupsen/logrus"
 )
 
 func main() {
-	// Set up logrus logging.
-	logLevel := strings.ToLower(os.Getenv("LOG"))
-	if logLevel != "" {
-		fmt.Printf("You have set the log level to '%s'\n", logLevel)
-		switch logLevel {
-		case "debug":
-			logrus.SetLevel(logrus.DebugLevel)
-		case "info":
-			logrus.SetLevel(logrus.InfoLevel)
-		case "warn":
-			logrus.SetLevel(logrus.WarnLevel)
-		case "error":
-			logrus.SetLevel(logrus.ErrorLevel)
-		default:
-			fmt.Printf("Unknown log level '%s', defaulting to 'info'\n", logLevel)
-			logrus.SetLevel(logrus.InfoLevel)
-		}
-	} else {
-		logrus.SetOutput(io.Discard) // Disable logging if LOG is not set.
-	}
+	// The first Ctrl-C (or SIGTERM) asks the running command to stop gracefully;
+	// once that has been requested, a second one kills the process as usual.
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		signal.Stop(signals)
+		fmt.Fprintln(os.Stderr, "\nStopping, press Ctrl-C again to abort immediately...")
+		cancel()
+	}()
 
-	if err := cli.Execute(); err != nil {
-		log.Fatal(err)
-	}
+	code := cli.Execute(ctx)
+	cancel()
+	os.Exit(code)
 }
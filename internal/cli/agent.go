@@ -0,0 +1,23 @@
+package cli
+
+import (
+	"github.com/shi0rik0/ssync/internal/core"
+	"github.com/spf13/cobra"
+)
+
+var agentCmd = &cobra.Command{
+	Use:   "agent",
+	Short: "Answers requests for manifests and file content on stdin and stdout, for sync, compare and diff over SSH.",
+	Long: `Answers requests for manifests and file content on its standard input and output.
+It is not meant to be run by hand: sync, compare and diff start it over SSH when given a
+location of the form [user@]host:path, much like rsync. A single letter before the colon is
+a drive, as in C:\Data or x:dir; give a host with a single-letter name as user@x:dir.
+
+The agent keeps the manifests of the directories it was asked about in the user's cache
+directory, so that only files that changed since the last request are hashed again.
+
+$SSYNC_SSH selects the ssh command (default "ssh", e.g. "ssh -p 2222") and
+$SSYNC_REMOTE_COMMAND the ssync command on the remote host (default "ssync").`,
+	Args: cobra.NoArgs,
+	RunE: core.Agent,
+}
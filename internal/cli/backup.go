@@ -0,0 +1,23 @@
+package cli
+
+import (
+	"github.com/shi0rik0/ssync/internal/core"
+	"github.com/spf13/cobra"
+)
+
+var backupCmd = &cobra.Command{
+	Use:   "backup <directory> <repository>",
+	Short: "Stores a directory in a backup repository as a new snapshot.",
+	Long: `Stores the files of a directory in a backup repository, creating the repository if needed,
+and records them as a new snapshot. Each content is stored once, named by its hash, so files that
+are identical, within the directory or across snapshots, take no additional space. Files that did not
+change since the last snapshot of the same directory, by modified time and size, are not read again.
+
+Use 'ssync snapshots' to list the snapshots and 'ssync restore' to get the files back.`,
+	Args: core.ProfileArgs(cobra.ExactArgs(2)),
+	RunE: core.WithProfile(core.Backup, core.ProfileSource, core.ProfileDestination),
+}
+
+func init() {
+	addErrorPolicyFlags(backupCmd, "read", "record them with an error")
+}
@@ -7,11 +7,16 @@ import (
 
 var compareCmd = &cobra.Command{
 	Use:   "compare <directory1> <directory2>",
-	Short: "Compares two directories and outputs differences.",
-	Args:  cobra.ExactArgs(2),
-	Run:   core.Compare,
+	Short: "Compares two directories, local or remote, and outputs differences.",
+	Args:  core.ProfileArgs(cobra.ExactArgs(2)),
+	RunE:  core.WithProfile(core.Compare, core.ProfileSource, core.ProfileDestination),
 }
 
 func init() {
 	compareCmd.Flags().BoolVarP(new(bool), "strict", "s", false, "Perform a strict comparison.")
+	compareCmd.Flags().String("quick-hash", "", "Compare quick hashes of the size and the first, middle and last N bytes (default 1M) instead of full hashes. Probabilistic.")
+	compareCmd.Flags().Lookup("quick-hash").NoOptDefVal = "1M"
+	addErrorPolicyFlags(compareCmd, "read", "report them as differing")
+	compareCmd.Flags().String("format", "text", "Output format: text, paths (one per line), json, or manifest (the entries of the files of directory1 that are missing or differ in directory2; needs --strict or --quick-hash).")
+	compareCmd.MarkFlagsMutuallyExclusive("strict", "quick-hash")
 }
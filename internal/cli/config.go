@@ -0,0 +1,27 @@
+package cli
+
+import (
+	"github.com/shi0rik0/ssync/internal/core"
+	"github.com/spf13/cobra"
+)
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Shows the configuration file and its profiles.",
+}
+
+var configShowCmd = &cobra.Command{
+	Use:   "show",
+	Short: "Prints the profiles of the configuration file, or only the one selected with --profile.",
+	Long: `Prints the profiles of the configuration file, or only the one selected with --profile.
+
+A profile may set source, destination and manifest, which stand in for the positional arguments,
+hash, which is md5 (the default), quick or quick:<window>, and the default of any command line flag by its name,
+such as ignore, on-error or block-size.`,
+	Args: cobra.NoArgs,
+	RunE: core.ConfigShow,
+}
+
+func init() {
+	configCmd.AddCommand(configShowCmd)
+}
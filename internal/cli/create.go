@@ -8,6 +8,16 @@ import (
 var createCmd = &cobra.Command{
 	Use:   "create <directory> <manifest>",
 	Short: "Generates a manifest file for a directory.",
-	Args:  cobra.ExactArgs(2),
-	Run:   core.Create,
+	Args:  core.ProfileArgs(cobra.ExactArgs(2)),
+	RunE:  core.WithProfile(core.Create, core.ProfileSource, core.ProfileManifest),
+}
+
+func init() {
+	createCmd.Flags().String("block-size", "", "Also record a hash for each block of this size (e.g. 4M), for delta transfers.")
+	createCmd.Flags().Bool("content-defined", false, "Split files into content-defined chunks of about --block-size (default 1M) instead of fixed-size blocks, for files that get data inserted or removed.")
+	createCmd.Flags().String("quick-hash", "", "Record quick hashes of the size and the first, middle and last N bytes (default 1M) instead of full hashes. Probabilistic.")
+	createCmd.Flags().Lookup("quick-hash").NoOptDefVal = "1M"
+	createCmd.Flags().Bool("force", false, "Overwrite the manifest if it already exists.")
+	createCmd.Flags().Bool("resume", false, "Continue from the partial manifest (<manifest>.partial) saved by an interrupted run.")
+	addErrorPolicyFlags(createCmd, "read", "record them with an error")
 }
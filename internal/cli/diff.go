@@ -0,0 +1,13 @@
+package cli
+
+import (
+	"github.com/shi0rik0/ssync/internal/core"
+	"github.com/spf13/cobra"
+)
+
+var diffCmd = &cobra.Command{
+	Use:   "diff <manifest1> <manifest2>",
+	Short: "Compares two manifests, or the current manifests of remote directories, and outputs differences.",
+	Args:  cobra.ExactArgs(2),
+	RunE:  core.Diff,
+}
@@ -0,0 +1,29 @@
+package cli
+
+import (
+	"github.com/shi0rik0/ssync/internal/core"
+	"github.com/spf13/cobra"
+)
+
+var dupesCmd = &cobra.Command{
+	Use:   "dupes <manifest>...",
+	Short: "Finds files with identical content in one or more manifests.",
+	Long: `Groups the files of one or more manifests by size and hash, without reading the files, and lists
+the groups of identical files, the ones wasting the most space first.
+
+With --verify, the files of each group are also compared byte by byte on disk before they are
+reported. This needs the directory each manifest describes, given with --root in the order of the manifests.
+Files recorded with quick hashes are grouped by their quick hash, which only samples their content:
+without --verify, those groups are listed as possible copies and left out of the wasted total.`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: core.Dupes,
+}
+
+func init() {
+	dupesCmd.Flags().String("min-size", "", "Leave out files smaller than this (e.g. 1M). Empty files are always left out.")
+	addIgnoreFlag(dupesCmd)
+	dupesCmd.Flags().StringArray("root", nil, "Directory described by the manifest at the same position (repeatable). Paths are then shown on disk.")
+	dupesCmd.Flags().Bool("verify", false, "Compare the files of each group byte by byte on disk before reporting them.")
+	dupesCmd.Flags().Int("top", 0, "Only list this many groups, the ones wasting the most space.")
+	dupesCmd.Flags().Bool("json", false, "Print the groups as JSON.")
+}
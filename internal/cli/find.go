@@ -0,0 +1,40 @@
+package cli
+
+import (
+	"github.com/shi0rik0/ssync/internal/core"
+	"github.com/spf13/cobra"
+)
+
+var findCmd = &cobra.Command{
+	Use:   "find <manifest>...",
+	Short: "Lists the files of one or more manifests that match the given conditions.",
+	Long: `Lists the files of one or more manifests that match all of the given conditions, without touching
+the file system, e.g. to search the manifests of drives that are offline:
+
+  ssync find archive.csv --glob 'photos/2019/**/*.cr2' --larger-than 10M --modified-after 2023-01-01
+
+With --format manifest, the files are written to stdout as a manifest of their own.`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: core.Find,
+}
+
+var lsCmd = &cobra.Command{
+	Use:   "ls <manifest> [directory]",
+	Short: "Lists the files and directories directly below a directory of a manifest.",
+	Args:  cobra.RangeArgs(1, 2),
+	RunE:  core.Ls,
+}
+
+func init() {
+	findCmd.Flags().String("glob", "", "Path pattern, where ** matches any number of directories (e.g. photos/**/*.jpg).")
+	findCmd.Flags().String("name", "", "Pattern for the file name (e.g. *.jpg).")
+	findCmd.Flags().String("hash", "", "Start of the hash.")
+	findCmd.Flags().String("larger-than", "", "Only files larger than this (e.g. 1G).")
+	findCmd.Flags().String("smaller-than", "", "Only files smaller than this (e.g. 4K).")
+	findCmd.Flags().String("modified-after", "", "Only files modified after this date or time (e.g. 2023-01-01 or 2023-01-01 15:04:05).")
+	findCmd.Flags().String("modified-before", "", "Only files modified before this date or time.")
+	findCmd.Flags().Bool("unreadable", false, "Only files that could not be read when the manifest was written.")
+	findCmd.Flags().String("format", "text", "Output format: text, paths (one per line), json, or manifest (a single manifest only).")
+
+	lsCmd.Flags().Bool("json", false, "Print the entries as JSON.")
+}
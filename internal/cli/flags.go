@@ -0,0 +1,24 @@
+package cli
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+// addErrorPolicyFlags registers --on-error and --ignore for a command that walks a directory tree.
+// failure is what cannot be done to a file, e.g. "read", and skipped what skip does with such files.
+func addErrorPolicyFlags(cmd *cobra.Command, failure, skipped string) {
+	addOnErrorFlag(cmd, failure, skipped)
+	addIgnoreFlag(cmd)
+}
+
+// addOnErrorFlag registers --on-error; see addErrorPolicyFlags.
+func addOnErrorFlag(cmd *cobra.Command, failure, skipped string) {
+	cmd.Flags().String("on-error", "skip", fmt.Sprintf("What to do with files that cannot be %s: skip (%s), abort, or retry:N (retry N times, then skip).", failure, skipped))
+}
+
+// addIgnoreFlag registers --ignore, whose patterns are matched by the ignore rules of internal/core.
+func addIgnoreFlag(cmd *cobra.Command) {
+	cmd.Flags().StringArray("ignore", nil, "Leave out files and directories matching this pattern (repeatable): a name at any depth (e.g. *.tmp) or, with a slash, a path from the root (e.g. cache/*).")
+}
@@ -0,0 +1,52 @@
+package cli
+
+import (
+	"github.com/shi0rik0/ssync/internal/core"
+	"github.com/spf13/cobra"
+)
+
+var historyCmd = &cobra.Command{
+	Use:   "history <history>",
+	Short: "Lists the generations of a manifest history.",
+	Long: `A manifest history is a directory holding the successive versions, or generations, of the
+manifest of a directory. Most generations are stored as the changes from the previous one.
+'ssync update --history' records each update; 'ssync history add' records existing manifests.
+Use 'ssync log' to see how files changed and 'ssync show' to see a generation.`,
+	Args: cobra.ExactArgs(1),
+	RunE: core.History,
+}
+
+var historyAddCmd = &cobra.Command{
+	Use:   "add <history> <manifest>...",
+	Short: "Records manifests as the newest generations of a manifest history, in the order given.",
+	Args:  cobra.MinimumNArgs(2),
+	RunE:  core.HistoryAdd,
+}
+
+var logCmd = &cobra.Command{
+	Use:   "log <history> [path]",
+	Short: "Shows when files appeared, changed, moved or disappeared across the generations of a manifest history.",
+	Long: `Shows when the files at or below a path (all files if none is given) appeared, changed, moved or
+disappeared, generation by generation. Files are considered moved when a file with the same hash
+and size disappeared in the same generation.`,
+	Args: cobra.RangeArgs(1, 2),
+	RunE: core.Log,
+}
+
+var showCmd = &cobra.Command{
+	Use:   "show <history> <generation> [path]",
+	Short: "Lists the files of a generation of a manifest history, or writes it as a manifest.",
+	Long: `Lists the files of a generation, given by its number or as "latest", at or below a path
+(all files if none is given). With --output, they are written as a manifest instead, which can be
+used with diff and the other commands.`,
+	Args: cobra.RangeArgs(2, 3),
+	RunE: core.Show,
+}
+
+func init() {
+	logCmd.Flags().Bool("json", false, "Print the changes as JSON.")
+	showCmd.Flags().String("output", "", "Write the files as a manifest to this path instead of listing them.")
+	showCmd.Flags().Bool("force", false, "Overwrite the --output manifest if it already exists.")
+
+	historyCmd.AddCommand(historyAddCmd)
+}
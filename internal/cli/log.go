@@ -0,0 +1,88 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// logFile is the file opened for --log-file, closed by Execute.
+var logFile *os.File
+
+// operationHook adds the command being run to every log record,
+// so that records from different runs can be told apart in a shared log pipeline.
+type operationHook struct {
+	operation string
+}
+
+func (h operationHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h operationHook) Fire(entry *logrus.Entry) error {
+	if _, ok := entry.Data["op"]; !ok {
+		entry.Data["op"] = h.operation
+	}
+	return nil
+}
+
+// setupLogging configures logrus from the --log-level, --log-file and --log-format flags.
+// Without --log-level, the LOG environment variable is used. Without either, nothing is logged
+// unless a log file is given, in which case the level is info.
+// Logs go to stderr or the log file, never to stdout, so that they do not mix with the output of a command.
+func setupLogging(cmd *cobra.Command) error {
+	levelFlag, err := cmd.Flags().GetString("log-level")
+	if err != nil {
+		return fmt.Errorf("error retrieving log-level flag: %v", err)
+	}
+	path, err := cmd.Flags().GetString("log-file")
+	if err != nil {
+		return fmt.Errorf("error retrieving log-file flag: %v", err)
+	}
+	format, err := cmd.Flags().GetString("log-format")
+	if err != nil {
+		return fmt.Errorf("error retrieving log-format flag: %v", err)
+	}
+
+	name := strings.ToLower(levelFlag)
+	if name == "" {
+		name = strings.ToLower(os.Getenv("LOG"))
+	}
+	if name == "" && path != "" {
+		name = "info"
+	}
+	if name == "" || name == "off" {
+		logrus.SetOutput(io.Discard)
+		return nil
+	}
+	level, err := logrus.ParseLevel(name)
+	if err != nil {
+		return fmt.Errorf("invalid log level %q: must be debug, info, warn, error or off", name)
+	}
+
+	switch format {
+	case "text":
+		logrus.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
+	case "json":
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		return fmt.Errorf("invalid log-format flag %q: must be text or json", format)
+	}
+
+	var w io.Writer = os.Stderr
+	if path != "" {
+		logFile, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("error opening log file: %v", err)
+		}
+		w = logFile
+	}
+	logrus.SetOutput(w)
+	logrus.SetLevel(level)
+	logrus.AddHook(operationHook{operation: strings.TrimPrefix(cmd.CommandPath(), cmd.Root().Name()+" ")})
+	return nil
+}
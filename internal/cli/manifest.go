@@ -0,0 +1,83 @@
+package cli
+
+import (
+	"github.com/shi0rik0/ssync/internal/core"
+	"github.com/spf13/cobra"
+)
+
+var manifestCmd = &cobra.Command{
+	Use:   "manifest",
+	Short: "Checks, signs and maintains manifest files.",
+}
+
+var manifestKeygenCmd = &cobra.Command{
+	Use:   "keygen <private-key> <public-key>",
+	Short: "Generates an ed25519 key pair for signing manifests.",
+	Args:  cobra.ExactArgs(2),
+	RunE:  core.ManifestKeygen,
+}
+
+var manifestSignCmd = &cobra.Command{
+	Use:   "sign <manifest> <private-key>",
+	Short: "Checks a manifest and writes a detached signature for it.",
+	Args:  cobra.ExactArgs(2),
+	RunE:  core.ManifestSign,
+}
+
+var manifestVerifyCmd = &cobra.Command{
+	Use:   "verify <manifest> [public-key]",
+	Short: "Checks a manifest for truncation or corruption, and its signature if a public key is given.",
+	Args:  cobra.RangeArgs(1, 2),
+	RunE:  core.ManifestVerify,
+}
+
+var manifestSealCmd = &cobra.Command{
+	Use:   "seal <manifest> <sealed-manifest>",
+	Short: "Adds an integrity trailer to a manifest written by an older ssync.",
+	Long: `Adds an integrity trailer to a manifest written by an older ssync.
+
+Manifests from before integrity trailers existed are still read by every command, with a warning,
+since a truncated one cannot be told from a complete one. Sealing a manifest once, e.g.
+'ssync manifest seal old.csv sealed.csv', makes it checked like a new one from then on.`,
+	Args: cobra.ExactArgs(2),
+	RunE: core.ManifestSeal,
+}
+
+var manifestSplitCmd = &cobra.Command{
+	Use:   "split <manifest> <directory>",
+	Short: "Writes a manifest of a directory of a manifest, with paths relative to that directory.",
+	Long: `Writes a manifest of the files below a directory of a manifest, with paths relative to that
+directory, so that it describes the directory as a root of its own, e.g. after moving it to another drive.
+The hashes are kept, so 'ssync update' does not have to hash the files again.`,
+	Args: cobra.ExactArgs(2),
+	RunE: core.ManifestSplit,
+}
+
+var manifestMergeCmd = &cobra.Command{
+	Use:   "merge <manifest[:directory]>...",
+	Short: "Combines manifests into one, each below its directory.",
+	Long: `Combines manifests into one, putting the files of each manifest below the directory given after
+it (e.g. photos.csv:media/photos), or at the root if none is given. Merging a single manifest moves
+its files below a directory. Nothing is written if two files end up at the same path.`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: core.ManifestMerge,
+}
+
+func init() {
+	manifestSignCmd.Flags().String("signature", "", "Signature file to write (default <manifest>.sig).")
+	manifestVerifyCmd.Flags().String("signature", "", "Signature file to check (default <manifest>.sig).")
+
+	for _, cmd := range []*cobra.Command{manifestSplitCmd, manifestMergeCmd} {
+		cmd.Flags().StringP("output", "o", "", "Manifest to write.")
+		cmd.MarkFlagRequired("output")
+		cmd.Flags().Bool("force", false, "Overwrite the output manifest if it already exists.")
+		cmd.Flags().Bool("keep-file-ids", false, "Keep the NTFS file IDs, for files that stay on the same volume. By default they are dropped and recorded anew by 'ssync update'.")
+	}
+
+	manifestCmd.AddCommand(manifestKeygenCmd)
+	manifestCmd.AddCommand(manifestSignCmd)
+	manifestCmd.AddCommand(manifestVerifyCmd)
+	manifestCmd.AddCommand(manifestSealCmd)
+	manifestCmd.AddCommand(manifestSplitCmd)
+	manifestCmd.AddCommand(manifestMergeCmd)
+}
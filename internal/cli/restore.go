@@ -0,0 +1,22 @@
+package cli
+
+import (
+	"github.com/shi0rik0/ssync/internal/core"
+	"github.com/spf13/cobra"
+)
+
+var restoreCmd = &cobra.Command{
+	Use:   "restore <repository> <snapshot> <directory>",
+	Short: "Restores the files of a snapshot from a backup repository.",
+	Long: `Restores the files of a snapshot, given by its ID or as "latest", into a directory, with their
+content and modified time, and its directories, including empty ones, with their modified time.
+Every file is verified against its hash. The directory must be empty or missing, unless --force
+is given: files already in it that are not in the snapshot are then left alone.`,
+	Args: cobra.ExactArgs(3),
+	RunE: core.Restore,
+}
+
+func init() {
+	restoreCmd.Flags().Bool("force", false, "Restore into a directory that is not empty, overwriting the files of the snapshot and leaving other files alone.")
+	addOnErrorFlag(restoreCmd, "restored", "report them and continue")
+}
@@ -1,21 +1,100 @@
 package cli
 
-import "github.com/spf13/cobra"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/shi0rik0/ssync/internal/core"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
 
 var rootCmd = &cobra.Command{
 	Use:   "ssync",
 	Short: "A simple file synchronization utility.",
-	Long:  `ssync is a command-line tool for synchronizing files.`,
+	Long: `ssync is a command-line tool for synchronizing files.
+
+Exit codes:
+  0  success; for compare, diff and manifest verify: no differences
+  1  compare, diff or manifest verify found differences
+  2  the command completed, but some files could not be processed
+  3  the command failed`,
+	// Errors are printed by Execute. Usage is only printed for invalid arguments and flags,
+	// which are checked before PersistentPreRunE.
+	SilenceErrors: true,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+		// The profile comes first, as it may set the logging flags.
+		if err := core.ApplyProfile(cmd); err != nil {
+			return err
+		}
+		if err := setupLogging(cmd); err != nil {
+			return err
+		}
+		started = time.Now()
+		logrus.WithField("args", args).Info("Command started")
+		return nil
+	},
 }
 
-func Execute() error {
-	return rootCmd.Execute()
+// started is when the command began running, for the log record of its duration.
+var started time.Time
+
+// Execute runs the command given on the command line and returns the exit code.
+// Errors are printed to stderr. Long-running commands stop when ctx is cancelled.
+func Execute(ctx context.Context) int {
+	err := rootCmd.ExecuteContext(ctx)
+	var exitErr *core.ExitError
+	if err != nil && (!errors.As(err, &exitErr) || exitErr.Err != nil) {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	}
+	code := core.ExitCode(err)
+	if !started.IsZero() {
+		entry := logrus.WithFields(logrus.Fields{"seconds": time.Since(started).Seconds(), "exitCode": code})
+		if err != nil {
+			entry = entry.WithError(err)
+		}
+		entry.Info("Command finished")
+	}
+	if logFile != nil {
+		logFile.Close()
+	}
+	return code
 }
 
 func init() {
+	rootCmd.PersistentFlags().BoolP("quiet", "q", false, "Do not print progress.")
+	rootCmd.PersistentFlags().String("progress", "auto", "How to print progress: auto (a live line on a terminal, plain otherwise), line, plain, json or none. Progress goes to stderr.")
+	rootCmd.PersistentFlags().String("log-level", "", "Log level: debug, info, warn, error or off (default: the LOG environment variable, otherwise off, or info with --log-file).")
+	rootCmd.PersistentFlags().String("log-file", "", "Append log records to this file instead of writing them to stderr.")
+	rootCmd.PersistentFlags().String("log-format", "text", "Format of log records: text or json.")
+	rootCmd.PersistentFlags().String("config", "", "Configuration file (default $XDG_CONFIG_HOME/ssync/config.toml, or config.toml in the ssync directory of the user's configuration directory).")
+	rootCmd.PersistentFlags().String("profile", "", "Take the arguments and default flag values from this profile of the configuration file.")
+
 	// 将所有子命令添加到根命令
 	rootCmd.AddCommand(createCmd)
 	rootCmd.AddCommand(updateCmd)
 	rootCmd.AddCommand(compareCmd)
+	rootCmd.AddCommand(diffCmd)
+	rootCmd.AddCommand(manifestCmd)
+	rootCmd.AddCommand(syncCmd)
+	rootCmd.AddCommand(watchCmd)
+	rootCmd.AddCommand(serveCmd)
+	rootCmd.AddCommand(agentCmd)
+	rootCmd.AddCommand(backupCmd)
+	rootCmd.AddCommand(restoreCmd)
+	rootCmd.AddCommand(snapshotsCmd)
+	rootCmd.AddCommand(historyCmd)
+	rootCmd.AddCommand(logCmd)
+	rootCmd.AddCommand(showCmd)
+	rootCmd.AddCommand(dupesCmd)
+	rootCmd.AddCommand(statsCmd)
+	rootCmd.AddCommand(duCmd)
+	rootCmd.AddCommand(findCmd)
+	rootCmd.AddCommand(lsCmd)
+	rootCmd.AddCommand(configCmd)
 	rootCmd.AddCommand(versionCmd)
 }
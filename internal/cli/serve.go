@@ -0,0 +1,26 @@
+package cli
+
+import (
+	"github.com/shi0rik0/ssync/internal/core"
+	"github.com/spf13/cobra"
+)
+
+var serveCmd = &cobra.Command{
+	Use:   "serve <directory> <manifest>",
+	Short: "Exposes a directory and its manifest over HTTP, for compare, diff and sync on other machines.",
+	Long: `Exposes a directory over HTTP until stopped with Ctrl-C. Clients use the URL of the server
+(e.g. http://host:7878/) in place of a directory for compare and as the source of sync, and in
+place of a manifest for diff. The manifest is brought up to date whenever a client asks for it.
+
+Every request must carry the token, given with --token or $SSYNC_TOKEN. Clients take it from $SSYNC_TOKEN.`,
+	Args: core.ProfileArgs(cobra.ExactArgs(2)),
+	RunE: core.WithProfile(core.Serve, core.ProfileSource, core.ProfileManifest),
+}
+
+func init() {
+	serveCmd.Flags().String("listen", "127.0.0.1:7878", "Address to listen on. Use e.g. :7878 to accept connections from other machines.")
+	serveCmd.Flags().String("token", "", "Token that clients must present (default $SSYNC_TOKEN).")
+	serveCmd.Flags().String("block-size", "", "Also record a hash for each block of this size (e.g. 4M), so that sync transfers only changed blocks.")
+	serveCmd.Flags().Bool("content-defined", false, "Split files into content-defined chunks of about --block-size (default 1M) instead of fixed-size blocks, for files that get data inserted or removed.")
+	addErrorPolicyFlags(serveCmd, "read", "record them with an error")
+}
@@ -0,0 +1,13 @@
+package cli
+
+import (
+	"github.com/shi0rik0/ssync/internal/core"
+	"github.com/spf13/cobra"
+)
+
+var snapshotsCmd = &cobra.Command{
+	Use:   "snapshots <repository>",
+	Short: "Lists the snapshots of a backup repository.",
+	Args:  cobra.ExactArgs(1),
+	RunE:  core.Snapshots,
+}
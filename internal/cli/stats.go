@@ -0,0 +1,37 @@
+package cli
+
+import (
+	"github.com/shi0rik0/ssync/internal/core"
+	"github.com/spf13/cobra"
+)
+
+var statsCmd = &cobra.Command{
+	Use:   "stats <manifest>",
+	Short: "Summarizes the files of a manifest: sizes, extensions, ages and the largest files.",
+	Long: `Summarizes the files of a manifest without touching the file system: their number and total size,
+how they are distributed by size, extension and age (by modified time), and the largest files.`,
+	Args: core.ProfileArgs(cobra.ExactArgs(1)),
+	RunE: core.WithProfile(core.Stats, core.ProfileManifest),
+}
+
+var duCmd = &cobra.Command{
+	Use:   "du <manifest> [directory]",
+	Short: "Shows the total size of the files below each directory of a manifest.",
+	Long: `Shows the number and total size of the files below a directory of a manifest (the root if none
+is given) and below each directory under it, down to --depth levels, without touching the file system.
+
+With --compare, the directories are listed with their size in an older manifest and in the manifest,
+if it changed, to show where the space went.`,
+	Args: core.ProfileArgs(cobra.RangeArgs(1, 2)),
+	RunE: core.WithProfile(core.Du, core.ProfileManifest),
+}
+
+func init() {
+	statsCmd.Flags().Int("top", 10, "Number of extensions and of largest files to list (at least 1); the other extensions are added up as (other).")
+	statsCmd.Flags().Bool("json", false, "Print the statistics as JSON.")
+
+	duCmd.Flags().Int("depth", 1, "Number of directory levels to list below the directory.")
+	duCmd.Flags().String("compare", "", "Older manifest to compare the sizes with.")
+	duCmd.Flags().String("sort", "name", "Order of the directories below the first one: name, or size (largest, or largest change, first).")
+	duCmd.Flags().Bool("json", false, "Print the directories as JSON.")
+}
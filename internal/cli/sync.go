@@ -0,0 +1,46 @@
+package cli
+
+import (
+	"github.com/shi0rik0/ssync/internal/core"
+	"github.com/spf13/cobra"
+)
+
+var syncCmd = &cobra.Command{
+	Use:   "sync <source> <destination>",
+	Short: "Copies new and changed files from one directory, local or remote, to another directory or an S3 bucket.",
+	Long: `Copies new and changed files from the source directory to the destination directory.
+
+Changed files larger than one block are not copied as a whole: only the blocks whose
+hash differs are rewritten, and the result is verified against the source hash.
+Blocks have a fixed size and are compared at the same offset, so data inserted into or removed
+from a file shifts the blocks after it, which are then all transferred again. With
+--content-defined, files are split into content-defined chunks instead, whose boundaries
+depend on the content and move along with it: a changed file is rebuilt from the chunks
+the destination already has, at whatever offset, and only the other chunks are transferred.
+Block lists recorded with 'create --block-size' or 'update --block-size' (and
+--content-defined) are used when the manifests are given, which avoids reading unchanged
+blocks at all.
+
+The source may be on another machine: the URL of a server started with 'ssync serve'
+(e.g. http://host:7878/), or [user@]host:path, which runs 'ssync agent' on the host over SSH.
+Its manifest then lists the source files and provides their block lists, so only the
+changed blocks are transferred.
+
+The destination may be an S3 bucket, s3://bucket/prefix. Changed files are uploaded as a
+whole, large ones in parts, with their hash and modified time in the object metadata.
+The bucket is not listed: the manifest stored in it says what it holds. The endpoint is
+taken from $SSYNC_S3_ENDPOINT (default https://s3.amazonaws.com), the credentials from
+$AWS_ACCESS_KEY_ID and $AWS_SECRET_ACCESS_KEY or ~/.aws/credentials.`,
+	Args: core.ProfileArgs(cobra.ExactArgs(2)),
+	RunE: core.WithProfile(core.Sync, core.ProfileSource, core.ProfileDestination),
+}
+
+func init() {
+	syncCmd.Flags().String("block-size", "", "Block size for delta transfers, or the average chunk size with --content-defined (default 1M).")
+	syncCmd.Flags().Bool("content-defined", false, "Transfer deltas of content-defined chunks instead of fixed-size blocks, so that data inserted into or removed from a file only transfers the chunks around it.")
+	syncCmd.Flags().String("source-manifest", "", "Manifest of the source directory with block lists.")
+	syncCmd.Flags().String("destination-manifest", "", "Manifest of the destination directory with block lists.")
+	syncCmd.Flags().Bool("in-place", false, "Write changed blocks directly into the destination file instead of a temporary copy (fixed-size blocks only).")
+	syncCmd.Flags().Bool("delete", false, "Delete files that only exist in the destination, except below source directories that could not be listed.")
+	addErrorPolicyFlags(syncCmd, "synced", "report them and continue")
+}
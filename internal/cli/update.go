@@ -6,8 +6,27 @@ import (
 )
 
 var updateCmd = &cobra.Command{
-	Use:   "update <directory> <old-manifest> <new-manifest>",
+	Use:   "update <directory> <old-manifest> [new-manifest]",
 	Short: "Updates a manifest file.",
-	Args:  cobra.ExactArgs(3),
-	Run:   core.Update,
+	Long: `Updates a manifest file, re-hashing only files that are new or changed.
+
+Without a new manifest path, the old manifest is replaced atomically and the
+previous versions are kept as <manifest>.1 (newest) to <manifest>.N.`,
+	Args: core.ProfileArgs(cobra.RangeArgs(2, 3)),
+	RunE: core.WithProfile(core.Update, core.ProfileSource, core.ProfileManifest),
+}
+
+func init() {
+	updateCmd.Flags().String("block-size", "", "Also record a hash for each block of this size (e.g. 4M), for delta transfers.")
+	updateCmd.Flags().Bool("content-defined", false, "Split files into content-defined chunks of about --block-size (default 1M) instead of fixed-size blocks, for files that get data inserted or removed.")
+	updateCmd.Flags().String("quick-hash", "", "Record quick hashes of the size and the first, middle and last N bytes (default 1M) instead of full hashes. Probabilistic.")
+	updateCmd.Flags().Lookup("quick-hash").NoOptDefVal = "1M"
+	updateCmd.Flags().Int("backups", 3, "Number of previous versions to keep when replacing the old manifest.")
+	updateCmd.Flags().Bool("force", false, "Overwrite the new manifest if it already exists.")
+	updateCmd.Flags().Bool("resume", false, "Continue from the partial manifest (<new-manifest>.partial) saved by an interrupted run.")
+	updateCmd.Flags().Bool("explain", false, "List every file with the reason its hash was reused or recalculated.")
+	updateCmd.Flags().Bool("json", false, "Print the summary (and the --explain list) as JSON.")
+	updateCmd.Flags().String("verify-sample", "", "Re-hash a random sample of unchanged files to detect silent corruption: a percentage of files (e.g. 5%) or a byte budget (e.g. 10G).")
+	updateCmd.Flags().String("history", "", "Also record the new manifest as a generation of this manifest history directory (see 'ssync log').")
+	addErrorPolicyFlags(updateCmd, "read", "record them with an error")
 }
@@ -0,0 +1,25 @@
+package cli
+
+import (
+	"time"
+
+	"github.com/shi0rik0/ssync/internal/core"
+	"github.com/spf13/cobra"
+)
+
+var watchCmd = &cobra.Command{
+	Use:   "watch <directory> <manifest>",
+	Short: "Keeps a manifest up to date while files change, until stopped with Ctrl-C.",
+	Args:  core.ProfileArgs(cobra.ExactArgs(2)),
+	RunE:  core.WithProfile(core.Watch, core.ProfileSource, core.ProfileManifest),
+}
+
+func init() {
+	watchCmd.Flags().Duration("debounce", 2*time.Second, "Re-hash a changed file once it has not changed for this long.")
+	watchCmd.Flags().Duration("flush-interval", time.Minute, "Write the manifest at most this often while it has changes.")
+	watchCmd.Flags().String("block-size", "", "Also record a hash for each block of this size (e.g. 4M), for delta transfers.")
+	watchCmd.Flags().Bool("content-defined", false, "Split files into content-defined chunks of about --block-size (default 1M) instead of fixed-size blocks, for files that get data inserted or removed.")
+	watchCmd.Flags().String("quick-hash", "", "Record quick hashes of the size and the first, middle and last N bytes (default 1M) instead of full hashes. Probabilistic.")
+	watchCmd.Flags().Lookup("quick-hash").NoOptDefVal = "1M"
+	addErrorPolicyFlags(watchCmd, "read", "record them with an error")
+}
@@ -0,0 +1,463 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// The agent protocol runs over any byte stream, such as the standard input and output of
+// 'ssync agent' at the far end of an SSH connection. Every message is a frame: a type byte,
+// the length of the payload as a big-endian uint32, and the payload. The client first sends
+// a hello frame with the protocol version, which the agent answers with its own, so that the
+// protocol also runs over unbuffered pipes. Then the client sends one request at a time,
+// which the agent answers with any number of data frames followed by an end or error frame.
+const (
+	frameHello    byte = 'H' // payload: agentProtocol
+	frameManifest byte = 'M' // request for the manifest of a directory, payload: JSON agentRequest
+	frameRead     byte = 'R' // request for the content of a file, payload: JSON agentRequest
+	frameData     byte = 'D' // part of a response
+	frameEnd      byte = 'E' // the response is complete
+	frameError    byte = 'X' // the request failed, payload: the error message
+)
+
+const (
+	agentProtocol   = "ssync-agent/1"
+	maxFramePayload = 1 << 20
+	agentChunkSize  = 64 * 1024
+)
+
+// Environment variables that select how 'ssync agent' is started for [user@]host:path locations.
+const (
+	sshEnv           = "SSYNC_SSH"            // the ssh command, default "ssh", e.g. "ssh -p 2222"
+	remoteCommandEnv = "SSYNC_REMOTE_COMMAND" // the ssync command on the remote host, default "ssync"
+)
+
+// agentRequest is the payload of manifest and read requests.
+type agentRequest struct {
+	Root      string `json:"root"`                // the directory on the agent's side
+	BlockSize int64  `json:"blockSize,omitempty"` // manifest: record block lists with blocks of this size
+	Chunked   bool   `json:"chunked,omitempty"`   // manifest: record content-defined chunks of about BlockSize instead
+	Path      string `json:"path,omitempty"`      // read: the file, relative to Root with "/" as separator
+	Offset    int64  `json:"offset,omitempty"`    // read: where to start
+	Length    int64  `json:"length,omitempty"`    // read: how much to read, -1 for up to the end
+}
+
+func writeFrame(w *bufio.Writer, kind byte, payload []byte) error {
+	var header [5]byte
+	header[0] = kind
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+func readFrame(r *bufio.Reader) (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header[1:])
+	if length > maxFramePayload {
+		return 0, nil, fmt.Errorf("agent protocol error: frame of %d bytes", length)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, unexpectedEOF(err)
+	}
+	return header[0], payload, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// handshake exchanges hello frames and checks that both sides speak the same protocol.
+// The client sends its hello first; the agent answers it even if the versions differ,
+// so that the client can report the mismatch too.
+func handshake(r *bufio.Reader, w *bufio.Writer, client bool) error {
+	sendHello := func() error {
+		if err := writeFrame(w, frameHello, []byte(agentProtocol)); err != nil {
+			return err
+		}
+		return w.Flush()
+	}
+	if client {
+		if err := sendHello(); err != nil {
+			return err
+		}
+	}
+	kind, payload, err := readFrame(r)
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	if !client {
+		if err := sendHello(); err != nil {
+			return err
+		}
+	}
+	if kind != frameHello || string(payload) != agentProtocol {
+		return fmt.Errorf("agent protocol mismatch: expected %s, got %q", agentProtocol, payload)
+	}
+	return nil
+}
+
+// RunAgent answers the requests of a client on rw until the client closes the stream.
+// Failed requests are reported to the client; only errors of the stream itself are returned.
+func RunAgent(ctx context.Context, rw io.ReadWriter) error {
+	r := bufio.NewReader(rw)
+	w := bufio.NewWriter(rw)
+	if err := handshake(r, w, false); err != nil {
+		return err
+	}
+	for {
+		kind, payload, err := readFrame(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var req agentRequest
+		if err := json.Unmarshal(payload, &req); err != nil {
+			return fmt.Errorf("agent protocol error: invalid request: %v", err)
+		}
+		logrus.WithFields(logrus.Fields{"request": string(kind), "root": req.Root, "path": req.Path}).Debug("Agent request")
+
+		switch kind {
+		case frameManifest:
+			err = sendAgentManifest(ctx, w, req)
+		case frameRead:
+			err = sendAgentFile(w, req)
+		default:
+			return fmt.Errorf("agent protocol error: unexpected frame %q", kind)
+		}
+		var failed *agentFailure
+		if errors.As(err, &failed) {
+			logrus.WithError(failed.err).Warn("Agent request failed")
+			err = writeFrame(w, frameError, []byte(failed.err.Error()))
+		} else if err == nil {
+			err = writeFrame(w, frameEnd, nil)
+		}
+		if err == nil {
+			err = w.Flush()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// agentFailure is an error of a request, reported to the client, as opposed to an error of the stream.
+type agentFailure struct {
+	err error
+}
+
+func (e *agentFailure) Error() string {
+	return e.err.Error()
+}
+
+// agentManifestPath returns where the agent keeps the manifest of a directory between runs,
+// so that only files that changed since the last request are hashed again.
+func agentManifestPath(root string) (string, error) {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(abs))
+	return filepath.Join(dir, "ssync", "agent", hex.EncodeToString(sum[:8])+".csv"), nil
+}
+
+// sendAgentManifest brings the agent's manifest of a directory up to date and sends it.
+func sendAgentManifest(ctx context.Context, w *bufio.Writer, req agentRequest) error {
+	if info, err := os.Stat(req.Root); err != nil {
+		return &agentFailure{err}
+	} else if !info.IsDir() {
+		return &agentFailure{fmt.Errorf("%s is not a directory", req.Root)}
+	}
+	manifestPath, err := agentManifestPath(req.Root)
+	if err != nil {
+		return &agentFailure{fmt.Errorf("error locating manifest cache: %v", err)}
+	}
+	if err := os.MkdirAll(filepath.Dir(manifestPath), 0755); err != nil {
+		return &agentFailure{fmt.Errorf("error creating manifest cache: %v", err)}
+	}
+	if _, err := os.Stat(manifestPath); err == nil {
+		_, err = UpdateManifest(ctx, req.Root, manifestPath, UpdateOptions{BlockSize: req.BlockSize, ContentDefined: req.Chunked})
+	} else {
+		_, err = CreateManifest(ctx, req.Root, manifestPath, CreateOptions{BlockSize: req.BlockSize, ContentDefined: req.Chunked})
+	}
+	if err != nil {
+		return &agentFailure{err}
+	}
+	file, err := os.Open(manifestPath)
+	if err != nil {
+		return &agentFailure{err}
+	}
+	defer file.Close()
+	return sendAgentData(w, file, -1)
+}
+
+// sendAgentFile sends the requested range of a file below the root of the request.
+func sendAgentFile(w *bufio.Writer, req agentRequest) error {
+	if !fs.ValidPath(req.Path) || req.Path == "." {
+		return &agentFailure{fmt.Errorf("invalid path %q", req.Path)}
+	}
+	root, err := os.OpenRoot(req.Root)
+	if err != nil {
+		return &agentFailure{err}
+	}
+	defer root.Close()
+	file, err := root.Open(req.Path)
+	if err != nil {
+		return &agentFailure{err}
+	}
+	defer file.Close()
+	if _, err := file.Seek(req.Offset, io.SeekStart); err != nil {
+		return &agentFailure{err}
+	}
+	return sendAgentData(w, file, req.Length)
+}
+
+// sendAgentData sends up to length bytes of r as data frames, or all of it if length is negative.
+// A read error after the first frames is still reported as a failed request.
+func sendAgentData(w *bufio.Writer, r io.Reader, length int64) error {
+	if length >= 0 {
+		r = io.LimitReader(r, length)
+	}
+	buf := make([]byte, agentChunkSize)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if err := writeFrame(w, frameData, buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return &agentFailure{err}
+		}
+	}
+}
+
+// agentClient sends requests to an agent, one at a time.
+type agentClient struct {
+	r     *bufio.Reader
+	w     *bufio.Writer
+	root  string
+	close func() error
+}
+
+// newAgentClient connects to an agent on rw, for the directory root on its side.
+func newAgentClient(rw io.ReadWriter, root string) (*agentClient, error) {
+	c := &agentClient{r: bufio.NewReader(rw), w: bufio.NewWriter(rw), root: root, close: func() error { return nil }}
+	if err := handshake(c.r, c.w, true); err != nil {
+		return nil, fmt.Errorf("error connecting to agent: %v", err)
+	}
+	return c, nil
+}
+
+// isSSH reports whether a location has the form [user@]host:path, for a directory reached with 'ssync agent' over SSH.
+// A single letter before the colon is always a drive, as in C:\Data or the drive-relative x:dir,
+// so a host whose name or alias is a single letter must be given with a user, as in user@x:dir.
+// URLs such as s3://bucket have a scheme and are not SSH locations either.
+func isSSH(location string) bool {
+	host, _, ok := strings.Cut(location, ":")
+	return ok && len(host) > 1 && !strings.ContainsAny(host, `/\`) && !strings.Contains(location, "://")
+}
+
+// dialAgent starts 'ssync agent' on the host of a [user@]host:path location over SSH and connects to it.
+func dialAgent(ctx context.Context, location string) (*agentClient, error) {
+	host, root, _ := strings.Cut(location, ":")
+	if root == "" {
+		root = "."
+	}
+	sshCommand := strings.Fields(os.Getenv(sshEnv))
+	if len(sshCommand) == 0 {
+		sshCommand = []string{"ssh"}
+	}
+	remoteCommand := os.Getenv(remoteCommandEnv)
+	if remoteCommand == "" {
+		remoteCommand = "ssync"
+	}
+	args := append(sshCommand[1:], host, remoteCommand, "agent")
+	logrus.WithField("args", args).Debug("Starting agent")
+
+	cmd := exec.Command(sshCommand[0], args...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("error starting %s: %v", sshCommand[0], err)
+	}
+	// The agent exits when its input is closed.
+	closeAgent := func() error {
+		stdin.Close()
+		return cmd.Wait()
+	}
+	c, err := newAgentClient(struct {
+		io.Reader
+		io.Writer
+	}{stdout, stdin}, root)
+	if err != nil {
+		closeAgent()
+		return nil, fmt.Errorf("%s: %v", host, err)
+	}
+	c.close = closeAgent
+	return c, nil
+}
+
+func (c *agentClient) send(kind byte, req agentRequest) error {
+	req.Root = c.root
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	if err := writeFrame(c.w, kind, payload); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
+
+// fetchManifest has the agent bring its manifest of the directory up to date, with block lists
+// of blockSize, and downloads it.
+func (c *agentClient) fetchManifest(ctx context.Context, blockSize int64, chunked bool) (*sortedManifest, error) {
+	if err := c.send(frameManifest, agentRequest{BlockSize: blockSize, Chunked: chunked}); err != nil {
+		return nil, err
+	}
+	resp := &agentResponse{c: c}
+	manifest, err := downloadManifest(resp)
+	if drainErr := resp.drain(); err == nil {
+		err = drainErr
+	}
+	return manifest, err
+}
+
+func (c *agentClient) open(ctx context.Context, relativePath string) sourceFile {
+	return &agentFile{c: c, path: relativePath}
+}
+
+func (c *agentClient) Close() error {
+	return c.close()
+}
+
+// agentResponse reads the data frames of a response up to its end frame.
+type agentResponse struct {
+	c    *agentClient
+	data []byte
+	done bool
+	err  error
+}
+
+func (r *agentResponse) Read(p []byte) (int, error) {
+	for len(r.data) == 0 {
+		if r.done {
+			return 0, r.err
+		}
+		kind, payload, err := readFrame(r.c.r)
+		if err != nil {
+			r.done, r.err = true, unexpectedEOF(err)
+			continue
+		}
+		switch kind {
+		case frameData:
+			r.data = payload
+		case frameEnd:
+			r.done, r.err = true, io.EOF
+		case frameError:
+			r.done, r.err = true, errors.New(string(payload))
+		default:
+			r.done, r.err = true, fmt.Errorf("agent protocol error: unexpected frame %q", kind)
+		}
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+// drain reads the rest of the response, so that the next request can be sent.
+// It returns the error of the response, if any.
+func (r *agentResponse) drain() error {
+	_, err := io.Copy(io.Discard, r)
+	return err
+}
+
+// agentFile is a file of a directory reached through an agent, see remoteDirectory.open.
+type agentFile struct {
+	c    *agentClient
+	path string
+	resp *agentResponse // the response of a streaming read, once started
+}
+
+func (f *agentFile) Read(p []byte) (int, error) {
+	if f.resp == nil {
+		if err := f.c.send(frameRead, agentRequest{Path: f.path, Length: -1}); err != nil {
+			return 0, err
+		}
+		f.resp = &agentResponse{c: f.c}
+	}
+	return f.resp.Read(p)
+}
+
+func (f *agentFile) ReadAt(p []byte, offset int64) (int, error) {
+	if err := f.c.send(frameRead, agentRequest{Path: f.path, Offset: offset, Length: int64(len(p))}); err != nil {
+		return 0, err
+	}
+	resp := &agentResponse{c: f.c}
+	n, err := io.ReadFull(resp, p)
+	if drainErr := resp.drain(); drainErr != nil {
+		return n, drainErr
+	}
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (f *agentFile) Close() error {
+	if f.resp != nil && !f.resp.done {
+		return f.resp.drain()
+	}
+	return nil
+}
+
+// Agent runs 'ssync agent', which answers requests on its standard input and output.
+// It is started over SSH by commands given a [user@]host:path location.
+func Agent(cmd *cobra.Command, args []string) error {
+	logrus.Debug("Executing 'agent' command")
+	return RunAgent(cmd.Context(), struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout})
+}
@@ -0,0 +1,186 @@
+package core
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// startTestAgent runs RunAgent on one end of a pair of pipes and connects a client for root to the other end.
+func startTestAgent(t *testing.T, root string) *agentClient {
+	t.Helper()
+	// The agent keeps its manifests in the user's cache directory.
+	cache := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", cache)
+	t.Setenv("LocalAppData", cache)
+
+	clientReader, agentWriter := io.Pipe()
+	agentReader, clientWriter := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := RunAgent(context.Background(), struct {
+			io.Reader
+			io.Writer
+		}{agentReader, agentWriter})
+		agentWriter.Close()
+		done <- err
+	}()
+
+	c, err := newAgentClient(struct {
+		io.Reader
+		io.Writer
+	}{clientReader, clientWriter}, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.close = func() error {
+		clientWriter.Close()
+		return <-done
+	}
+	t.Cleanup(func() {
+		if err := c.Close(); err != nil {
+			t.Errorf("agent: %v", err)
+		}
+	})
+	return c
+}
+
+func TestAgentManifest(t *testing.T) {
+	root := t.TempDir()
+	writeTestFiles(t, root, map[string]string{"a.txt": "alpha", "dir/b.txt": "bravo", "dir.txt": "charlie"})
+	c := startTestAgent(t, root)
+
+	manifest, err := c.fetchManifest(context.Background(), 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manifest.Close()
+	got := collect(t, manifest)
+	want := []struct{ path, content string }{{"a.txt", "alpha"}, {"dir/b.txt", "bravo"}, {"dir.txt", "charlie"}}
+	if len(got) != len(want) {
+		t.Fatalf("got %d entries, want %d: %v", len(got), len(want), got)
+	}
+	for i, w := range want {
+		if got[i].Path != w.path || got[i].Size != int64(len(w.content)) || got[i].Hash != md5Hex(w.content) {
+			t.Errorf("entry %d = %s %d %s, want %s %d %s", i, got[i].Path, got[i].Size, got[i].Hash, w.path, len(w.content), md5Hex(w.content))
+		}
+	}
+
+	// The second request updates the cached manifest instead of creating it.
+	writeTestFiles(t, root, map[string]string{"e.txt": "echo"})
+	manifest2, err := c.fetchManifest(context.Background(), 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manifest2.Close()
+	if got := collect(t, manifest2); len(got) != 4 || got[3].Path != "e.txt" {
+		t.Errorf("updated manifest = %v, want e.txt added", got)
+	}
+}
+
+func TestAgentReadFile(t *testing.T) {
+	root := t.TempDir()
+	content := strings.Repeat("0123456789", agentChunkSize/5) // several data frames
+	writeTestFiles(t, root, map[string]string{"dir/big.bin": content})
+	c := startTestAgent(t, root)
+
+	file := c.open(context.Background(), "dir/big.bin")
+	data, err := io.ReadAll(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != content {
+		t.Errorf("read %d bytes, want %d", len(data), len(content))
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	file = c.open(context.Background(), "dir/big.bin")
+	defer file.Close()
+	buf := make([]byte, 10)
+	if n, err := file.ReadAt(buf, 3); err != nil || string(buf[:n]) != "3456789012" {
+		t.Errorf("ReadAt(3) = %q, %v", buf[:n], err)
+	}
+	tail := int64(len(content)) - 4
+	if n, err := file.ReadAt(buf, tail); err != io.EOF || string(buf[:n]) != "6789" {
+		t.Errorf("ReadAt(%d) = %q, %v, want \"6789\", EOF", tail, buf[:n], err)
+	}
+}
+
+func TestAgentErrors(t *testing.T) {
+	root := t.TempDir()
+	writeTestFiles(t, root, map[string]string{"a.txt": "alpha"})
+	c := startTestAgent(t, root)
+
+	for _, tt := range []struct{ path, want string }{
+		{"missing.txt", "missing.txt"},
+		{"../a.txt", "invalid path"},
+		{".", "invalid path"},
+	} {
+		file := c.open(context.Background(), tt.path)
+		_, err := io.ReadAll(file)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("reading %q: error %v, want one containing %q", tt.path, err, tt.want)
+		}
+		file.Close()
+	}
+
+	// A failed request leaves the connection usable.
+	data, err := io.ReadAll(c.open(context.Background(), "a.txt"))
+	if err != nil || string(data) != "alpha" {
+		t.Errorf("reading after errors = %q, %v", data, err)
+	}
+
+	missing := startTestAgent(t, filepath.Join(root, "missing"))
+	if _, err := missing.fetchManifest(context.Background(), 0, false); err == nil {
+		t.Error("fetching the manifest of a missing directory succeeded")
+	}
+}
+
+func TestAgentProtocolMismatch(t *testing.T) {
+	clientReader, agentWriter := io.Pipe()
+	agentReader, clientWriter := io.Pipe()
+	go func() {
+		io.Copy(io.Discard, agentReader)
+	}()
+	go func() {
+		// An agent of another protocol version.
+		agentWriter.Write([]byte{frameHello, 0, 0, 0, 13})
+		agentWriter.Write([]byte("ssync-agent/0"))
+		agentWriter.Close()
+	}()
+	_, err := newAgentClient(struct {
+		io.Reader
+		io.Writer
+	}{clientReader, clientWriter}, ".")
+	clientWriter.Close()
+	if err == nil || !strings.Contains(err.Error(), "protocol mismatch") {
+		t.Errorf("error = %v, want a protocol mismatch", err)
+	}
+}
+
+func TestIsSSH(t *testing.T) {
+	for _, tt := range []struct {
+		location string
+		want     bool
+	}{
+		{"host:dir", true},
+		{"user@host:/data", true},
+		{"user@x:dir", true},
+		{"host:", true},
+		{`C:\Data`, false},
+		{"x:dir", false},
+		{"dir", false},
+		{"./host:dir", false},
+		{`.\host:dir`, false},
+		{"s3://bucket/prefix", false},
+		{"http://host:7878/", false},
+	} {
+		if got := isSSH(tt.location); got != tt.want {
+			t.Errorf("isSSH(%q) = %v, want %v", tt.location, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// atomicFile is a temporary file that replaces its target path only when committed,
+// so readers never see a half-written file and a failed run leaves the old file intact.
+// The temporary name ends with the target's base name, so extensions such as ".gz" still apply.
+type atomicFile struct {
+	*os.File
+	path string
+	done bool
+}
+
+// createManifestFile creates parent directories and an atomicFile for path.
+// Unless overwrite is set, it fails if path already exists.
+func createManifestFile(path string, overwrite bool) (*atomicFile, error) {
+	parent := filepath.Dir(path)
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return nil, fmt.Errorf("error creating parent directory: %v", err)
+	}
+
+	if !overwrite {
+		if _, err := os.Stat(path); err == nil {
+			return nil, fmt.Errorf("file already exists: %s (use --force to overwrite it)", path)
+		}
+	}
+
+	file, err := os.CreateTemp(parent, ".ssync-*-"+filepath.Base(path))
+	if err != nil {
+		return nil, fmt.Errorf("error creating file: %v", err)
+	}
+	return &atomicFile{File: file, path: path}, nil
+}
+
+// Commit closes the temporary file and renames it over the target path.
+func (f *atomicFile) Commit() error {
+	return f.CommitAs(f.path)
+}
+
+// CommitAs is like Commit, but renames the temporary file to path instead of the target path.
+func (f *atomicFile) CommitAs(path string) error {
+	if f.done {
+		return fmt.Errorf("%s has already been committed or aborted", f.path)
+	}
+	f.done = true
+	if err := f.File.Sync(); err != nil {
+		f.File.Close()
+		os.Remove(f.File.Name())
+		return fmt.Errorf("error syncing file: %v", err)
+	}
+	if err := f.File.Close(); err != nil {
+		os.Remove(f.File.Name())
+		return fmt.Errorf("error closing file: %v", err)
+	}
+	if err := os.Rename(f.File.Name(), path); err != nil {
+		os.Remove(f.File.Name())
+		return fmt.Errorf("error replacing %s: %v", path, err)
+	}
+	return nil
+}
+
+// Abort discards the temporary file. It does nothing after Commit, so it can be deferred.
+func (f *atomicFile) Abort() {
+	if f.done {
+		return
+	}
+	f.done = true
+	f.File.Close()
+	os.Remove(f.File.Name())
+}
+
+// backupPath returns the name of the n-th backup of a file, e.g. "manifest.csv.2".
+// Backup 0 is the file itself.
+func backupPath(path string, n int) string {
+	if n == 0 {
+		return path
+	}
+	return path + "." + strconv.Itoa(n)
+}
+
+// rotateBackups keeps up to count older versions of path as path.1 (newest) to path.<count> (oldest).
+// The current file stays in place, so it can then be replaced atomically.
+func rotateBackups(path string, count int) error {
+	if count <= 0 {
+		return nil
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+
+	if err := os.Remove(backupPath(path, count)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error removing oldest backup: %v", err)
+	}
+	for n := count - 1; n >= 1; n-- {
+		err := os.Rename(backupPath(path, n), backupPath(path, n+1))
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error rotating backup %s: %v", backupPath(path, n), err)
+		}
+	}
+
+	// A hard link makes the backup without copying; not every file system supports them.
+	if err := os.Link(path, backupPath(path, 1)); err == nil {
+		return nil
+	}
+	return copyFileContent(path, backupPath(path, 1))
+}
+
+func copyFileContent(srcPath, dstPath string) error {
+	in, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dstPath)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
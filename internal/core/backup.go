@@ -0,0 +1,640 @@
+package core
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// latestSnapshot selects the most recent snapshot where a snapshot ID is expected.
+const latestSnapshot = "latest"
+
+// repository is a backup repository: a directory holding the contents of files by hash,
+// so that every content is stored once however many files and snapshots share it,
+// and the snapshots, each the manifest of one backup run:
+//
+//	objects/ab/abcdef...      the content of a file, named by its MD5 hash
+//	snapshots/<id>.csv.zst    the manifest of the files of a snapshot
+//	snapshots/<id>.dirs.csv.zst  the directories of a snapshot, with their modified times, as a manifest without hashes
+//	snapshots/<id>.json       the Snapshot record, written last, once the snapshot is complete
+type repository struct {
+	path string
+}
+
+// Snapshot describes one backup run.
+type Snapshot struct {
+	ID     string    `json:"id"`     // the time of the backup, e.g. 20261018T153600Z
+	Source string    `json:"source"` // absolute path of the directory that was backed up
+	Time   time.Time `json:"time"`
+	Files  int       `json:"files"`
+	// Directories counts the directories below the source, which are recorded so that empty ones
+	// and the modified times of all are restored too. Snapshots of older versions have none recorded.
+	Directories int   `json:"directories"`
+	Bytes       int64 `json:"bytes"`  // total size of the files
+	Added       int64 `json:"added"`  // size of the contents that were not in the repository yet
+	Errors      int   `json:"errors"` // files that could not be read, recorded without content
+}
+
+// openRepository opens the repository at path, creating it if create is set.
+func openRepository(path string, create bool) (*repository, error) {
+	r := &repository{path: path}
+	if create {
+		for _, dir := range []string{r.objectsDir(), r.snapshotsDir()} {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return nil, fmt.Errorf("error creating repository: %v", err)
+			}
+		}
+	}
+	if info, err := os.Stat(r.snapshotsDir()); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a backup repository", path)
+	}
+	return r, nil
+}
+
+func (r *repository) objectsDir() string {
+	return filepath.Join(r.path, "objects")
+}
+
+func (r *repository) snapshotsDir() string {
+	return filepath.Join(r.path, "snapshots")
+}
+
+// objectPath returns the path of the content with the given hash. The hash is read from a snapshot,
+// so it must be an MD5 hash in hex to become part of a path inside the objects directory.
+func (r *repository) objectPath(hash string) (string, error) {
+	if len(hash) != 2*md5.Size || strings.Trim(hash, "0123456789abcdef") != "" {
+		return "", fmt.Errorf("invalid content hash %q", hash)
+	}
+	return filepath.Join(r.objectsDir(), hash[:2], hash), nil
+}
+
+func (r *repository) manifestPath(id string) string {
+	return filepath.Join(r.snapshotsDir(), id+".csv.zst")
+}
+
+func (r *repository) directoriesPath(id string) string {
+	return filepath.Join(r.snapshotsDir(), id+".dirs.csv.zst")
+}
+
+func (r *repository) recordPath(id string) string {
+	return filepath.Join(r.snapshotsDir(), id+".json")
+}
+
+// hasObject reports whether the content with the given hash is stored.
+func (r *repository) hasObject(hash string) bool {
+	objectPath, err := r.objectPath(hash)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(objectPath)
+	return err == nil
+}
+
+// store copies the file at path into the repository, unless its content is already there.
+// It returns the hash of the content and its size, and the number of bytes added to the repository.
+// The hash is calculated while copying, so it matches what was stored even if the file is being written to.
+func (r *repository) store(path string) (hash string, size, added int64, err error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	defer in.Close()
+
+	tmp, err := os.CreateTemp(r.objectsDir(), ".ssync-*.tmp")
+	if err != nil {
+		return "", 0, 0, fmt.Errorf("error creating object: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	digest := md5.New()
+	size, err = io.Copy(io.MultiWriter(tmp, digest), in)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", 0, 0, err
+	}
+
+	hash = hex.EncodeToString(digest.Sum(nil))
+	if r.hasObject(hash) {
+		return hash, size, 0, nil
+	}
+	objectPath, err := r.objectPath(hash)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	if err := os.MkdirAll(filepath.Dir(objectPath), 0755); err != nil {
+		return "", 0, 0, fmt.Errorf("error creating object: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), objectPath); err != nil {
+		return "", 0, 0, fmt.Errorf("error creating object: %v", err)
+	}
+	return hash, size, size, nil
+}
+
+// snapshots returns the complete snapshots of the repository, oldest first.
+func (r *repository) snapshots() ([]Snapshot, error) {
+	entries, err := os.ReadDir(r.snapshotsDir())
+	if err != nil {
+		return nil, fmt.Errorf("error reading snapshots: %v", err)
+	}
+	var snapshots []Snapshot
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok {
+			continue
+		}
+		data, err := os.ReadFile(r.recordPath(id))
+		if err != nil {
+			return nil, fmt.Errorf("error reading snapshot %s: %v", id, err)
+		}
+		var snapshot Snapshot
+		if err := json.Unmarshal(data, &snapshot); err != nil {
+			return nil, fmt.Errorf("error reading snapshot %s: %v", id, err)
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].ID < snapshots[j].ID })
+	return snapshots, nil
+}
+
+// snapshot returns the snapshot with the given ID, or the most recent one for latestSnapshot.
+func (r *repository) snapshot(id string) (Snapshot, error) {
+	snapshots, err := r.snapshots()
+	if err != nil {
+		return Snapshot{}, err
+	}
+	if id == latestSnapshot && len(snapshots) > 0 {
+		return snapshots[len(snapshots)-1], nil
+	}
+	for _, snapshot := range snapshots {
+		if snapshot.ID == id {
+			return snapshot, nil
+		}
+	}
+	return Snapshot{}, fmt.Errorf("no snapshot %s in %s", id, r.path)
+}
+
+// newSnapshotID returns an unused ID for a snapshot taken at t.
+func (r *repository) newSnapshotID(t time.Time) string {
+	base := t.UTC().Format("20060102T150405Z")
+	id := base
+	for n := 2; ; n++ {
+		if _, err := os.Stat(r.manifestPath(id)); os.IsNotExist(err) {
+			return id
+		}
+		id = fmt.Sprintf("%s-%d", base, n)
+	}
+}
+
+// BackupOptions configures BackupDirectory.
+type BackupOptions struct {
+	Ignore  []string // leave out files and directories matching these patterns (see ignoreRules)
+	OnError ErrorPolicy
+	Events  EventHandler
+}
+
+// BackupDirectory stores the files below root in the repository at repoPath, creating it if needed,
+// and records them as a new snapshot. Contents already in the repository are not stored again.
+// Files that did not change since the last snapshot of root, by modified time and size, are not even read.
+// Files that cannot be read are recorded with an error, unless opts.OnError aborts.
+// Nothing is recorded if the backup is interrupted.
+func BackupDirectory(ctx context.Context, root, repoPath string, opts BackupOptions) (*Snapshot, error) {
+	ignore, err := newIgnoreRules(opts.Ignore)
+	if err != nil {
+		return nil, err
+	}
+	source, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := os.Stat(source); err != nil {
+		return nil, err
+	} else if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", root)
+	}
+	// The repository would back itself up, and grow with every snapshot.
+	if repoAbs, err := filepath.Abs(repoPath); err != nil {
+		return nil, err
+	} else if rel, err := filepath.Rel(source, repoAbs); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, fmt.Errorf("the repository %s is inside the directory %s", repoPath, root)
+	}
+	repo, err := openRepository(repoPath, true)
+	if err != nil {
+		return nil, err
+	}
+
+	// The previous snapshot of the same directory tells which files are unchanged.
+	previous := newManifestCursor(&sliceIterator{})
+	snapshots, err := repo.snapshots()
+	if err != nil {
+		return nil, err
+	}
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		if snapshots[i].Source == source {
+			manifest, err := openSortedManifest(repo.manifestPath(snapshots[i].ID))
+			if err != nil {
+				return nil, fmt.Errorf("error reading snapshot %s: %v", snapshots[i].ID, err)
+			}
+			previous = newManifestCursor(manifest)
+			logrus.WithField("snapshot", snapshots[i].ID).Debug("Comparing with previous snapshot")
+			break
+		}
+	}
+	defer previous.Close()
+
+	snapshot := &Snapshot{Source: source, Time: time.Now()}
+	snapshot.ID = repo.newSnapshotID(snapshot.Time)
+	file, err := createManifestFile(repo.manifestPath(snapshot.ID), false)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Abort()
+	writer, err := newManifestWriter(file.File)
+	if err != nil {
+		return nil, err
+	}
+
+	totalFiles, totalBytes := measureTree(ctx, root, ignore)
+	progress := ProgressEvent{Stage: StageBackup, TotalFiles: totalFiles, TotalBytes: totalBytes}
+	walker := newDirWalker(root, ignore, func(path string, err error) error {
+		return opts.OnError.skip(opts.Events, path, err)
+	}, nil)
+	defer walker.Close()
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		fileInfo, err := walker.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error traversing directory: %w", err)
+		}
+
+		old, err := previous.Find(fileInfo.Path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading previous snapshot: %v", err)
+		}
+		if old != nil && old.Error == "" && sameModifiedTimeAndSize(*old, fileInfo) && repo.hasObject(old.Hash) {
+			fileInfo.Hash = old.Hash
+		} else {
+			path := filepath.Join(root, filepath.FromSlash(fileInfo.Path))
+			var added int64
+			err := opts.OnError.try(ctx, path, func() error {
+				var err error
+				fileInfo.Hash, fileInfo.Size, added, err = repo.store(path)
+				return err
+			})
+			if err != nil {
+				if err := unreadable(ctx, opts.OnError, opts.Events, path, &fileInfo, fmt.Errorf("error storing file: %w", err)); err != nil {
+					return nil, err
+				}
+			}
+			snapshot.Added += added
+		}
+		if err := writer.Write(fileInfo); err != nil {
+			return nil, err
+		}
+
+		progress.Path = fileInfo.Path
+		progress.Files++
+		progress.Bytes += fileInfo.Size
+		opts.Events.progress(progress)
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	if err := file.Commit(); err != nil {
+		return nil, fmt.Errorf("error writing snapshot: %v", err)
+	}
+	snapshot.Files, snapshot.Bytes, snapshot.Errors = writer.count, writer.size, writer.errors
+	if snapshot.Directories, err = repo.recordDirectories(ctx, snapshot.ID, root, ignore); err != nil {
+		return nil, fmt.Errorf("error writing snapshot: %v", err)
+	}
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(repo.recordPath(snapshot.ID), data, 0644); err != nil {
+		return nil, fmt.Errorf("error writing snapshot: %v", err)
+	}
+	return snapshot, nil
+}
+
+// recordDirectories writes the directories below root, with their modified times, for the snapshot id
+// and returns their number. Directories that cannot be listed have already been reported by the walk
+// of the files, and are recorded as far as they could be read.
+func (r *repository) recordDirectories(ctx context.Context, id, root string, ignore *ignoreRules) (int, error) {
+	file, err := createManifestFile(r.directoriesPath(id), false)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Abort()
+	writer, err := newManifestWriter(file.File)
+	if err != nil {
+		return 0, err
+	}
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if err != nil {
+			return nil
+		}
+		if ignored, err := ignore.skipWalk(root, path, d); ignored {
+			return err
+		}
+		if path == root || !d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		relativePath, err := filepath.Rel(root, path)
+		if err != nil {
+			return nil
+		}
+		return writer.Write(FileInfo{Path: filepath.ToSlash(relativePath), ModifiedTime: info.ModTime()})
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := writer.Close(); err != nil {
+		return 0, err
+	}
+	if err := file.Commit(); err != nil {
+		return 0, err
+	}
+	return writer.count, nil
+}
+
+// RestoreOptions configures RestoreSnapshot.
+type RestoreOptions struct {
+	// Force restores into a directory that is not empty, overwriting the files of the snapshot.
+	// Other files in the directory are left alone.
+	Force   bool
+	OnError ErrorPolicy
+	Events  EventHandler
+}
+
+// RestoreSnapshot rebuilds the files of a snapshot below target, with their content and modified time,
+// and its directories, including empty ones, with their modified time.
+// id may be "latest". Every file is verified against its hash. Files the snapshot recorded
+// without content, because they could not be read, are reported with a WarningEvent.
+func RestoreSnapshot(ctx context.Context, repoPath, id, target string, opts RestoreOptions) (*Snapshot, error) {
+	repo, err := openRepository(repoPath, false)
+	if err != nil {
+		return nil, err
+	}
+	snapshot, err := repo.snapshot(id)
+	if err != nil {
+		return nil, err
+	}
+	if !opts.Force {
+		entries, err := os.ReadDir(target)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if len(entries) > 0 {
+			return nil, fmt.Errorf("%s is not empty (use --force to restore into it anyway)", target)
+		}
+	}
+
+	manifest, err := openManifest(repo.manifestPath(snapshot.ID))
+	if err != nil {
+		return nil, fmt.Errorf("error reading snapshot %s: %v", snapshot.ID, err)
+	}
+	defer manifest.Close()
+
+	progress := ProgressEvent{Stage: StageRestore, TotalFiles: snapshot.Files, TotalBytes: snapshot.Bytes}
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		fileInfo, err := manifest.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading snapshot %s: %v", snapshot.ID, err)
+		}
+		// A damaged or forged snapshot must not write outside the target.
+		if !fs.ValidPath(fileInfo.Path) {
+			return nil, fmt.Errorf("invalid path %q in snapshot %s", fileInfo.Path, snapshot.ID)
+		}
+
+		path := filepath.Join(target, filepath.FromSlash(fileInfo.Path))
+		if fileInfo.Error != "" {
+			opts.Events.emit(&WarningEvent{Path: path, Err: fmt.Errorf("not in the snapshot, it could not be read: %s", fileInfo.Error)})
+		} else {
+			err := opts.OnError.try(ctx, path, func() error {
+				return repo.restore(fileInfo, path)
+			})
+			if err != nil {
+				if err := opts.OnError.skip(opts.Events, path, fmt.Errorf("error restoring file: %w", err)); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		progress.Path = fileInfo.Path
+		progress.Files++
+		progress.Bytes += fileInfo.Size
+		opts.Events.progress(progress)
+	}
+	if err := repo.restoreDirectories(ctx, snapshot.ID, target, opts); err != nil {
+		return nil, err
+	}
+	return &snapshot, nil
+}
+
+// restoreDirectories creates the directories of a snapshot below target and sets their modified times,
+// once the files have been restored, since creating files in a directory changes its modified time.
+// The directories below a directory are done before it, for the same reason.
+func (r *repository) restoreDirectories(ctx context.Context, id, target string, opts RestoreOptions) error {
+	// Snapshots of older versions have no directories recorded.
+	if _, err := os.Stat(r.directoriesPath(id)); os.IsNotExist(err) {
+		return nil
+	}
+	manifest, err := openManifest(r.directoriesPath(id))
+	if err != nil {
+		return fmt.Errorf("error reading directories of snapshot %s: %v", id, err)
+	}
+	defer manifest.Close()
+	var dirs []FileInfo
+	for {
+		dir, err := manifest.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error reading directories of snapshot %s: %v", id, err)
+		}
+		if !fs.ValidPath(dir.Path) {
+			return fmt.Errorf("invalid path %q in snapshot %s", dir.Path, id)
+		}
+		dirs = append(dirs, dir)
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		path := filepath.Join(target, filepath.FromSlash(dirs[i].Path))
+		err := os.MkdirAll(path, 0755)
+		if err == nil {
+			err = os.Chtimes(path, dirs[i].ModifiedTime, dirs[i].ModifiedTime)
+		}
+		if err != nil {
+			if err := opts.OnError.skip(opts.Events, path, fmt.Errorf("error restoring directory: %w", err)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// restore writes the content of a snapshot entry to path and sets its modified time.
+// The file only appears once its content has been verified against the hash.
+func (r *repository) restore(fileInfo FileInfo, path string) error {
+	objectPath, err := r.objectPath(fileInfo.Hash)
+	if err != nil {
+		return err
+	}
+	in, err := os.Open(objectPath)
+	if err != nil {
+		return fmt.Errorf("missing content: %v", err)
+	}
+	defer in.Close()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("error creating parent directory: %v", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".ssync-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	digest := md5.New()
+	_, err = io.Copy(io.MultiWriter(tmp, digest), in)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if hash := hex.EncodeToString(digest.Sum(nil)); hash != fileInfo.Hash {
+		return errors.New("content in the repository is damaged: hash is " + hash)
+	}
+	if err := os.Chtimes(tmp.Name(), fileInfo.ModifiedTime, fileInfo.ModifiedTime); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// ListSnapshots returns the snapshots of the repository at repoPath, oldest first.
+func ListSnapshots(repoPath string) ([]Snapshot, error) {
+	repo, err := openRepository(repoPath, false)
+	if err != nil {
+		return nil, err
+	}
+	return repo.snapshots()
+}
+
+func Backup(cmd *cobra.Command, args []string) error {
+	directoryPath := args[0]
+	repoPath := args[1]
+	ignore, err := getIgnoreFlag(cmd)
+	if err != nil {
+		return err
+	}
+	policy, err := getErrorPolicyFlag(cmd)
+	if err != nil {
+		return err
+	}
+	logrus.Debugf("Executing 'backup' command with directory: '%s', repository: '%s'", directoryPath, repoPath)
+
+	printer, err := newEventPrinter(cmd, os.Stdout)
+	if err != nil {
+		return err
+	}
+	snapshot, err := BackupDirectory(cmd.Context(), directoryPath, repoPath, BackupOptions{
+		Ignore:  ignore,
+		OnError: policy,
+		Events:  printer.handle,
+	})
+	printer.done()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Snapshot %s saved: %d files, %s, %s added to the repository\n",
+		snapshot.ID, snapshot.Files, toFriendlySize(snapshot.Bytes), toFriendlySize(snapshot.Added))
+	return printer.errorReport()
+}
+
+func Restore(cmd *cobra.Command, args []string) error {
+	repoPath := args[0]
+	id := args[1]
+	target := args[2]
+	force, err := cmd.Flags().GetBool("force")
+	if err != nil {
+		return fmt.Errorf("error retrieving force flag: %v", err)
+	}
+	policy, err := getErrorPolicyFlag(cmd)
+	if err != nil {
+		return err
+	}
+	logrus.Debugf("Executing 'restore' command with repository: '%s', snapshot: '%s', target: '%s', force: %t", repoPath, id, target, force)
+
+	printer, err := newEventPrinter(cmd, os.Stdout)
+	if err != nil {
+		return err
+	}
+	snapshot, err := RestoreSnapshot(cmd.Context(), repoPath, id, target, RestoreOptions{
+		Force:   force,
+		OnError: policy,
+		Events:  printer.handle,
+	})
+	printer.done()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Snapshot %s restored to %s: %d files, %s\n", snapshot.ID, target, snapshot.Files, toFriendlySize(snapshot.Bytes))
+	return printer.errorReport()
+}
+
+func Snapshots(cmd *cobra.Command, args []string) error {
+	repoPath := args[0]
+	logrus.Debugf("Executing 'snapshots' command with repository: '%s'", repoPath)
+
+	snapshots, err := ListSnapshots(repoPath)
+	if err != nil {
+		return err
+	}
+	if len(snapshots) == 0 {
+		fmt.Printf("No snapshots in %s\n", repoPath)
+		return nil
+	}
+	fmt.Printf("%-20s  %-19s  %8s  %10s  %10s  %s\n", "ID", "Time", "Files", "Size", "Added", "Source")
+	for _, s := range snapshots {
+		fmt.Printf("%-20s  %-19s  %8d  %10s  %10s  %s\n",
+			s.ID, s.Time.Local().Format("2006-01-02 15:04:05"), s.Files, toFriendlySize(s.Bytes), toFriendlySize(s.Added), s.Source)
+	}
+	return nil
+}
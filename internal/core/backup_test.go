@@ -0,0 +1,66 @@
+package core
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestObjectPath(t *testing.T) {
+	repo := &repository{path: t.TempDir()}
+	hash := md5Hex("alpha")
+	path, err := repo.objectPath(hash)
+	if err != nil || path != filepath.Join(repo.path, "objects", hash[:2], hash) {
+		t.Errorf("objectPath(%q) = %q, %v", hash, path, err)
+	}
+
+	for _, hash := range []string{"", "a", "../..", strings.Repeat("../", 10) + "xx", strings.ToUpper(hash), hash + "00", "2c" + strings.Repeat("/", 30)} {
+		if path, err := repo.objectPath(hash); err == nil {
+			t.Errorf("objectPath(%q) = %q", hash, path)
+		}
+		if repo.hasObject(hash) {
+			t.Errorf("hasObject(%q) = true", hash)
+		}
+	}
+}
+
+func TestBackupRestore(t *testing.T) {
+	parent := t.TempDir()
+	source := filepath.Join(parent, "source")
+	writeTestFiles(t, source, map[string]string{"a.txt": "alpha", "dir/b.txt": "bravo", "dir/c.txt": "alpha"})
+	var opts BackupOptions
+
+	repoPath := filepath.Join(parent, "repo")
+	snapshot, err := BackupDirectory(context.Background(), source, repoPath, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.Files != 3 || snapshot.Added != int64(len("alpha")+len("bravo")) {
+		t.Errorf("snapshot of %d files added %d bytes", snapshot.Files, snapshot.Added)
+	}
+
+	target := filepath.Join(parent, "target")
+	if _, err := RestoreSnapshot(context.Background(), repoPath, snapshot.ID, target, RestoreOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for path, content := range map[string]string{"a.txt": "alpha", "dir/b.txt": "bravo", "dir/c.txt": "alpha"} {
+		if data, err := os.ReadFile(filepath.Join(target, filepath.FromSlash(path))); err != nil || string(data) != content {
+			t.Errorf("restored %s = %q, %v", path, data, err)
+		}
+	}
+
+	for _, repoPath := range []string{source, filepath.Join(source, "repo"), filepath.Join(source, "dir", "repo")} {
+		if _, err := BackupDirectory(context.Background(), source, repoPath, opts); err == nil || !strings.Contains(err.Error(), "inside") {
+			t.Errorf("backup into %s: error %v, want the repository to be rejected", repoPath, err)
+		}
+		if _, err := os.Stat(filepath.Join(source, "repo")); err == nil {
+			t.Errorf("backup into %s created the repository", repoPath)
+		}
+	}
+	// A sibling whose name starts like the source is not inside it.
+	if _, err := BackupDirectory(context.Background(), source, source+"-repo", opts); err != nil {
+		t.Errorf("backup into %s-repo: %v", source, err)
+	}
+}
@@ -0,0 +1,412 @@
+package core
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Block lists come in two kinds. Fixed-size blocks split a file at multiples of the block size:
+// block i covers bytes [i*blockSize, (i+1)*blockSize). Delta transfers compare them at the
+// same offset, which suits files changed in place, such as disk images and databases.
+// Content-defined chunks end wherever a rolling hash of the content says so (see chunker),
+// so data inserted into or removed from a file only changes the chunks around it, and
+// delta transfers find the other chunks at their new offsets.
+
+// chunkedBlocksPrefix marks a list of content-defined chunks in the Blocks column.
+const chunkedBlocksPrefix = "cdc:"
+
+// formatBlocks encodes a block list for the Blocks column: "<block size>:<hash>:<hash>:..." for
+// fixed-size blocks, or "cdc:<average size>:<size>-<hash>:<size>-<hash>:..." for content-defined
+// chunks, which chunkSizes is not nil for. Files without a block list are encoded as an empty string.
+func formatBlocks(blockSize int64, blockHashes []string, chunkSizes []int64) string {
+	if blockSize == 0 {
+		return ""
+	}
+	if chunkSizes == nil {
+		return strconv.FormatInt(blockSize, 10) + ":" + strings.Join(blockHashes, ":")
+	}
+	var b strings.Builder
+	b.WriteString(chunkedBlocksPrefix)
+	b.WriteString(strconv.FormatInt(blockSize, 10))
+	for i, hash := range blockHashes {
+		fmt.Fprintf(&b, ":%d-%s", chunkSizes[i], hash)
+	}
+	return b.String()
+}
+
+func parseBlocks(s string) (int64, []string, []int64, error) {
+	if s == "" {
+		return 0, nil, nil, nil
+	}
+	chunked := strings.HasPrefix(s, chunkedBlocksPrefix)
+	parts := strings.Split(strings.TrimPrefix(s, chunkedBlocksPrefix), ":")
+	blockSize, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || blockSize <= 0 {
+		return 0, nil, nil, fmt.Errorf("invalid block size %q", parts[0])
+	}
+	if !chunked {
+		return blockSize, parts[1:], nil, nil
+	}
+	blockHashes := make([]string, 0, len(parts)-1)
+	chunkSizes := make([]int64, 0, len(parts)-1)
+	for _, part := range parts[1:] {
+		size, hash, ok := strings.Cut(part, "-")
+		chunkSize, err := strconv.ParseInt(size, 10, 64)
+		if !ok || err != nil || chunkSize <= 0 {
+			return 0, nil, nil, fmt.Errorf("invalid chunk %q", part)
+		}
+		blockHashes = append(blockHashes, hash)
+		chunkSizes = append(chunkSizes, chunkSize)
+	}
+	return blockSize, blockHashes, chunkSizes, nil
+}
+
+// gearTable maps each byte to a random value for the rolling hash of chunker.
+// It is generated from a fixed seed, as changing it would invalidate every recorded chunk list.
+var gearTable = func() (table [256]uint64) {
+	x := uint64(0x737379e3c4463d1a)
+	for i := range table {
+		// splitmix64
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// chunker splits a stream into content-defined chunks with a gear hash, as in FastCDC.
+// A chunk ends after a byte where the hash of the bytes before it has all bits of mask clear,
+// but is at least minSize and at most maxSize long. As the hash only depends on the last
+// 64 bytes, chunk boundaries move along with the content when data is inserted or removed.
+type chunker struct {
+	r       io.Reader
+	minSize int
+	mask    uint64
+	buf     []byte // holds up to maxSize bytes of the stream from start
+	start   int
+	end     int
+	err     error
+}
+
+// newChunker returns a chunker for chunks of about averageSize bytes: between a quarter and
+// four times that, with boundaries about every averageSize bytes after the minimum.
+func newChunker(r io.Reader, averageSize int64) *chunker {
+	return &chunker{
+		r:       r,
+		minSize: int(averageSize / 4),
+		mask:    1<<(bits.Len64(uint64(averageSize))-1) - 1,
+		buf:     make([]byte, 4*averageSize),
+	}
+}
+
+// next returns the next chunk, or io.EOF after the last one.
+// The chunk is only valid until the next call.
+func (c *chunker) next() ([]byte, error) {
+	if c.start > 0 {
+		c.end = copy(c.buf, c.buf[c.start:c.end])
+		c.start = 0
+	}
+	for c.end < len(c.buf) && c.err == nil {
+		var n int
+		n, c.err = c.r.Read(c.buf[c.end:])
+		c.end += n
+	}
+	if c.err != nil && c.err != io.EOF {
+		return nil, c.err
+	}
+	if c.end == 0 {
+		return nil, io.EOF
+	}
+	c.start = c.boundary(c.buf[:c.end])
+	return c.buf[:c.start], nil
+}
+
+// boundary returns the length of the chunk at the start of data, which holds at least
+// a whole chunk unless it is the end of the stream.
+func (c *chunker) boundary(data []byte) int {
+	if len(data) <= c.minSize {
+		return len(data)
+	}
+	var hash uint64
+	for i := c.minSize; i < len(data); i++ {
+		hash = hash<<1 + gearTable[data[i]]
+		if hash&c.mask == 0 {
+			return i + 1
+		}
+	}
+	return len(data)
+}
+
+// calculateChunkMD5 calculates the MD5 checksum of a file and splits it into content-defined chunks
+// of about averageSize, returning the MD5 and size of each chunk, in a single pass.
+func calculateChunkMD5(filePath string, averageSize int64) (string, []string, []int64, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("failed to open file %s: %w", filePath, err)
+	}
+	defer file.Close()
+
+	fileHash := md5.New()
+	chunkHashes := []string{}
+	chunkSizes := []int64{}
+	c := newChunker(file, averageSize)
+	for {
+		chunk, err := c.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", nil, nil, fmt.Errorf("failed to read file %s: %w", filePath, err)
+		}
+		fileHash.Write(chunk)
+		chunkHash := md5.Sum(chunk)
+		chunkHashes = append(chunkHashes, hex.EncodeToString(chunkHash[:]))
+		chunkSizes = append(chunkSizes, int64(len(chunk)))
+	}
+	return hex.EncodeToString(fileHash.Sum(nil)), chunkHashes, chunkSizes, nil
+}
+
+// calculateBlockMD5 calculates the MD5 checksum of a file and of each of its blocks in a single pass.
+func calculateBlockMD5(filePath string, blockSize int64) (string, []string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to open file %s: %w", filePath, err)
+	}
+	defer file.Close()
+
+	fileHash := md5.New()
+	var blockHashes []string
+	for {
+		blockHash := md5.New()
+		n, err := io.CopyN(io.MultiWriter(fileHash, blockHash), file, blockSize)
+		if n > 0 {
+			blockHashes = append(blockHashes, hex.EncodeToString(blockHash.Sum(nil)))
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to read file %s: %w", filePath, err)
+		}
+	}
+	return hex.EncodeToString(fileHash.Sum(nil)), blockHashes, nil
+}
+
+// applyDelta rewrites dstPath so that it has the content of src, read from srcPath, writing only the
+// blocks whose hash differs from dstBlockHashes. If srcBlockHashes is not nil, blocks
+// it marks as equal are not even read from the source and srcHash must be the MD5 of
+// the source; otherwise the whole source is read and hashed on the way.
+// Unless inPlace is set, the changes are applied to a temporary copy that replaces
+// dstPath at the end, so an interrupted transfer never leaves a half-written file behind.
+// Finally the whole destination is re-hashed and compared with the source hash.
+// It returns the number of bytes written.
+func applyDelta(src io.ReaderAt, srcPath, dstPath string, size, blockSize int64, srcHash string, srcBlockHashes, dstBlockHashes []string, inPlace bool) (int64, error) {
+	var dst *os.File
+	var err error
+	if inPlace {
+		dst, err = os.OpenFile(dstPath, os.O_RDWR, 0)
+		if err != nil {
+			return 0, err
+		}
+		defer dst.Close()
+	} else {
+		dst, err = copyToTemp(dstPath)
+		if err != nil {
+			return 0, err
+		}
+		defer os.Remove(dst.Name())
+		defer dst.Close()
+	}
+
+	srcFileHash := md5.New()
+	buf := make([]byte, blockSize)
+	written := int64(0)
+	for i, offset := 0, int64(0); offset < size; i, offset = i+1, offset+blockSize {
+		sameAsDst := func(blockHash string) bool {
+			return i < len(dstBlockHashes) && dstBlockHashes[i] == blockHash
+		}
+		if srcBlockHashes != nil && i < len(srcBlockHashes) && sameAsDst(srcBlockHashes[i]) {
+			continue
+		}
+
+		block := buf[:min(blockSize, size-offset)]
+		if _, err := src.ReadAt(block, offset); err != nil {
+			return written, fmt.Errorf("error reading %s: %w", srcPath, err)
+		}
+		if srcBlockHashes == nil {
+			srcFileHash.Write(block)
+			blockHash := md5.Sum(block)
+			if sameAsDst(hex.EncodeToString(blockHash[:])) {
+				continue
+			}
+		}
+		if _, err := dst.WriteAt(block, offset); err != nil {
+			return written, fmt.Errorf("error writing %s: %w", dstPath, err)
+		}
+		written += int64(len(block))
+	}
+	if srcBlockHashes == nil {
+		srcHash = hex.EncodeToString(srcFileHash.Sum(nil))
+	}
+
+	if err := dst.Truncate(size); err != nil {
+		return written, fmt.Errorf("error truncating %s: %w", dstPath, err)
+	}
+
+	// Verify the result as a whole, which also catches stale block lists.
+	if _, err := dst.Seek(0, io.SeekStart); err != nil {
+		return written, err
+	}
+	dstFileHash := md5.New()
+	if _, err := io.Copy(dstFileHash, dst); err != nil {
+		return written, fmt.Errorf("error verifying %s: %w", dstPath, err)
+	}
+	if dstHash := hex.EncodeToString(dstFileHash.Sum(nil)); dstHash != srcHash {
+		return written, fmt.Errorf("verification of %s failed: hash is %s, expected %s", dstPath, dstHash, srcHash)
+	}
+
+	if err := dst.Close(); err != nil {
+		return written, err
+	}
+	if !inPlace {
+		if err := os.Rename(dst.Name(), dstPath); err != nil {
+			return written, fmt.Errorf("error replacing %s: %w", dstPath, err)
+		}
+	}
+	return written, nil
+}
+
+// applyChunkDelta rewrites dstPath so that it has the content of src, read from srcPath, using lists of
+// content-defined chunks. Chunks of the source that the old destination already has, at any offset,
+// are copied from there and only the others are read from src. If srcChunkHashes is not nil,
+// srcChunkSizes gives the size of each of its chunks and srcHash must be the MD5 of the source;
+// otherwise the whole source is read, split into chunks of about averageSize and hashed on the way.
+// As chunks move around, the result is always built in a temporary file that replaces dstPath
+// at the end. Its hash is compared with the source hash before that.
+// It returns the number of bytes that had to be taken from the source.
+func applyChunkDelta(src io.ReaderAt, srcPath, dstPath string, size, averageSize int64, srcHash string, srcChunkHashes []string, srcChunkSizes []int64, dstChunkHashes []string, dstChunkSizes []int64) (int64, error) {
+	old, err := os.Open(dstPath)
+	if err != nil {
+		return 0, err
+	}
+	defer old.Close()
+	tmp, err := os.CreateTemp(filepath.Dir(dstPath), ".ssync-*.tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	// Keep the permissions of the file that will be replaced.
+	if info, err := old.Stat(); err == nil {
+		tmp.Chmod(info.Mode().Perm())
+	}
+
+	// Where each chunk of the old destination is.
+	type section struct{ offset, size int64 }
+	have := make(map[string]section, len(dstChunkHashes))
+	for i, offset := 0, int64(0); i < len(dstChunkHashes) && i < len(dstChunkSizes); i++ {
+		if _, ok := have[dstChunkHashes[i]]; !ok {
+			have[dstChunkHashes[i]] = section{offset, dstChunkSizes[i]}
+		}
+		offset += dstChunkSizes[i]
+	}
+
+	resultHash := md5.New()
+	out := bufio.NewWriter(io.MultiWriter(tmp, resultHash))
+	taken := int64(0)
+	if srcChunkHashes == nil {
+		srcFileHash := md5.New()
+		c := newChunker(io.NewSectionReader(src, 0, size), averageSize)
+		for {
+			chunk, err := c.next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return taken, fmt.Errorf("error reading %s: %w", srcPath, err)
+			}
+			srcFileHash.Write(chunk)
+			chunkHash := md5.Sum(chunk)
+			if _, ok := have[hex.EncodeToString(chunkHash[:])]; !ok {
+				taken += int64(len(chunk))
+			}
+			if _, err := out.Write(chunk); err != nil {
+				return taken, fmt.Errorf("error writing %s: %w", dstPath, err)
+			}
+		}
+		srcHash = hex.EncodeToString(srcFileHash.Sum(nil))
+	} else {
+		var buf []byte
+		for i, offset := 0, int64(0); i < len(srcChunkHashes) && i < len(srcChunkSizes); i++ {
+			chunkSize := srcChunkSizes[i]
+			if int64(cap(buf)) < chunkSize {
+				buf = make([]byte, chunkSize)
+			}
+			chunk := buf[:chunkSize]
+			if at, ok := have[srcChunkHashes[i]]; ok && at.size == chunkSize {
+				if _, err := old.ReadAt(chunk, at.offset); err != nil {
+					return taken, fmt.Errorf("error reading %s: %w", dstPath, err)
+				}
+			} else {
+				if _, err := src.ReadAt(chunk, offset); err != nil {
+					return taken, fmt.Errorf("error reading %s: %w", srcPath, err)
+				}
+				taken += chunkSize
+			}
+			if _, err := out.Write(chunk); err != nil {
+				return taken, fmt.Errorf("error writing %s: %w", dstPath, err)
+			}
+			offset += chunkSize
+		}
+	}
+	if err := out.Flush(); err != nil {
+		return taken, fmt.Errorf("error writing %s: %w", dstPath, err)
+	}
+
+	// Verify the result as a whole, which also catches stale chunk lists.
+	if resultHash := hex.EncodeToString(resultHash.Sum(nil)); resultHash != srcHash {
+		return taken, fmt.Errorf("verification of %s failed: hash is %s, expected %s", dstPath, resultHash, srcHash)
+	}
+	if err := tmp.Close(); err != nil {
+		return taken, err
+	}
+	old.Close()
+	if err := os.Rename(tmp.Name(), dstPath); err != nil {
+		return taken, fmt.Errorf("error replacing %s: %w", dstPath, err)
+	}
+	return taken, nil
+}
+
+// copyToTemp copies a file to a new temporary file in the same directory and returns it opened for writing.
+func copyToTemp(path string) (*os.File, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".ssync-*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(tmp, in); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, fmt.Errorf("error copying %s: %w", path, err)
+	}
+	// Keep the permissions of the file that will be replaced.
+	if info, err := in.Stat(); err == nil {
+		tmp.Chmod(info.Mode().Perm())
+	}
+	return tmp, nil
+}
@@ -0,0 +1,300 @@
+package core
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// randomBytes returns n reproducible pseudo-random bytes.
+func randomBytes(seed int64, n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func TestFormatParseBlocks(t *testing.T) {
+	for _, tt := range []struct {
+		blockSize   int64
+		blockHashes []string
+		chunkSizes  []int64
+		formatted   string
+	}{
+		{0, nil, nil, ""},
+		{4096, []string{"aa", "bb"}, nil, "4096:aa:bb"},
+		{4096, []string{"aa", "bb"}, []int64{5000, 17}, "cdc:4096:5000-aa:17-bb"},
+	} {
+		formatted := formatBlocks(tt.blockSize, tt.blockHashes, tt.chunkSizes)
+		if formatted != tt.formatted {
+			t.Errorf("formatBlocks(%d, %v, %v) = %q, want %q", tt.blockSize, tt.blockHashes, tt.chunkSizes, formatted, tt.formatted)
+		}
+		blockSize, blockHashes, chunkSizes, err := parseBlocks(formatted)
+		if err != nil || blockSize != tt.blockSize || !slices.Equal(blockHashes, tt.blockHashes) || !slices.Equal(chunkSizes, tt.chunkSizes) {
+			t.Errorf("parseBlocks(%q) = %d, %v, %v, %v", formatted, blockSize, blockHashes, chunkSizes, err)
+		}
+	}
+
+	for _, s := range []string{"x:aa", "0:aa", "-1:aa", "cdc:x:1-aa", "cdc:4096:aa", "cdc:4096:0-aa", "cdc:4096:x-aa"} {
+		if _, _, _, err := parseBlocks(s); err == nil {
+			t.Errorf("parseBlocks(%q) succeeded", s)
+		}
+	}
+}
+
+// chunks splits data with a chunker and returns the chunk sizes.
+func chunks(t *testing.T, data []byte, averageSize int64) []int {
+	t.Helper()
+	c := newChunker(bytes.NewReader(data), averageSize)
+	var sizes []int
+	for {
+		chunk, err := c.next()
+		if err != nil {
+			break
+		}
+		sizes = append(sizes, len(chunk))
+	}
+	total := 0
+	for _, size := range sizes {
+		total += size
+	}
+	if total != len(data) {
+		t.Fatalf("chunks cover %d bytes of %d", total, len(data))
+	}
+	return sizes
+}
+
+func TestChunker(t *testing.T) {
+	const averageSize = 4096
+	data := randomBytes(1, 1<<20)
+	sizes := chunks(t, data, averageSize)
+	for i, size := range sizes[:len(sizes)-1] {
+		if size < averageSize/4 || size > 4*averageSize {
+			t.Errorf("chunk %d has %d bytes, outside [%d, %d]", i, size, averageSize/4, 4*averageSize)
+		}
+	}
+	if n := len(sizes); n < len(data)/(4*averageSize) || n > len(data)/(averageSize/2) {
+		t.Errorf("%d chunks for %d bytes with an average size of %d", n, len(data), averageSize)
+	}
+	if !slices.Equal(sizes, chunks(t, data, averageSize)) {
+		t.Error("chunking the same data twice gives different chunks")
+	}
+
+	// After an insertion near the start, the chunk boundaries fall back into step with the old ones.
+	inserted := slices.Concat(data[:100], []byte("inserted"), data[100:])
+	boundaries := func(sizes []int, shift int) map[int]bool {
+		set := map[int]bool{}
+		offset := 0
+		for _, size := range sizes {
+			offset += size
+			set[offset-shift] = true
+		}
+		return set
+	}
+	old := boundaries(sizes, 0)
+	common := 0
+	for offset := range boundaries(chunks(t, inserted, averageSize), len("inserted")) {
+		if old[offset] {
+			common++
+		}
+	}
+	if common < len(sizes)-3 {
+		t.Errorf("only %d of %d chunk boundaries survive an insertion", common, len(sizes))
+	}
+
+	if sizes := chunks(t, nil, averageSize); len(sizes) != 0 {
+		t.Errorf("empty data has chunks %v", sizes)
+	}
+	if sizes := chunks(t, data[:100], averageSize); !slices.Equal(sizes, []int{100}) {
+		t.Errorf("small data has chunks %v", sizes)
+	}
+}
+
+func TestCalculateChunkMD5(t *testing.T) {
+	data := randomBytes(2, 100000)
+	path := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	hash, chunkHashes, chunkSizes, err := calculateChunkMD5(path, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash != md5Hex(string(data)) {
+		t.Errorf("hash = %s, want %s", hash, md5Hex(string(data)))
+	}
+	offset := int64(0)
+	for i, size := range chunkSizes {
+		if chunkHashes[i] != md5Hex(string(data[offset:offset+size])) {
+			t.Errorf("chunk %d has the wrong hash", i)
+		}
+		offset += size
+	}
+	if offset != int64(len(data)) {
+		t.Errorf("chunks cover %d bytes of %d", offset, len(data))
+	}
+}
+
+// blockHashes returns the hash of each block of data.
+func blockHashes(data []byte, blockSize int) []string {
+	var hashes []string
+	for offset := 0; offset < len(data); offset += blockSize {
+		hashes = append(hashes, md5Hex(string(data[offset:min(offset+blockSize, len(data))])))
+	}
+	return hashes
+}
+
+func TestApplyDelta(t *testing.T) {
+	const blockSize = 1024
+	base := randomBytes(3, 10*blockSize)
+	changed := bytes.Clone(base)
+	copy(changed[3*blockSize+10:], "changed")
+
+	for _, tt := range []struct {
+		name       string
+		src, dst   []byte
+		srcHashes  bool // pass the block list of the source
+		inPlace    bool
+		written    int64
+		staleDst   bool // the destination's block list does not match its content
+		shouldFail bool
+	}{
+		{name: "one block changed", src: changed, dst: base, written: blockSize},
+		{name: "one block changed, source list", src: changed, dst: base, srcHashes: true, written: blockSize},
+		{name: "one block changed, in place", src: changed, dst: base, srcHashes: true, inPlace: true, written: blockSize},
+		{name: "unchanged", src: base, dst: base, written: 0},
+		{name: "grown", src: slices.Concat(base, []byte("tail")), dst: base, written: 4},
+		{name: "shrunk", src: base[:5*blockSize+1], dst: base, written: 1},
+		{name: "shrunk, in place", src: base[:5*blockSize+1], dst: base, srcHashes: true, inPlace: true, written: 1},
+		{name: "stale destination list", src: changed, dst: base, srcHashes: true, staleDst: true, shouldFail: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dstPath := filepath.Join(t.TempDir(), "dst")
+			if err := os.WriteFile(dstPath, tt.dst, 0644); err != nil {
+				t.Fatal(err)
+			}
+			dstHashes := blockHashes(tt.dst, blockSize)
+			if tt.staleDst {
+				dstHashes = blockHashes(tt.src, blockSize)
+			}
+			var srcHash string
+			var srcHashes []string
+			if tt.srcHashes {
+				srcHash, srcHashes = md5Hex(string(tt.src)), blockHashes(tt.src, blockSize)
+			}
+
+			written, err := applyDelta(bytes.NewReader(tt.src), "src", dstPath, int64(len(tt.src)), blockSize, srcHash, srcHashes, dstHashes, tt.inPlace)
+			if tt.shouldFail {
+				if err == nil || !strings.Contains(err.Error(), "verification") {
+					t.Errorf("error = %v, want a verification failure", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if written != tt.written {
+				t.Errorf("wrote %d bytes, want %d", written, tt.written)
+			}
+			if got, _ := os.ReadFile(dstPath); !bytes.Equal(got, tt.src) {
+				t.Error("destination differs from the source")
+			}
+		})
+	}
+}
+
+func TestApplyChunkDelta(t *testing.T) {
+	const averageSize = 4096
+	base := randomBytes(4, 64*averageSize)
+	inserted := slices.Concat(base[:1000], []byte("inserted near the start"), base[1000:])
+	removed := slices.Concat(base[:30000], base[40000:])
+
+	split := func(data []byte) ([]string, []int64) {
+		var hashes []string
+		var sizes []int64
+		c := newChunker(bytes.NewReader(data), averageSize)
+		for {
+			chunk, err := c.next()
+			if err != nil {
+				return hashes, sizes
+			}
+			hashes = append(hashes, md5Hex(string(chunk)))
+			sizes = append(sizes, int64(len(chunk)))
+		}
+	}
+
+	for _, tt := range []struct {
+		name      string
+		src, dst  []byte
+		srcChunks bool
+		maxTaken  int64
+	}{
+		{name: "insertion", src: inserted, dst: base, maxTaken: 8 * averageSize},
+		{name: "insertion, source list", src: inserted, dst: base, srcChunks: true, maxTaken: 8 * averageSize},
+		{name: "removal, source list", src: removed, dst: base, srcChunks: true, maxTaken: 8 * averageSize},
+		{name: "unchanged, source list", src: base, dst: base, srcChunks: true, maxTaken: 0},
+		{name: "unrelated", src: randomBytes(5, 10000), dst: base, srcChunks: true, maxTaken: 10000},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dstPath := filepath.Join(t.TempDir(), "dst")
+			if err := os.WriteFile(dstPath, tt.dst, 0644); err != nil {
+				t.Fatal(err)
+			}
+			dstHashes, dstSizes := split(tt.dst)
+			var srcHash string
+			var srcHashes []string
+			var srcSizes []int64
+			if tt.srcChunks {
+				srcHash = md5Hex(string(tt.src))
+				srcHashes, srcSizes = split(tt.src)
+			}
+
+			taken, err := applyChunkDelta(bytes.NewReader(tt.src), "src", dstPath, int64(len(tt.src)), averageSize, srcHash, srcHashes, srcSizes, dstHashes, dstSizes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if taken > tt.maxTaken {
+				t.Errorf("took %d bytes from the source, want at most %d", taken, tt.maxTaken)
+			}
+			if got, _ := os.ReadFile(dstPath); !bytes.Equal(got, tt.src) {
+				t.Error("destination differs from the source")
+			}
+		})
+	}
+
+	// A chunk list that no longer describes the destination fails and leaves it alone.
+	for _, stale := range [][]byte{inserted, removed} {
+		dstPath := filepath.Join(t.TempDir(), "dst")
+		if err := os.WriteFile(dstPath, base, 0644); err != nil {
+			t.Fatal(err)
+		}
+		srcHashes, srcSizes := split(inserted)
+		dstHashes, dstSizes := split(stale)
+		_, err := applyChunkDelta(bytes.NewReader(inserted), "src", dstPath, int64(len(inserted)), averageSize, md5Hex(string(inserted)), srcHashes, srcSizes, dstHashes, dstSizes)
+		if err == nil {
+			t.Error("a delta with a stale destination list succeeded")
+		}
+		if got, _ := os.ReadFile(dstPath); !bytes.Equal(got, base) {
+			t.Error("a failed delta changed the destination")
+		}
+	}
+}
+
+func TestNeedsRehashChunked(t *testing.T) {
+	fixed := FileInfo{Size: 10000, Hash: md5Hex("x"), BlockSize: 4096, BlockHashes: []string{"a", "b", "c"}}
+	chunked := FileInfo{Size: 10000, Hash: md5Hex("x"), BlockSize: 4096, BlockHashes: []string{"a", "b"}, ChunkSizes: []int64{5000, 5000}}
+	fixedOpts := hashOptions{blockSize: 4096}
+	chunkedOpts := hashOptions{blockSize: 4096, chunked: true}
+	if needsRehash(fixed, fixedOpts) || needsRehash(chunked, chunkedOpts) {
+		t.Error("an entry with the requested kind of block list needs a rehash")
+	}
+	if !needsRehash(fixed, chunkedOpts) || !needsRehash(chunked, fixedOpts) {
+		t.Error("an entry with the other kind of block list does not need a rehash")
+	}
+	if opts := hashOptionsOf(chunked); !opts.chunked || opts.blockSize != 4096 {
+		t.Errorf("hashOptionsOf(chunked entry) = %+v", opts)
+	}
+}
@@ -0,0 +1,131 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// ChangeKind classifies what update did with a path.
+type ChangeKind string
+
+const (
+	ChangeUnchanged  ChangeKind = "unchanged"  // same path, modified time and size: hash reused
+	ChangeMoved      ChangeKind = "moved"      // same file found at a new path: hash reused
+	ChangeModified   ChangeKind = "modified"   // same path, different modified time or size: re-hashed
+	ChangeNew        ChangeKind = "new"        // path not in the old manifest: hashed
+	ChangeRehashed   ChangeKind = "rehashed"   // looks unchanged, but the hash options changed: re-hashed
+	ChangeDeleted    ChangeKind = "deleted"    // path in the old manifest, but no longer on disk
+	ChangeVerified   ChangeKind = "verified"   // unchanged, sampled for verification and the hash still matches
+	ChangeSuspect    ChangeKind = "suspect"    // unchanged, sampled for verification but the hash no longer matches
+	ChangeUnreadable ChangeKind = "unreadable" // could not be read: recorded with an error instead of a hash
+)
+
+// changeKinds lists the kinds in the order they are reported.
+var changeKinds = []ChangeKind{ChangeUnchanged, ChangeVerified, ChangeSuspect, ChangeMoved, ChangeModified, ChangeNew, ChangeRehashed, ChangeUnreadable, ChangeDeleted}
+
+// FileChange explains what update did with one path.
+type FileChange struct {
+	Path    string     `json:"path"`
+	Change  ChangeKind `json:"change"`
+	Size    int64      `json:"size"`
+	OldPath string     `json:"oldPath,omitempty"`
+	Reason  string     `json:"reason"`
+}
+
+type ChangeCount struct {
+	Files int   `json:"files"`
+	Bytes int64 `json:"bytes"`
+}
+
+// ChangeSummary counts files and bytes per kind of change.
+type ChangeSummary map[ChangeKind]*ChangeCount
+
+func newChangeSummary() ChangeSummary {
+	summary := make(ChangeSummary)
+	for _, kind := range changeKinds {
+		summary[kind] = &ChangeCount{}
+	}
+	return summary
+}
+
+func (s ChangeSummary) add(change FileChange) {
+	s[change.Change].Files++
+	s[change.Change].Bytes += change.Size
+}
+
+// changeReport writes the per-file explanations and the summary of an update,
+// either as text or as a single JSON object of the form {"files": [...], "summary": {...}}.
+// Explanations must be reported in manifest order.
+type changeReport struct {
+	w       io.Writer
+	explain bool
+	json    bool
+	started bool
+	files   int
+}
+
+// begin starts the report, once. The file list is streamed before the summary,
+// which is only complete once every file has been reported.
+func (r *changeReport) begin() error {
+	if !r.json || r.started {
+		return nil
+	}
+	r.started = true
+	var err error
+	if r.explain {
+		_, err = io.WriteString(r.w, "{\"files\":[")
+	} else {
+		_, err = io.WriteString(r.w, "{")
+	}
+	return err
+}
+
+func (r *changeReport) file(change FileChange) error {
+	if !r.explain {
+		return nil
+	}
+	if err := r.begin(); err != nil {
+		return err
+	}
+	if !r.json {
+		_, err := fmt.Fprintf(r.w, "[%s] %s: %s\n", change.Change, change.Path, change.Reason)
+		return err
+	}
+	data, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	if r.files > 0 {
+		io.WriteString(r.w, ",")
+	}
+	r.files++
+	_, err = fmt.Fprintf(r.w, "\n%s", data)
+	return err
+}
+
+func (r *changeReport) end(summary ChangeSummary) error {
+	if err := r.begin(); err != nil {
+		return err
+	}
+	if r.json {
+		data, err := json.Marshal(summary)
+		if err != nil {
+			return err
+		}
+		if r.explain {
+			io.WriteString(r.w, "\n],")
+		}
+		_, err = fmt.Fprintf(r.w, "\"summary\":%s}\n", data)
+		return err
+	}
+
+	fmt.Fprintln(r.w, "Summary:")
+	for _, kind := range changeKinds {
+		count := summary[kind]
+		if _, err := fmt.Fprintf(r.w, "  %-10s %10d files %12s\n", kind, count.Files, toFriendlySize(count.Bytes)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
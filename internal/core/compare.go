@@ -1,157 +1,345 @@
 package core
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"io/fs"
-	"path/filepath"
-	"sort"
-	"sync"
+	"os"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
-func walkDir(dir string, strict bool) ([]FileInfo, error) {
-	var fileInfoSlice []FileInfo
-	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
-		if err != nil {
-			return err
+// describeDifference returns why two entries for the same path differ, or "" if they match.
+// Hashes are only taken into account if compareHash is set and both were computed the same way.
+func describeDifference(fi1, fi2 FileInfo, compareHash bool) string {
+	reason := ""
+	if fi1.ModifiedTime.Unix() != fi2.ModifiedTime.Unix() {
+		reason += "modified time differs, "
+	}
+	if fi1.Size != fi2.Size {
+		reason += "size differs, "
+	}
+	if compareHash && (fi1.Error != "" || fi2.Error != "") {
+		// Without a hash, the content cannot be shown to match.
+		reason += "could not be read, "
+	}
+	if compareHash && hashesComparable(fi1.Hash, fi2.Hash) && fi1.Hash != fi2.Hash {
+		if isQuickHash(fi1.Hash) {
+			reason += "quick hash differs, "
+		} else {
+			reason += "hash differs, "
 		}
-		if d.IsDir() {
-			return nil // Skip directories
+	}
+	if reason == "" {
+		return ""
+	}
+	return reason[:len(reason)-2] // Remove trailing comma and space
+}
+
+// Difference is a path that differs between the two sides of a comparison.
+type Difference struct {
+	Path   string
+	Left   *FileInfo // nil if the path only exists on the right
+	Right  *FileInfo // nil if the path only exists on the left
+	Reason string    // why the entries differ, if the path exists on both sides
+}
+
+// difference compares the entries for one path found on the left, the right or both sides.
+// The entries are copied, so the pointers may be reused by the caller.
+func difference(fi1, fi2 *FileInfo, compareHash bool) (Difference, bool) {
+	switch {
+	case fi2 == nil:
+		left := *fi1
+		return Difference{Path: fi1.Path, Left: &left}, true
+	case fi1 == nil:
+		right := *fi2
+		return Difference{Path: fi2.Path, Right: &right}, true
+	}
+	reason := describeDifference(*fi1, *fi2, compareHash)
+	if reason == "" {
+		return Difference{}, false
+	}
+	left, right := *fi1, *fi2
+	return Difference{Path: fi1.Path, Left: &left, Right: &right, Reason: reason}, true
+}
+
+// formatDifference formats one line of comparison output.
+func formatDifference(d Difference) string {
+	switch {
+	case d.Right == nil:
+		return fmt.Sprintf("[<--] %s\n", d.Path)
+	case d.Left == nil:
+		return fmt.Sprintf("[-->] %s\n", d.Path)
+	default:
+		return fmt.Sprintf("[=/=] %s: %s\n", d.Path, d.Reason)
+	}
+}
+
+// comparedFile is a difference printed by 'compare --format json'.
+type comparedFile struct {
+	Path   string        `json:"path"`
+	Status string        `json:"status"` // "left-only", "right-only" or "differs"
+	Reason string        `json:"reason,omitempty"`
+	Left   *comparedSide `json:"left,omitempty"`
+	Right  *comparedSide `json:"right,omitempty"`
+}
+
+// comparedSide is the entry of a path on one side of a comparedFile.
+type comparedSide struct {
+	ModifiedTime time.Time `json:"modifiedTime"`
+	Size         int64     `json:"size"`
+	Hash         string    `json:"hash,omitempty"`
+	Error        string    `json:"error,omitempty"`
+}
+
+func newComparedFile(d Difference) comparedFile {
+	side := func(fileInfo *FileInfo) *comparedSide {
+		if fileInfo == nil {
+			return nil
 		}
+		return &comparedSide{ModifiedTime: fileInfo.ModifiedTime, Size: fileInfo.Size, Hash: fileInfo.Hash, Error: fileInfo.Error}
+	}
+	file := comparedFile{Path: d.Path, Status: "differs", Reason: d.Reason, Left: side(d.Left), Right: side(d.Right)}
+	switch {
+	case d.Right == nil:
+		file.Status = "left-only"
+	case d.Left == nil:
+		file.Status = "right-only"
+	}
+	return file
+}
+
+// CompareOptions configures CompareDirectories.
+type CompareOptions struct {
+	Hash            bool     // also compare full hashes of the files
+	QuickHashWindow int64    // compare quick hashes with windows of this size instead, 0 for none
+	Ignore          []string // leave out files and directories matching these patterns (see ignoreRules)
+	OnError         ErrorPolicy
+	Events          EventHandler
+}
 
-		relativePath, err := filepath.Rel(dir, path) // Make the path relative to the directory.
+// CompareResult counts the differences found by CompareDirectories.
+type CompareResult struct {
+	OnlyLeft  int // paths that only exist on the left
+	OnlyRight int // paths that only exist on the right
+	Differing int // paths on both sides whose entries differ
+}
 
-		if err != nil {
-			return fmt.Errorf("error getting relative path for %s: %w", path, err)
+// CompareDirectories compares the files below two directories and reports each difference
+// as a DifferenceEvent. Files that cannot be hashed are reported as differing, unless
+// opts.OnError aborts the comparison. Either directory may be a remote directory (see isRemote),
+// whose files are compared with the hashes of its manifest.
+func CompareDirectories(ctx context.Context, left, right string, opts CompareOptions) (*CompareResult, error) {
+	ignore, err := newIgnoreRules(opts.Ignore)
+	if err != nil {
+		return nil, err
+	}
+	if opts.QuickHashWindow > 0 && (isRemote(left) || isRemote(right)) {
+		return nil, fmt.Errorf("quick hashes cannot be compared with a remote directory, whose manifest holds full hashes")
+	}
+	var visit func(path string, fileInfo *FileInfo) error
+	if opts.Hash || opts.QuickHashWindow > 0 {
+		visit = func(path string, fileInfo *FileInfo) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			err := opts.OnError.try(ctx, path, func() error {
+				return hashFileInfo(path, fileInfo, hashOptions{quickWindow: opts.QuickHashWindow})
+			})
+			switch {
+			case err == nil:
+			case opts.OnError.Abort || ctx.Err() != nil:
+				return fmt.Errorf("error calculating hash for %s: %w", path, err)
+			default:
+				// Reported when the consumer reaches the file, so events stay in order.
+				fileInfo.Error = err.Error()
+			}
+			return nil
 		}
+	}
+	onError := func(path string, err error) error {
+		return opts.OnError.skip(opts.Events, path, err)
+	}
 
-		relativePath = filepath.ToSlash(relativePath) // Convert to forward slashes for consistency.
+	// Both trees are walked (and hashed) concurrently and joined in path order,
+	// so differences are reported as the walk progresses and memory use stays constant.
+	// A remote directory is listed from its manifest instead.
+	walker1, close1, err := openTree(ctx, left, ignore, onError, visit)
+	if err != nil {
+		return nil, err
+	}
+	defer close1()
+	walker2, close2, err := openTree(ctx, right, ignore, onError, visit)
+	if err != nil {
+		return nil, err
+	}
+	defer close2()
 
-		fi, err := d.Info()
-		if err != nil {
+	// Totals are only worth a second walk when the files are hashed, which is what takes time.
+	// A remote directory is not measured, so neither are the totals then.
+	progress := ProgressEvent{Stage: StageCompare}
+	if visit != nil && !isRemote(left) && !isRemote(right) {
+		files1, bytes1 := measureTree(ctx, left, ignore)
+		files2, bytes2 := measureTree(ctx, right, ignore)
+		progress.TotalFiles, progress.TotalBytes = files1+files2, bytes1+bytes2
+	}
+
+	result := &CompareResult{}
+	err = mergeJoin(walker1, walker2, func(fi1, fi2 *FileInfo) error {
+		if err := ctx.Err(); err != nil {
 			return err
 		}
-		fileInfo := FileInfo{
-			Path:         relativePath,
-			ModifiedTime: fi.ModTime(),
-			Size:         fi.Size(),
-		}
-		if strict {
-			fileInfo.Hash, err = calculateMD5(path)
-			if err != nil {
-				return fmt.Errorf("error calculating MD5 for %s: %w", path, err)
+		for i, fi := range []*FileInfo{fi1, fi2} {
+			if fi != nil {
+				if fi.Error != "" {
+					dir := []string{left, right}[i]
+					opts.Events.emit(&WarningEvent{Path: locationPath(dir, fi.Path), Err: errors.New(fi.Error)})
+				}
+				progress.Path = fi.Path
+				progress.Files++
+				if visit != nil {
+					progress.Bytes += fi.Size
+				}
 			}
 		}
-		fileInfoSlice = append(fileInfoSlice, fileInfo)
+		opts.Events.progress(progress)
+		d, ok := difference(fi1, fi2, visit != nil)
+		if !ok {
+			return nil
+		}
+		switch {
+		case d.Right == nil:
+			result.OnlyLeft++
+		case d.Left == nil:
+			result.OnlyRight++
+		default:
+			result.Differing++
+		}
+		opts.Events.emit(&DifferenceEvent{d})
 		return nil
 	})
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("error walking directories %s and %s: %w", left, right, err)
 	}
-	return fileInfoSlice, nil
+	return result, nil
 }
 
-func fileInfoSliceToMap(fileInfoSlice []FileInfo) map[string]FileInfo {
-	fileInfoMap := make(map[string]FileInfo)
-	for _, fi := range fileInfoSlice {
-		fileInfoMap[fi.Path] = fi
-	}
-	return fileInfoMap
-}
-
-func Compare(cmd *cobra.Command, args []string) {
+func Compare(cmd *cobra.Command, args []string) error {
 	dir1 := args[0]
 	dir2 := args[1]
 	strictFlag, err := cmd.Flags().GetBool("strict")
 	if err != nil {
-		fmt.Printf("Error retrieving strict flag: %v\n", err)
-		return
+		return fmt.Errorf("error retrieving strict flag: %v", err)
 	}
-	logrus.Debugf("Executing 'compare' command with arguments: dir1='%s', dir2='%s', strict=%t", dir1, dir2, strictFlag)
-
-	if !strictFlag {
-		fmt.Printf("Warning: Strict comparison is disabled.\n")
+	quickWindow, err := getSizeFlag(cmd, "quick-hash")
+	if err != nil {
+		return fmt.Errorf("error retrieving quick-hash flag: %v", err)
 	}
-
-	var fileInfoSlice1, fileInfoSlice2 []FileInfo
-	var err1, err2 error
-	var wg sync.WaitGroup
-
-	wg.Add(2)
-
-	go func() {
-		defer wg.Done()
-		fileInfoSlice1, err1 = walkDir(dir1, strictFlag)
-	}()
-
-	go func() {
-		defer wg.Done()
-		fileInfoSlice2, err2 = walkDir(dir2, strictFlag)
-	}()
-
-	wg.Wait()
-
-	if err1 != nil {
-		fmt.Printf("Error walking directory %s: %v\n", dir1, err1)
-		return
+	ignore, err := getIgnoreFlag(cmd)
+	if err != nil {
+		return err
 	}
-	if err2 != nil {
-		fmt.Printf("Error walking directory %s: %v\n", dir2, err2)
-		return
+	policy, err := getErrorPolicyFlag(cmd)
+	if err != nil {
+		return err
 	}
+	format, err := getFormatFlag(cmd)
+	if err != nil {
+		return err
+	}
+	if format == "manifest" && !strictFlag && quickWindow == 0 {
+		return fmt.Errorf("--format manifest records hashes, so it needs --strict or --quick-hash")
+	}
+	logrus.Debugf("Executing 'compare' command with arguments: dir1='%s', dir2='%s', strict=%t, quick hash window=%d, format: %s", dir1, dir2, strictFlag, quickWindow, format)
 
-	fileInfoMap1 := fileInfoSliceToMap(fileInfoSlice1)
-	fileInfoMap2 := fileInfoSliceToMap(fileInfoSlice2)
-
-	type output struct {
-		Path string
-		Msg  string
+	switch {
+	case quickWindow > 0:
+		fmt.Fprint(os.Stderr, quickHashWarning(quickWindow))
+	case !strictFlag:
+		fmt.Fprintln(os.Stderr, "Warning: Strict comparison is disabled.")
 	}
-	outputs := make([]output, 0)
 
-	for path, fi1 := range fileInfoMap1 {
-		fi2, exists := fileInfoMap2[path]
-		if !exists {
-			outputs = append(outputs, output{Path: path, Msg: fmt.Sprintf("[<--] %s", path)})
-			continue
+	printer, err := newEventPrinter(cmd, os.Stdout)
+	if err != nil {
+		return err
+	}
+	var writer *manifestWriter
+	if format == "manifest" {
+		if writer, err = newManifestWriter(os.Stdout); err != nil {
+			return err
 		}
-
-		mtimeEqual := fi1.ModifiedTime.Unix() == fi2.ModifiedTime.Unix()
-		sizeEqual := fi1.Size == fi2.Size
-		hashEqual := !strictFlag || fi1.Hash == fi2.Hash
-		if !mtimeEqual || !sizeEqual || !hashEqual {
-			reason := ""
-			if !mtimeEqual {
-				reason += "modified time differs, "
+	}
+	// JSON output is an array, streamed as the differences are found.
+	printed := 0
+	printDifference := func(d Difference) error {
+		switch format {
+		case "manifest":
+			// The files of the first directory that a sync would copy.
+			if d.Left != nil {
+				return writer.Write(*d.Left)
 			}
-			if !sizeEqual {
-				reason += "size differs, "
-				if !hashEqual {
-					reason += "hash differs, "
-				}
-				reason = reason[:len(reason)-2] // Remove trailing comma and space
-				outputs = append(outputs, output{Path: path, Msg: fmt.Sprintf("[=/=] %s: %s", path, reason)})
+		case "json":
+			data, err := json.MarshalIndent(newComparedFile(d), "  ", "  ")
+			if err != nil {
+				return err
+			}
+			if printed == 0 {
+				printer.printf("[\n  %s", data)
+			} else {
+				printer.printf(",\n  %s", data)
 			}
+		case "paths":
+			printer.printf("%s\n", d.Path)
+		default:
+			printer.printf("%s", formatDifference(d))
 		}
+		printed++
+		return nil
+	}
+	var printErr error
+	result, err := CompareDirectories(cmd.Context(), dir1, dir2, CompareOptions{
+		Hash:            strictFlag,
+		QuickHashWindow: quickWindow,
+		Ignore:          ignore,
+		OnError:         policy,
+		Events: func(e Event) {
+			if d, ok := e.(*DifferenceEvent); ok {
+				if printErr == nil {
+					printErr = printDifference(d.Difference)
+				}
+				return
+			}
+			printer.handle(e)
+		},
+	})
+	printer.done()
+	if err == nil {
+		err = printErr
+	}
+	if err != nil {
+		return err
 	}
 
-	for path := range fileInfoMap2 {
-		_, exists := fileInfoMap1[path]
-		if !exists {
-			outputs = append(outputs, output{Path: path, Msg: fmt.Sprintf("[-->] %s", path)})
+	switch format {
+	case "manifest":
+		if err := writer.Close(); err != nil {
+			return err
 		}
+	case "json":
+		if printed == 0 {
+			fmt.Println("[]")
+		} else {
+			fmt.Println("\n]")
+		}
+	case "text":
+		fmt.Printf("Comparison completed between %s and %s\n", dir1, dir2)
 	}
-
-	// Sort outputs by path for consistent output
-	sort.Slice(outputs, func(i, j int) bool {
-		return outputs[i].Path < outputs[j].Path
-	})
-
-	for _, out := range outputs {
-		fmt.Println(out.Msg)
+	if result.OnlyLeft+result.OnlyRight+result.Differing > 0 {
+		printer.errorReport()
+		return errDifferences
 	}
-
-	fmt.Printf("Comparison completed between %s and %s\n", dir1, dir2)
+	return printer.errorReport()
 }
@@ -0,0 +1,128 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// compression identifies how a manifest file is encoded on disk.
+type compression int
+
+const (
+	compressionNone compression = iota
+	compressionGzip
+	compressionZstd
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// compressionFromPath picks the compression for a manifest from its file extension,
+// e.g. "manifest.csv.gz" or "manifest.csv.zst".
+func compressionFromPath(path string) compression {
+	lower := strings.ToLower(path)
+	switch {
+	case strings.HasSuffix(lower, ".gz"):
+		return compressionGzip
+	case strings.HasSuffix(lower, ".zst"):
+		return compressionZstd
+	default:
+		return compressionNone
+	}
+}
+
+// sniffCompression detects the compression of a stream from its magic bytes without consuming them.
+func sniffCompression(r *bufio.Reader) (compression, error) {
+	magic, err := r.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return compressionNone, err
+	}
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return compressionGzip, nil
+	case bytes.HasPrefix(magic, zstdMagic):
+		return compressionZstd, nil
+	default:
+		return compressionNone, nil
+	}
+}
+
+// openManifestFile opens a manifest file for reading and transparently decompresses it.
+// The compression is sniffed from the content, so the extension does not have to match.
+func openManifestFile(path string) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(file)
+	c, err := sniffCompression(br)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("error detecting compression of %s: %v", path, err)
+	}
+
+	switch c {
+	case compressionGzip:
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("error opening gzip stream of %s: %v", path, err)
+		}
+		return &decompressingReader{Reader: zr, closers: []io.Closer{zr, file}}, nil
+	case compressionZstd:
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("error opening zstd stream of %s: %v", path, err)
+		}
+		return &decompressingReader{Reader: zr, closers: []io.Closer{zr.IOReadCloser(), file}}, nil
+	default:
+		return &decompressingReader{Reader: br, closers: []io.Closer{file}}, nil
+	}
+}
+
+// newCompressingWriter wraps w with the compression implied by the manifest path.
+// Closing the returned writer flushes the compressed stream but does not close w.
+func newCompressingWriter(w io.Writer, path string) (io.WriteCloser, error) {
+	switch compressionFromPath(path) {
+	case compressionGzip:
+		return gzip.NewWriter(w), nil
+	case compressionZstd:
+		return zstd.NewWriter(w)
+	default:
+		return nopWriteCloser{w}, nil
+	}
+}
+
+type decompressingReader struct {
+	io.Reader
+	closers []io.Closer
+}
+
+// Close closes the decompressor and the file. Closing more than once is harmless.
+func (r *decompressingReader) Close() error {
+	var firstErr error
+	for _, c := range r.closers {
+		if err := c.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	r.closers = nil
+	return firstErr
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
@@ -0,0 +1,281 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// Config is the ssync configuration file, config.toml. It defines named profiles:
+//
+//	[profiles.photos]
+//	source = 'D:\Photos'
+//	destination = 'E:\Backup\Photos'
+//	manifest = 'D:\photos.csv.zst'
+//	ignore = ["Thumbs.db", "*.tmp"]
+//	hash = "quick:1M"
+//	on-error = "retry:3"
+type Config struct {
+	Profiles map[string]Profile `toml:"profiles"`
+}
+
+// Profile holds the settings of a profile. The keys "source", "destination" and "manifest"
+// stand in for the positional arguments of commands; every other key is the default
+// value of the command line flag of the same name. Flags given on the command line win.
+// The key "hash" selects the hash algorithm: "md5" for full MD5 hashes, the default, or
+// "quick" or "quick:<window>" for quick hashes, as with --quick-hash.
+type Profile map[string]any
+
+// Keys of a profile that stand in for positional arguments.
+const (
+	ProfileSource      = "source"
+	ProfileDestination = "destination"
+	ProfileManifest    = "manifest"
+)
+
+// ProfileHash is the key of a profile that selects the hash algorithm. Rather than the flag
+// of the same name (find's --hash, the start of a hash), it maps onto --quick-hash: "md5"
+// leaves the flag unset and "quick" or "quick:<window>" sets it.
+const ProfileHash = "hash"
+
+// configPath returns the path of the configuration file: the --config flag, or config.toml
+// in the ssync directory below $XDG_CONFIG_HOME or the user's configuration directory.
+// explicit is set if the path was given with --config, in which case the file must exist.
+func configPath(cmd *cobra.Command) (path string, explicit bool, err error) {
+	path, err = cmd.Flags().GetString("config")
+	if err != nil {
+		return "", false, fmt.Errorf("error retrieving config flag: %v", err)
+	}
+	if path != "" {
+		return path, true, nil
+	}
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		dir, err = os.UserConfigDir()
+		if err != nil {
+			return "", false, fmt.Errorf("error locating configuration directory: %v", err)
+		}
+	}
+	return filepath.Join(dir, "ssync", "config.toml"), false, nil
+}
+
+// loadConfig reads the configuration file of cmd. A missing default configuration file is an empty configuration.
+func loadConfig(cmd *cobra.Command) (*Config, string, error) {
+	path, explicit, err := configPath(cmd)
+	if err != nil {
+		return nil, "", err
+	}
+	config := &Config{}
+	if _, err := toml.DecodeFile(path, config); err != nil {
+		if os.IsNotExist(err) && !explicit {
+			return config, path, nil
+		}
+		return nil, path, fmt.Errorf("error reading configuration file %s: %v", path, err)
+	}
+	return config, path, nil
+}
+
+// loadProfile returns the profile selected with --profile, or nil if there is none.
+func loadProfile(cmd *cobra.Command) (Profile, error) {
+	name, err := cmd.Flags().GetString("profile")
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving profile flag: %v", err)
+	}
+	if name == "" {
+		return nil, nil
+	}
+	config, path, err := loadConfig(cmd)
+	if err != nil {
+		return nil, err
+	}
+	profile, ok := config.Profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("profile %q is not defined in %s", name, path)
+	}
+	return profile, nil
+}
+
+// ApplyProfile sets the flags of cmd that were not given on the command line to the values
+// of the profile selected with --profile. It must run before the flags are read.
+// Settings for flags of other commands are left alone, so that profiles can be shared by commands.
+func ApplyProfile(cmd *cobra.Command) error {
+	profile, err := loadProfile(cmd)
+	if profile == nil || err != nil {
+		return err
+	}
+	known := profileKeys(cmd.Root())
+	for _, key := range sortedKeys(profile) {
+		if !known[key] {
+			return fmt.Errorf("unknown setting %q in profile", key)
+		}
+		if key == ProfileHash {
+			if err := applyProfileHash(cmd.Flags(), profile); err != nil {
+				return fmt.Errorf("invalid setting %q in profile: %v", key, err)
+			}
+			continue
+		}
+		flag := cmd.Flags().Lookup(key)
+		if flag == nil || flag.Changed {
+			continue
+		}
+		if err := setFlag(cmd.Flags(), key, profile[key]); err != nil {
+			return fmt.Errorf("invalid setting %q in profile: %v", key, err)
+		}
+		logrus.WithFields(logrus.Fields{"flag": key, "value": flag.Value.String()}).Debug("Flag set from profile")
+	}
+	return nil
+}
+
+// profileKeys returns the keys a profile may contain: the positional keys and the flags of all commands.
+func profileKeys(root *cobra.Command) map[string]bool {
+	known := map[string]bool{ProfileSource: true, ProfileDestination: true, ProfileManifest: true, ProfileHash: true}
+	var visit func(cmd *cobra.Command)
+	visit = func(cmd *cobra.Command) {
+		cmd.Flags().VisitAll(func(flag *pflag.Flag) { known[flag.Name] = true })
+		cmd.PersistentFlags().VisitAll(func(flag *pflag.Flag) { known[flag.Name] = true })
+		for _, sub := range cmd.Commands() {
+			visit(sub)
+		}
+	}
+	visit(root)
+	// Selecting the profile and configuration file from within a profile makes no sense.
+	delete(known, "profile")
+	delete(known, "config")
+	return known
+}
+
+// applyProfileHash sets --quick-hash from the "hash" setting of a profile, if cmd has that flag
+// and it was not given on the command line.
+func applyProfileHash(flags *pflag.FlagSet, profile Profile) error {
+	value, ok := profile[ProfileHash].(string)
+	if !ok {
+		return fmt.Errorf("expected a string, got %v", profile[ProfileHash])
+	}
+	algorithm, window, hasWindow := strings.Cut(value, ":")
+	switch {
+	case algorithm == "md5" && !hasWindow:
+		if _, ok := profile["quick-hash"]; ok {
+			return fmt.Errorf("md5 conflicts with the quick-hash setting")
+		}
+		return nil
+	case algorithm == "quick" && (!hasWindow || window != ""):
+		if _, ok := profile["quick-hash"]; ok {
+			return fmt.Errorf("give either hash or quick-hash, not both")
+		}
+	default:
+		return fmt.Errorf("unsupported hash algorithm %q: expected md5, quick or quick:<window>", value)
+	}
+	flag := flags.Lookup("quick-hash")
+	if flag == nil || flag.Changed {
+		return nil
+	}
+	if !hasWindow {
+		window = flag.NoOptDefVal
+	}
+	return flags.Set("quick-hash", window)
+}
+
+// setFlag sets a flag to a value decoded from TOML. Arrays set a repeatable flag once per element.
+func setFlag(flags *pflag.FlagSet, name string, value any) error {
+	switch value := value.(type) {
+	case string:
+		return flags.Set(name, value)
+	case bool:
+		return flags.Set(name, strconv.FormatBool(value))
+	case int64:
+		return flags.Set(name, strconv.FormatInt(value, 10))
+	case float64:
+		return flags.Set(name, strconv.FormatFloat(value, 'f', -1, 64))
+	case []any:
+		for _, element := range value {
+			if err := setFlag(flags, name, element); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported value %v", value)
+	}
+}
+
+// ProfileArgs wraps the validation of positional arguments so that they may be omitted
+// when a profile is selected; the command then takes them from the profile.
+func ProfileArgs(validate cobra.PositionalArgs) cobra.PositionalArgs {
+	return func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 && cmd.Flags().Changed("profile") {
+			return nil
+		}
+		return validate(cmd, args)
+	}
+}
+
+// WithProfile wraps a command so that, if it was run with a profile and without positional
+// arguments, it receives the profile's values for the given keys as its arguments.
+func WithProfile(run func(cmd *cobra.Command, args []string) error, keys ...string) func(cmd *cobra.Command, args []string) error {
+	return func(cmd *cobra.Command, args []string) error {
+		if len(args) > 0 {
+			return run(cmd, args)
+		}
+		profile, err := loadProfile(cmd)
+		if err != nil {
+			return err
+		}
+		if profile == nil {
+			return fmt.Errorf("missing arguments: give them on the command line or select a profile with --profile")
+		}
+		for _, key := range keys {
+			value, ok := profile[key].(string)
+			if !ok || value == "" {
+				return fmt.Errorf("the profile has no %q setting, which '%s' needs", key, cmd.CommandPath())
+			}
+			args = append(args, value)
+		}
+		return run(cmd, args)
+	}
+}
+
+// ConfigShow prints the profiles of the configuration file as TOML, or only the one selected with --profile.
+func ConfigShow(cmd *cobra.Command, args []string) error {
+	config, path, err := loadConfig(cmd)
+	if err != nil {
+		return err
+	}
+	name, err := cmd.Flags().GetString("profile")
+	if err != nil {
+		return fmt.Errorf("error retrieving profile flag: %v", err)
+	}
+
+	if name != "" {
+		profile, ok := config.Profiles[name]
+		if !ok {
+			return fmt.Errorf("profile %q is not defined in %s", name, path)
+		}
+		config = &Config{Profiles: map[string]Profile{name: profile}}
+	}
+	if len(config.Profiles) == 0 {
+		fmt.Printf("# No profiles defined in %s\n", path)
+		return nil
+	}
+	fmt.Printf("# %s\n", path)
+	if err := toml.NewEncoder(os.Stdout).Encode(config); err != nil {
+		return fmt.Errorf("error printing configuration: %v", err)
+	}
+	return nil
+}
+
+func sortedKeys(profile Profile) []string {
+	keys := make([]string, 0, len(profile))
+	for key := range profile {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
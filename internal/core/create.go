@@ -1,77 +1,115 @@
 package core
 
 import (
+	"context"
 	"fmt"
 	"io/fs"
+	"os"
 	"path/filepath"
-	"sort"
-	"sync"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
-func Create(cmd *cobra.Command, args []string) {
-	// Extract arguments.
-	directoryPath := args[0]
-	manifestPath := args[1]
+// CreateOptions configures CreateManifest.
+type CreateOptions struct {
+	BlockSize       int64    // also record a block list with blocks of this size, 0 for none
+	ContentDefined  bool     // split files into content-defined chunks of about BlockSize instead of fixed-size blocks
+	QuickHashWindow int64    // record quick hashes with windows of this size instead of full hashes, 0 for full hashes
+	Force           bool     // overwrite the manifest if it already exists
+	Resume          bool     // reuse the hashes of the partial manifest left by an interrupted run, if there is one
+	Ignore          []string // leave out files and directories matching these patterns (see ignoreRules)
+	OnError         ErrorPolicy
+	Events          EventHandler
+}
+
+// partialManifestPath returns where an interrupted create saves its partial manifest.
+func partialManifestPath(manifestPath string) string {
+	return manifestPath + ".partial"
+}
 
-	logrus.Debugf("Executing 'create' command with directory: '%s', manifest: '%s'", directoryPath, manifestPath)
+// CreateManifest hashes every file below root and writes a manifest of them to manifestPath.
+// The manifest only replaces manifestPath once it is complete.
+// Files that cannot be read are recorded with an error, unless opts.OnError aborts.
+//
+// If ctx is cancelled, the files hashed so far are saved as a partial manifest next to manifestPath,
+// which is returned together with the context's error. A later call with Resume set,
+// or UpdateManifest with the partial manifest as the old manifest, continues from it.
+func CreateManifest(ctx context.Context, root, manifestPath string, opts CreateOptions) (*Manifest, error) {
+	hashOpts, err := newHashOptions(opts.BlockSize, opts.QuickHashWindow, opts.ContentDefined)
+	if err != nil {
+		return nil, err
+	}
+	ignore, err := newIgnoreRules(opts.Ignore)
+	if err != nil {
+		return nil, err
+	}
 
-	isNTFS, err := isNTFS(directoryPath)
+	isNTFS, err := isNTFS(root)
 	if err != nil {
-		fmt.Printf("Error checking file system type: %v\n", err)
-		return
+		return nil, fmt.Errorf("error checking file system type: %v", err)
 	}
 	if !isNTFS {
-		fmt.Printf("The directory is not on an NTFS file system. NTFS file IDs will not be available.\n")
-		return
+		return nil, fmt.Errorf("%s is not on an NTFS file system, NTFS file IDs are not available", root)
 	}
 
-	// Create the manifest file.
-	file, err := createFile(manifestPath)
+	// Create the manifest file. It only replaces manifestPath once it is complete.
+	file, err := createManifestFile(manifestPath, opts.Force)
 	if err != nil {
-		fmt.Printf("Error creating manifest file: %v\n", err)
-		return
+		return nil, fmt.Errorf("error creating manifest file: %v", err)
 	}
-	defer file.Close()
+	defer file.Abort()
 
-	totalFileSize := int64(0)
-	// Traverse the directory to get the total file size.
-	_ = filepath.WalkDir(directoryPath, func(path string, d fs.DirEntry, err error) error {
-		if err != nil || d.IsDir() {
-			return nil
-		}
-		info, err := d.Info()
-		if err != nil {
-			return nil
+	// When resuming, files that are unchanged since they were listed in the partial manifest are not hashed again.
+	partialPath := partialManifestPath(manifestPath)
+	var resumed *manifestCursor
+	if opts.Resume {
+		if _, err := os.Stat(partialPath); os.IsNotExist(err) {
+			logrus.Debugf("No partial manifest %s to resume from, starting from scratch", partialPath)
+		} else {
+			partial, err := openSortedManifestWith(partialPath, openPartialManifest)
+			if err != nil {
+				return nil, fmt.Errorf("error reading partial manifest: %v", err)
+			}
+			resumed = newManifestCursor(partial)
+			defer resumed.Close()
 		}
-		totalFileSize += info.Size()
-		return nil
-	})
+	}
 
-	processedFileSizeChan := make(chan int64)
-	var wg sync.WaitGroup
-	wg.Add(1)
-	// Start a goroutine to print progress.
-	go func() {
-		defer wg.Done()
-		totalSize := int64(0)
-		for size := range processedFileSizeChan {
-			totalSize += size
-			fmt.Printf("\r%80s", "") // Clear the line
-			fmt.Printf("\rProcessed file size: %s, Total: %s", toFriendlySize(totalSize), toFriendlySize(totalFileSize))
-		}
-		fmt.Println()
-	}()
+	totalFiles, totalBytes := measureTree(ctx, root, ignore)
 
-	fileInfoSlice := make([]FileInfo, 0)
+	// WalkDir visits files in manifest order, so entries are written as they are found
+	// instead of being collected and sorted in memory.
+	writer, err := newManifestWriter(file.File)
+	if err != nil {
+		return nil, fmt.Errorf("error writing manifest file: %v", err)
+	}
 
-	err = filepath.WalkDir(directoryPath, func(path string, d fs.DirEntry, err error) error {
+	progress := ProgressEvent{Stage: StageHash, TotalFiles: totalFiles, TotalBytes: totalBytes}
+	writeEntry := func(fileInfo FileInfo) error {
+		if err := writer.Write(fileInfo); err != nil {
+			return err
+		}
+		progress.Path = fileInfo.Path
+		progress.Files++
+		progress.Bytes += fileInfo.Size
+		opts.Events.progress(progress)
+		return nil
+	}
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
 		if err != nil {
-			// Log error but continue walking.
-			fmt.Printf("Warning: Error processing file %q: %v\n", path, err)
-			return nil
+			// Without the root there would be nothing to record at all, which is no manifest of it.
+			if path == root {
+				return err
+			}
+			// The path cannot be listed; there is nothing to record for it in the manifest.
+			return opts.OnError.skip(opts.Events, path, err)
+		}
+		if ignored, err := ignore.skipWalk(root, path, d); ignored {
+			return err
 		}
 
 		if d.IsDir() {
@@ -82,64 +120,175 @@ func Create(cmd *cobra.Command, args []string) {
 		// Get os.FileInfo from fs.DirEntry to access ModTime and Size.
 		info, err := d.Info()
 		if err != nil {
-			// Log error but continue walking if info can't be retrieved for a file.
-			fmt.Printf("Warning: Error getting file info for %q: %v\n", path, err)
-			return nil
+			return opts.OnError.skip(opts.Events, path, fmt.Errorf("error getting file info: %w", err))
 		}
 
 		// Make the path relative to the directory and normalize slashes.
-		relativePath, err := filepath.Rel(directoryPath, path)
+		relativePath, err := filepath.Rel(root, path)
 		if err != nil {
-			// Log error but continue walking.
-			fmt.Printf("Error processing file %q: %v\n", path, err)
+			opts.Events.emit(&WarningEvent{Path: path, Err: err})
 			return nil
 		}
 		relativePath = filepath.ToSlash(relativePath)
 
-		// Process the file details.
-		modifiedTime := info.ModTime()
-		size := info.Size()
-		hash, err := calculateMD5(path)
-		if err != nil {
-			// Panic on MD5 calculation error as it's critical.
-			panic(fmt.Sprintf("Error calculating MD5 for file %s: %v", path, err))
+		// Create FileInfo, hash the file and write it to the manifest.
+		// A file that cannot be read is written with an error instead of a hash.
+		fileInfo := FileInfo{
+			Path:         relativePath,
+			ModifiedTime: info.ModTime(),
+			Size:         info.Size(),
 		}
-		fileID, err := getNTFSFileID(path)
+		err = opts.OnError.try(ctx, path, func() error {
+			fileID, err := getNTFSFileID(path)
+			fileInfo.NTFSFileID = fileID
+			return err
+		})
 		if err != nil {
-			panic(fmt.Sprintf("Error getting NTFS file ID for file %s: %v", path, err))
+			if err := unreadable(ctx, opts.OnError, opts.Events, path, &fileInfo, fmt.Errorf("error getting NTFS file ID: %w", err)); err != nil {
+				return err
+			}
+			return writeEntry(fileInfo)
 		}
-
-		// Create FileInfo and append to slice.
-		fileInfo := FileInfo{
-			Path:         relativePath,
-			ModifiedTime: modifiedTime,
-			Size:         size,
-			Hash:         hash,
-			NTFSFileID:   fileID,
+		reused := false
+		if resumed != nil {
+			old, err := resumed.Find(relativePath)
+			if err != nil {
+				return fmt.Errorf("error reading partial manifest: %v", err)
+			}
+			if old != nil && sameModifiedTimeAndSize(*old, fileInfo) && !needsRehash(*old, hashOpts) {
+				fileInfo.Hash, fileInfo.BlockSize, fileInfo.BlockHashes, fileInfo.ChunkSizes = old.Hash, old.BlockSize, old.BlockHashes, old.ChunkSizes
+				reused = true
+			}
 		}
-		fileInfoSlice = append(fileInfoSlice, fileInfo)
-		processedFileSizeChan <- size
-		return nil
+		if !reused {
+			err := opts.OnError.try(ctx, path, func() error {
+				return hashFileInfo(path, &fileInfo, hashOpts)
+			})
+			if err != nil {
+				if err := unreadable(ctx, opts.OnError, opts.Events, path, &fileInfo, fmt.Errorf("error calculating hash: %w", err)); err != nil {
+					return err
+				}
+			}
+		}
+		return writeEntry(fileInfo)
 	})
+	if ctx.Err() != nil {
+		return savePartialManifest(ctx, file, writer, resumed, partialPath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error traversing directory: %w", err)
+	}
 
-	close(processedFileSizeChan)
-	wg.Wait()
+	err = writer.Close()
+	if err == nil {
+		err = file.Commit()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error writing manifest file: %v", err)
+	}
+	if resumed != nil {
+		resumed.Close()
+	}
+	// The partial manifest of an earlier run is obsolete once the manifest is complete.
+	if err := os.Remove(partialPath); err != nil && !os.IsNotExist(err) {
+		opts.Events.emit(&WarningEvent{Path: partialPath, Err: fmt.Errorf("error removing partial manifest: %w", err)})
+	}
+	return writer.manifest(manifestPath), nil
+}
 
+// unreadable records that the file at path could not be read in fileInfo, after err has been
+// retried as far as policy allows. It returns err if the operation has to stop instead.
+func unreadable(ctx context.Context, policy ErrorPolicy, events EventHandler, path string, fileInfo *FileInfo, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	if err := policy.skip(events, path, err); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	fileInfo.Hash, fileInfo.BlockSize, fileInfo.BlockHashes, fileInfo.ChunkSizes = "", 0, nil, nil
+	fileInfo.Error = err.Error()
+	return nil
+}
+
+// savePartialManifest finishes the manifest of an interrupted create as a partial manifest.
+// The entries of the partial manifest being resumed that the walk did not reach yet are kept,
+// so that interrupting a resumed run never loses hashes.
+func savePartialManifest(ctx context.Context, file *atomicFile, writer *manifestWriter, resumed *manifestCursor, partialPath string) (*Manifest, error) {
+	if resumed != nil {
+		err := resumed.After(writer.last, writer.Write)
+		if err != nil {
+			return nil, fmt.Errorf("interrupted, and could not keep the rest of partial manifest: %v", err)
+		}
+		// The partial manifest being resumed is about to be replaced and must be closed on Windows.
+		resumed.Close()
+	}
+	writer.partial = true
+	err := writer.Close()
+	if err == nil {
+		err = file.CommitAs(partialPath)
+	}
 	if err != nil {
-		fmt.Printf("Error traversing directory: %v\n", err)
+		return nil, fmt.Errorf("interrupted, and could not save partial manifest: %v", err)
 	}
+	return writer.manifest(partialPath), fmt.Errorf("interrupted: %w", ctx.Err())
+}
 
-	// Sort fileInfoSlice by Path for consistent manifest generation.
-	sort.Slice(fileInfoSlice, func(i, j int) bool {
-		return fileInfoSlice[i].Path < fileInfoSlice[j].Path
-	})
+func Create(cmd *cobra.Command, args []string) error {
+	// Extract arguments.
+	directoryPath := args[0]
+	manifestPath := args[1]
+	blockSize, quickWindow, contentDefined, err := getHashFlags(cmd)
+	if err != nil {
+		return err
+	}
+	force, err := cmd.Flags().GetBool("force")
+	if err != nil {
+		return fmt.Errorf("error retrieving force flag: %v", err)
+	}
+	resume, err := cmd.Flags().GetBool("resume")
+	if err != nil {
+		return fmt.Errorf("error retrieving resume flag: %v", err)
+	}
+	ignore, err := getIgnoreFlag(cmd)
+	if err != nil {
+		return err
+	}
+	policy, err := getErrorPolicyFlag(cmd)
+	if err != nil {
+		return err
+	}
 
-	// Write the collected file information to the manifest file.
-	err = writeManifest(file, fileInfoSlice)
+	logrus.Debugf("Executing 'create' command with directory: '%s', manifest: '%s', block size: %d, quick hash window: %d, resume: %t", directoryPath, manifestPath, blockSize, quickWindow, resume)
+	if quickWindow > 0 {
+		fmt.Fprint(os.Stderr, quickHashWarning(quickWindow))
+	}
+
+	printer, err := newEventPrinter(cmd, os.Stdout)
 	if err != nil {
-		fmt.Printf("Error writing manifest file: %v\n", err)
-		return
+		return err
+	}
+	manifest, err := CreateManifest(cmd.Context(), directoryPath, manifestPath, CreateOptions{
+		BlockSize:       blockSize,
+		ContentDefined:  contentDefined,
+		QuickHashWindow: quickWindow,
+		Force:           force,
+		Resume:          resume,
+		Ignore:          ignore,
+		OnError:         policy,
+		Events:          printer.handle,
+	})
+	printer.done()
+	if manifest != nil && manifest.Partial {
+		fmt.Printf("Interrupted. The %d files hashed so far were saved to %s; run the same command with --resume to continue.\n", manifest.Files, manifest.Path)
+		return err
+	}
+	if err != nil {
+		return err
 	}
 
-	fmt.Printf("Manifest written to %s\n", manifestPath)
+	fmt.Printf("Manifest written to %s\n", manifest.Path)
+	if manifest.Errors > 0 {
+		fmt.Printf("%d files could not be read and were recorded with an error; 'ssync update' tries them again.\n", manifest.Errors)
+	}
+	return printer.errorReport()
 }
@@ -0,0 +1,196 @@
+package core
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// destinationBackend is a sync destination other than a local directory, such as an S3 bucket.
+// It is not listed: it stores its own manifest, which says what it holds and is replaced
+// by an updated manifest at the end of each sync.
+type destinationBackend interface {
+	// fetchManifest returns the manifest stored at the destination. A destination without one is empty.
+	fetchManifest(ctx context.Context) (fileIterator, func(), error)
+	// manifestName is the relative path the manifest is stored at, which files of the source may not use.
+	manifestName() string
+	// upload stores a file together with its hash and modified time, replacing any previous version.
+	upload(ctx context.Context, fileInfo FileInfo, r io.Reader) error
+	// touch records a new modified time for a file whose stored content is already up to date.
+	touch(ctx context.Context, fileInfo FileInfo) error
+	remove(ctx context.Context, relativePath string) error
+	// storeManifest replaces the manifest stored at the destination with the manifest file at path.
+	storeManifest(ctx context.Context, path string) error
+}
+
+// isBackend reports whether a location names a destination backend rather than a local directory.
+func isBackend(location string) bool {
+	return strings.HasPrefix(location, "s3://")
+}
+
+func openBackend(location string) (destinationBackend, error) {
+	return newS3Destination(location)
+}
+
+// backendSync is the state of a sync to a destination backend.
+type backendSync struct {
+	backend   destinationBackend
+	source    syncSource
+	srcCursor *manifestCursor // source manifest, whose hashes are reused for files that did not change
+	// srcSkipped reports whether a path is in a source directory that could not be listed, whose files are not deleted.
+	srcSkipped func(relativePath string) bool
+	delete     bool
+	policy     ErrorPolicy
+	fail       func(path string, err error) error
+	printer    *eventPrinter
+	stats      *syncStats
+	progress   *ProgressEvent
+}
+
+// run makes the backend a copy of the files of srcWalker. Files whose modified time and size match
+// the stored manifest are skipped; the others are hashed and only uploaded if their content changed.
+// The stored manifest is only replaced if the sync runs to the end, so an interrupted sync
+// uploads the files it did not record again next time.
+func (s *backendSync) run(ctx context.Context, srcWalker fileIterator) error {
+	stored, closeStored, err := s.backend.fetchManifest(ctx)
+	if err != nil {
+		return fmt.Errorf("error reading the manifest of the destination: %v", err)
+	}
+	defer closeStored()
+
+	file, err := os.CreateTemp("", "ssync-destination-*.csv.zst")
+	if err != nil {
+		return fmt.Errorf("error creating temporary file: %v", err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	writer, err := newManifestWriter(file)
+	if err != nil {
+		return err
+	}
+
+	err = mergeJoin(srcWalker, stored, func(srcFileInfo, dstFileInfo *FileInfo) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		entry, err := s.syncFile(ctx, srcFileInfo, dstFileInfo)
+		if err != nil || entry == nil {
+			return err
+		}
+		return writer.Write(*entry)
+	})
+	if err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("error writing manifest: %v", err)
+	}
+	if err := s.backend.storeManifest(ctx, file.Name()); err != nil {
+		return fmt.Errorf("error storing the manifest of the destination: %v", err)
+	}
+	return nil
+}
+
+// syncFile brings one path of the backend up to date and returns its entry for the new manifest,
+// or nil if the path is gone. Files that fail keep their previous entry.
+func (s *backendSync) syncFile(ctx context.Context, srcFileInfo, dstFileInfo *FileInfo) (*FileInfo, error) {
+	if srcFileInfo != nil {
+		s.progress.Path = srcFileInfo.Path
+		s.progress.Files++
+		defer s.printer.handle(s.progress)
+	}
+	switch {
+	case srcFileInfo == nil:
+		if !s.delete || s.srcSkipped(dstFileInfo.Path) {
+			return dstFileInfo, nil
+		}
+		err := s.policy.try(ctx, dstFileInfo.Path, func() error { return s.backend.remove(ctx, dstFileInfo.Path) })
+		if err != nil {
+			return dstFileInfo, s.fail(dstFileInfo.Path, fmt.Errorf("error deleting: %w", err))
+		}
+		s.printer.printf("[deleted] %s\n", dstFileInfo.Path)
+		s.stats.deleted++
+		return nil, nil
+
+	case srcFileInfo.Path == s.backend.manifestName():
+		return dstFileInfo, s.fail(srcFileInfo.Path, errors.New("the destination stores its manifest under this name"))
+
+	case dstFileInfo != nil && sameModifiedTimeAndSize(*srcFileInfo, *dstFileInfo):
+		return dstFileInfo, nil
+	}
+
+	entry := FileInfo{Path: srcFileInfo.Path, ModifiedTime: srcFileInfo.ModifiedTime, Size: srcFileInfo.Size}
+	err := s.policy.try(ctx, srcFileInfo.Path, func() error {
+		var err error
+		entry.Hash, err = s.sourceHash(*srcFileInfo)
+		return err
+	})
+	if err != nil {
+		return dstFileInfo, s.fail(srcFileInfo.Path, fmt.Errorf("error calculating hash: %w", err))
+	}
+
+	if dstFileInfo != nil && dstFileInfo.Hash == entry.Hash {
+		err := s.policy.try(ctx, srcFileInfo.Path, func() error { return s.backend.touch(ctx, entry) })
+		if err != nil {
+			return dstFileInfo, s.fail(srcFileInfo.Path, fmt.Errorf("error updating modified time: %w", err))
+		}
+		s.printer.printf("[touched] %s\n", srcFileInfo.Path)
+		return &entry, nil
+	}
+
+	err = s.policy.try(ctx, srcFileInfo.Path, func() error {
+		in, err := s.source(srcFileInfo.Path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		// Hide io.ReaderAt, which would let the upload read parts concurrently: remote sources read one request at a time.
+		return s.backend.upload(ctx, entry, struct{ io.Reader }{in})
+	})
+	if err != nil {
+		return dstFileInfo, s.fail(srcFileInfo.Path, fmt.Errorf("error uploading: %w", err))
+	}
+	if dstFileInfo == nil {
+		s.printer.printf("[new] %s\n", srcFileInfo.Path)
+	} else {
+		s.printer.printf("[copy] %s\n", srcFileInfo.Path)
+	}
+	s.stats.copied++
+	s.progress.Bytes += srcFileInfo.Size
+	return &entry, nil
+}
+
+// sourceHash returns the MD5 hash of a source file: from its manifest entry if that still
+// describes the file, otherwise by reading it.
+func (s *backendSync) sourceHash(fileInfo FileInfo) (string, error) {
+	if fileInfo.Hash != "" && !isQuickHash(fileInfo.Hash) && fileInfo.Error == "" {
+		// Entries of remote sources come from their manifest.
+		return fileInfo.Hash, nil
+	}
+	entry, err := s.srcCursor.Find(fileInfo.Path)
+	if err != nil {
+		return "", err
+	}
+	if entry != nil && entry.Error == "" && !isQuickHash(entry.Hash) && sameModifiedTimeAndSize(*entry, fileInfo) {
+		return entry.Hash, nil
+	}
+
+	in, err := s.source(fileInfo.Path)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	hash := md5.New()
+	if _, err := io.Copy(hash, in); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
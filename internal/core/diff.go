@@ -0,0 +1,48 @@
+package core
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// Diff compares two manifests without touching the file system.
+// Both manifests are streamed and joined in path order. Either may be the URL of a directory
+// on another machine (see 'ssync serve' and 'ssync agent'), whose current manifest is used.
+func Diff(cmd *cobra.Command, args []string) error {
+	manifestPath1 := args[0]
+	manifestPath2 := args[1]
+	logrus.Debugf("Executing 'diff' command with manifests: '%s', '%s'", manifestPath1, manifestPath2)
+
+	manifest1, close1, err := openManifestLocation(cmd.Context(), manifestPath1)
+	if err != nil {
+		return fmt.Errorf("error reading manifest %s: %v", manifestPath1, err)
+	}
+	defer close1()
+
+	manifest2, close2, err := openManifestLocation(cmd.Context(), manifestPath2)
+	if err != nil {
+		return fmt.Errorf("error reading manifest %s: %v", manifestPath2, err)
+	}
+	defer close2()
+
+	differences := 0
+	err = mergeJoin(manifest1, manifest2, func(fi1, fi2 *FileInfo) error {
+		// Manifests always carry hashes, so the comparison is always strict.
+		if d, ok := difference(fi1, fi2, true); ok {
+			fmt.Print(formatDifference(d))
+			differences++
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error reading manifests: %v", err)
+	}
+
+	fmt.Printf("Comparison completed between %s and %s\n", manifestPath1, manifestPath2)
+	if differences > 0 {
+		return errDifferences
+	}
+	return nil
+}
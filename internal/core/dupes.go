@@ -0,0 +1,386 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// dupesChunkSize is how much of each file of a group is compared at a time by --verify.
+const dupesChunkSize = 64 * 1024
+
+// DupesOptions configures FindDuplicates.
+type DupesOptions struct {
+	MinSize int64    // leave out files smaller than this; empty files are always left out
+	Ignore  []string // leave out files and directories matching these patterns (see ignoreRules)
+	// Roots are the directories the manifests describe, one per manifest. They are only needed to verify.
+	Roots []string
+	// Verify compares the files of each group byte by byte on disk, dropping files that changed
+	// since their manifest was written or whose content differs.
+	Verify bool
+	Events EventHandler
+}
+
+// DuplicateFile is one copy of a duplicated content.
+type DuplicateFile struct {
+	Manifest     string    `json:"manifest"`
+	Path         string    `json:"path"`
+	ModifiedTime time.Time `json:"modifiedTime"`
+}
+
+// DuplicateGroup is a content found more than once.
+type DuplicateGroup struct {
+	Hash   string `json:"hash"`
+	Size   int64  `json:"size"`   // size of one copy
+	Wasted int64  `json:"wasted"` // size of all copies but one
+	// Unverified is set for a group found by quick hashes, which only sample the files, and not
+	// compared on disk: its files are only candidates for being identical.
+	Unverified bool            `json:"unverified,omitempty"`
+	Files      []DuplicateFile `json:"files"`
+}
+
+// FindDuplicates groups the files of one or more manifests by content, using the sizes and hashes
+// recorded in the manifests, and returns the groups of more than one file, most wasted bytes first.
+// Files recorded with quick hashes are only grouped with each other, and only by their quick hash,
+// so their groups are marked as unverified unless opts.Verify compares them on disk.
+// A manifest given more than once, under any name, is only read once.
+// The manifests are read twice, so that only the files of a size that occurs more than once are kept in memory.
+func FindDuplicates(ctx context.Context, manifestPaths []string, opts DupesOptions) ([]DuplicateGroup, error) {
+	ignore, err := newIgnoreRules(opts.Ignore)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Verify && len(opts.Roots) != len(manifestPaths) {
+		return nil, fmt.Errorf("verifying needs the directory of each manifest: got %d for %d manifests", len(opts.Roots), len(manifestPaths))
+	}
+	manifestPaths, opts.Roots, err = uniqueManifests(manifestPaths, opts.Roots)
+	if err != nil {
+		return nil, err
+	}
+	minSize := max(opts.MinSize, 1)
+	candidate := func(fileInfo FileInfo) bool {
+		return fileInfo.Size >= minSize && fileInfo.Hash != "" && fileInfo.Error == "" && !ignore.matchPath(fileInfo.Path)
+	}
+
+	sizes := make(map[int64]int)
+	for _, manifestPath := range manifestPaths {
+		err := forEachEntry(ctx, manifestPath, func(fileInfo FileInfo) {
+			if candidate(fileInfo) {
+				sizes[fileInfo.Size]++
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	type key struct {
+		size int64
+		hash string
+	}
+	groups := make(map[key]*DuplicateGroup)
+	for _, manifestPath := range manifestPaths {
+		// A path listed twice in a manifest is still one file.
+		seen := make(map[string]bool)
+		err := forEachEntry(ctx, manifestPath, func(fileInfo FileInfo) {
+			if !candidate(fileInfo) || sizes[fileInfo.Size] < 2 || seen[fileInfo.Path] {
+				return
+			}
+			seen[fileInfo.Path] = true
+			k := key{fileInfo.Size, fileInfo.Hash}
+			group := groups[k]
+			if group == nil {
+				group = &DuplicateGroup{Hash: fileInfo.Hash, Size: fileInfo.Size, Unverified: isQuickHash(fileInfo.Hash)}
+				groups[k] = group
+			}
+			group.Files = append(group.Files, DuplicateFile{Manifest: manifestPath, Path: fileInfo.Path, ModifiedTime: fileInfo.ModifiedTime})
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var result []DuplicateGroup
+	for _, group := range groups {
+		if len(group.Files) < 2 {
+			continue
+		}
+		if opts.Verify {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			// Files that are still identical on disk are verified, whatever their hashes.
+			for _, files := range verifyDuplicates(*group, opts.Roots, manifestPaths, opts.Events) {
+				result = append(result, DuplicateGroup{Hash: group.Hash, Size: group.Size, Files: files})
+			}
+			continue
+		}
+		result = append(result, *group)
+	}
+	for i := range result {
+		result[i].Wasted = result[i].Size * int64(len(result[i].Files)-1)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Wasted != result[j].Wasted {
+			return result[i].Wasted > result[j].Wasted
+		}
+		return result[i].Hash < result[j].Hash
+	})
+	return result, nil
+}
+
+// uniqueManifests leaves out the manifests that are given more than once, by name or as the same file,
+// together with their roots, if any.
+func uniqueManifests(manifestPaths, roots []string) ([]string, []string, error) {
+	var uniquePaths, uniqueRoots []string
+	var infos []os.FileInfo
+next:
+	for i, manifestPath := range manifestPaths {
+		info, err := os.Stat(manifestPath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading manifest %s: %v", manifestPath, err)
+		}
+		for _, other := range infos {
+			if os.SameFile(info, other) {
+				logrus.Debugf("Manifest %s is given more than once, reading it once", manifestPath)
+				continue next
+			}
+		}
+		infos = append(infos, info)
+		uniquePaths = append(uniquePaths, manifestPath)
+		if len(roots) > 0 {
+			uniqueRoots = append(uniqueRoots, roots[i])
+		}
+	}
+	return uniquePaths, uniqueRoots, nil
+}
+
+// forEachEntry calls fn for every entry of a manifest.
+func forEachEntry(ctx context.Context, manifestPath string, fn func(fileInfo FileInfo)) error {
+	manifest, err := openManifest(manifestPath)
+	if err != nil {
+		return fmt.Errorf("error reading manifest %s: %v", manifestPath, err)
+	}
+	defer manifest.Close()
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		fileInfo, err := manifest.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading manifest %s: %v", manifestPath, err)
+		}
+		fn(fileInfo)
+	}
+}
+
+// verifyDuplicates compares the files of a group on disk and returns the sets of files that are
+// still identical, with at least two files each. Files that changed since their manifest was
+// written, by modified time and size, or cannot be read are reported with a WarningEvent and left out.
+func verifyDuplicates(group DuplicateGroup, roots, manifestPaths []string, events EventHandler) [][]DuplicateFile {
+	rootOf := make(map[string]string)
+	for i, manifestPath := range manifestPaths {
+		rootOf[manifestPath] = roots[i]
+	}
+
+	type openCopy struct {
+		DuplicateFile
+		file *os.File
+		buf  []byte
+	}
+	var copies []*openCopy
+	defer func() {
+		for _, c := range copies {
+			c.file.Close()
+		}
+	}()
+	for _, f := range group.Files {
+		path := filepath.Join(rootOf[f.Manifest], filepath.FromSlash(f.Path))
+		file, err := os.Open(path)
+		if err != nil {
+			events.emit(&WarningEvent{Path: path, Err: err})
+			continue
+		}
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			events.emit(&WarningEvent{Path: path, Err: err})
+			continue
+		}
+		if !sameModifiedTimeAndSize(FileInfo{ModifiedTime: info.ModTime(), Size: info.Size()}, FileInfo{ModifiedTime: f.ModifiedTime, Size: group.Size}) {
+			file.Close()
+			events.emit(&WarningEvent{Path: path, Err: fmt.Errorf("changed since the manifest was written")})
+			continue
+		}
+		copies = append(copies, &openCopy{DuplicateFile: f, file: file, buf: make([]byte, dupesChunkSize)})
+	}
+
+	// Read all copies in step. Whenever chunks differ, the copies split into sets of equal chunks,
+	// which are compared separately from then on.
+	sets := [][]*openCopy{copies}
+	for offset := int64(0); offset < group.Size; offset += dupesChunkSize {
+		var next [][]*openCopy
+		for _, set := range sets {
+			var read []*openCopy
+			for _, c := range set {
+				n, err := io.ReadFull(c.file, c.buf)
+				if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+					events.emit(&WarningEvent{Path: c.file.Name(), Err: err})
+					continue
+				}
+				c.buf = c.buf[:n]
+				read = append(read, c)
+			}
+			for len(read) > 0 {
+				var same, rest []*openCopy
+				for _, c := range read {
+					if bytes.Equal(c.buf, read[0].buf) {
+						same = append(same, c)
+					} else {
+						rest = append(rest, c)
+					}
+				}
+				if len(same) > 1 {
+					next = append(next, same)
+				}
+				read = rest
+			}
+		}
+		for _, set := range next {
+			for _, c := range set {
+				c.buf = c.buf[:cap(c.buf)]
+			}
+		}
+		sets = next
+	}
+
+	var result [][]DuplicateFile
+	for _, set := range sets {
+		if len(set) < 2 {
+			continue
+		}
+		files := make([]DuplicateFile, len(set))
+		for i, c := range set {
+			files[i] = c.DuplicateFile
+		}
+		result = append(result, files)
+	}
+	return result
+}
+
+func Dupes(cmd *cobra.Command, args []string) error {
+	minSize, err := getSizeFlag(cmd, "min-size")
+	if err != nil {
+		return fmt.Errorf("invalid min-size flag: %v", err)
+	}
+	ignore, err := getIgnoreFlag(cmd)
+	if err != nil {
+		return err
+	}
+	roots, err := cmd.Flags().GetStringArray("root")
+	if err != nil {
+		return fmt.Errorf("error retrieving root flag: %v", err)
+	}
+	verify, err := cmd.Flags().GetBool("verify")
+	if err != nil {
+		return fmt.Errorf("error retrieving verify flag: %v", err)
+	}
+	top, err := cmd.Flags().GetInt("top")
+	if err != nil {
+		return fmt.Errorf("error retrieving top flag: %v", err)
+	}
+	jsonFlag, err := cmd.Flags().GetBool("json")
+	if err != nil {
+		return fmt.Errorf("error retrieving json flag: %v", err)
+	}
+	if len(roots) > 0 && len(roots) != len(args) {
+		return fmt.Errorf("give one --root per manifest: got %d for %d manifests", len(roots), len(args))
+	}
+	if verify && len(roots) == 0 {
+		return fmt.Errorf("--verify needs the directory of each manifest (--root)")
+	}
+	logrus.Debugf("Executing 'dupes' command with manifests: %v, roots: %v, min size: %d, verify: %t", args, roots, minSize, verify)
+
+	printer, err := newEventPrinter(cmd, os.Stderr)
+	if err != nil {
+		return err
+	}
+	groups, err := FindDuplicates(cmd.Context(), args, DupesOptions{
+		MinSize: minSize,
+		Ignore:  ignore,
+		Roots:   roots,
+		Verify:  verify,
+		Events:  printer.handle,
+	})
+	printer.done()
+	if err != nil {
+		return err
+	}
+	// Unverified groups may not be duplicates at all, so they are counted apart.
+	var wasted, unverifiedWasted int64
+	unverified := 0
+	for _, group := range groups {
+		if group.Unverified {
+			unverified++
+			unverifiedWasted += group.Wasted
+		} else {
+			wasted += group.Wasted
+		}
+	}
+	total := len(groups) - unverified
+	if top > 0 && len(groups) > top {
+		groups = groups[:top]
+	}
+
+	if jsonFlag {
+		if groups == nil {
+			groups = []DuplicateGroup{}
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(groups); err != nil {
+			return err
+		}
+		return printer.errorReport()
+	}
+
+	// Paths are shown on disk when the directories are known, and with their manifest when there are several.
+	rootOf := make(map[string]string)
+	for i, root := range roots {
+		rootOf[args[i]] = root
+	}
+	for _, group := range groups {
+		if group.Unverified {
+			fmt.Printf("%d possible copies of %s, %s wasted if identical (same quick hash %s, unverified):\n", len(group.Files), toFriendlySize(group.Size), toFriendlySize(group.Wasted), group.Hash)
+		} else {
+			fmt.Printf("%d copies of %s, %s wasted (%s):\n", len(group.Files), toFriendlySize(group.Size), toFriendlySize(group.Wasted), group.Hash)
+		}
+		for _, f := range group.Files {
+			switch {
+			case len(roots) > 0:
+				fmt.Printf("  %s\n", filepath.Join(rootOf[f.Manifest], filepath.FromSlash(f.Path)))
+			case len(args) > 1:
+				fmt.Printf("  %s: %s\n", f.Manifest, f.Path)
+			default:
+				fmt.Printf("  %s\n", f.Path)
+			}
+		}
+	}
+	fmt.Printf("%d groups of duplicates, %s wasted\n", total, toFriendlySize(wasted))
+	if unverified > 0 {
+		fmt.Printf("%d groups of possible duplicates by quick hash, %s wasted if identical: check them with --verify\n", unverified, toFriendlySize(unverifiedWasted))
+	}
+	return printer.errorReport()
+}
@@ -0,0 +1,85 @@
+package core
+
+// Event is something that happens while a manifest is created, updated or compared.
+// It is one of *ProgressEvent, *WarningEvent, *ChangeEvent, *DifferenceEvent or *FlushEvent.
+type Event interface {
+	event()
+}
+
+// EventHandler receives the events of an operation. It is called from the goroutine
+// running the operation, in order, and must not block for long.
+type EventHandler func(Event)
+
+// Stages of an operation reported by ProgressEvent.
+const (
+	StageScan    = "scan"    // walking the directory and comparing it with the old manifest
+	StageHash    = "hash"    // hashing files
+	StageVerify  = "verify"  // re-hashing a sample of unchanged files
+	StageCompare = "compare" // walking and comparing two directories
+	StageSync    = "sync"    // copying files
+	StageBackup  = "backup"  // storing files in a backup repository
+	StageRestore = "restore" // restoring files from a snapshot
+)
+
+// ProgressEvent reports that a file has been processed. Counts are per stage and include the file.
+type ProgressEvent struct {
+	Stage      string // one of the Stage constants
+	Path       string // path relative to the root, with forward slashes
+	Files      int    // files processed so far
+	TotalFiles int    // files to process in total, 0 if unknown
+	Bytes      int64  // bytes processed so far
+	TotalBytes int64  // bytes to process in total, 0 if unknown
+}
+
+// WarningEvent reports a problem that did not stop the operation, such as an unreadable path.
+type WarningEvent struct {
+	Path string // path on disk
+	Err  error
+}
+
+// ChangeEvent explains what UpdateManifest or WatchManifest did with one path.
+// Changes are reported in manifest order, by WatchManifest within each batch of changes.
+type ChangeEvent struct {
+	FileChange
+}
+
+// DifferenceEvent reports a path that differs between the two sides of a comparison.
+// Differences are reported in manifest order.
+type DifferenceEvent struct {
+	Difference
+}
+
+// FlushEvent reports that WatchManifest wrote the manifest.
+type FlushEvent struct {
+	Manifest
+}
+
+func (*ProgressEvent) event()   {}
+func (*WarningEvent) event()    {}
+func (*ChangeEvent) event()     {}
+func (*DifferenceEvent) event() {}
+func (*FlushEvent) event()      {}
+
+// emit passes an event to handler, if there is one.
+func (handler EventHandler) emit(e Event) {
+	if handler != nil {
+		handler(e)
+	}
+}
+
+// progress emits a copy of a progress event, so the caller can keep updating its own.
+func (handler EventHandler) progress(e ProgressEvent) {
+	handler.emit(&e)
+}
+
+// Manifest describes a manifest file that has been written.
+type Manifest struct {
+	Path   string // where the manifest was written
+	Files  int    // number of entries
+	Bytes  int64  // total size of the files
+	Digest string // digest of the entries from the integrity trailer, e.g. "sha256:<hex>"
+	// Partial is set for a manifest saved by an interrupted CreateManifest or UpdateManifest.
+	// It only lists the files hashed before the interruption, or their old entries.
+	Partial bool
+	Errors  int // entries recorded with an error because the file could not be read
+}
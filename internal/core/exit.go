@@ -0,0 +1,56 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Exit codes of ssync.
+const (
+	ExitOK          = 0 // success; for compare, diff and verify: no differences
+	ExitDifferences = 1 // compare, diff or verify found differences
+	ExitPartial     = 2 // the command completed, but some files could not be processed
+	ExitFatal       = 3 // the command failed
+)
+
+// ExitError is an error that makes ssync exit with a specific code.
+// Err may be nil if the command has already reported the outcome, e.g. differences that were found.
+type ExitError struct {
+	Code int
+	Err  error
+}
+
+func (e *ExitError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("exit code %d", e.Code)
+	}
+	return e.Err.Error()
+}
+
+func (e *ExitError) Unwrap() error {
+	return e.Err
+}
+
+// ExitCode returns the exit code for an error returned by a command.
+// Errors without an ExitError are fatal.
+func ExitCode(err error) int {
+	if err == nil {
+		return ExitOK
+	}
+	var exitErr *ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.Code
+	}
+	return ExitFatal
+}
+
+// errDifferences is returned by commands that found and reported differences.
+var errDifferences = &ExitError{Code: ExitDifferences}
+
+// partialFailure returns an ExitPartial error if an operation completed with warnings.
+func partialFailure(warnings int) error {
+	if warnings == 0 {
+		return nil
+	}
+	return &ExitError{Code: ExitPartial, Err: fmt.Errorf("completed with %d warnings, see above", warnings)}
+}
@@ -0,0 +1,339 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// FindOptions selects entries of a manifest. Zero values select everything.
+type FindOptions struct {
+	Glob           string // path pattern, where "**" matches any number of directories, e.g. "photos/**/*.cr2"
+	Name           string // pattern for the file name alone, e.g. "*.jpg"
+	HashPrefix     string // start of the hash, in any case
+	LargerThan     int64  // select files larger than this many bytes, if positive
+	SmallerThan    int64  // select files smaller than this many bytes, if positive
+	ModifiedAfter  time.Time
+	ModifiedBefore time.Time
+	Unreadable     bool // only select files recorded with an error
+}
+
+// validate checks the patterns, so that a bad one fails up front rather than matching nothing.
+func (o FindOptions) validate() error {
+	for _, segment := range strings.Split(o.Glob, "/") {
+		if _, err := path.Match(segment, ""); err != nil {
+			return fmt.Errorf("invalid glob %q: %v", o.Glob, err)
+		}
+	}
+	if _, err := path.Match(o.Name, ""); err != nil {
+		return fmt.Errorf("invalid name pattern %q: %v", o.Name, err)
+	}
+	return nil
+}
+
+func (o FindOptions) match(fileInfo FileInfo) bool {
+	switch {
+	case o.Glob != "" && !matchGlob(strings.Split(o.Glob, "/"), strings.Split(fileInfo.Path, "/")):
+		return false
+	case o.Name != "" && !matchName(o.Name, path.Base(fileInfo.Path)):
+		return false
+	case o.HashPrefix != "" && !strings.HasPrefix(strings.ToLower(fileInfo.Hash), strings.ToLower(o.HashPrefix)):
+		return false
+	case o.LargerThan > 0 && fileInfo.Size <= o.LargerThan:
+		return false
+	case o.SmallerThan > 0 && fileInfo.Size >= o.SmallerThan:
+		return false
+	case !o.ModifiedAfter.IsZero() && !fileInfo.ModifiedTime.After(o.ModifiedAfter):
+		return false
+	case !o.ModifiedBefore.IsZero() && !fileInfo.ModifiedTime.Before(o.ModifiedBefore):
+		return false
+	case o.Unreadable && fileInfo.Error == "":
+		return false
+	}
+	return true
+}
+
+func matchName(pattern, name string) bool {
+	ok, _ := path.Match(pattern, name)
+	return ok
+}
+
+// matchGlob matches the segments of a path against the segments of a pattern,
+// where a "**" segment matches any number of segments, including none.
+func matchGlob(pattern, segments []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(segments); i++ {
+				if matchGlob(pattern[1:], segments[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(segments) == 0 || !matchName(pattern[0], segments[0]) {
+			return false
+		}
+		pattern, segments = pattern[1:], segments[1:]
+	}
+	return len(segments) == 0
+}
+
+// FindInManifest calls fn for every entry of a manifest selected by opts, in the order of the manifest.
+func FindInManifest(ctx context.Context, manifestPath string, opts FindOptions, fn func(fileInfo FileInfo) error) error {
+	if err := opts.validate(); err != nil {
+		return err
+	}
+	var fnErr error
+	err := forEachEntry(ctx, manifestPath, func(fileInfo FileInfo) {
+		if fnErr == nil && opts.match(fileInfo) {
+			fnErr = fn(fileInfo)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return fnErr
+}
+
+// DirectoryEntry is a file or a directory directly below a directory of a manifest.
+type DirectoryEntry struct {
+	Name         string    `json:"name"`
+	Directory    bool      `json:"directory"`
+	Files        int       `json:"files"` // 1 for a file, the files below it for a directory
+	Bytes        int64     `json:"bytes"`
+	ModifiedTime time.Time `json:"modifiedTime"` // for a directory, that of the newest file below it
+	Hash         string    `json:"hash,omitempty"`
+	Error        string    `json:"error,omitempty"`
+}
+
+// ListDirectory returns the files and directories directly below dir (a path relative to the root,
+// "" for the root) in a manifest, directories first. Manifests only list files, so the directories
+// are those that contain files, with the number and size of the files below them.
+func ListDirectory(ctx context.Context, manifestPath, dir string) ([]DirectoryEntry, error) {
+	dir = cleanSubtree(dir)
+	entries := make(map[string]*DirectoryEntry)
+	found := false
+	err := forEachEntry(ctx, manifestPath, func(fileInfo FileInfo) {
+		if !inSubtree(fileInfo.Path, dir) || fileInfo.Path == dir {
+			return
+		}
+		found = true
+		name, _, isDir := strings.Cut(strings.TrimPrefix(fileInfo.Path[len(dir):], "/"), "/")
+		entry := entries[name]
+		if entry == nil {
+			entry = &DirectoryEntry{Name: name, Directory: isDir}
+			entries[name] = entry
+		}
+		entry.Files++
+		entry.Bytes += fileInfo.Size
+		if fileInfo.ModifiedTime.After(entry.ModifiedTime) {
+			entry.ModifiedTime = fileInfo.ModifiedTime
+		}
+		if !isDir {
+			entry.Hash, entry.Error = fileInfo.Hash, fileInfo.Error
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !found && dir != "" {
+		return nil, fmt.Errorf("no directory %s in %s", dir, manifestPath)
+	}
+
+	result := make([]DirectoryEntry, 0, len(entries))
+	for _, entry := range entries {
+		result = append(result, *entry)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Directory != result[j].Directory {
+			return result[i].Directory
+		}
+		return result[i].Name < result[j].Name
+	})
+	return result, nil
+}
+
+// parseTimeFlag parses a date or time given on the command line, in local time unless it has a zone:
+// "2023-01-01", "2023-01-01 15:04:05", "2023-01-01T15:04:05" or RFC 3339.
+func parseTimeFlag(cmd *cobra.Command, name string) (time.Time, error) {
+	value, err := cmd.Flags().GetString(name)
+	if err != nil || value == "" {
+		return time.Time{}, err
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02", "2006-01-02 15:04:05", "2006-01-02T15:04:05"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid %s flag %q: expected a date such as 2023-01-01 or a time such as 2023-01-01 15:04:05", name, value)
+}
+
+// getFindFlags reads the flags of 'find' into FindOptions.
+func getFindFlags(cmd *cobra.Command) (FindOptions, error) {
+	var opts FindOptions
+	var err error
+	if opts.Glob, err = cmd.Flags().GetString("glob"); err != nil {
+		return opts, fmt.Errorf("error retrieving glob flag: %v", err)
+	}
+	if opts.Name, err = cmd.Flags().GetString("name"); err != nil {
+		return opts, fmt.Errorf("error retrieving name flag: %v", err)
+	}
+	if opts.HashPrefix, err = cmd.Flags().GetString("hash"); err != nil {
+		return opts, fmt.Errorf("error retrieving hash flag: %v", err)
+	}
+	if opts.LargerThan, err = getSizeFlag(cmd, "larger-than"); err != nil {
+		return opts, fmt.Errorf("invalid larger-than flag: %v", err)
+	}
+	if opts.SmallerThan, err = getSizeFlag(cmd, "smaller-than"); err != nil {
+		return opts, fmt.Errorf("invalid smaller-than flag: %v", err)
+	}
+	if opts.ModifiedAfter, err = parseTimeFlag(cmd, "modified-after"); err != nil {
+		return opts, err
+	}
+	if opts.ModifiedBefore, err = parseTimeFlag(cmd, "modified-before"); err != nil {
+		return opts, err
+	}
+	if opts.Unreadable, err = cmd.Flags().GetBool("unreadable"); err != nil {
+		return opts, fmt.Errorf("error retrieving unreadable flag: %v", err)
+	}
+	return opts, nil
+}
+
+// getFormatFlag reads the --format flag of find and compare, which both print their files
+// as text, paths (one per line), json or manifest.
+func getFormatFlag(cmd *cobra.Command) (string, error) {
+	format, err := cmd.Flags().GetString("format")
+	if err != nil {
+		return "", fmt.Errorf("error retrieving format flag: %v", err)
+	}
+	switch format {
+	case "text", "paths", "json", "manifest":
+		return format, nil
+	default:
+		return "", fmt.Errorf("invalid format flag %q: expected text, paths, json or manifest", format)
+	}
+}
+
+// foundFile is an entry printed by 'find --format json'.
+type foundFile struct {
+	Manifest     string    `json:"manifest"`
+	Path         string    `json:"path"`
+	ModifiedTime time.Time `json:"modifiedTime"`
+	Size         int64     `json:"size"`
+	Hash         string    `json:"hash,omitempty"`
+	Error        string    `json:"error,omitempty"`
+}
+
+func Find(cmd *cobra.Command, args []string) error {
+	opts, err := getFindFlags(cmd)
+	if err != nil {
+		return err
+	}
+	format, err := getFormatFlag(cmd)
+	if err != nil {
+		return err
+	}
+	if format == "manifest" && len(args) > 1 {
+		return fmt.Errorf("--format manifest writes a single manifest, so it takes a single manifest")
+	}
+	logrus.Debugf("Executing 'find' command with manifests: %v, options: %+v, format: %s", args, opts, format)
+
+	var writer *manifestWriter
+	if format == "manifest" {
+		if writer, err = newManifestWriter(os.Stdout); err != nil {
+			return err
+		}
+	}
+	var found []foundFile
+	count, size := 0, int64(0)
+	for _, manifestPath := range args {
+		err := FindInManifest(cmd.Context(), manifestPath, opts, func(fileInfo FileInfo) error {
+			count++
+			size += fileInfo.Size
+			// With several manifests, text output shows which one each file comes from.
+			name := fileInfo.Path
+			if len(args) > 1 {
+				name = manifestPath + ": " + fileInfo.Path
+			}
+			switch format {
+			case "manifest":
+				return writer.Write(fileInfo)
+			case "json":
+				found = append(found, foundFile{Manifest: manifestPath, Path: fileInfo.Path, ModifiedTime: fileInfo.ModifiedTime,
+					Size: fileInfo.Size, Hash: fileInfo.Hash, Error: fileInfo.Error})
+			case "paths":
+				fmt.Println(name)
+			default:
+				line := fmt.Sprintf("%s  %10s  %s", fileInfo.ModifiedTime.Local().Format("2006-01-02 15:04:05"), toFriendlySize(fileInfo.Size), name)
+				if fileInfo.Error != "" {
+					line += " (unreadable: " + fileInfo.Error + ")"
+				}
+				fmt.Println(line)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	switch format {
+	case "manifest":
+		return writer.Close()
+	case "json":
+		if found == nil {
+			found = []foundFile{}
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(found)
+	case "text":
+		fmt.Printf("%d files, %s\n", count, toFriendlySize(size))
+	}
+	return nil
+}
+
+func Ls(cmd *cobra.Command, args []string) error {
+	manifestPath := args[0]
+	dir := ""
+	if len(args) == 2 {
+		dir = args[1]
+	}
+	jsonFlag, err := cmd.Flags().GetBool("json")
+	if err != nil {
+		return fmt.Errorf("error retrieving json flag: %v", err)
+	}
+	logrus.Debugf("Executing 'ls' command with manifest: '%s', directory: '%s'", manifestPath, dir)
+
+	entries, err := ListDirectory(cmd.Context(), manifestPath, dir)
+	if err != nil {
+		return err
+	}
+	if jsonFlag {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(entries)
+	}
+	for _, entry := range entries {
+		switch {
+		case entry.Directory:
+			fmt.Printf("%s  %10s  %s/ (%d files)\n", entry.ModifiedTime.Local().Format("2006-01-02 15:04:05"), toFriendlySize(entry.Bytes), entry.Name, entry.Files)
+		case entry.Error != "":
+			fmt.Printf("%s  %10s  %s (unreadable: %s)\n", entry.ModifiedTime.Local().Format("2006-01-02 15:04:05"), toFriendlySize(entry.Bytes), entry.Name, entry.Error)
+		default:
+			fmt.Printf("%s  %10s  %s\n", entry.ModifiedTime.Local().Format("2006-01-02 15:04:05"), toFriendlySize(entry.Bytes), entry.Name)
+		}
+	}
+	return nil
+}
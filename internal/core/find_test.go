@@ -0,0 +1,75 @@
+package core
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+func TestMatchGlob(t *testing.T) {
+	for _, tt := range []struct {
+		pattern, path string
+		want          bool
+	}{
+		{"*.jpg", "a.jpg", true},
+		{"*.jpg", "dir/a.jpg", false},
+		{"dir/*.jpg", "dir/a.jpg", true},
+		{"dir/*", "dir/sub/a.jpg", false},
+		{"**", "a.jpg", true},
+		{"**", "dir/sub/a.jpg", true},
+		{"**/*.jpg", "a.jpg", true},
+		{"**/*.jpg", "dir/sub/a.jpg", true},
+		{"**/*.jpg", "dir/sub/a.png", false},
+		{"photos/**/*.cr2", "photos/a.cr2", true},
+		{"photos/**/*.cr2", "photos/2023/01/a.cr2", true},
+		{"photos/**/*.cr2", "other/photos/a.cr2", false},
+		{"photos/**", "photos/2023/a.cr2", true},
+		{"photos/**", "photos", true},
+		{"**/sub/**", "dir/sub/deeper/a.jpg", true},
+		{"**/sub/**", "dir/subway/a.jpg", false},
+		{"dir/?.jpg", "dir/a.jpg", true},
+		{"dir/[ab].jpg", "dir/c.jpg", false},
+	} {
+		if got := matchGlob(strings.Split(tt.pattern, "/"), strings.Split(tt.path, "/")); got != tt.want {
+			t.Errorf("matchGlob(%q, %q) = %t, want %t", tt.pattern, tt.path, got, tt.want)
+		}
+	}
+
+	for _, opts := range []FindOptions{{Glob: "dir/[a"}, {Glob: "**/[a/b"}, {Name: "[a"}} {
+		if err := opts.validate(); err == nil {
+			t.Errorf("%+v is valid", opts)
+		}
+	}
+}
+
+func TestParseTimeFlag(t *testing.T) {
+	for _, tt := range []struct {
+		value string
+		want  time.Time
+	}{
+		{"", time.Time{}},
+		{"2023-01-02", time.Date(2023, 1, 2, 0, 0, 0, 0, time.Local)},
+		{"2023-01-02 15:04:05", time.Date(2023, 1, 2, 15, 4, 5, 0, time.Local)},
+		{"2023-01-02T15:04:05", time.Date(2023, 1, 2, 15, 4, 5, 0, time.Local)},
+		{"2023-01-02T15:04:05Z", time.Date(2023, 1, 2, 15, 4, 5, 0, time.UTC)},
+		{"2023-01-02T15:04:05+02:00", time.Date(2023, 1, 2, 13, 4, 5, 0, time.UTC)},
+	} {
+		cmd := &cobra.Command{}
+		cmd.Flags().String("after", "", "")
+		cmd.Flags().Set("after", tt.value)
+		if got, err := parseTimeFlag(cmd, "after"); err != nil || !got.Equal(tt.want) {
+			t.Errorf("parseTimeFlag(%q) = %v, %v, want %v", tt.value, got, err, tt.want)
+		}
+	}
+
+	for _, value := range []string{"yesterday", "2023-13-01", "2023-01-02 15:04", "02.01.2023"} {
+		cmd := &cobra.Command{}
+		cmd.Flags().String("after", "", "")
+		cmd.Flags().Set("after", value)
+		if got, err := parseTimeFlag(cmd, "after"); err == nil {
+			t.Errorf("parseTimeFlag(%q) = %v", value, got)
+		}
+	}
+}
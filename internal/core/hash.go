@@ -0,0 +1,188 @@
+package core
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// quickHashPrefix marks a quick hash in the Hash column. The full format is
+// "quick:<window size>:<hex MD5>"; plain hex values are full MD5 hashes.
+const quickHashPrefix = "quick:"
+
+// hashOptions selects how files are hashed.
+type hashOptions struct {
+	blockSize   int64 // record a block list with blocks of this size, 0 for none
+	chunked     bool  // split files into content-defined chunks of about blockSize instead of fixed-size blocks
+	quickWindow int64 // compute a quick hash with windows of this size, 0 for a full hash
+}
+
+// newHashOptions checks that block lists and quick hashes are not combined.
+// Content-defined chunks are about defaultBlockSize if no block size is given.
+func newHashOptions(blockSize, quickWindow int64, chunked bool) (hashOptions, error) {
+	if chunked && blockSize == 0 {
+		blockSize = defaultBlockSize
+	}
+	if blockSize > 0 && quickWindow > 0 {
+		return hashOptions{}, fmt.Errorf("block lists need a full hash and cannot be combined with quick hashes")
+	}
+	return hashOptions{blockSize: blockSize, chunked: chunked, quickWindow: quickWindow}, nil
+}
+
+// getHashFlags reads the --block-size, --content-defined and --quick-hash flags.
+func getHashFlags(cmd *cobra.Command) (blockSize, quickWindow int64, chunked bool, err error) {
+	blockSize, err = getSizeFlag(cmd, "block-size")
+	if err != nil {
+		return 0, 0, false, fmt.Errorf("invalid block-size flag: %v", err)
+	}
+	chunked, err = cmd.Flags().GetBool("content-defined")
+	if err != nil {
+		return 0, 0, false, fmt.Errorf("error retrieving content-defined flag: %v", err)
+	}
+	quickWindow, err = getSizeFlag(cmd, "quick-hash")
+	if err != nil {
+		return 0, 0, false, fmt.Errorf("invalid quick-hash flag: %v", err)
+	}
+	return blockSize, quickWindow, chunked, nil
+}
+
+// hashKind returns the kind of a hash from the Hash column.
+// Only hashes of the same kind can be compared with each other.
+func hashKind(hash string) string {
+	if !strings.HasPrefix(hash, quickHashPrefix) {
+		return "md5"
+	}
+	window, _, _ := strings.Cut(strings.TrimPrefix(hash, quickHashPrefix), ":")
+	return quickHashPrefix + window
+}
+
+func isQuickHash(hash string) bool {
+	return strings.HasPrefix(hash, quickHashPrefix)
+}
+
+// hashesComparable reports whether two hashes were computed the same way.
+func hashesComparable(hash1, hash2 string) bool {
+	return hash1 != "" && hash2 != "" && hashKind(hash1) == hashKind(hash2)
+}
+
+// quickHashWarning explains what a matching quick hash does and does not prove.
+func quickHashWarning(window int64) string {
+	return fmt.Sprintf("Warning: Quick hashes only cover the size and the first, middle and last %s of each file. "+
+		"They are probabilistic: matching quick hashes do not prove identical content.\n", toFriendlySize(window))
+}
+
+// needsRehash reports whether an existing entry must be re-hashed to match the hash options,
+// even though the file looks unchanged.
+// Entries of files that could not be read are always re-hashed.
+func needsRehash(fileInfo FileInfo, opts hashOptions) bool {
+	if fileInfo.Error != "" {
+		return true
+	}
+	wantKind := "md5"
+	if opts.quickWindow > 0 {
+		wantKind = quickHashPrefix + strconv.FormatInt(opts.quickWindow, 10)
+	}
+	if hashKind(fileInfo.Hash) != wantKind {
+		return true
+	}
+	// Files no larger than one block gain nothing from a block list.
+	return opts.blockSize > 0 && fileInfo.Size > opts.blockSize &&
+		(fileInfo.BlockSize != opts.blockSize || (fileInfo.ChunkSizes != nil) != opts.chunked)
+}
+
+// hashOptionsOf returns the options that reproduce the hash of an existing entry.
+func hashOptionsOf(fileInfo FileInfo) hashOptions {
+	opts := hashOptions{blockSize: fileInfo.BlockSize, chunked: fileInfo.ChunkSizes != nil}
+	if isQuickHash(fileInfo.Hash) {
+		window := strings.TrimPrefix(hashKind(fileInfo.Hash), quickHashPrefix)
+		opts.quickWindow, _ = strconv.ParseInt(window, 10, 64)
+	}
+	return opts
+}
+
+// rehash recalculates the hash of a file the same way the hash of its entry was calculated.
+func rehash(path string, fileInfo FileInfo) (string, error) {
+	if err := hashFileInfo(path, &fileInfo, hashOptionsOf(fileInfo)); err != nil {
+		return "", err
+	}
+	return fileInfo.Hash, nil
+}
+
+// hashFileInfo fills in the hash of a file, and its block list if the options ask for one.
+func hashFileInfo(path string, fileInfo *FileInfo, opts hashOptions) error {
+	fileInfo.BlockSize = 0
+	fileInfo.BlockHashes = nil
+	fileInfo.ChunkSizes = nil
+	start := time.Now()
+
+	switch {
+	case opts.quickWindow > 0:
+		hash, err := calculateQuickHash(path, fileInfo.Size, opts.quickWindow)
+		if err != nil {
+			return err
+		}
+		fileInfo.Hash = hash
+	case opts.blockSize > 0 && fileInfo.Size > opts.blockSize && opts.chunked:
+		hash, chunkHashes, chunkSizes, err := calculateChunkMD5(path, opts.blockSize)
+		if err != nil {
+			return err
+		}
+		fileInfo.Hash = hash
+		fileInfo.BlockSize = opts.blockSize
+		fileInfo.BlockHashes = chunkHashes
+		fileInfo.ChunkSizes = chunkSizes
+	case opts.blockSize > 0 && fileInfo.Size > opts.blockSize:
+		hash, blockHashes, err := calculateBlockMD5(path, opts.blockSize)
+		if err != nil {
+			return err
+		}
+		fileInfo.Hash = hash
+		fileInfo.BlockSize = opts.blockSize
+		fileInfo.BlockHashes = blockHashes
+	default:
+		hash, err := calculateMD5(path)
+		if err != nil {
+			return err
+		}
+		fileInfo.Hash = hash
+	}
+	logrus.WithFields(logrus.Fields{"path": path, "bytes": fileInfo.Size, "seconds": time.Since(start).Seconds()}).Debug("Hashed file")
+	return nil
+}
+
+// calculateQuickHash hashes the size of a file and three windows of its content:
+// the start, the middle and the end. Files no larger than three windows are hashed completely.
+// It reads at most 3*window bytes, however large the file is.
+func calculateQuickHash(filePath string, size, window int64) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to open file %s: %w", filePath, err)
+	}
+	defer file.Close()
+
+	hash := md5.New()
+	binary.Write(hash, binary.LittleEndian, size)
+
+	offsets := []int64{0}
+	length := size
+	if size > 3*window {
+		offsets = []int64{0, (size - window) / 2, size - window}
+		length = window
+	}
+	for _, offset := range offsets {
+		if _, err := io.Copy(hash, io.NewSectionReader(file, offset, length)); err != nil {
+			return "", fmt.Errorf("failed to read file %s: %w", filePath, err)
+		}
+	}
+
+	return quickHashPrefix + strconv.FormatInt(window, 10) + ":" + hex.EncodeToString(hash.Sum(nil)), nil
+}
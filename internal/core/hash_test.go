@@ -0,0 +1,106 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCalculateQuickHash(t *testing.T) {
+	const window = 1024
+	dir := t.TempDir()
+	quickHash := func(data []byte) string {
+		t.Helper()
+		path := filepath.Join(dir, "file")
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		hash, err := calculateQuickHash(path, int64(len(data)), window)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hash
+	}
+
+	// A file of up to three windows is hashed completely, after its size.
+	small := randomBytes(6, 3*window)
+	var size bytes.Buffer
+	binary.Write(&size, binary.LittleEndian, int64(len(small)))
+	if got, want := quickHash(small), "quick:1024:"+md5Hex(size.String()+string(small)); got != want {
+		t.Errorf("quick hash of a small file = %s, want %s", got, want)
+	}
+
+	large := randomBytes(7, 10*window)
+	hash := quickHash(large)
+	if !strings.HasPrefix(hash, "quick:1024:") || len(hash) != len("quick:1024:")+32 || hashKind(hash) != "quick:1024" {
+		t.Errorf("quick hash %q is not formatted as quick:<window>:<hex MD5>", hash)
+	}
+	for _, tt := range []struct {
+		name    string
+		offset  int
+		changed bool
+	}{
+		{"first window", 10, true},
+		{"between the first and the middle window", 2 * window, false},
+		{"middle window", 5 * window, true},
+		{"between the middle and the last window", 7 * window, false},
+		{"last window", 10*window - 1, true},
+	} {
+		data := bytes.Clone(large)
+		data[tt.offset]++
+		if changed := quickHash(data) != hash; changed != tt.changed {
+			t.Errorf("changing a byte in the %s changes the quick hash: %t, want %t", tt.name, changed, tt.changed)
+		}
+	}
+	if quickHash(large[:len(large)-1]) == hash {
+		t.Error("a shorter file has the same quick hash")
+	}
+}
+
+func TestHashKinds(t *testing.T) {
+	full := md5Hex("alpha")
+	quick := "quick:1048576:" + full
+	for _, tt := range []struct {
+		hash1, hash2 string
+		comparable   bool
+	}{
+		{full, md5Hex("bravo"), true},
+		{quick, "quick:1048576:" + md5Hex("bravo"), true},
+		{quick, "quick:4096:" + full, false},
+		{quick, full, false},
+		{"", full, false},
+		{"", "", false},
+	} {
+		if got := hashesComparable(tt.hash1, tt.hash2); got != tt.comparable {
+			t.Errorf("hashesComparable(%q, %q) = %t, want %t", tt.hash1, tt.hash2, got, tt.comparable)
+		}
+	}
+
+	if opts := hashOptionsOf(FileInfo{Hash: quick}); opts.quickWindow != 1048576 || opts.blockSize != 0 {
+		t.Errorf("hashOptionsOf(quick hash) = %+v", opts)
+	}
+	if opts := hashOptionsOf(FileInfo{Hash: full}); opts.quickWindow != 0 {
+		t.Errorf("hashOptionsOf(full hash) = %+v", opts)
+	}
+	for _, tt := range []struct {
+		hash   string
+		opts   hashOptions
+		rehash bool
+	}{
+		{quick, hashOptions{quickWindow: 1048576}, false},
+		{quick, hashOptions{quickWindow: 4096}, true},
+		{quick, hashOptions{}, true},
+		{full, hashOptions{quickWindow: 1048576}, true},
+		{full, hashOptions{}, false},
+	} {
+		if got := needsRehash(FileInfo{Size: 5, Hash: tt.hash}, tt.opts); got != tt.rehash {
+			t.Errorf("needsRehash(%q, %+v) = %t, want %t", tt.hash, tt.opts, got, tt.rehash)
+		}
+	}
+	if _, err := newHashOptions(4096, 1048576, false); err == nil {
+		t.Error("block lists were combined with quick hashes")
+	}
+}
@@ -0,0 +1,68 @@
+package core
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeTestFiles creates the files of a tree below root, keyed by slash-separated relative path.
+func writeTestFiles(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for relativePath, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(relativePath))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// md5Hex returns the hash that a manifest records for content.
+func md5Hex(content string) string {
+	sum := md5.Sum([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// collect reads the remaining entries of an iterator.
+func collect(t *testing.T, it fileIterator) []FileInfo {
+	t.Helper()
+	var fileInfoSlice []FileInfo
+	for {
+		fileInfo, err := it.Next()
+		if err == io.EOF {
+			return fileInfoSlice
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		fileInfoSlice = append(fileInfoSlice, fileInfo)
+	}
+}
+
+// writeTestManifest writes entries, which must be in manifest order, as a complete manifest at path.
+func writeTestManifest(t *testing.T, path string, entries []FileInfo) {
+	t.Helper()
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	writer, err := newManifestWriter(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if err := writer.Write(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
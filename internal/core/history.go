@@ -0,0 +1,654 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// A manifest history is a directory holding successive versions of the manifest of a directory,
+// its generations, numbered from 1:
+//
+//	generations.json        the list of generations, written last
+//	000001.csv.zst          a generation stored in full, as a manifest
+//	000002.delta.csv.zst    a generation stored as the changes from the previous generation
+//
+// A delta is a manifest of the entries that are new or different in its generation, plus a
+// tombstone, an entry with a size of -1, for every path that is gone. Every historyKeyframeInterval-th
+// generation is stored in full, so reading a generation never applies more deltas than that.
+const (
+	historyIndexName        = "generations.json"
+	historyKeyframeInterval = 32
+	tombstoneSize           = -1
+)
+
+// Generation describes one version of the manifest in a history.
+type Generation struct {
+	Number   int       `json:"number"`
+	Time     time.Time `json:"time"`     // modified time of the manifest it was recorded from
+	Manifest string    `json:"manifest"` // path of that manifest
+	Full     bool      `json:"full"`     // stored in full rather than as a delta
+	Files    int       `json:"files"`
+	Bytes    int64     `json:"bytes"`
+	Changes  int       `json:"changes"` // entries that differ from the previous generation
+}
+
+// HistoryEvent is a change to a path between a generation and the one before it.
+type HistoryEvent struct {
+	Generation int       `json:"generation"`
+	Time       time.Time `json:"time"`
+	FileChange
+}
+
+func generationPath(historyDir string, g Generation) string {
+	if g.Full {
+		return filepath.Join(historyDir, fmt.Sprintf("%06d.csv.zst", g.Number))
+	}
+	return filepath.Join(historyDir, fmt.Sprintf("%06d.delta.csv.zst", g.Number))
+}
+
+// ListGenerations returns the generations of the history in historyDir, oldest first.
+// A history that does not exist yet has none.
+func ListGenerations(historyDir string) ([]Generation, error) {
+	data, err := os.ReadFile(filepath.Join(historyDir, historyIndexName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading history: %v", err)
+	}
+	var generations []Generation
+	if err := json.Unmarshal(data, &generations); err != nil {
+		return nil, fmt.Errorf("error reading history %s: %v", historyDir, err)
+	}
+	return generations, nil
+}
+
+// findGeneration returns the index of a generation given by its number or as "latest".
+func findGeneration(generations []Generation, historyDir, number string) (int, error) {
+	if len(generations) == 0 {
+		return 0, fmt.Errorf("no generations in %s", historyDir)
+	}
+	if number == "latest" {
+		return len(generations) - 1, nil
+	}
+	n, err := strconv.Atoi(number)
+	if err == nil {
+		for i, g := range generations {
+			if g.Number == n {
+				return i, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("no generation %s in %s", number, historyDir)
+}
+
+// openGeneration returns the entries of generations[index], by reading the last full generation
+// up to it and applying the deltas after that one.
+func openGeneration(historyDir string, generations []Generation, index int) (fileIterator, func(), error) {
+	start := index
+	for start > 0 && !generations[start].Full {
+		start--
+	}
+	var closers []func() error
+	closeAll := func() {
+		for _, c := range closers {
+			c()
+		}
+	}
+	var it fileIterator
+	for _, g := range generations[start : index+1] {
+		manifest, err := openSortedManifest(generationPath(historyDir, g))
+		if err != nil {
+			closeAll()
+			return nil, nil, fmt.Errorf("error reading generation %d: %v", g.Number, err)
+		}
+		closers = append(closers, manifest.Close)
+		if it == nil {
+			it = manifest
+		} else {
+			it = &deltaIterator{base: it, delta: manifest}
+		}
+	}
+	return it, closeAll, nil
+}
+
+// deltaIterator applies a delta to the entries of the generation before it.
+type deltaIterator struct {
+	base, delta       fileIterator
+	b, d              FileInfo
+	baseErr, deltaErr error
+	started           bool
+}
+
+func (it *deltaIterator) Next() (FileInfo, error) {
+	if !it.started {
+		it.b, it.baseErr = it.base.Next()
+		it.d, it.deltaErr = it.delta.Next()
+		it.started = true
+	}
+	for {
+		if it.baseErr != nil && it.baseErr != io.EOF {
+			return FileInfo{}, it.baseErr
+		}
+		if it.deltaErr != nil && it.deltaErr != io.EOF {
+			return FileInfo{}, it.deltaErr
+		}
+		if it.baseErr == io.EOF && it.deltaErr == io.EOF {
+			return FileInfo{}, io.EOF
+		}
+
+		cmp := 1
+		switch {
+		case it.deltaErr == io.EOF:
+			cmp = -1
+		case it.baseErr == nil:
+			cmp = comparePaths(it.b.Path, it.d.Path)
+		}
+		if cmp < 0 {
+			fileInfo := it.b
+			it.b, it.baseErr = it.base.Next()
+			return fileInfo, nil
+		}
+		if cmp == 0 {
+			it.b, it.baseErr = it.base.Next()
+		}
+		fileInfo := it.d
+		it.d, it.deltaErr = it.delta.Next()
+		if fileInfo.Size != tombstoneSize {
+			return fileInfo, nil
+		}
+	}
+}
+
+// sameEntry reports whether two entries record exactly the same thing.
+func sameEntry(a, b FileInfo) bool {
+	return a.Path == b.Path && a.ModifiedTime.Unix() == b.ModifiedTime.Unix() && a.Size == b.Size &&
+		a.Hash == b.Hash && a.NTFSFileID == b.NTFSFileID && a.BlockSize == b.BlockSize &&
+		slices.Equal(a.BlockHashes, b.BlockHashes) && slices.Equal(a.ChunkSizes, b.ChunkSizes) && a.Error == b.Error
+}
+
+// RecordGeneration adds the manifest at manifestPath to the history in historyDir as its newest
+// generation, creating the history if needed. The manifest itself is left alone.
+func RecordGeneration(historyDir, manifestPath string) (*Generation, error) {
+	info, err := os.Stat(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	generations, err := ListGenerations(historyDir)
+	if err != nil {
+		return nil, err
+	}
+	generation := Generation{Number: 1, Time: info.ModTime(), Manifest: manifestPath, Full: true}
+	var previous fileIterator = &sliceIterator{}
+	if len(generations) > 0 {
+		generation.Number = generations[len(generations)-1].Number + 1
+		generation.Full = len(generations)%historyKeyframeInterval == 0
+		it, closePrevious, err := openGeneration(historyDir, generations, len(generations)-1)
+		if err != nil {
+			return nil, err
+		}
+		defer closePrevious()
+		previous = it
+	}
+
+	manifest, err := openSortedManifest(manifestPath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest %s: %v", manifestPath, err)
+	}
+	defer manifest.Close()
+	// A generation file whose number is not in the index yet is left over from a run that failed
+	// before it could update the index, so it is replaced, whichever way it was stored.
+	orphan := generation
+	orphan.Full = !generation.Full
+	if err := os.Remove(generationPath(historyDir, orphan)); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("error removing unrecorded generation %d: %v", generation.Number, err)
+	}
+	file, err := createManifestFile(generationPath(historyDir, generation), true)
+	if err != nil {
+		return nil, fmt.Errorf("error creating generation %d: %v", generation.Number, err)
+	}
+	defer file.Abort()
+	writer, err := newManifestWriter(file.File)
+	if err != nil {
+		return nil, err
+	}
+
+	err = mergeJoin(previous, manifest, func(old, cur *FileInfo) error {
+		if cur == nil {
+			generation.Changes++
+			if generation.Full {
+				return nil
+			}
+			return writer.Write(FileInfo{Path: old.Path, Size: tombstoneSize})
+		}
+		generation.Files++
+		generation.Bytes += cur.Size
+		changed := old == nil || !sameEntry(*old, *cur)
+		if changed {
+			generation.Changes++
+		}
+		if changed || generation.Full {
+			return writer.Write(*cur)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error recording generation: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	if err := file.Commit(); err != nil {
+		return nil, fmt.Errorf("error writing generation: %v", err)
+	}
+
+	generations = append(generations, generation)
+	data, err := json.MarshalIndent(generations, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	index, err := createManifestFile(filepath.Join(historyDir, historyIndexName), true)
+	if err != nil {
+		return nil, err
+	}
+	defer index.Abort()
+	if _, err := index.Write(data); err != nil {
+		return nil, fmt.Errorf("error writing history: %v", err)
+	}
+	if err := index.Commit(); err != nil {
+		return nil, fmt.Errorf("error writing history: %v", err)
+	}
+	return &generation, nil
+}
+
+// FileHistory returns how the files at or below path, a path relative to the root with forward
+// slashes ("" for all files), changed from generation to generation of the history in historyDir.
+// The files of the first generation are reported as new.
+// The generations are read once, in order: the entries of each are carried forward to the next
+// in a temporary manifest, which the next delta is applied to.
+func FileHistory(historyDir, path string) ([]HistoryEvent, error) {
+	path = cleanSubtree(path)
+	generations, err := ListGenerations(historyDir)
+	if err != nil {
+		return nil, err
+	}
+	if len(generations) == 0 {
+		return nil, fmt.Errorf("no generations in %s", historyDir)
+	}
+
+	var events []HistoryEvent
+	previousPath := "" // the temporary manifest of the previous generation, "" before the first
+	defer func() {
+		if previousPath != "" {
+			os.Remove(previousPath)
+		}
+	}()
+	for i, g := range generations {
+		changes, currentPath, err := generationStep(historyDir, g, previousPath, path, i < len(generations)-1)
+		if err != nil {
+			return nil, fmt.Errorf("error reading generation %d: %v", g.Number, err)
+		}
+		if previousPath != "" {
+			os.Remove(previousPath)
+		}
+		previousPath = currentPath
+		for _, change := range changes {
+			events = append(events, HistoryEvent{Generation: g.Number, Time: g.Time, FileChange: change})
+		}
+	}
+	return events, nil
+}
+
+// generationStep compares generation g with the previous generation, whose entries are in the
+// manifest at previousPath ("" for none), and returns the changes to the paths below filter.
+// With keep, the entries of g are written to a temporary manifest, whose path is returned.
+func generationStep(historyDir string, g Generation, previousPath, filter string, keep bool) ([]FileChange, string, error) {
+	var previous fileIterator = &sliceIterator{}
+	if previousPath != "" {
+		manifest, err := openSortedManifest(previousPath)
+		if err != nil {
+			return nil, "", err
+		}
+		defer manifest.Close()
+		previous = manifest
+	}
+	stored, err := openSortedManifest(generationPath(historyDir, g))
+	if err != nil {
+		return nil, "", err
+	}
+	defer stored.Close()
+
+	var file *os.File
+	var writer *manifestWriter
+	if keep {
+		if file, err = os.CreateTemp("", "ssync-history-*.csv.zst"); err != nil {
+			return nil, "", fmt.Errorf("error creating temporary file: %v", err)
+		}
+		defer file.Close()
+		if writer, err = newManifestWriter(file); err != nil {
+			os.Remove(file.Name())
+			return nil, "", err
+		}
+	}
+
+	diff := newGenerationDiff(filter)
+	err = mergeJoin(previous, stored, func(old, entry *FileInfo) error {
+		// A full generation lists every file; a delta only the new and changed ones, and tombstones.
+		cur := entry
+		switch {
+		case g.Full:
+		case entry == nil:
+			cur = old
+		case entry.Size == tombstoneSize:
+			cur = nil
+		}
+		if old == nil && cur == nil {
+			return nil
+		}
+		diff.add(old, cur)
+		if cur != nil && writer != nil {
+			return writer.Write(*cur)
+		}
+		return nil
+	})
+	if err == nil && writer != nil {
+		err = writer.Close()
+	}
+	if err == nil && file != nil {
+		err = file.Close()
+	}
+	if err != nil {
+		if file != nil {
+			os.Remove(file.Name())
+		}
+		return nil, "", err
+	}
+	currentPath := ""
+	if file != nil {
+		currentPath = file.Name()
+	}
+	return diff.changes(), currentPath, nil
+}
+
+// generationDiff collects the changes between two generations to the paths matching filter.
+// A file that disappeared while a file with the same hash and size appeared is reported as moved.
+// Only changes that can be reported are kept in memory: those to paths matching filter, and up to
+// maxMoveCandidates new and deleted files elsewhere that have a hash, since they may be one side
+// of a move into or out of the paths matching filter. Beyond that, such moves are reported
+// as new or deleted files.
+type generationDiff struct {
+	filter  string
+	matched []FileChange // modified files, and new and deleted files without a hash
+	// added and deleted hold new and deleted files that may have moved by hash and size, in manifest order.
+	added, deleted map[string][]FileChange
+	others         int // entries of added and deleted that do not match filter
+}
+
+func newGenerationDiff(filter string) *generationDiff {
+	return &generationDiff{filter: filter, added: make(map[string][]FileChange), deleted: make(map[string][]FileChange)}
+}
+
+// add records the change to a path, given its entries in the previous and the current generation.
+func (d *generationDiff) add(old, cur *FileInfo) {
+	switch {
+	case old == nil:
+		change := FileChange{Path: cur.Path, Change: ChangeNew, Size: cur.Size}
+		if hash := movableHash(*cur); hash != "" && d.keep(cur.Path) {
+			key := hash + "/" + strconv.FormatInt(cur.Size, 10)
+			d.added[key] = append(d.added[key], change)
+		} else if inSubtree(cur.Path, d.filter) {
+			d.matched = append(d.matched, change)
+		}
+	case cur == nil:
+		change := FileChange{Path: old.Path, Change: ChangeDeleted, Size: old.Size}
+		if hash := movableHash(*old); hash != "" && d.keep(old.Path) {
+			key := hash + "/" + strconv.FormatInt(old.Size, 10)
+			d.deleted[key] = append(d.deleted[key], change)
+		} else if inSubtree(old.Path, d.filter) {
+			d.matched = append(d.matched, change)
+		}
+	default:
+		if change, ok := historyChange(*old, *cur); ok && inSubtree(cur.Path, d.filter) {
+			d.matched = append(d.matched, change)
+		}
+	}
+}
+
+// keep reports whether a new or deleted file with a hash is kept as a candidate for a move.
+func (d *generationDiff) keep(path string) bool {
+	if inSubtree(path, d.filter) {
+		return true
+	}
+	if d.others >= maxMoveCandidates {
+		return false
+	}
+	d.others++
+	return true
+}
+
+// changes pairs the deleted files of each content with the new ones in manifest order, as moves,
+// and returns the changes to the paths matching the filter, in manifest order.
+// A move matches if either of its paths does.
+func (d *generationDiff) changes() []FileChange {
+	changes := d.matched
+	for key, added := range d.added {
+		deleted := d.deleted[key]
+		for i, a := range added {
+			if i < len(deleted) {
+				a.Change, a.OldPath, a.Reason = ChangeMoved, deleted[i].Path, "same content"
+			}
+			if inSubtree(a.Path, d.filter) || (a.OldPath != "" && inSubtree(a.OldPath, d.filter)) {
+				changes = append(changes, a)
+			}
+		}
+	}
+	for key, deleted := range d.deleted {
+		for _, del := range deleted[min(len(d.added[key]), len(deleted)):] {
+			if inSubtree(del.Path, d.filter) {
+				changes = append(changes, del)
+			}
+		}
+	}
+	slices.SortStableFunc(changes, func(a, b FileChange) int { return comparePaths(a.Path, b.Path) })
+	return changes
+}
+
+// movableHash returns the hash that identifies the content of a file for move detection, or "" if it has none.
+func movableHash(fileInfo FileInfo) string {
+	if fileInfo.Error != "" {
+		return ""
+	}
+	return fileInfo.Hash
+}
+
+// historyChange describes how a file that exists in two consecutive generations changed, if it did.
+// Changes that only concern how the file was recorded, such as its block list, are not reported.
+func historyChange(old, cur FileInfo) (FileChange, bool) {
+	change := FileChange{Path: cur.Path, Change: ChangeModified, Size: cur.Size}
+	switch {
+	case cur.Error != "" && old.Error == "":
+		change.Change, change.Reason = ChangeUnreadable, cur.Error
+	case old.Size != cur.Size:
+		change.Reason = fmt.Sprintf("size changed from %s", toFriendlySize(old.Size))
+	case hashesComparable(old.Hash, cur.Hash) && old.Hash != cur.Hash:
+		change.Reason = "content changed"
+	case old.ModifiedTime.Unix() != cur.ModifiedTime.Unix():
+		change.Reason = "modified time changed"
+	default:
+		return change, false
+	}
+	return change, true
+}
+
+func History(cmd *cobra.Command, args []string) error {
+	historyDir := args[0]
+	logrus.Debugf("Executing 'history' command with history: '%s'", historyDir)
+
+	generations, err := ListGenerations(historyDir)
+	if err != nil {
+		return err
+	}
+	if len(generations) == 0 {
+		fmt.Printf("No generations in %s\n", historyDir)
+		return nil
+	}
+	fmt.Printf("%10s  %-19s  %8s  %10s  %8s  %s\n", "Generation", "Time", "Files", "Size", "Changes", "Stored")
+	for _, g := range generations {
+		stored := "delta"
+		if g.Full {
+			stored = "full"
+		}
+		fmt.Printf("%10d  %-19s  %8d  %10s  %8d  %s\n",
+			g.Number, g.Time.Local().Format("2006-01-02 15:04:05"), g.Files, toFriendlySize(g.Bytes), g.Changes, stored)
+	}
+	return nil
+}
+
+func HistoryAdd(cmd *cobra.Command, args []string) error {
+	historyDir := args[0]
+	logrus.Debugf("Executing 'history add' command with history: '%s', manifests: %v", historyDir, args[1:])
+
+	for _, manifestPath := range args[1:] {
+		generation, err := RecordGeneration(historyDir, manifestPath)
+		if err != nil {
+			return fmt.Errorf("error recording %s: %v", manifestPath, err)
+		}
+		fmt.Printf("Recorded %s as generation %d: %d changes\n", manifestPath, generation.Number, generation.Changes)
+	}
+	return nil
+}
+
+func Log(cmd *cobra.Command, args []string) error {
+	historyDir := args[0]
+	path := ""
+	if len(args) == 2 {
+		path = args[1]
+	}
+	jsonFlag, err := cmd.Flags().GetBool("json")
+	if err != nil {
+		return fmt.Errorf("error retrieving json flag: %v", err)
+	}
+	logrus.Debugf("Executing 'log' command with history: '%s', path: '%s'", historyDir, path)
+
+	events, err := FileHistory(historyDir, path)
+	if err != nil {
+		return err
+	}
+	if jsonFlag {
+		if events == nil {
+			events = []HistoryEvent{}
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(events)
+	}
+	for _, e := range events {
+		line := fmt.Sprintf("#%-4d %s  [%s] %s", e.Generation, e.Time.Local().Format("2006-01-02 15:04:05"), e.Change, e.Path)
+		if e.OldPath != "" {
+			line = fmt.Sprintf("#%-4d %s  [%s] %s -> %s", e.Generation, e.Time.Local().Format("2006-01-02 15:04:05"), e.Change, e.OldPath, e.Path)
+		}
+		if e.Reason != "" {
+			line += " (" + e.Reason + ")"
+		}
+		fmt.Println(line)
+	}
+	if len(events) == 0 {
+		fmt.Println("No changes")
+	}
+	return nil
+}
+
+func Show(cmd *cobra.Command, args []string) error {
+	historyDir := args[0]
+	number := args[1]
+	path := ""
+	if len(args) == 3 {
+		path = cleanSubtree(args[2])
+	}
+	output, err := cmd.Flags().GetString("output")
+	if err != nil {
+		return fmt.Errorf("error retrieving output flag: %v", err)
+	}
+	force, err := cmd.Flags().GetBool("force")
+	if err != nil {
+		return fmt.Errorf("error retrieving force flag: %v", err)
+	}
+	logrus.Debugf("Executing 'show' command with history: '%s', generation: '%s', path: '%s', output: '%s'", historyDir, number, path, output)
+
+	generations, err := ListGenerations(historyDir)
+	if err != nil {
+		return err
+	}
+	index, err := findGeneration(generations, historyDir, number)
+	if err != nil {
+		return err
+	}
+	generation := generations[index]
+	entries, closeEntries, err := openGeneration(historyDir, generations, index)
+	if err != nil {
+		return err
+	}
+	defer closeEntries()
+
+	// With --output, the entries are written as a manifest that the other commands can use.
+	var file *atomicFile
+	var writer *manifestWriter
+	if output != "" {
+		file, err = createManifestFile(output, force)
+		if err != nil {
+			return err
+		}
+		defer file.Abort()
+		writer, err = newManifestWriter(file.File)
+		if err != nil {
+			return err
+		}
+	}
+
+	files, size := 0, int64(0)
+	for {
+		fileInfo, err := entries.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error reading generation %d: %v", generation.Number, err)
+		}
+		if !inSubtree(fileInfo.Path, path) {
+			continue
+		}
+		files++
+		size += fileInfo.Size
+		if writer != nil {
+			if err := writer.Write(fileInfo); err != nil {
+				return err
+			}
+			continue
+		}
+		if fileInfo.Error != "" {
+			fmt.Printf("%s  %10s  %s (unreadable: %s)\n", fileInfo.ModifiedTime.Local().Format("2006-01-02 15:04:05"), toFriendlySize(fileInfo.Size), fileInfo.Path, fileInfo.Error)
+		} else {
+			fmt.Printf("%s  %10s  %s\n", fileInfo.ModifiedTime.Local().Format("2006-01-02 15:04:05"), toFriendlySize(fileInfo.Size), fileInfo.Path)
+		}
+	}
+	if writer != nil {
+		if err := writer.Close(); err != nil {
+			return err
+		}
+		if err := file.Commit(); err != nil {
+			return fmt.Errorf("error writing manifest file: %v", err)
+		}
+		fmt.Printf("Manifest of generation %d written to %s\n", generation.Number, output)
+	}
+	fmt.Printf("Generation %d (%s): %d files, %s\n", generation.Number, generation.Time.Local().Format("2006-01-02 15:04:05"), files, toFriendlySize(size))
+	return nil
+}
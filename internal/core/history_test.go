@@ -0,0 +1,75 @@
+package core
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestGenerationDiff(t *testing.T) {
+	file := func(path, content string) *FileInfo {
+		return &FileInfo{Path: path, Size: int64(len(content)), Hash: md5Hex(content)}
+	}
+	type step struct{ old, cur *FileInfo }
+	steps := []step{
+		{nil, file("docs/moved-in.txt", "moved in")},
+		{nil, file("docs/new.txt", "new")},
+		{file("docs/old.txt", "old"), nil},
+		{file("docs/report.txt", "v1"), file("docs/report.txt", "v2, longer")},
+		{file("docs/same.txt", "same"), file("docs/same.txt", "same")},
+		{nil, file("other/moved-out.txt", "moved out")},
+		{file("other/moved-in.txt", "moved in"), nil},
+		{nil, file("other/new.txt", "other new")},
+		{file("other/report.txt", "v1"), file("other/report.txt", "v2")},
+		{file("docs/moved-out.txt", "moved out"), nil},
+	}
+
+	for _, tt := range []struct {
+		filter string
+		full   bool // no room for candidates outside the filter
+		want   []string
+	}{
+		{"", false, []string{
+			"moved docs/moved-in.txt from other/moved-in.txt",
+			"new docs/new.txt",
+			"deleted docs/old.txt",
+			"modified docs/report.txt",
+			"moved other/moved-out.txt from docs/moved-out.txt",
+			"new other/new.txt",
+			"modified other/report.txt",
+		}},
+		{"docs", false, []string{
+			"moved docs/moved-in.txt from other/moved-in.txt",
+			"new docs/new.txt",
+			"deleted docs/old.txt",
+			"modified docs/report.txt",
+			"moved other/moved-out.txt from docs/moved-out.txt",
+		}},
+		{"docs", true, []string{
+			"new docs/moved-in.txt",
+			"deleted docs/moved-out.txt",
+			"new docs/new.txt",
+			"deleted docs/old.txt",
+			"modified docs/report.txt",
+		}},
+		{"docs/new.txt", false, []string{"new docs/new.txt"}},
+	} {
+		d := newGenerationDiff(tt.filter)
+		if tt.full {
+			d.others = maxMoveCandidates
+		}
+		for _, s := range steps {
+			d.add(s.old, s.cur)
+		}
+		var got []string
+		for _, change := range d.changes() {
+			description := fmt.Sprintf("%s %s", change.Change, change.Path)
+			if change.OldPath != "" {
+				description += " from " + change.OldPath
+			}
+			got = append(got, description)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("filter %q, full %v:\n got %q\nwant %q", tt.filter, tt.full, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package core
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// ignoreRules decides which files and directories below a root are left out of manifests,
+// comparisons and syncs. A nil *ignoreRules ignores nothing.
+//
+// A pattern without a slash matches the name of a file or directory at any depth,
+// e.g. "*.tmp", "Thumbs.db" or ".git". A pattern with a slash matches the whole path
+// relative to the root, e.g. "cache/*". Patterns use the syntax of path.Match.
+// Everything below an ignored directory is ignored too.
+type ignoreRules struct {
+	names []string // patterns without a slash
+	paths []string // patterns with a slash, with leading and trailing slashes removed
+}
+
+func newIgnoreRules(patterns []string) (*ignoreRules, error) {
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+	rules := &ignoreRules{}
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid ignore pattern %q: %v", pattern, err)
+		}
+		if strings.Contains(pattern, "/") {
+			rules.paths = append(rules.paths, strings.Trim(pattern, "/"))
+		} else {
+			rules.names = append(rules.names, pattern)
+		}
+	}
+	return rules, nil
+}
+
+// match reports whether a path relative to the root, with "/" as separator, is ignored.
+// Parent directories are not checked: callers skip ignored directories as a whole.
+func (r *ignoreRules) match(relativePath string) bool {
+	if r == nil || relativePath == "." {
+		return false
+	}
+	name := path.Base(relativePath)
+	for _, pattern := range r.names {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	for _, pattern := range r.paths {
+		if ok, _ := path.Match(pattern, relativePath); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPath is like match, but also reports paths below an ignored directory,
+// for lists of files such as manifests, where directories have no entries of their own.
+func (r *ignoreRules) matchPath(relativePath string) bool {
+	if r == nil {
+		return false
+	}
+	for i := range len(relativePath) {
+		if relativePath[i] == '/' && r.match(relativePath[:i]) {
+			return true
+		}
+	}
+	return r.match(relativePath)
+}
+
+// skipWalk is called from a filepath.WalkDir callback for each entry below root.
+// It reports whether the entry is ignored, with fs.SkipDir for an ignored directory
+// so that WalkDir does not descend into it.
+func (r *ignoreRules) skipWalk(root, walkPath string, d fs.DirEntry) (bool, error) {
+	if r == nil {
+		return false, nil
+	}
+	relativePath, err := filepath.Rel(root, walkPath)
+	if err != nil || !r.match(filepath.ToSlash(relativePath)) {
+		return false, nil
+	}
+	if d.IsDir() {
+		return true, fs.SkipDir
+	}
+	return true, nil
+}
+
+// getIgnoreFlag reads the --ignore patterns of cmd.
+func getIgnoreFlag(cmd *cobra.Command) ([]string, error) {
+	patterns, err := cmd.Flags().GetStringArray("ignore")
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving ignore flag: %v", err)
+	}
+	return patterns, nil
+}
@@ -0,0 +1,612 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// manifestHeader is the first line of every manifest written by this version of ssync.
+// Readers locate columns by name, so manifests from older versions, which lack
+// some of the trailing columns, can still be read.
+var manifestHeader = []string{"Path", "ModifiedTime", "Size", "Hash", "NtfsFileId", "Blocks", "Error"}
+
+// legacyManifestHeader is the header of manifests written before integrity trailers existed.
+// A manifest with this header and no trailer at all is read as it is, with a warning;
+// 'ssync manifest seal' adds the trailer. Any other manifest without a trailer is truncated.
+var legacyManifestHeader = []string{"Path", "ModifiedTime", "Size", "Hash", "NtfsFileId"}
+
+// warnedLegacyManifests holds the paths of legacy manifests that have been warned about,
+// so that a manifest read several times is only reported once.
+var warnedLegacyManifests sync.Map
+
+// manifestColumns holds the index of each known column in a manifest, or -1 if it is missing.
+type manifestColumns struct {
+	path, modifiedTime, size, hash, fileID, blocks, error int
+}
+
+func parseManifestHeader(header []string) (manifestColumns, error) {
+	cols := manifestColumns{-1, -1, -1, -1, -1, -1, -1}
+	for i, name := range header {
+		switch name {
+		case "Path":
+			cols.path = i
+		case "ModifiedTime":
+			cols.modifiedTime = i
+		case "Size":
+			cols.size = i
+		case "Hash":
+			cols.hash = i
+		case "NtfsFileId":
+			cols.fileID = i
+		case "Blocks":
+			cols.blocks = i
+		case "Error":
+			cols.error = i
+		}
+	}
+	if cols.path < 0 || cols.modifiedTime < 0 || cols.size < 0 || cols.hash < 0 || cols.fileID < 0 {
+		return cols, fmt.Errorf("invalid manifest header: %v", header)
+	}
+	return cols, nil
+}
+
+const (
+	// trailerMarker starts the last line of a manifest. Entries can never be mistaken
+	// for the trailer because they have a different number of fields.
+	trailerMarker     = "#ssync-trailer"
+	trailerFieldCount = 3
+	// partialMarker replaces trailerMarker in a manifest saved by an interrupted create or update.
+	// Such a manifest only lists the files hashed before the interruption, or their old entries.
+	partialMarker = "#ssync-partial"
+	digestPrefix  = "sha256:"
+)
+
+// manifestTrailer is the last line of a manifest. It records the number of entries and
+// a SHA-256 digest of the CSV encoding of the header and all entries,
+// so that truncated or edited manifests are rejected.
+type manifestTrailer struct {
+	Count   int
+	Digest  string // "sha256:" followed by the hex digest
+	Partial bool   // the manifest was saved by an interrupted create or update
+}
+
+func (t manifestTrailer) fields() []string {
+	marker := trailerMarker
+	if t.Partial {
+		marker = partialMarker
+	}
+	return []string{marker, strconv.Itoa(t.Count), t.Digest}
+}
+
+func parseTrailer(fields []string) (manifestTrailer, error) {
+	count, err := strconv.Atoi(fields[1])
+	if err != nil || count < 0 {
+		return manifestTrailer{}, fmt.Errorf("invalid entry count in manifest trailer: %q", fields[1])
+	}
+	if !strings.HasPrefix(fields[2], digestPrefix) {
+		return manifestTrailer{}, fmt.Errorf("unsupported digest in manifest trailer: %q", fields[2])
+	}
+	return manifestTrailer{Count: count, Digest: fields[2], Partial: fields[0] == partialMarker}, nil
+}
+
+// fileIterator yields file entries one at a time in manifest order (see comparePaths).
+// Next returns io.EOF after the last entry.
+type fileIterator interface {
+	Next() (FileInfo, error)
+}
+
+// comparePaths orders slash-separated relative paths component by component,
+// which is the order in which filepath.WalkDir visits files.
+// Plain string order differs from it whenever a name contains a byte smaller than '/',
+// e.g. "a/b" sorts before "a.txt" here but after it as a string.
+func comparePaths(a, b string) int {
+	n := min(len(a), len(b))
+	for i := 0; i < n; i++ {
+		ca, cb := a[i], b[i]
+		if ca == cb {
+			continue
+		}
+		if ca == '/' {
+			return -1
+		}
+		if cb == '/' {
+			return 1
+		}
+		if ca < cb {
+			return -1
+		}
+		return 1
+	}
+	switch {
+	case len(a) < len(b):
+		return -1
+	case len(a) > len(b):
+		return 1
+	default:
+		return 0
+	}
+}
+
+// cleanSubtree turns a directory given on the command line into a path relative to the root,
+// with "/" as separator, and "" for the root itself.
+func cleanSubtree(dir string) string {
+	return strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(dir)), "/")
+}
+
+// inSubtree reports whether a path relative to the root is dir or lies below it.
+// Every path lies below the root, "".
+func inSubtree(relativePath, dir string) bool {
+	return dir == "" || relativePath == dir || strings.HasPrefix(relativePath, dir+"/")
+}
+
+// sortFileInfoSlice sorts entries into manifest order.
+func sortFileInfoSlice(fileInfoSlice []FileInfo) {
+	sort.Slice(fileInfoSlice, func(i, j int) bool {
+		return comparePaths(fileInfoSlice[i].Path, fileInfoSlice[j].Path) < 0
+	})
+}
+
+// manifestReader streams the entries of a manifest file,
+// so memory use does not depend on the number of entries.
+type manifestReader struct {
+	path   string
+	file   io.ReadCloser
+	r      *csv.Reader
+	header int // number of fields per entry
+	cols   manifestColumns
+	digest hash.Hash
+	dw     *csv.Writer // re-encodes every record read into digest
+	last   string
+	count  int
+	legacy bool // accept a missing trailer
+	// old is set if the header is legacyManifestHeader. A missing trailer is then accepted with a warning,
+	// and so are entries out of manifest order, since older versions sorted paths as plain strings.
+	old     bool
+	partial bool // accept a partial manifest
+	trailer *manifestTrailer
+}
+
+// openManifest opens a manifest for streaming and reads its header.
+// Gzip and zstd compressed manifests are decompressed transparently.
+// The integrity trailer is checked when the last entry has been read.
+func openManifest(manifestPath string) (*manifestReader, error) {
+	file, err := openManifestFile(manifestPath)
+	if err != nil {
+		return nil, fmt.Errorf("error opening manifest file: %v", err)
+	}
+
+	r := csv.NewReader(file)
+	r.FieldsPerRecord = -1 // The trailer has fewer fields than the entries.
+	r.ReuseRecord = true
+
+	header, err := r.Read()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("error reading manifest header: %v", err)
+	}
+	cols, err := parseManifestHeader(header)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	digest := sha256.New()
+	dw := csv.NewWriter(digest)
+	dw.Write(header)
+
+	old := slices.Equal(header, legacyManifestHeader)
+	return &manifestReader{path: manifestPath, file: file, r: r, header: len(header), cols: cols, digest: digest, dw: dw, old: old}, nil
+}
+
+// openLegacyManifest is like openManifest but accepts manifests written before
+// integrity trailers existed. A trailer that is present is still checked.
+func openLegacyManifest(manifestPath string) (*manifestReader, error) {
+	mr, err := openManifest(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	mr.legacy = true
+	return mr, nil
+}
+
+// openPartialManifest is like openManifest but also accepts a partial manifest
+// saved by an interrupted create, for commands that continue from one.
+func openPartialManifest(manifestPath string) (*manifestReader, error) {
+	mr, err := openManifest(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	mr.partial = true
+	return mr, nil
+}
+
+// Next returns the next entry of the manifest, or io.EOF at the end.
+// Reaching the end without a valid trailer is an error.
+func (mr *manifestReader) Next() (FileInfo, error) {
+	fields, err := mr.r.Read()
+	if err == io.EOF {
+		switch {
+		case mr.trailer != nil || mr.legacy:
+		case mr.old:
+			if _, warned := warnedLegacyManifests.LoadOrStore(mr.path, true); !warned {
+				logrus.WithField("path", mr.path).Warn("Manifest without integrity trailer")
+				fmt.Fprintf(os.Stderr, "Warning: %s was written by an older ssync and has no integrity trailer, so it cannot be checked for truncation; 'ssync manifest seal' adds one.\n", mr.path)
+			}
+		default:
+			return FileInfo{}, fmt.Errorf("manifest has no integrity trailer after %d entries: it is truncated", mr.count)
+		}
+		return FileInfo{}, io.EOF
+	}
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("error reading manifest line: %v", err)
+	}
+	if mr.trailer != nil {
+		return FileInfo{}, fmt.Errorf("unexpected data after manifest trailer: %v", fields)
+	}
+
+	if len(fields) == trailerFieldCount && (fields[0] == trailerMarker || fields[0] == partialMarker) {
+		trailer, err := parseTrailer(fields)
+		if err != nil {
+			return FileInfo{}, err
+		}
+		if trailer.Count != mr.count {
+			return FileInfo{}, fmt.Errorf("manifest is corrupt: trailer expects %d entries, found %d", trailer.Count, mr.count)
+		}
+		if digest := mr.sum(); trailer.Digest != digest {
+			return FileInfo{}, fmt.Errorf("manifest is corrupt: digest %s does not match trailer digest %s", digest, trailer.Digest)
+		}
+		if trailer.Partial && !mr.partial {
+			return FileInfo{}, fmt.Errorf("manifest is partial: it was saved by an interrupted 'create' or 'update' and lists %d files (finish it with --resume or 'ssync update')", trailer.Count)
+		}
+		mr.trailer = &trailer
+		return mr.Next()
+	}
+	if len(fields) != mr.header {
+		return FileInfo{}, fmt.Errorf("invalid manifest line (field count): %v", fields)
+	}
+	mr.dw.Write(fields)
+
+	unixTime, err := strconv.ParseInt(fields[mr.cols.modifiedTime], 10, 64)
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("error parsing ModifiedTime in line %v: %v", fields, err)
+	}
+	size, err := strconv.ParseInt(fields[mr.cols.size], 10, 64)
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("error parsing Size in line %v: %v", fields, err)
+	}
+	fileID, err := strconv.ParseUint(fields[mr.cols.fileID], 10, 64)
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("error parsing NTFSFileID in line %v: %v", fields, err)
+	}
+
+	fileInfo := FileInfo{
+		Path:         fields[mr.cols.path],
+		ModifiedTime: time.Unix(unixTime, 0),
+		Size:         size,
+		Hash:         fields[mr.cols.hash],
+		NTFSFileID:   fileID,
+	}
+	if mr.cols.blocks >= 0 {
+		fileInfo.BlockSize, fileInfo.BlockHashes, fileInfo.ChunkSizes, err = parseBlocks(fields[mr.cols.blocks])
+		if err != nil {
+			return FileInfo{}, fmt.Errorf("error parsing Blocks in line for %q: %v", fileInfo.Path, err)
+		}
+	}
+	if mr.cols.error >= 0 {
+		fileInfo.Error = fields[mr.cols.error]
+	}
+	if mr.count > 0 && !mr.old && comparePaths(mr.last, fileInfo.Path) >= 0 {
+		return FileInfo{}, fmt.Errorf("manifest is corrupt: %q is out of order after %q", fileInfo.Path, mr.last)
+	}
+	mr.last = fileInfo.Path
+	mr.count++
+	return fileInfo, nil
+}
+
+func (mr *manifestReader) sum() string {
+	mr.dw.Flush()
+	return digestPrefix + hex.EncodeToString(mr.digest.Sum(nil))
+}
+
+// Trailer returns the verified trailer once Next has returned io.EOF.
+// It is nil for a legacy manifest without a trailer.
+func (mr *manifestReader) Trailer() *manifestTrailer {
+	return mr.trailer
+}
+
+// Close closes the underlying file.
+func (mr *manifestReader) Close() error {
+	return mr.file.Close()
+}
+
+// readManifest reads a whole manifest file into memory.
+func readManifest(manifestPath string) ([]FileInfo, error) {
+	mr, err := openManifest(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	defer mr.Close()
+
+	var fileInfoSlice []FileInfo
+	for {
+		fileInfo, err := mr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		fileInfoSlice = append(fileInfoSlice, fileInfo)
+	}
+	return fileInfoSlice, nil
+}
+
+// sortedManifest is a fileIterator over a manifest that is guaranteed to be in manifest order.
+type sortedManifest struct {
+	fileIterator
+	close func() error
+}
+
+func (sm *sortedManifest) Close() error {
+	return sm.close()
+}
+
+// openSortedManifest opens a manifest for merge-joining.
+// Manifests written since the integrity trailer was added are in manifest order and are streamed;
+// the order is checked as the entries are read. Older manifests, recognised by their header,
+// may be sorted as plain strings; those are loaded and re-sorted in memory,
+// so they keep working at the old memory cost until they are rewritten.
+func openSortedManifest(manifestPath string) (*sortedManifest, error) {
+	return openSortedManifestWith(manifestPath, openManifest)
+}
+
+// openSortedManifestWith is openSortedManifest with a different function to open the manifest.
+func openSortedManifestWith(manifestPath string, open func(string) (*manifestReader, error)) (*sortedManifest, error) {
+	mr, err := open(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	if !mr.old {
+		return &sortedManifest{fileIterator: mr, close: mr.Close}, nil
+	}
+	defer mr.Close()
+
+	logrus.Debugf("Manifest %s was written by an older ssync, sorting it in memory", manifestPath)
+	var fileInfoSlice []FileInfo
+	for {
+		fileInfo, err := mr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		fileInfoSlice = append(fileInfoSlice, fileInfo)
+	}
+	sortFileInfoSlice(fileInfoSlice)
+	return &sortedManifest{fileIterator: &sliceIterator{fileInfoSlice: fileInfoSlice}, close: func() error { return nil }}, nil
+}
+
+// sliceIterator is a fileIterator over an in-memory slice that is already in manifest order.
+type sliceIterator struct {
+	fileInfoSlice []FileInfo
+	next          int
+}
+
+func (si *sliceIterator) Next() (FileInfo, error) {
+	if si.next >= len(si.fileInfoSlice) {
+		return FileInfo{}, io.EOF
+	}
+	fileInfo := si.fileInfoSlice[si.next]
+	si.next++
+	return fileInfo, nil
+}
+
+// manifestWriter streams entries to a manifest file.
+// Entries must be written in manifest order.
+type manifestWriter struct {
+	cw      io.WriteCloser
+	w       *csv.Writer
+	digest  hash.Hash
+	last    string
+	count   int
+	size    int64
+	errors  int  // entries recorded with an error instead of a hash
+	partial bool // mark the manifest as partial in its trailer
+	// trailer is set once the writer has been closed.
+	trailer manifestTrailer
+}
+
+// newManifestWriter writes the manifest header to file and returns a writer for the entries.
+// The output is compressed if the file name ends with ".gz" or ".zst".
+func newManifestWriter(file *os.File) (*manifestWriter, error) {
+	cw, err := newCompressingWriter(file, file.Name())
+	if err != nil {
+		return nil, fmt.Errorf("error setting up manifest compression: %v", err)
+	}
+	digest := sha256.New()
+	w := csv.NewWriter(io.MultiWriter(cw, digest))
+	if err := w.Write(manifestHeader); err != nil {
+		return nil, fmt.Errorf("error writing header to manifest file: %v", err)
+	}
+	return &manifestWriter{cw: cw, w: w, digest: digest}, nil
+}
+
+// Write appends an entry to the manifest.
+func (mw *manifestWriter) Write(fileInfo FileInfo) error {
+	if mw.count > 0 && comparePaths(mw.last, fileInfo.Path) >= 0 {
+		return fmt.Errorf("manifest entries out of order: %q after %q", fileInfo.Path, mw.last)
+	}
+	line := []string{
+		fileInfo.Path,
+		strconv.FormatInt(fileInfo.ModifiedTime.Unix(), 10),
+		strconv.FormatInt(fileInfo.Size, 10),
+		fileInfo.Hash,
+		strconv.FormatUint(fileInfo.NTFSFileID, 10),
+		formatBlocks(fileInfo.BlockSize, fileInfo.BlockHashes, fileInfo.ChunkSizes),
+		fileInfo.Error,
+	}
+	if err := mw.w.Write(line); err != nil {
+		return fmt.Errorf("error writing line to manifest file: %v", err)
+	}
+	mw.last = fileInfo.Path
+	mw.count++
+	mw.size += fileInfo.Size
+	if fileInfo.Error != "" {
+		mw.errors++
+	}
+	return nil
+}
+
+// Close writes the integrity trailer and flushes the manifest.
+// It does not close the underlying file.
+func (mw *manifestWriter) Close() error {
+	mw.w.Flush()
+	if err := mw.w.Error(); err != nil {
+		return fmt.Errorf("error flushing manifest file: %v", err)
+	}
+
+	// The trailer itself is not part of the digest, so it is written past the digesting writer.
+	trailer := manifestTrailer{Count: mw.count, Digest: digestPrefix + hex.EncodeToString(mw.digest.Sum(nil)), Partial: mw.partial}
+	tw := csv.NewWriter(mw.cw)
+	tw.Write(trailer.fields())
+	tw.Flush()
+	if err := tw.Error(); err != nil {
+		return fmt.Errorf("error writing manifest trailer: %v", err)
+	}
+
+	if err := mw.cw.Close(); err != nil {
+		return fmt.Errorf("error finishing compressed manifest: %v", err)
+	}
+	mw.trailer = trailer
+	return nil
+}
+
+// manifest describes what has been written, once the writer has been closed.
+func (mw *manifestWriter) manifest(path string) *Manifest {
+	return &Manifest{Path: path, Files: mw.count, Bytes: mw.size, Digest: mw.trailer.Digest, Partial: mw.trailer.Partial, Errors: mw.errors}
+}
+
+// mergeJoin walks two iterators in manifest order and calls fn once per distinct path.
+// Either argument of fn is nil when the path only exists on the other side;
+// the pointers are only valid for the duration of the call.
+// Memory use is constant regardless of the number of entries.
+func mergeJoin(left, right fileIterator, fn func(l, r *FileInfo) error) error {
+	l, lerr := left.Next()
+	r, rerr := right.Next()
+	for {
+		if lerr != nil && lerr != io.EOF {
+			return lerr
+		}
+		if rerr != nil && rerr != io.EOF {
+			return rerr
+		}
+		if lerr == io.EOF && rerr == io.EOF {
+			return nil
+		}
+
+		var c int
+		switch {
+		case lerr == io.EOF:
+			c = 1
+		case rerr == io.EOF:
+			c = -1
+		default:
+			c = comparePaths(l.Path, r.Path)
+		}
+
+		var err error
+		switch {
+		case c < 0:
+			err = fn(&l, nil)
+			l, lerr = left.Next()
+		case c > 0:
+			err = fn(nil, &r)
+			r, rerr = right.Next()
+		default:
+			err = fn(&l, &r)
+			l, lerr = left.Next()
+			r, rerr = right.Next()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// manifestCursor looks up manifest entries by path while streaming through the manifest.
+// Lookups must be made in manifest order.
+type manifestCursor struct {
+	it      fileIterator
+	current FileInfo
+	err     error
+	started bool
+}
+
+func newManifestCursor(it fileIterator) *manifestCursor {
+	return &manifestCursor{it: it}
+}
+
+// Find returns the entry for path, or nil if the manifest has none.
+func (c *manifestCursor) Find(path string) (*FileInfo, error) {
+	if !c.started {
+		c.current, c.err = c.it.Next()
+		c.started = true
+	}
+	for c.err == nil && comparePaths(c.current.Path, path) < 0 {
+		c.current, c.err = c.it.Next()
+	}
+	if c.err == io.EOF {
+		return nil, nil
+	}
+	if c.err != nil {
+		return nil, c.err
+	}
+	if c.current.Path != path {
+		return nil, nil
+	}
+	fileInfo := c.current
+	return &fileInfo, nil
+}
+
+// After calls fn for every remaining entry whose path comes after path, in manifest order.
+// The cursor cannot be used for lookups afterwards.
+func (c *manifestCursor) After(path string, fn func(fileInfo FileInfo) error) error {
+	if _, err := c.Find(path); err != nil {
+		return err
+	}
+	for ; c.err == nil; c.current, c.err = c.it.Next() {
+		if comparePaths(c.current.Path, path) > 0 {
+			if err := fn(c.current); err != nil {
+				return err
+			}
+		}
+	}
+	if c.err == io.EOF {
+		return nil
+	}
+	return c.err
+}
+
+// Close closes the underlying manifest, if it can be closed.
+func (c *manifestCursor) Close() error {
+	if closer, ok := c.it.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
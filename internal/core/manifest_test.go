@@ -0,0 +1,213 @@
+package core
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testEntries returns manifest entries, in manifest order, that use every column.
+func testEntries() []FileInfo {
+	return []FileInfo{
+		{Path: "a/b.txt", ModifiedTime: time.Unix(1700000000, 0), Size: 5, Hash: md5Hex("bravo"), NTFSFileID: 42},
+		{Path: "a.txt", ModifiedTime: time.Unix(1700000001, 0), Size: 10000, Hash: md5Hex("big"), BlockSize: 4096, BlockHashes: []string{"aa", "bb", "cc"}},
+		{Path: "c, \"quoted\".txt", ModifiedTime: time.Unix(1700000002, 0), Size: 5000, Hash: md5Hex("cdc"), BlockSize: 4096, BlockHashes: []string{"dd", "ee"}, ChunkSizes: []int64{3000, 2000}},
+		{Path: "locked.txt", ModifiedTime: time.Unix(1700000003, 0), Size: 7, Error: "access denied"},
+	}
+}
+
+func TestCompressedManifestRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	entries := testEntries()
+	for _, tt := range []struct {
+		name  string
+		magic []byte
+	}{
+		{"m.csv", []byte("Path,")},
+		{"m.csv.gz", gzipMagic},
+		{"m.csv.zst", zstdMagic},
+		{"M.CSV.GZ", gzipMagic},
+	} {
+		path := filepath.Join(dir, tt.name)
+		writeTestManifest(t, path, entries)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(data, tt.magic) {
+			t.Errorf("%s starts with %q, want %q", tt.name, data[:min(len(data), 8)], tt.magic)
+		}
+		got, err := readManifest(path)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(got, entries) {
+			t.Errorf("%s: read %v, want %v", tt.name, got, entries)
+		}
+
+		// The compression is recognised by its content, whatever the name.
+		renamed := filepath.Join(dir, "renamed-"+tt.name+".txt")
+		if err := os.WriteFile(renamed, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := readManifest(renamed); err != nil || !reflect.DeepEqual(got, entries) {
+			t.Errorf("%s renamed: read %v, %v", tt.name, got, err)
+		}
+	}
+
+	empty := filepath.Join(dir, "empty.csv.zst")
+	writeTestManifest(t, empty, nil)
+	if got, err := readManifest(empty); err != nil || len(got) != 0 {
+		t.Errorf("empty manifest: read %v, %v", got, err)
+	}
+}
+
+func TestComparePaths(t *testing.T) {
+	for _, tt := range []struct {
+		a, b string
+		want int
+	}{
+		{"a", "a", 0},
+		{"a", "b", -1},
+		{"a", "a/b", -1},
+		{"a/b", "a.txt", -1},
+		{"a/b", "a-b", -1},
+		{"a/z", "a0", -1},
+		{"a b/c", "a/c", 1},
+		{"dir/b.txt", "dir.txt", -1},
+		{"B", "a", -1},
+		{"", "a", -1},
+	} {
+		if got := comparePaths(tt.a, tt.b); got != tt.want {
+			t.Errorf("comparePaths(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+		if got := comparePaths(tt.b, tt.a); got != -tt.want {
+			t.Errorf("comparePaths(%q, %q) = %d, want %d", tt.b, tt.a, got, -tt.want)
+		}
+	}
+}
+
+func TestManifestOrder(t *testing.T) {
+	dir := t.TempDir()
+
+	file, err := os.Create(filepath.Join(dir, "written.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	writer, err := newManifestWriter(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Write(FileInfo{Path: "a.txt"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"a.txt", "a/b.txt", "0.txt"} {
+		if err := writer.Write(FileInfo{Path: p}); err == nil {
+			t.Errorf("writing %s after a.txt succeeded", p)
+		}
+	}
+
+	// Current manifests are streamed, so entries out of order are an error when they are read.
+	unsorted := filepath.Join(dir, "unsorted.csv")
+	if err := os.WriteFile(unsorted, []byte("Path,ModifiedTime,Size,Hash,NtfsFileId,Blocks,Error\na.txt,0,1,x,0,,\na/b.txt,0,1,x,0,,\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sm, err := openSortedManifest(unsorted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sm.Close()
+	if _, err := sm.Next(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sm.Next(); err == nil || !strings.Contains(err.Error(), "out of order") {
+		t.Errorf("reading an entry out of order: %v", err)
+	}
+
+	// Manifests with the legacy header were sorted as plain strings and are sorted again.
+	legacy := filepath.Join(dir, "legacy.csv")
+	if err := os.WriteFile(legacy, []byte("Path,ModifiedTime,Size,Hash,NtfsFileId\na.txt,0,1,x,0\na/b.txt,0,1,x,0\n0.txt,0,1,x,0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sm, err = openSortedManifest(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sm.Close()
+	var paths []string
+	for _, fileInfo := range collect(t, sm) {
+		paths = append(paths, fileInfo.Path)
+	}
+	if want := []string{"0.txt", "a/b.txt", "a.txt"}; !slices.Equal(paths, want) {
+		t.Errorf("legacy manifest read as %v, want %v", paths, want)
+	}
+}
+
+func TestManifestTrailer(t *testing.T) {
+	dir := t.TempDir()
+	intact := filepath.Join(dir, "intact.csv")
+	entries := testEntries()
+	writeTestManifest(t, intact, entries)
+	trailer, err := verifyManifest(intact)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trailer.Count != len(entries) || !strings.HasPrefix(trailer.Digest, digestPrefix) || trailer.Partial {
+		t.Errorf("trailer = %+v", trailer)
+	}
+	data, err := os.ReadFile(intact)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitAfter(string(data), "\n")
+	lines = lines[:len(lines)-1] // the empty string after the last newline
+	last := len(lines) - 1
+
+	for _, tt := range []struct {
+		name   string
+		lines  []string
+		reason string
+	}{
+		{"truncated", lines[:last], "truncated"},
+		{"entry removed", slices.Delete(slices.Clone(lines), 2, 3), "expects"},
+		{"entry edited", slices.Replace(slices.Clone(lines), 1, 2, strings.Replace(lines[1], ",5,", ",6,", 1)), "digest"},
+		{"data after the trailer", append(slices.Clone(lines), lines[1]), "after manifest trailer"},
+		{"partial", slices.Replace(slices.Clone(lines), last, last+1, strings.Replace(lines[last], trailerMarker, partialMarker, 1)), "partial"},
+	} {
+		path := filepath.Join(dir, strings.ReplaceAll(tt.name, " ", "-")+".csv")
+		if err := os.WriteFile(path, []byte(strings.Join(tt.lines, "")), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := verifyManifest(path); err == nil || !strings.Contains(err.Error(), tt.reason) {
+			t.Errorf("%s: error %v, want one containing %q", tt.name, err, tt.reason)
+		}
+	}
+
+	// A partial manifest is only read by the commands that continue from it.
+	mr, err := openPartialManifest(filepath.Join(dir, "partial.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+	if got := collect(t, mr); len(got) != len(entries) || mr.Trailer() == nil || !mr.Trailer().Partial {
+		t.Errorf("partial manifest: %d entries, trailer %v", len(got), mr.Trailer())
+	}
+
+	// A manifest with the legacy header and no trailer is read with a warning, but cannot be verified.
+	legacy := filepath.Join(dir, "legacy.csv")
+	if err := os.WriteFile(legacy, []byte("Path,ModifiedTime,Size,Hash,NtfsFileId\na.txt,0,1,x,0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := readManifest(legacy); err != nil || len(got) != 1 {
+		t.Errorf("legacy manifest: read %v, %v", got, err)
+	}
+	if _, err := verifyManifest(legacy); err == nil {
+		t.Error("verifying a legacy manifest succeeded")
+	}
+}
@@ -0,0 +1,82 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// defaultRetryDelay is how long ErrorPolicy waits between retries if RetryDelay is not set.
+const defaultRetryDelay = time.Second
+
+// ErrorPolicy decides what happens when a file cannot be read, e.g. because another program has it locked.
+// The zero value skips such files: they are reported with a WarningEvent and, where the operation
+// writes a manifest, recorded in it with an error instead of a hash.
+type ErrorPolicy struct {
+	Abort      bool          // stop at the first file that cannot be read, instead of skipping it
+	Retries    int           // try reading a file this many more times before giving up on it
+	RetryDelay time.Duration // wait between retries, defaultRetryDelay if 0
+}
+
+// parseErrorPolicy parses the --on-error flag: "skip", "abort" or "retry:N".
+// Files that still cannot be read after N retries are skipped.
+func parseErrorPolicy(s string) (ErrorPolicy, error) {
+	switch {
+	case s == "skip":
+		return ErrorPolicy{}, nil
+	case s == "abort":
+		return ErrorPolicy{Abort: true}, nil
+	case strings.HasPrefix(s, "retry:"):
+		retries, err := strconv.Atoi(strings.TrimPrefix(s, "retry:"))
+		if err != nil || retries < 1 {
+			return ErrorPolicy{}, fmt.Errorf("invalid on-error flag %q: the number of retries must be a positive integer", s)
+		}
+		return ErrorPolicy{Retries: retries}, nil
+	default:
+		return ErrorPolicy{}, fmt.Errorf("invalid on-error flag %q: must be skip, abort or retry:N", s)
+	}
+}
+
+// getErrorPolicyFlag reads the --on-error flag of cmd.
+func getErrorPolicyFlag(cmd *cobra.Command) (ErrorPolicy, error) {
+	onError, err := cmd.Flags().GetString("on-error")
+	if err != nil {
+		return ErrorPolicy{}, fmt.Errorf("error retrieving on-error flag: %v", err)
+	}
+	return parseErrorPolicy(onError)
+}
+
+// try calls fn, and calls it again up to p.Retries times while it fails.
+// It returns the error of the last call, or the context's error if ctx is cancelled while waiting.
+func (p ErrorPolicy) try(ctx context.Context, path string, fn func() error) error {
+	err := fn()
+	for retry := 1; err != nil && retry <= p.Retries; retry++ {
+		delay := p.RetryDelay
+		if delay == 0 {
+			delay = defaultRetryDelay
+		}
+		logrus.WithFields(logrus.Fields{"path": path, "retry": retry, "retries": p.Retries, "delaySeconds": delay.Seconds()}).WithError(err).Info("Retrying")
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		err = fn()
+	}
+	return err
+}
+
+// skip decides what to do with a path that could not be read: it returns err if the policy aborts,
+// otherwise it reports err with a WarningEvent and returns nil.
+func (p ErrorPolicy) skip(events EventHandler, path string, err error) error {
+	if p.Abort {
+		return err
+	}
+	events.emit(&WarningEvent{Path: path, Err: err})
+	return nil
+}
@@ -0,0 +1,266 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// progressMode selects how progress is printed.
+type progressMode string
+
+const (
+	progressAuto  progressMode = "auto"  // progressLine on a terminal, progressPlain otherwise
+	progressLine  progressMode = "line"  // a single line that is redrawn in place
+	progressPlain progressMode = "plain" // a line every plainInterval, for log files
+	progressJSON  progressMode = "json"  // a JSON object per line every jsonInterval, for job runners
+	progressNone  progressMode = "none"
+)
+
+// How often progress is printed in each mode. The final state of each stage is always printed.
+const (
+	lineInterval  = 100 * time.Millisecond
+	plainInterval = 10 * time.Second
+	jsonInterval  = time.Second
+)
+
+// progressRecord is the JSON form of a progress report.
+type progressRecord struct {
+	Stage          string   `json:"stage"`
+	Path           string   `json:"path"`
+	Files          int      `json:"files"`
+	TotalFiles     int      `json:"totalFiles"`
+	Bytes          int64    `json:"bytes"`
+	TotalBytes     int64    `json:"totalBytes"`
+	ElapsedSeconds float64  `json:"elapsedSeconds"`
+	BytesPerSecond float64  `json:"bytesPerSecond"`
+	ETASeconds     *float64 `json:"etaSeconds,omitempty"`
+	Done           bool     `json:"done"`
+}
+
+// eventPrinter prints the progress and warnings of an operation for the command line.
+// Progress goes to stderr, so it never mixes with the output of a command on stdout,
+// and is throttled so that long runs do not flood a terminal or a log file.
+type eventPrinter struct {
+	w        io.Writer // output other than progress and warnings
+	progress io.Writer // progress and warnings
+	warnings []WarningEvent
+	mode     progressMode
+	stage    string
+	start    time.Time      // when the current stage started
+	printed  time.Time      // when progress was last printed
+	last     *ProgressEvent // the latest progress event
+	pending  bool           // last has not been printed yet
+	width    int            // width of the progress line on screen, 0 if there is none
+}
+
+// newEventPrinter creates an eventPrinter for the --quiet and --progress flags.
+// Warnings go to stderr; other output printed through the eventPrinter goes to w.
+func newEventPrinter(cmd *cobra.Command, w io.Writer) (*eventPrinter, error) {
+	quiet, err := cmd.Flags().GetBool("quiet")
+	if err != nil {
+		return nil, err
+	}
+	progress, err := cmd.Flags().GetString("progress")
+	if err != nil {
+		return nil, err
+	}
+
+	mode := progressMode(progress)
+	switch {
+	case quiet:
+		mode = progressNone
+	case mode == progressAuto && isTerminal(os.Stderr):
+		mode = progressLine
+	case mode == progressAuto:
+		mode = progressPlain
+	case mode != progressLine && mode != progressPlain && mode != progressJSON && mode != progressNone:
+		return nil, fmt.Errorf("invalid progress flag %q: must be auto, line, plain, json or none", progress)
+	}
+	return &eventPrinter{w: w, progress: os.Stderr, mode: mode}, nil
+}
+
+func (p *eventPrinter) handle(e Event) {
+	switch e := e.(type) {
+	case *ProgressEvent:
+		now := time.Now()
+		if e.Stage != p.stage {
+			p.done()
+			p.stage = e.Stage
+			p.start = now
+			p.printed = time.Time{}
+		}
+		event := *e
+		p.last = &event
+		if p.mode == progressNone {
+			return
+		}
+		p.pending = true
+		if now.Sub(p.printed) >= p.interval() {
+			p.print(now, false)
+		}
+	case *WarningEvent:
+		p.warnings = append(p.warnings, *e)
+		logrus.WithField("path", e.Path).WithError(e.Err).Warn("Warning")
+		p.clearLine()
+		fmt.Fprintf(p.progress, "Warning: %q: %v\n", e.Path, e.Err)
+	}
+}
+
+// printf prints to w, after clearing the progress line so the two do not run together.
+func (p *eventPrinter) printf(format string, args ...any) {
+	p.clearLine()
+	fmt.Fprintf(p.w, format, args...)
+}
+
+// clearLine removes the progress line from the screen before other output is printed.
+func (p *eventPrinter) clearLine() {
+	if p.width > 0 {
+		fmt.Fprintf(p.progress, "\r%*s\r", p.width, "")
+		p.width = 0
+		p.printed = time.Time{} // Redraw the progress line with the next event.
+	}
+}
+
+// done prints the final progress of the current stage and ends the progress line, if there is one.
+func (p *eventPrinter) done() {
+	if p.stage != "" && p.last != nil {
+		logrus.WithFields(logrus.Fields{
+			"stage":   p.stage,
+			"files":   p.last.Files,
+			"bytes":   p.last.Bytes,
+			"seconds": time.Since(p.start).Seconds(),
+		}).Info("Stage finished")
+	}
+	if p.pending {
+		p.print(time.Now(), true)
+	}
+	if p.width > 0 {
+		fmt.Fprintln(p.progress)
+		p.width = 0
+	}
+	p.stage = ""
+}
+
+// errorReport lists the warnings once more at the end of a command, where they are not lost among
+// other output, and returns an ExitPartial error if there were any.
+func (p *eventPrinter) errorReport() error {
+	if len(p.warnings) == 0 {
+		return nil
+	}
+	p.done()
+	fmt.Fprintf(p.progress, "\nProblems (%d):\n", len(p.warnings))
+	for _, w := range p.warnings {
+		fmt.Fprintf(p.progress, "  %s: %v\n", w.Path, w.Err)
+	}
+	return partialFailure(len(p.warnings))
+}
+
+func (p *eventPrinter) interval() time.Duration {
+	switch p.mode {
+	case progressPlain:
+		return plainInterval
+	case progressJSON:
+		return jsonInterval
+	default:
+		return lineInterval
+	}
+}
+
+func (p *eventPrinter) print(now time.Time, done bool) {
+	e := p.last
+	elapsed := now.Sub(p.start)
+	record := progressRecord{
+		Stage:          e.Stage,
+		Path:           e.Path,
+		Files:          e.Files,
+		TotalFiles:     e.TotalFiles,
+		Bytes:          e.Bytes,
+		TotalBytes:     e.TotalBytes,
+		ElapsedSeconds: elapsed.Seconds(),
+		Done:           done,
+	}
+	filesPerSecond := 0.0
+	if elapsed > 0 {
+		record.BytesPerSecond = float64(e.Bytes) / elapsed.Seconds()
+		filesPerSecond = float64(e.Files) / elapsed.Seconds()
+	}
+	// The ETA is based on bytes where they are known, as hashing time depends on size rather than on the number of files.
+	switch {
+	case e.TotalBytes > 0 && record.BytesPerSecond > 0:
+		eta := float64(max(e.TotalBytes-e.Bytes, 0)) / record.BytesPerSecond
+		record.ETASeconds = &eta
+	case e.TotalBytes == 0 && e.TotalFiles > 0 && filesPerSecond > 0:
+		eta := float64(max(e.TotalFiles-e.Files, 0)) / filesPerSecond
+		record.ETASeconds = &eta
+	}
+	p.printed = now
+	p.pending = false
+
+	switch p.mode {
+	case progressJSON:
+		data, _ := json.Marshal(record)
+		fmt.Fprintf(p.progress, "%s\n", data)
+	case progressPlain:
+		fmt.Fprintln(p.progress, formatProgress(record, filesPerSecond, 0))
+	case progressLine:
+		// Keep the line short enough not to wrap on a standard console, which would break redrawing.
+		line := formatProgress(record, filesPerSecond, 79)
+		fmt.Fprintf(p.progress, "\r%-*s", p.width, line)
+		p.width = len(line)
+	}
+}
+
+// formatProgress formats a progress report as a line of text such as
+// "hash: 12/40 files, 1.20 GB/3.40 GB (35%), 85.30 MB/s, ETA 27s, photos/img_0012.jpg".
+// With a maxWidth, the path is shortened from the left to make the line fit.
+func formatProgress(record progressRecord, filesPerSecond float64, maxWidth int) string {
+	parts := []string{}
+	if record.TotalFiles > 0 {
+		parts = append(parts, fmt.Sprintf("%d/%d files", record.Files, record.TotalFiles))
+	} else {
+		parts = append(parts, fmt.Sprintf("%d files", record.Files))
+	}
+	switch {
+	case record.TotalBytes > 0:
+		parts = append(parts, fmt.Sprintf("%s/%s (%d%%)", toFriendlySize(record.Bytes), toFriendlySize(record.TotalBytes), record.Bytes*100/record.TotalBytes))
+	case record.Bytes > 0:
+		parts = append(parts, toFriendlySize(record.Bytes))
+	}
+	if record.Bytes > 0 {
+		parts = append(parts, toFriendlySize(int64(record.BytesPerSecond))+"/s")
+	} else {
+		parts = append(parts, fmt.Sprintf("%.0f files/s", filesPerSecond))
+	}
+	if record.ETASeconds != nil && !record.Done {
+		parts = append(parts, "ETA "+(time.Duration(*record.ETASeconds)*time.Second).String())
+	}
+	if record.Done {
+		parts = append(parts, "done in "+(time.Duration(record.ElapsedSeconds)*time.Second).String())
+	}
+	line := record.Stage + ": " + strings.Join(parts, ", ")
+
+	path := record.Path
+	if record.Done {
+		path = ""
+	}
+	if maxWidth > 0 && path != "" {
+		room := maxWidth - len(line) - len(", ")
+		switch {
+		case room < len("..."):
+			path = ""
+		case len(path) > room:
+			path = "..." + path[len(path)-room+len("..."):]
+		}
+	}
+	if path != "" {
+		line += ", " + path
+	}
+	return line
+}
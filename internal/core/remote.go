@@ -0,0 +1,265 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// tokenEnv is the environment variable holding the token for servers started with 'ssync serve'.
+const tokenEnv = "SSYNC_TOKEN"
+
+// isRemote reports whether a location names a directory on another machine rather than a local path:
+// the URL of a server started with 'ssync serve', or [user@]host:path for 'ssync agent' over SSH.
+func isRemote(location string) bool {
+	return isHTTP(location) || isSSH(location)
+}
+
+func isHTTP(location string) bool {
+	return strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://")
+}
+
+// remoteDirectory is a directory on another machine whose files can be listed and read.
+type remoteDirectory interface {
+	// fetchManifest returns the current manifest of the directory. Where the remote side
+	// hashes the files itself, it records block lists with blocks of blockSize (0 for none),
+	// or content-defined chunks of about blockSize if chunked is set.
+	fetchManifest(ctx context.Context, blockSize int64, chunked bool) (*sortedManifest, error)
+	// open returns the content of a file. Reading streams the whole file;
+	// ReadAt fetches the requested range only, so that delta transfers only download changed blocks.
+	open(ctx context.Context, relativePath string) sourceFile
+	Close() error
+}
+
+// openRemote connects to a remote directory, see isRemote.
+func openRemote(ctx context.Context, location string) (remoteDirectory, error) {
+	if isHTTP(location) {
+		return newHTTPDirectory(location)
+	}
+	return dialAgent(ctx, location)
+}
+
+// httpDirectory is a directory exposed by 'ssync serve', at a URL such as http://host:7878/.
+// The token is taken from $SSYNC_TOKEN rather than the URL, so that it does not end up in logs and process lists.
+type httpDirectory struct {
+	base   *url.URL
+	token  string
+	client *http.Client
+}
+
+func newHTTPDirectory(location string) (*httpDirectory, error) {
+	base, err := url.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL %s: %v", location, err)
+	}
+	if base.User != nil {
+		return nil, fmt.Errorf("invalid URL %s: give the token in $%s instead", base.Redacted(), tokenEnv)
+	}
+	base.Path = strings.TrimSuffix(base.Path, "/")
+	return &httpDirectory{base: base, token: os.Getenv(tokenEnv), client: http.DefaultClient}, nil
+}
+
+// get requests a path below the base URL. Non-2xx responses are returned as errors.
+func (t *httpDirectory) get(ctx context.Context, path string, header http.Header) (*http.Response, error) {
+	u := *t.base
+	u.Path += path
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if t.token != "" {
+		req.Header.Set("Authorization", "Bearer "+t.token)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %s: %s", u.Redacted(), resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+// fetchManifest downloads the current manifest of the directory. The server decides on the block lists.
+func (t *httpDirectory) fetchManifest(ctx context.Context, blockSize int64, chunked bool) (*sortedManifest, error) {
+	resp, err := t.get(ctx, "/manifest", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return downloadManifest(resp.Body)
+}
+
+// downloadManifest copies a manifest received from a remote directory to a temporary file and opens it.
+// Closing the returned manifest removes the temporary file.
+func downloadManifest(r io.Reader) (*sortedManifest, error) {
+	file, err := os.CreateTemp("", "ssync-remote-*.csv")
+	if err != nil {
+		return nil, fmt.Errorf("error creating temporary file: %v", err)
+	}
+	_, err = io.Copy(file, r)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return nil, fmt.Errorf("error downloading manifest: %v", err)
+	}
+
+	// The manifest is read twice: it is only used once its trailer has been verified,
+	// so that a truncated or edited manifest cannot cause any change.
+	if _, err := verifyManifest(file.Name()); err != nil {
+		os.Remove(file.Name())
+		return nil, err
+	}
+	manifest, err := openSortedManifest(file.Name())
+	if err != nil {
+		os.Remove(file.Name())
+		return nil, err
+	}
+	closeManifest := manifest.close
+	manifest.close = func() error {
+		err := closeManifest()
+		os.Remove(file.Name())
+		return err
+	}
+	return manifest, nil
+}
+
+// fileURLPath returns the URL path of a file of the remote directory.
+func fileURLPath(relativePath string) string {
+	return "/files/" + relativePath
+}
+
+func (t *httpDirectory) open(ctx context.Context, relativePath string) sourceFile {
+	return &httpFile{ctx: ctx, tree: t, path: relativePath}
+}
+
+func (t *httpDirectory) Close() error {
+	return nil
+}
+
+// httpFile is a file of a directory exposed by 'ssync serve', see remoteDirectory.open.
+type httpFile struct {
+	ctx  context.Context
+	tree *httpDirectory
+	path string
+	body io.ReadCloser // the response of a streaming read, once started
+}
+
+func (f *httpFile) Read(p []byte) (int, error) {
+	if f.body == nil {
+		resp, err := f.tree.get(f.ctx, fileURLPath(f.path), nil)
+		if err != nil {
+			return 0, err
+		}
+		f.body = resp.Body
+	}
+	return f.body.Read(p)
+}
+
+func (f *httpFile) ReadAt(p []byte, offset int64) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	header := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", offset, offset+int64(len(p))-1)}}
+	resp, err := f.tree.get(f.ctx, fileURLPath(f.path), header)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return 0, fmt.Errorf("server ignored range request for %s: %s", f.path, resp.Status)
+	}
+	n, err := io.ReadFull(resp.Body, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (f *httpFile) Close() error {
+	if f.body != nil {
+		return f.body.Close()
+	}
+	return nil
+}
+
+// openManifestLocation opens a manifest for merge-joining: a manifest file, or the current
+// manifest of a remote directory.
+func openManifestLocation(ctx context.Context, location string) (fileIterator, func(), error) {
+	if !isRemote(location) {
+		manifest, err := openSortedManifest(location)
+		if err != nil {
+			return nil, nil, err
+		}
+		return manifest, func() { manifest.Close() }, nil
+	}
+	_, manifest, closeRemote, err := openRemoteTree(ctx, location, nil, 0, false)
+	return manifest, closeRemote, err
+}
+
+// locationPath returns the path of a file below a local directory or a remote directory, for messages.
+func locationPath(location, relativePath string) string {
+	if isRemote(location) {
+		return strings.TrimSuffix(location, "/") + "/" + relativePath
+	}
+	return filepath.Join(location, filepath.FromSlash(relativePath))
+}
+
+// ignoringIterator leaves out the entries of a fileIterator that match ignore rules.
+type ignoringIterator struct {
+	fileIterator
+	ignore *ignoreRules
+}
+
+func (it *ignoringIterator) Next() (FileInfo, error) {
+	for {
+		fileInfo, err := it.fileIterator.Next()
+		if err != nil || !it.ignore.matchPath(fileInfo.Path) {
+			return fileInfo, err
+		}
+	}
+}
+
+// openTree lists the files below a local directory, like newDirWalker, or below a remote
+// directory, from its current manifest. visit is only called for local files:
+// the entries of a remote directory already carry their hashes.
+func openTree(ctx context.Context, location string, ignore *ignoreRules, onError func(path string, err error) error, visit func(path string, fileInfo *FileInfo) error) (fileIterator, func(), error) {
+	if !isRemote(location) {
+		walker := newDirWalker(location, ignore, onError, visit)
+		return walker, walker.Close, nil
+	}
+	_, files, closeRemote, err := openRemoteTree(ctx, location, ignore, 0, false)
+	return files, closeRemote, err
+}
+
+// openRemoteTree connects to a remote directory and lists its files from its current manifest,
+// leaving out ignored files. The returned function closes both.
+// blockSize and chunked select the block lists, see remoteDirectory.fetchManifest.
+func openRemoteTree(ctx context.Context, location string, ignore *ignoreRules, blockSize int64, chunked bool) (remoteDirectory, fileIterator, func(), error) {
+	remote, err := openRemote(ctx, location)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	manifest, err := remote.fetchManifest(ctx, blockSize, chunked)
+	if err != nil {
+		remote.Close()
+		return nil, nil, nil, fmt.Errorf("error fetching manifest of %s: %v", location, err)
+	}
+	closeRemote := func() {
+		manifest.Close()
+		remote.Close()
+	}
+	return remote, &ignoringIterator{fileIterator: manifest, ignore: ignore}, closeRemote, nil
+}
@@ -0,0 +1,253 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// maxReportedCollisions limits how many colliding paths a failed merge lists.
+const maxReportedCollisions = 10
+
+// RerootOptions configures SplitManifest and MergeManifests.
+type RerootOptions struct {
+	Force bool // overwrite the output manifest if it already exists
+	// KeepFileIDs keeps the NTFS file IDs. By default they are dropped, since file IDs are only unique
+	// within a volume and a re-rooted manifest usually describes files that were moved to another one;
+	// 'ssync update' records the IDs of the files where they are now.
+	KeepFileIDs bool
+}
+
+// MergeInput is a manifest to merge, with the directory its files go below ("" for the root).
+type MergeInput struct {
+	Path   string
+	Prefix string
+}
+
+// parseMergeInput parses "manifest:prefix" or just "manifest". A colon after a drive letter,
+// as in C:\manifest.csv, does not start a prefix.
+func parseMergeInput(arg string) MergeInput {
+	i := strings.LastIndex(arg, ":")
+	if i <= 1 {
+		return MergeInput{Path: arg}
+	}
+	return MergeInput{Path: arg[:i], Prefix: cleanSubtree(arg[i+1:])}
+}
+
+// SplitManifest writes a manifest of the files below dir (a path relative to the root of the manifest)
+// to outputPath, with paths relative to dir, so that it describes dir as a root of its own.
+// The hashes are kept, so the files do not have to be hashed again wherever dir is moved to.
+func SplitManifest(ctx context.Context, manifestPath, dir, outputPath string, opts RerootOptions) (*Manifest, error) {
+	dir = cleanSubtree(dir)
+	if dir == "" {
+		return nil, fmt.Errorf("give a directory below the root of the manifest")
+	}
+	manifest, err := openSortedManifest(manifestPath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest %s: %v", manifestPath, err)
+	}
+	defer manifest.Close()
+	file, err := createManifestFile(outputPath, opts.Force)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Abort()
+	writer, err := newManifestWriter(file.File)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		fileInfo, err := manifest.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading manifest %s: %v", manifestPath, err)
+		}
+		if !inSubtree(fileInfo.Path, dir) || fileInfo.Path == dir {
+			continue
+		}
+		fileInfo.Path = fileInfo.Path[len(dir)+1:]
+		if !opts.KeepFileIDs {
+			fileInfo.NTFSFileID = 0
+		}
+		if err := writer.Write(fileInfo); err != nil {
+			return nil, err
+		}
+	}
+	if writer.count == 0 {
+		return nil, fmt.Errorf("no files below %s in %s", dir, manifestPath)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	if err := file.Commit(); err != nil {
+		return nil, fmt.Errorf("error writing manifest file: %v", err)
+	}
+	return writer.manifest(outputPath), nil
+}
+
+// mergeSource is an input of MergeManifests with its next entry.
+type mergeSource struct {
+	MergeInput
+	manifest *sortedManifest
+	head     FileInfo
+	err      error
+}
+
+func (s *mergeSource) advance() {
+	s.head, s.err = s.manifest.Next()
+	if s.err == nil && s.Prefix != "" {
+		s.head.Path = s.Prefix + "/" + s.head.Path
+	}
+}
+
+// MergeManifests combines manifests into one at outputPath, putting the files of each below its prefix.
+// It fails without writing anything if two files end up at the same path, or a file where
+// another manifest has a directory.
+func MergeManifests(ctx context.Context, inputs []MergeInput, outputPath string, opts RerootOptions) (*Manifest, error) {
+	var sources []*mergeSource
+	defer func() {
+		for _, s := range sources {
+			s.manifest.Close()
+		}
+	}()
+	for _, input := range inputs {
+		manifest, err := openSortedManifest(input.Path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading manifest %s: %v", input.Path, err)
+		}
+		source := &mergeSource{MergeInput: input, manifest: manifest}
+		sources = append(sources, source)
+		source.advance()
+	}
+	file, err := createManifestFile(outputPath, opts.Force)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Abort()
+	writer, err := newManifestWriter(file.File)
+	if err != nil {
+		return nil, err
+	}
+
+	// Each step writes the smallest head in manifest order; any other source with the same path collides.
+	var collisions []string
+	collisionCount := 0
+	collide := func(format string, args ...any) {
+		collisionCount++
+		if len(collisions) < maxReportedCollisions {
+			collisions = append(collisions, fmt.Sprintf(format, args...))
+		}
+	}
+	var last *mergeSource // source and path of the entry before
+	lastPath := ""
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		var next *mergeSource
+		for _, s := range sources {
+			if s.err != nil && s.err != io.EOF {
+				return nil, fmt.Errorf("error reading manifest %s: %v", s.Path, s.err)
+			}
+			if s.err == nil && (next == nil || comparePaths(s.head.Path, next.head.Path) < 0) {
+				next = s
+			}
+		}
+		if next == nil {
+			break
+		}
+
+		fileInfo := next.head
+		for _, s := range sources {
+			if s != next && s.err == nil && s.head.Path == fileInfo.Path {
+				collide("%s is in both %s and %s", fileInfo.Path, next.Path, s.Path)
+				s.advance()
+			}
+		}
+		// A file sorts right before the files below a directory of the same name.
+		if last != nil && last != next && strings.HasPrefix(fileInfo.Path, lastPath+"/") {
+			collide("%s is a file in %s but a directory in %s", lastPath, last.Path, next.Path)
+		}
+		if !opts.KeepFileIDs {
+			fileInfo.NTFSFileID = 0
+		}
+		if collisionCount == 0 {
+			if err := writer.Write(fileInfo); err != nil {
+				return nil, err
+			}
+		}
+		last, lastPath = next, fileInfo.Path
+		next.advance()
+	}
+	if collisionCount > 0 {
+		return nil, fmt.Errorf("%d paths collide:\n  %s", collisionCount, strings.Join(collisions, "\n  "))
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	if err := file.Commit(); err != nil {
+		return nil, fmt.Errorf("error writing manifest file: %v", err)
+	}
+	return writer.manifest(outputPath), nil
+}
+
+// getRerootFlags reads the flags shared by 'manifest split' and 'manifest merge'.
+func getRerootFlags(cmd *cobra.Command) (output string, opts RerootOptions, err error) {
+	if output, err = cmd.Flags().GetString("output"); err != nil {
+		return "", opts, fmt.Errorf("error retrieving output flag: %v", err)
+	}
+	if opts.Force, err = cmd.Flags().GetBool("force"); err != nil {
+		return "", opts, fmt.Errorf("error retrieving force flag: %v", err)
+	}
+	if opts.KeepFileIDs, err = cmd.Flags().GetBool("keep-file-ids"); err != nil {
+		return "", opts, fmt.Errorf("error retrieving keep-file-ids flag: %v", err)
+	}
+	return output, opts, nil
+}
+
+func ManifestSplit(cmd *cobra.Command, args []string) error {
+	manifestPath := args[0]
+	dir := args[1]
+	output, opts, err := getRerootFlags(cmd)
+	if err != nil {
+		return err
+	}
+	logrus.Debugf("Executing 'manifest split' command with manifest: '%s', directory: '%s', output: '%s'", manifestPath, dir, output)
+
+	manifest, err := SplitManifest(cmd.Context(), manifestPath, dir, output, opts)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Manifest of %s written to %s: %d files, %s\n", dir, manifest.Path, manifest.Files, toFriendlySize(manifest.Bytes))
+	return nil
+}
+
+func ManifestMerge(cmd *cobra.Command, args []string) error {
+	output, opts, err := getRerootFlags(cmd)
+	if err != nil {
+		return err
+	}
+	var inputs []MergeInput
+	for _, arg := range args {
+		inputs = append(inputs, parseMergeInput(arg))
+	}
+	logrus.Debugf("Executing 'manifest merge' command with manifests: %+v, output: '%s'", inputs, output)
+
+	manifest, err := MergeManifests(cmd.Context(), inputs, output, opts)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Merged manifest written to %s: %d files, %s\n", manifest.Path, manifest.Files, toFriendlySize(manifest.Bytes))
+	return nil
+}
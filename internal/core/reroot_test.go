@@ -0,0 +1,120 @@
+package core
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseMergeInput(t *testing.T) {
+	for _, tt := range []struct {
+		arg  string
+		want MergeInput
+	}{
+		{"m.csv", MergeInput{Path: "m.csv"}},
+		{"m.csv:photos", MergeInput{Path: "m.csv", Prefix: "photos"}},
+		{"m.csv:/photos/2023/", MergeInput{Path: "m.csv", Prefix: "photos/2023"}},
+		{"m.csv:", MergeInput{Path: "m.csv"}},
+		{"m.csv:.", MergeInput{Path: "m.csv"}},
+		{"dir/m:2.csv:photos", MergeInput{Path: "dir/m:2.csv", Prefix: "photos"}},
+		{`C:\m.csv`, MergeInput{Path: `C:\m.csv`}},
+		{`C:\m.csv:photos`, MergeInput{Path: `C:\m.csv`, Prefix: "photos"}},
+	} {
+		if got := parseMergeInput(tt.arg); got != tt.want {
+			t.Errorf("parseMergeInput(%q) = %+v, want %+v", tt.arg, got, tt.want)
+		}
+	}
+}
+
+func TestSplitMergeRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	entry := func(path string, fileID uint64) FileInfo {
+		return FileInfo{Path: path, ModifiedTime: time.Unix(1700000000, 0), Size: int64(len(path)), Hash: md5Hex(path), NTFSFileID: fileID}
+	}
+	manifestPath := filepath.Join(dir, "all.csv")
+	all := []FileInfo{entry("docs/a.txt", 1), entry("docs/sub/b.txt", 2), entry("docs.txt", 3), entry("photos/c.jpg", 4), entry("photos/d.jpg", 5)}
+	writeTestManifest(t, manifestPath, all)
+
+	docsPath := filepath.Join(dir, "docs.csv")
+	if _, err := SplitManifest(context.Background(), manifestPath, "docs", docsPath, RerootOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	photosPath := filepath.Join(dir, "photos.csv")
+	if _, err := SplitManifest(context.Background(), manifestPath, "/photos/", photosPath, RerootOptions{KeepFileIDs: true}); err != nil {
+		t.Fatal(err)
+	}
+	docs, err := readManifest(docsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 2 || docs[0].Path != "a.txt" || docs[1].Path != "sub/b.txt" || docs[0].Hash != all[0].Hash || docs[0].NTFSFileID != 0 {
+		t.Errorf("split manifest of docs = %v", docs)
+	}
+
+	// Merging the parts back below their directories gives the original manifest, less docs.txt.
+	rootPath := filepath.Join(dir, "root.csv")
+	writeTestManifest(t, rootPath, []FileInfo{entry("docs.txt", 3)})
+	mergedPath := filepath.Join(dir, "merged.csv.gz")
+	manifest, err := MergeManifests(context.Background(), []MergeInput{{Path: photosPath, Prefix: "photos"}, {Path: rootPath}, {Path: docsPath, Prefix: "docs"}}, mergedPath, RerootOptions{KeepFileIDs: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	merged, err := readManifest(mergedPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append([]FileInfo{}, all...)
+	want[0].NTFSFileID, want[1].NTFSFileID = 0, 0
+	if !reflect.DeepEqual(merged, want) || manifest.Files != len(want) {
+		t.Errorf("merged manifest = %v, want %v", merged, want)
+	}
+
+	if _, err := SplitManifest(context.Background(), manifestPath, "missing", filepath.Join(dir, "missing.csv"), RerootOptions{}); err == nil {
+		t.Error("splitting off a missing directory succeeded")
+	}
+}
+
+func TestMergeCollisions(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, paths ...string) string {
+		var entries []FileInfo
+		for _, p := range paths {
+			entries = append(entries, FileInfo{Path: p, Size: 1, Hash: md5Hex(p)})
+		}
+		path := filepath.Join(dir, name)
+		writeTestManifest(t, path, entries)
+		return path
+	}
+	first := write("first.csv", "a.txt", "dir/b.txt")
+	second := write("second.csv", "a.txt", "c.txt")
+	file := write("file.csv", "x", "y")
+	tree := write("tree.csv", "x/a.txt")
+
+	for _, tt := range []struct {
+		name   string
+		inputs []MergeInput
+		want   string
+	}{
+		{"same file", []MergeInput{{Path: first}, {Path: second}}, "a.txt is in both"},
+		{"same file below a prefix", []MergeInput{{Path: first, Prefix: "p"}, {Path: second, Prefix: "p"}}, "p/a.txt is in both"},
+		{"file and directory", []MergeInput{{Path: file}, {Path: tree}}, "x is a file"},
+		{"file and directory of a prefix", []MergeInput{{Path: file}, {Path: second, Prefix: "y"}}, "y is a file"},
+	} {
+		output := filepath.Join(dir, strings.ReplaceAll(tt.name, " ", "-")+".csv")
+		if _, err := MergeManifests(context.Background(), tt.inputs, output, RerootOptions{}); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: error %v, want one containing %q", tt.name, err, tt.want)
+		}
+		if _, err := os.Stat(output); err == nil {
+			t.Errorf("%s: the failed merge wrote %s", tt.name, output)
+		}
+	}
+
+	output := filepath.Join(dir, "prefixed.csv")
+	if _, err := MergeManifests(context.Background(), []MergeInput{{Path: first, Prefix: "one"}, {Path: second, Prefix: "two"}}, output, RerootOptions{}); err != nil {
+		t.Errorf("merging below different prefixes: %v", err)
+	}
+}
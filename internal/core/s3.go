@@ -0,0 +1,203 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+const (
+	// s3EndpointEnv selects the S3-compatible service, e.g. http://127.0.0.1:9000 for a local stand-in.
+	s3EndpointEnv     = "SSYNC_S3_ENDPOINT"
+	defaultS3Endpoint = "https://s3.amazonaws.com"
+	// s3ManifestName is the name of the manifest object below the prefix of the destination.
+	s3ManifestName = ".ssync-manifest.csv.zst"
+	// s3PartSize is the part size of multipart uploads, which are used for files larger than one part.
+	s3PartSize = 16 * 1024 * 1024
+	// s3MaxCopySize is the largest object a single copy request can copy.
+	s3MaxCopySize = 5 * 1024 * 1024 * 1024
+	// Object metadata holding the MD5 hash and the modified time (Unix seconds) of a file.
+	s3HashMetadata     = "Ssync-Hash"
+	s3ModifiedMetadata = "Ssync-Modified"
+)
+
+// s3Destination is a sync destination in an S3 bucket, at a location such as s3://bucket/prefix.
+// Each file is an object named by its relative path below the prefix, with its hash and
+// modified time in the object metadata. The manifest of the destination is an object as well.
+//
+// Credentials are taken from $AWS_ACCESS_KEY_ID and $AWS_SECRET_ACCESS_KEY, ~/.aws/credentials
+// or the instance role, the region from $AWS_REGION and the endpoint from $SSYNC_S3_ENDPOINT.
+type s3Destination struct {
+	store  objectStore
+	bucket string
+	prefix string // empty, or ending with "/"
+}
+
+// objectStore is the bucket of an S3-compatible service, as far as s3Destination uses it.
+type objectStore interface {
+	bucketExists(ctx context.Context) (bool, error)
+	// get returns the content of an object, or errNoSuchObject.
+	get(ctx context.Context, key string) (io.ReadCloser, error)
+	put(ctx context.Context, key string, r io.Reader, size int64, metadata map[string]string, contentType string) error
+	// setMetadata replaces the metadata of an object of the given size.
+	setMetadata(ctx context.Context, key string, size int64, metadata map[string]string) error
+	remove(ctx context.Context, key string) error
+}
+
+// errNoSuchObject is returned by objectStore.get for a key that has no object.
+var errNoSuchObject = errors.New("no such object")
+
+func newS3Destination(location string) (*s3Destination, error) {
+	bucket, prefix, _ := strings.Cut(strings.TrimPrefix(location, "s3://"), "/")
+	if bucket == "" {
+		return nil, fmt.Errorf("invalid location %s: expected s3://bucket/prefix", location)
+	}
+	if prefix = strings.Trim(prefix, "/"); prefix != "" {
+		prefix += "/"
+	}
+
+	endpoint := os.Getenv(s3EndpointEnv)
+	if endpoint == "" {
+		endpoint = defaultS3Endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid %s %q: expected a URL such as https://s3.amazonaws.com", s3EndpointEnv, endpoint)
+	}
+	creds := credentials.NewChainCredentials([]credentials.Provider{
+		&credentials.EnvAWS{},
+		&credentials.EnvMinio{},
+		&credentials.FileAWSCredentials{},
+		&credentials.IAM{},
+	})
+	client, err := minio.New(u.Host, &minio.Options{Creds: creds, Secure: u.Scheme == "https", Region: os.Getenv("AWS_REGION")})
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to %s: %v", endpoint, err)
+	}
+	return &s3Destination{store: &minioStore{client: client, bucket: bucket}, bucket: bucket, prefix: prefix}, nil
+}
+
+func (d *s3Destination) key(relativePath string) string {
+	return d.prefix + relativePath
+}
+
+func (d *s3Destination) manifestName() string {
+	return s3ManifestName
+}
+
+// fetchManifest downloads the manifest object. It is only used if its integrity trailer verifies.
+func (d *s3Destination) fetchManifest(ctx context.Context) (fileIterator, func(), error) {
+	// Checked first, so that a mistyped bucket fails once rather than once per file.
+	if exists, err := d.store.bucketExists(ctx); err != nil {
+		return nil, nil, err
+	} else if !exists {
+		return nil, nil, fmt.Errorf("bucket %s does not exist", d.bucket)
+	}
+	object, err := d.store.get(ctx, d.key(s3ManifestName))
+	if err == errNoSuchObject {
+		return &sliceIterator{}, func() {}, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	defer object.Close()
+	manifest, err := downloadManifest(object)
+	if err != nil {
+		return nil, nil, err
+	}
+	return manifest, func() { manifest.Close() }, nil
+}
+
+// metadata returns the object metadata for a file.
+func (d *s3Destination) metadata(fileInfo FileInfo) map[string]string {
+	return map[string]string{
+		s3HashMetadata:     fileInfo.Hash,
+		s3ModifiedMetadata: strconv.FormatInt(fileInfo.ModifiedTime.Unix(), 10),
+	}
+}
+
+func (d *s3Destination) upload(ctx context.Context, fileInfo FileInfo, r io.Reader) error {
+	return d.store.put(ctx, d.key(fileInfo.Path), r, fileInfo.Size, d.metadata(fileInfo), "application/octet-stream")
+}
+
+func (d *s3Destination) touch(ctx context.Context, fileInfo FileInfo) error {
+	return d.store.setMetadata(ctx, d.key(fileInfo.Path), fileInfo.Size, d.metadata(fileInfo))
+}
+
+func (d *s3Destination) remove(ctx context.Context, relativePath string) error {
+	return d.store.remove(ctx, d.key(relativePath))
+}
+
+func (d *s3Destination) storeManifest(ctx context.Context, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	return d.store.put(ctx, d.key(s3ManifestName), file, info.Size(), nil, "application/zstd")
+}
+
+// minioStore is an objectStore backed by a bucket of an S3-compatible service.
+type minioStore struct {
+	client *minio.Client
+	bucket string
+}
+
+func (m *minioStore) bucketExists(ctx context.Context) (bool, error) {
+	return m.client.BucketExists(ctx, m.bucket)
+}
+
+func (m *minioStore) get(ctx context.Context, key string) (io.ReadCloser, error) {
+	object, err := m.client.GetObject(ctx, m.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	// GetObject is lazy: a missing object only shows when it is first accessed.
+	if _, err := object.Stat(); err != nil {
+		object.Close()
+		if minio.ToErrorResponse(err).Code == minio.NoSuchKey {
+			return nil, errNoSuchObject
+		}
+		return nil, err
+	}
+	return object, nil
+}
+
+func (m *minioStore) put(ctx context.Context, key string, r io.Reader, size int64, metadata map[string]string, contentType string) error {
+	_, err := m.client.PutObject(ctx, m.bucket, key, r, size, minio.PutObjectOptions{
+		UserMetadata: metadata,
+		ContentType:  contentType,
+		PartSize:     s3PartSize,
+	})
+	return err
+}
+
+// setMetadata replaces the metadata of an object by copying it onto itself on the server.
+// Objects larger than a single copy request allows are copied in parts.
+func (m *minioStore) setMetadata(ctx context.Context, key string, size int64, metadata map[string]string) error {
+	dst := minio.CopyDestOptions{Bucket: m.bucket, Object: key, UserMetadata: metadata, ReplaceMetadata: true}
+	src := minio.CopySrcOptions{Bucket: m.bucket, Object: key}
+	var err error
+	if size <= s3MaxCopySize {
+		_, err = m.client.CopyObject(ctx, dst, src)
+	} else {
+		_, err = m.client.ComposeObject(ctx, dst, src)
+	}
+	return err
+}
+
+func (m *minioStore) remove(ctx context.Context, key string) error {
+	return m.client.RemoveObject(ctx, m.bucket, key, minio.RemoveObjectOptions{})
+}
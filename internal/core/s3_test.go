@@ -0,0 +1,216 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeStore is an in-memory objectStore, a local stand-in for an S3 bucket.
+type fakeStore struct {
+	objects map[string]fakeObject
+}
+
+type fakeObject struct {
+	data     []byte
+	metadata map[string]string
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{objects: map[string]fakeObject{}}
+}
+
+func (s *fakeStore) bucketExists(ctx context.Context) (bool, error) {
+	return true, nil
+}
+
+func (s *fakeStore) get(ctx context.Context, key string) (io.ReadCloser, error) {
+	object, ok := s.objects[key]
+	if !ok {
+		return nil, errNoSuchObject
+	}
+	return io.NopCloser(bytes.NewReader(object.data)), nil
+}
+
+func (s *fakeStore) put(ctx context.Context, key string, r io.Reader, size int64, metadata map[string]string, contentType string) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) != size {
+		return io.ErrUnexpectedEOF
+	}
+	s.objects[key] = fakeObject{data: data, metadata: metadata}
+	return nil
+}
+
+func (s *fakeStore) setMetadata(ctx context.Context, key string, size int64, metadata map[string]string) error {
+	object, ok := s.objects[key]
+	if !ok {
+		return errNoSuchObject
+	}
+	object.metadata = metadata
+	s.objects[key] = object
+	return nil
+}
+
+func (s *fakeStore) remove(ctx context.Context, key string) error {
+	delete(s.objects, key)
+	return nil
+}
+
+// syncToBackend runs a sync of srcDir to backend and returns what it did.
+func syncToBackend(t *testing.T, srcDir string, backend destinationBackend, deleteFiles bool) (syncStats, error) {
+	t.Helper()
+	walker := newDirWalker(srcDir, nil, nil, nil)
+	defer walker.Close()
+	var stats syncStats
+	s := &backendSync{
+		backend:    backend,
+		source:     localSource(srcDir),
+		srcCursor:  newManifestCursor(&sliceIterator{}),
+		srcSkipped: walker.skipped,
+		delete:     deleteFiles,
+		fail:       func(path string, err error) error { return err },
+		printer:    &eventPrinter{w: io.Discard, progress: io.Discard, mode: progressNone},
+		stats:      &stats,
+		progress:   &ProgressEvent{Stage: StageSync},
+	}
+	err := s.run(context.Background(), walker)
+	return stats, err
+}
+
+func TestS3DestinationSync(t *testing.T) {
+	src := t.TempDir()
+	writeTestFiles(t, src, map[string]string{"a.txt": "alpha", "dir/b.txt": "bravo"})
+	store := newFakeStore()
+	backend := &s3Destination{store: store, bucket: "bucket", prefix: "backup/"}
+
+	stats, err := syncToBackend(t, src, backend, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.copied != 2 {
+		t.Errorf("copied %d files, want 2", stats.copied)
+	}
+	for path, content := range map[string]string{"a.txt": "alpha", "dir/b.txt": "bravo"} {
+		object, ok := store.objects["backup/"+path]
+		if !ok {
+			t.Fatalf("no object for %s", path)
+		}
+		if string(object.data) != content || object.metadata[s3HashMetadata] != md5Hex(content) {
+			t.Errorf("object for %s = %q with hash %s", path, object.data, object.metadata[s3HashMetadata])
+		}
+	}
+
+	// The stored manifest describes the bucket, and is what the next sync compares with.
+	manifest, closeManifest, err := backend.fetchManifest(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := collect(t, manifest)
+	closeManifest()
+	if len(entries) != 2 || entries[0].Path != "a.txt" || entries[1].Path != "dir/b.txt" || entries[1].Hash != md5Hex("bravo") {
+		t.Errorf("stored manifest = %v", entries)
+	}
+
+	stats, err = syncToBackend(t, src, backend, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.copied != 0 {
+		t.Errorf("an unchanged source copied %d files", stats.copied)
+	}
+
+	// A changed file is uploaded again and a deleted one is removed.
+	writeTestFiles(t, src, map[string]string{"a.txt": "alpha, changed"})
+	if err := os.Remove(filepath.Join(src, "dir", "b.txt")); err != nil {
+		t.Fatal(err)
+	}
+	stats, err = syncToBackend(t, src, backend, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.copied != 1 || stats.deleted != 1 {
+		t.Errorf("copied %d and deleted %d files, want 1 and 1", stats.copied, stats.deleted)
+	}
+	if _, ok := store.objects["backup/dir/b.txt"]; ok {
+		t.Error("deleted file is still in the bucket")
+	}
+	if got := string(store.objects["backup/a.txt"].data); got != "alpha, changed" {
+		t.Errorf("changed file = %q", got)
+	}
+
+	// Only the modified time changed: the object's metadata is replaced, its content is not uploaded.
+	modified := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(filepath.Join(src, "a.txt"), modified, modified); err != nil {
+		t.Fatal(err)
+	}
+	stats, err = syncToBackend(t, src, backend, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.copied != 0 || store.objects["backup/a.txt"].metadata[s3ModifiedMetadata] != strconv.FormatInt(modified.Unix(), 10) {
+		t.Errorf("touching copied %d files, metadata %v", stats.copied, store.objects["backup/a.txt"].metadata)
+	}
+}
+
+func TestS3DestinationUntrustedManifest(t *testing.T) {
+	entries := []FileInfo{
+		{Path: "a.txt", ModifiedTime: time.Unix(1700000000, 0), Size: 5, Hash: md5Hex("alpha")},
+		{Path: "b.txt", ModifiedTime: time.Unix(1700000000, 0), Size: 5, Hash: md5Hex("bravo")},
+	}
+	manifestPath := filepath.Join(t.TempDir(), "m.csv")
+	writeTestManifest(t, manifestPath, entries)
+	valid, err := os.ReadFile(manifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitAfter(string(valid), "\n")
+
+	for _, tt := range []struct {
+		name     string
+		manifest string
+		want     string
+	}{
+		{"edited", strings.Replace(string(valid), ",5,", ",6,", 1), "corrupt"},
+		{"truncated", strings.Join(lines[:len(lines)-2], ""), "truncated"},
+		{"entry removed", lines[0] + lines[2] + lines[3], "corrupt"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newFakeStore()
+			store.objects[s3ManifestName] = fakeObject{data: []byte(tt.manifest)}
+			backend := &s3Destination{store: store, bucket: "bucket"}
+			if _, _, err := backend.fetchManifest(context.Background()); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("fetchManifest error = %v, want one containing %q", err, tt.want)
+			}
+
+			// A sync does not act on the manifest: nothing is uploaded or deleted.
+			src := t.TempDir()
+			writeTestFiles(t, src, map[string]string{"c.txt": "charlie"})
+			if _, err := syncToBackend(t, src, backend, true); err == nil {
+				t.Error("sync with an untrusted manifest succeeded")
+			}
+			if len(store.objects) != 1 || string(store.objects[s3ManifestName].data) != tt.manifest {
+				t.Errorf("sync with an untrusted manifest changed the bucket: %d objects", len(store.objects))
+			}
+		})
+	}
+
+	store := newFakeStore()
+	store.objects[s3ManifestName] = fakeObject{data: valid}
+	manifest, closeManifest, err := (&s3Destination{store: store, bucket: "bucket"}).fetchManifest(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeManifest()
+	if got := collect(t, manifest); len(got) != 2 {
+		t.Errorf("valid manifest has %d entries, want 2", len(got))
+	}
+}
@@ -0,0 +1,72 @@
+package core
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+)
+
+// sampler picks a random sample of files, either a fixed fraction of them
+// or as many as fit into a byte budget.
+type sampler struct {
+	rate   float64
+	budget int64 // 0 for a fraction
+	used   int64
+}
+
+// parseVerifySample parses "5%" (a fraction of the files) or a size such as "10G" (a byte budget).
+// An empty string means no sampling.
+func parseVerifySample(s string) (rate float64, budget int64, err error) {
+	if s == "" {
+		return 0, 0, nil
+	}
+	if percent, ok := strings.CutSuffix(s, "%"); ok {
+		value, err := strconv.ParseFloat(percent, 64)
+		if err != nil || value < 0 || value > 100 {
+			return 0, 0, fmt.Errorf("invalid percentage %q", s)
+		}
+		return value / 100, 0, nil
+	}
+	budget, err = parseSize(s)
+	if err != nil {
+		return 0, 0, err
+	}
+	return 0, budget, nil
+}
+
+// newSampler returns a sampler for a fraction of the files or, if budget is set, a byte budget.
+// It returns nil if there is nothing to sample.
+func newSampler(rate float64, budget int64) *sampler {
+	switch {
+	case budget > 0:
+		return &sampler{budget: budget}
+	case rate > 0:
+		return &sampler{rate: min(rate, 1)}
+	default:
+		return nil
+	}
+}
+
+// prepare sets the sampling rate for a byte budget, given the total size of the files to sample from.
+func (s *sampler) prepare(totalBytes int64) {
+	if s.budget == 0 {
+		return
+	}
+	s.rate = 1
+	if totalBytes > s.budget {
+		s.rate = float64(s.budget) / float64(totalBytes)
+	}
+}
+
+// pick decides whether a file of the given size is part of the sample.
+func (s *sampler) pick(size int64) bool {
+	if s.budget > 0 && s.used >= s.budget {
+		return false
+	}
+	if rand.Float64() >= s.rate {
+		return false
+	}
+	s.used += size
+	return true
+}
@@ -0,0 +1,257 @@
+package core
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// ServeOptions configures ServeDirectory.
+type ServeOptions struct {
+	Token          string   // required as "Authorization: Bearer <token>" on every request, no authentication if empty
+	BlockSize      int64    // record block lists with blocks of this size, so that clients can transfer deltas, 0 for none
+	ContentDefined bool     // record content-defined chunks of about BlockSize instead of fixed-size blocks
+	Ignore         []string // leave out files and directories matching these patterns (see ignoreRules)
+	OnError        ErrorPolicy
+	Events         EventHandler
+}
+
+// directoryServer is the HTTP handler of ServeDirectory.
+type directoryServer struct {
+	root         string
+	manifestPath string
+	opts         ServeOptions
+	ignore       *ignoreRules
+	files        *os.Root
+	mu           sync.Mutex // serializes manifest updates, and keeps the manifest file in place while it is sent
+}
+
+// ServeDirectory exposes root over HTTP on listener until ctx is cancelled:
+//
+//	GET /manifest       the manifest of root, brought up to date like UpdateManifest first
+//	GET /files/<path>   the content of a file, with support for range requests
+//
+// The manifest is kept at manifestPath and created like CreateManifest if it does not exist.
+// Clients such as 'ssync compare', 'ssync diff' and 'ssync sync' use the URL of the server
+// in place of a local directory.
+func ServeDirectory(ctx context.Context, root, manifestPath string, listener net.Listener, opts ServeOptions) error {
+	s, err := newDirectoryServer(ctx, root, manifestPath, opts)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	server := &http.Server{Handler: s.handler(), BaseContext: func(net.Listener) context.Context { return ctx }}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+	err = server.Serve(listener)
+	if errors.Is(err, http.ErrServerClosed) {
+		<-done
+		return nil
+	}
+	return err
+}
+
+// newDirectoryServer opens root and creates its manifest if there is none yet.
+func newDirectoryServer(ctx context.Context, root, manifestPath string, opts ServeOptions) (*directoryServer, error) {
+	ignore, err := newIgnoreRules(opts.Ignore)
+	if err != nil {
+		return nil, err
+	}
+	files, err := os.OpenRoot(root)
+	if err != nil {
+		return nil, fmt.Errorf("error opening %s: %v", root, err)
+	}
+
+	s := &directoryServer{root: root, manifestPath: manifestPath, opts: opts, ignore: ignore, files: files}
+	if _, err := os.Stat(manifestPath); err != nil {
+		_, err := CreateManifest(ctx, root, manifestPath, CreateOptions{
+			BlockSize:      opts.BlockSize,
+			ContentDefined: opts.ContentDefined,
+			Ignore:         opts.Ignore,
+			OnError:        opts.OnError,
+			Events:         opts.Events,
+		})
+		if err != nil {
+			files.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// handler routes the requests of ServeDirectory.
+func (s *directoryServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /manifest", s.serveManifest)
+	mux.HandleFunc("GET /files/{path...}", s.serveFile)
+	return s.authenticate(mux)
+}
+
+func (s *directoryServer) Close() error {
+	return s.files.Close()
+}
+
+// authenticate rejects requests without the token, if there is one.
+func (s *directoryServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logrus.WithFields(logrus.Fields{"method": r.Method, "path": r.URL.Path, "remote": r.RemoteAddr}).Debug("Request")
+		if s.opts.Token != "" {
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.opts.Token)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "invalid or missing token", http.StatusUnauthorized)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// serveManifest brings the manifest up to date and sends it.
+func (s *directoryServer) serveManifest(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Unchanged files are not worth an event each.
+	events := func(e Event) {
+		if change, ok := e.(*ChangeEvent); ok && change.Change == ChangeUnchanged {
+			return
+		}
+		s.opts.Events.emit(e)
+	}
+	_, err := UpdateManifest(r.Context(), s.root, s.manifestPath, UpdateOptions{
+		BlockSize:      s.opts.BlockSize,
+		ContentDefined: s.opts.ContentDefined,
+		Ignore:         s.opts.Ignore,
+		OnError:        s.opts.OnError,
+		Events:         events,
+	})
+	if err != nil {
+		logrus.WithError(err).Error("Error updating manifest")
+		http.Error(w, "error updating manifest", http.StatusInternalServerError)
+		return
+	}
+
+	file, err := os.Open(s.manifestPath)
+	if err != nil {
+		logrus.WithError(err).Error("Error opening manifest")
+		http.Error(w, "error opening manifest", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		http.Error(w, "error opening manifest", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, "", info.ModTime(), file)
+}
+
+// serveFile sends the content of a file below root. Paths that leave root, or that are ignored, are not found.
+func (s *directoryServer) serveFile(w http.ResponseWriter, r *http.Request) {
+	relativePath := r.PathValue("path")
+	if relativePath == "" || !fs.ValidPath(relativePath) || s.ignore.matchPath(relativePath) {
+		http.NotFound(w, r)
+		return
+	}
+	file, err := s.files.Open(relativePath)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, "", info.ModTime(), file)
+}
+
+// Serve runs 'ssync serve'. The token is taken from --token or $SSYNC_TOKEN; one of them is required.
+func Serve(cmd *cobra.Command, args []string) error {
+	directoryPath := args[0]
+	manifestPath := args[1]
+	address, err := cmd.Flags().GetString("listen")
+	if err != nil {
+		return fmt.Errorf("error retrieving listen flag: %v", err)
+	}
+	token, err := cmd.Flags().GetString("token")
+	if err != nil {
+		return fmt.Errorf("error retrieving token flag: %v", err)
+	}
+	if token == "" {
+		token = os.Getenv(tokenEnv)
+	}
+	if token == "" {
+		return fmt.Errorf("a token is required: give it with --token or $%s", tokenEnv)
+	}
+	blockSize, err := getSizeFlag(cmd, "block-size")
+	if err != nil {
+		return fmt.Errorf("invalid block-size flag: %v", err)
+	}
+	contentDefined, err := cmd.Flags().GetBool("content-defined")
+	if err != nil {
+		return fmt.Errorf("error retrieving content-defined flag: %v", err)
+	}
+	ignore, err := getIgnoreFlag(cmd)
+	if err != nil {
+		return err
+	}
+	policy, err := getErrorPolicyFlag(cmd)
+	if err != nil {
+		return err
+	}
+	logrus.Debugf("Executing 'serve' command with directory: '%s', manifest: '%s', address: '%s'", directoryPath, manifestPath, address)
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("error listening on %s: %v", address, err)
+	}
+	printer, err := newEventPrinter(cmd, os.Stdout)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	fmt.Printf("Serving %s on http://%s/, press Ctrl-C to stop.\n", directoryPath, listener.Addr())
+	err = ServeDirectory(cmd.Context(), directoryPath, manifestPath, listener, ServeOptions{
+		Token:          token,
+		BlockSize:      blockSize,
+		ContentDefined: contentDefined,
+		Ignore:         ignore,
+		OnError:        policy,
+		Events: func(e Event) {
+			if change, ok := e.(*ChangeEvent); ok {
+				printer.printf("[%s] %s: %s\n", change.Change, change.Path, change.Reason)
+				return
+			}
+			printer.handle(e)
+		},
+	})
+	printer.done()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Stopped serving %s\n", directoryPath)
+	return printer.errorReport()
+}
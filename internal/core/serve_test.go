@@ -0,0 +1,185 @@
+package core
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testToken = "secret-token"
+
+// startTestServer serves root like ServeDirectory, with testToken, on a loopback address.
+func startTestServer(t *testing.T, root string, opts ServeOptions) *httptest.Server {
+	t.Helper()
+	opts.Token = testToken
+	s, err := newDirectoryServer(context.Background(), root, filepath.Join(t.TempDir(), "served.csv"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(s.handler())
+	t.Cleanup(func() {
+		server.Close()
+		s.Close()
+	})
+	return server
+}
+
+// get requests path from server with the given Authorization header, if any, and returns the status and body.
+func get(t *testing.T, server *httptest.Server, path, authorization string, header http.Header) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, server.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func TestServeAuthentication(t *testing.T) {
+	root := t.TempDir()
+	writeTestFiles(t, root, map[string]string{"a.txt": "alpha"})
+	server := startTestServer(t, root, ServeOptions{})
+
+	for _, path := range []string{"/files/a.txt", "/manifest"} {
+		for _, authorization := range []string{"", "Bearer wrong", "Bearer " + testToken + "x", "Basic " + testToken, testToken} {
+			if status, body := get(t, server, path, authorization, nil); status != http.StatusUnauthorized || strings.Contains(body, "alpha") {
+				t.Errorf("GET %s with Authorization %q: status %d, want 401", path, authorization, status)
+			}
+		}
+	}
+	if status, body := get(t, server, "/files/a.txt", "Bearer "+testToken, nil); status != http.StatusOK || body != "alpha" {
+		t.Errorf("GET with the token: status %d, body %q", status, body)
+	}
+}
+
+func TestServeRange(t *testing.T) {
+	root := t.TempDir()
+	writeTestFiles(t, root, map[string]string{"dir/digits.txt": "0123456789"})
+	server := startTestServer(t, root, ServeOptions{})
+
+	for _, tt := range []struct {
+		rangeHeader string
+		status      int
+		body        string
+	}{
+		{"bytes=2-4", http.StatusPartialContent, "234"},
+		{"bytes=7-", http.StatusPartialContent, "789"},
+		{"bytes=-2", http.StatusPartialContent, "89"},
+		{"bytes=20-30", http.StatusRequestedRangeNotSatisfiable, ""},
+	} {
+		status, body := get(t, server, "/files/dir/digits.txt", "Bearer "+testToken, http.Header{"Range": {tt.rangeHeader}})
+		if status != tt.status || (tt.body != "" && body != tt.body) {
+			t.Errorf("Range %s: status %d, body %q, want %d, %q", tt.rangeHeader, status, body, tt.status, tt.body)
+		}
+	}
+
+	// The client of remote.go reads ranges for delta transfers.
+	t.Setenv(tokenEnv, testToken)
+	remote, err := newHTTPDirectory(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := remote.open(context.Background(), "dir/digits.txt")
+	defer file.Close()
+	buf := make([]byte, 4)
+	if n, err := file.ReadAt(buf, 3); err != nil || string(buf[:n]) != "3456" {
+		t.Errorf("ReadAt(3) = %q, %v", buf[:n], err)
+	}
+	if n, err := file.ReadAt(buf, 8); err != io.EOF || string(buf[:n]) != "89" {
+		t.Errorf("ReadAt(8) = %q, %v, want \"89\", EOF", buf[:n], err)
+	}
+}
+
+func TestServePathTraversal(t *testing.T) {
+	parent := t.TempDir()
+	root := filepath.Join(parent, "root")
+	writeTestFiles(t, parent, map[string]string{"outside.txt": "outside", "root/a.txt": "alpha", "root/dir/b.txt": "bravo", "root/cache.tmp": "ignored"})
+	server := startTestServer(t, root, ServeOptions{Ignore: []string{"*.tmp"}})
+
+	for _, path := range []string{
+		"/files/../outside.txt",
+		"/files/%2e%2e/outside.txt",
+		"/files/dir/../../outside.txt",
+		"/files/dir/..%2f..%2foutside.txt",
+		"/files/%2e%2e%2foutside.txt",
+		"/files/" + filepath.ToSlash(filepath.Join(parent, "outside.txt")),
+		"/files/dir",
+		"/files/",
+		"/files/cache.tmp",
+	} {
+		if status, body := get(t, server, path, "Bearer "+testToken, nil); status == http.StatusOK || strings.Contains(body, "outside") || strings.Contains(body, "ignored") {
+			t.Errorf("GET %s: status %d, body %q", path, status, body)
+		}
+	}
+	if status, body := get(t, server, "/files/dir/b.txt", "Bearer "+testToken, nil); status != http.StatusOK || body != "bravo" {
+		t.Errorf("GET /files/dir/b.txt: status %d, body %q", status, body)
+	}
+
+	// A symbolic link may not lead out of the root either.
+	if err := os.Symlink(filepath.Join(parent, "outside.txt"), filepath.Join(root, "link.txt")); err == nil {
+		if status, body := get(t, server, "/files/link.txt", "Bearer "+testToken, nil); status == http.StatusOK || strings.Contains(body, "outside") {
+			t.Errorf("GET /files/link.txt: status %d, body %q", status, body)
+		}
+	}
+}
+
+func TestServeManifest(t *testing.T) {
+	root := t.TempDir()
+	writeTestFiles(t, root, map[string]string{"a.txt": "alpha", "dir/b.txt": "bravo"})
+	server := startTestServer(t, root, ServeOptions{})
+
+	t.Setenv(tokenEnv, testToken)
+	remote, err := newHTTPDirectory(server.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := remote.fetchManifest(context.Background(), 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := collect(t, manifest)
+	manifest.Close()
+	if len(entries) != 2 || entries[0].Path != "a.txt" || entries[0].Hash != md5Hex("alpha") || entries[1].Path != "dir/b.txt" {
+		t.Errorf("manifest = %v", entries)
+	}
+
+	// Each request brings the manifest up to date first.
+	writeTestFiles(t, root, map[string]string{"c.txt": "charlie"})
+	manifest, err = remote.fetchManifest(context.Background(), 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries = collect(t, manifest)
+	manifest.Close()
+	if len(entries) != 3 || entries[1].Path != "c.txt" || entries[1].Hash != md5Hex("charlie") {
+		t.Errorf("updated manifest = %v", entries)
+	}
+
+	t.Setenv(tokenEnv, "wrong")
+	remote, err = newHTTPDirectory(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := remote.fetchManifest(context.Background(), 0, false); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("fetching with a wrong token: %v, want a 401 error", err)
+	}
+}
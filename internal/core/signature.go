@@ -0,0 +1,270 @@
+package core
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// signedMessage is what a manifest signature covers. The trailer digest already
+// covers every entry, so the manifest does not have to be hashed a second time,
+// and the signature stays valid if the manifest is recompressed.
+func signedMessage(trailer manifestTrailer) []byte {
+	return []byte(fmt.Sprintf("ssync-manifest-v1\n%d\n%s\n", trailer.Count, trailer.Digest))
+}
+
+// verifyManifest reads a whole manifest and returns its trailer if the manifest is intact.
+func verifyManifest(manifestPath string) (manifestTrailer, error) {
+	mr, err := openManifest(manifestPath)
+	if err != nil {
+		return manifestTrailer{}, err
+	}
+	defer mr.Close()
+
+	for {
+		_, err := mr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return manifestTrailer{}, err
+		}
+	}
+	if mr.Trailer() == nil {
+		return manifestTrailer{}, fmt.Errorf("manifest %s has no integrity trailer", manifestPath)
+	}
+	return *mr.Trailer(), nil
+}
+
+func signaturePath(cmd *cobra.Command, manifestPath string) (string, error) {
+	path, err := cmd.Flags().GetString("signature")
+	if err != nil {
+		return "", err
+	}
+	if path == "" {
+		path = manifestPath + ".sig"
+	}
+	return path, nil
+}
+
+func readPEM(path, blockType string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != blockType {
+		return nil, fmt.Errorf("%s does not contain a PEM block of type %q", path, blockType)
+	}
+	return block.Bytes, nil
+}
+
+func readPrivateKey(path string) (ed25519.PrivateKey, error) {
+	der, err := readPEM(path, "PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing private key %s: %v", path, err)
+	}
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an ed25519 private key", path)
+	}
+	return privateKey, nil
+}
+
+func readPublicKey(path string) (ed25519.PublicKey, error) {
+	der, err := readPEM(path, "PUBLIC KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing public key %s: %v", path, err)
+	}
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an ed25519 public key", path)
+	}
+	return publicKey, nil
+}
+
+func writePEM(path, blockType string, der []byte, perm os.FileMode) error {
+	file, err := createFile(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := file.Chmod(perm); err != nil {
+		return fmt.Errorf("error setting permissions of %s: %v", path, err)
+	}
+	return pem.Encode(file, &pem.Block{Type: blockType, Bytes: der})
+}
+
+// ManifestKeygen generates an ed25519 key pair for signing manifests.
+func ManifestKeygen(cmd *cobra.Command, args []string) error {
+	privateKeyPath := args[0]
+	publicKeyPath := args[1]
+	logrus.Debugf("Executing 'manifest keygen' command with private key: '%s', public key: '%s'", privateKeyPath, publicKeyPath)
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return fmt.Errorf("error generating key pair: %v", err)
+	}
+	privateDER, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return fmt.Errorf("error encoding private key: %v", err)
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return fmt.Errorf("error encoding public key: %v", err)
+	}
+
+	if err := writePEM(privateKeyPath, "PRIVATE KEY", privateDER, 0600); err != nil {
+		return fmt.Errorf("error writing private key: %v", err)
+	}
+	if err := writePEM(publicKeyPath, "PUBLIC KEY", publicDER, 0644); err != nil {
+		return fmt.Errorf("error writing public key: %v", err)
+	}
+
+	fmt.Printf("Private key written to %s, keep it secret\n", privateKeyPath)
+	fmt.Printf("Public key written to %s\n", publicKeyPath)
+	return nil
+}
+
+// ManifestSign checks a manifest's integrity and writes a detached signature for it.
+func ManifestSign(cmd *cobra.Command, args []string) error {
+	manifestPath := args[0]
+	privateKeyPath := args[1]
+	sigPath, err := signaturePath(cmd, manifestPath)
+	if err != nil {
+		return fmt.Errorf("error retrieving signature flag: %v", err)
+	}
+	logrus.Debugf("Executing 'manifest sign' command with manifest: '%s', private key: '%s', signature: '%s'", manifestPath, privateKeyPath, sigPath)
+
+	privateKey, err := readPrivateKey(privateKeyPath)
+	if err != nil {
+		return fmt.Errorf("error reading private key: %v", err)
+	}
+
+	trailer, err := verifyManifest(manifestPath)
+	if err != nil {
+		return fmt.Errorf("refusing to sign manifest %s: %v", manifestPath, err)
+	}
+
+	signature := ed25519.Sign(privateKey, signedMessage(trailer))
+	err = os.WriteFile(sigPath, []byte(base64.StdEncoding.EncodeToString(signature)+"\n"), 0644)
+	if err != nil {
+		return fmt.Errorf("error writing signature: %v", err)
+	}
+
+	fmt.Printf("Signature written to %s\n", sigPath)
+	return nil
+}
+
+// ManifestVerify checks a manifest's integrity trailer and, if a public key is given, its signature.
+func ManifestVerify(cmd *cobra.Command, args []string) error {
+	manifestPath := args[0]
+	sigPath, err := signaturePath(cmd, manifestPath)
+	if err != nil {
+		return fmt.Errorf("error retrieving signature flag: %v", err)
+	}
+	logrus.Debugf("Executing 'manifest verify' command with arguments: %v, signature: '%s'", args, sigPath)
+
+	trailer, err := verifyManifest(manifestPath)
+	if err != nil {
+		fmt.Printf("Manifest %s is NOT intact: %v\n", manifestPath, err)
+		return errDifferences
+	}
+	fmt.Printf("Manifest %s is intact: %d entries, %s\n", manifestPath, trailer.Count, trailer.Digest)
+
+	if len(args) < 2 {
+		return nil
+	}
+
+	publicKey, err := readPublicKey(args[1])
+	if err != nil {
+		return fmt.Errorf("error reading public key: %v", err)
+	}
+	data, err := os.ReadFile(sigPath)
+	if err != nil {
+		return fmt.Errorf("error reading signature: %v", err)
+	}
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return fmt.Errorf("error decoding signature %s: %v", sigPath, err)
+	}
+
+	if !ed25519.Verify(publicKey, signedMessage(trailer), signature) {
+		fmt.Printf("Signature %s is NOT valid for this manifest and key\n", sigPath)
+		return errDifferences
+	}
+	fmt.Printf("Signature %s is valid\n", sigPath)
+	return nil
+}
+
+// ManifestSeal rewrites a manifest from an older ssync with an integrity trailer.
+// The manifest is loaded into memory so that it can be brought into manifest order.
+func ManifestSeal(cmd *cobra.Command, args []string) error {
+	manifestPath := args[0]
+	sealedManifestPath := args[1]
+	logrus.Debugf("Executing 'manifest seal' command with manifest: '%s', sealed manifest: '%s'", manifestPath, sealedManifestPath)
+
+	mr, err := openLegacyManifest(manifestPath)
+	if err != nil {
+		return fmt.Errorf("error reading manifest: %v", err)
+	}
+	defer mr.Close()
+
+	var fileInfoSlice []FileInfo
+	for {
+		fileInfo, err := mr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error reading manifest: %v", err)
+		}
+		fileInfoSlice = append(fileInfoSlice, fileInfo)
+	}
+	if mr.Trailer() != nil {
+		return fmt.Errorf("manifest %s already has an integrity trailer", manifestPath)
+	}
+	sortFileInfoSlice(fileInfoSlice)
+
+	file, err := createManifestFile(sealedManifestPath, false)
+	if err != nil {
+		return fmt.Errorf("error creating sealed manifest file: %v", err)
+	}
+	defer file.Abort()
+
+	writer, err := newManifestWriter(file.File)
+	if err != nil {
+		return fmt.Errorf("error writing sealed manifest file: %v", err)
+	}
+	for _, fileInfo := range fileInfoSlice {
+		if err := writer.Write(fileInfo); err != nil {
+			return fmt.Errorf("error writing sealed manifest file: %v", err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("error writing sealed manifest file: %v", err)
+	}
+	if err := file.Commit(); err != nil {
+		return fmt.Errorf("error writing sealed manifest file: %v", err)
+	}
+
+	fmt.Printf("Sealed manifest with %d entries written to %s\n", len(fileInfoSlice), sealedManifestPath)
+	return nil
+}
@@ -0,0 +1,399 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// StatsBucket counts the files of one size range, extension or age range.
+type StatsBucket struct {
+	Label string `json:"label"`
+	Files int    `json:"files"`
+	Bytes int64  `json:"bytes"`
+}
+
+// StatsFile is one of the largest files of a manifest.
+type StatsFile struct {
+	Path         string    `json:"path"`
+	Size         int64     `json:"size"`
+	ModifiedTime time.Time `json:"modifiedTime"`
+}
+
+// ManifestStats summarizes the files of a manifest.
+type ManifestStats struct {
+	Files      int           `json:"files"`
+	Bytes      int64         `json:"bytes"`
+	Unreadable int           `json:"unreadable"` // files recorded with an error
+	Oldest     time.Time     `json:"oldest"`
+	Newest     time.Time     `json:"newest"`
+	Sizes      []StatsBucket `json:"sizes"`
+	Extensions []StatsBucket `json:"extensions"` // most bytes first, the rest summed up as "(other)"
+	Ages       []StatsBucket `json:"ages"`       // by modified time, relative to when the statistics were made
+	Largest    []StatsFile   `json:"largest"`
+}
+
+// statsSizeBounds are the upper bounds (exclusive) of the size histogram, after which come the larger files.
+var statsSizeBounds = []int64{1, 1 << 10, 10 << 10, 100 << 10, 1 << 20, 10 << 20, 100 << 20, 1 << 30, 10 << 30}
+
+// statsAgeBounds are the upper bounds (exclusive) of the age histogram, after which come the older files.
+var statsAgeBounds = []struct {
+	label string
+	age   time.Duration
+}{
+	{"< 1 day", 24 * time.Hour},
+	{"< 1 week", 7 * 24 * time.Hour},
+	{"< 1 month", 30 * 24 * time.Hour},
+	{"< 1 year", 365 * 24 * time.Hour},
+	{"< 5 years", 5 * 365 * 24 * time.Hour},
+}
+
+func sizeBucketLabel(i int) string {
+	switch {
+	case i == 0:
+		return "empty"
+	case i < len(statsSizeBounds):
+		return "< " + toFriendlySize(statsSizeBounds[i])
+	default:
+		return ">= " + toFriendlySize(statsSizeBounds[len(statsSizeBounds)-1])
+	}
+}
+
+// fileExtension returns the lower-case extension of a path, such as ".jpg", or "(none)".
+func fileExtension(relativePath string) string {
+	ext := strings.ToLower(path.Ext(path.Base(relativePath)))
+	if ext == "" || ext == "." {
+		return "(none)"
+	}
+	return ext
+}
+
+// StatsForManifest summarizes the files of a manifest without touching the file system.
+// top limits the number of extensions and of largest files; it must be at least 1.
+func StatsForManifest(ctx context.Context, manifestPath string, top int) (*ManifestStats, error) {
+	if top < 1 {
+		return nil, fmt.Errorf("invalid top %d: must be at least 1", top)
+	}
+	now := time.Now()
+	stats := &ManifestStats{
+		Sizes:      make([]StatsBucket, len(statsSizeBounds)+1),
+		Ages:       make([]StatsBucket, len(statsAgeBounds)+1),
+		Extensions: []StatsBucket{},
+		Largest:    []StatsFile{},
+	}
+	for i := range stats.Sizes {
+		stats.Sizes[i].Label = sizeBucketLabel(i)
+	}
+	for i, bound := range statsAgeBounds {
+		stats.Ages[i].Label = bound.label
+	}
+	stats.Ages[len(statsAgeBounds)].Label = "older"
+	extensions := make(map[string]*StatsBucket)
+
+	err := forEachEntry(ctx, manifestPath, func(fileInfo FileInfo) {
+		stats.Files++
+		stats.Bytes += fileInfo.Size
+		if fileInfo.Error != "" {
+			stats.Unreadable++
+		}
+		if stats.Oldest.IsZero() || fileInfo.ModifiedTime.Before(stats.Oldest) {
+			stats.Oldest = fileInfo.ModifiedTime
+		}
+		if fileInfo.ModifiedTime.After(stats.Newest) {
+			stats.Newest = fileInfo.ModifiedTime
+		}
+
+		i := sort.Search(len(statsSizeBounds), func(i int) bool { return fileInfo.Size < statsSizeBounds[i] })
+		stats.Sizes[i].Files++
+		stats.Sizes[i].Bytes += fileInfo.Size
+
+		age := now.Sub(fileInfo.ModifiedTime)
+		i = sort.Search(len(statsAgeBounds), func(i int) bool { return age < statsAgeBounds[i].age })
+		stats.Ages[i].Files++
+		stats.Ages[i].Bytes += fileInfo.Size
+
+		ext := fileExtension(fileInfo.Path)
+		bucket := extensions[ext]
+		if bucket == nil {
+			bucket = &StatsBucket{Label: ext}
+			extensions[ext] = bucket
+		}
+		bucket.Files++
+		bucket.Bytes += fileInfo.Size
+
+		// Keep the largest files sorted, largest first.
+		if len(stats.Largest) < top || fileInfo.Size > stats.Largest[len(stats.Largest)-1].Size {
+			i := sort.Search(len(stats.Largest), func(i int) bool { return stats.Largest[i].Size < fileInfo.Size })
+			stats.Largest = append(stats.Largest, StatsFile{})
+			copy(stats.Largest[i+1:], stats.Largest[i:])
+			stats.Largest[i] = StatsFile{Path: fileInfo.Path, Size: fileInfo.Size, ModifiedTime: fileInfo.ModifiedTime}
+			if len(stats.Largest) > top {
+				stats.Largest = stats.Largest[:top]
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, bucket := range extensions {
+		stats.Extensions = append(stats.Extensions, *bucket)
+	}
+	sort.Slice(stats.Extensions, func(i, j int) bool {
+		if stats.Extensions[i].Bytes != stats.Extensions[j].Bytes {
+			return stats.Extensions[i].Bytes > stats.Extensions[j].Bytes
+		}
+		return stats.Extensions[i].Label < stats.Extensions[j].Label
+	})
+	if len(stats.Extensions) > top {
+		other := StatsBucket{Label: "(other)"}
+		for _, bucket := range stats.Extensions[top:] {
+			other.Files += bucket.Files
+			other.Bytes += bucket.Bytes
+		}
+		stats.Extensions = append(stats.Extensions[:top], other)
+	}
+	return stats, nil
+}
+
+// DirectoryUsage is the number and total size of the files at or below a directory.
+type DirectoryUsage struct {
+	Path  string `json:"path"` // relative to the root, "." for the root
+	Files int    `json:"files"`
+	Bytes int64  `json:"bytes"`
+}
+
+// DiskUsage adds up the files of a manifest per directory, for dir (a path relative to the root,
+// "" for the root) and the directories below it down to depth levels. The directories are
+// returned in manifest order, each one before the directories below it.
+func DiskUsage(ctx context.Context, manifestPath, dir string, depth int) ([]DirectoryUsage, error) {
+	dir = cleanSubtree(dir)
+	root := dir
+	if root == "" {
+		root = "."
+	}
+	usage := map[string]*DirectoryUsage{root: {Path: root}}
+	dirs := []string{root}
+	add := func(p string, size int64) {
+		u := usage[p]
+		if u == nil {
+			u = &DirectoryUsage{Path: p}
+			usage[p] = u
+			dirs = append(dirs, p)
+		}
+		u.Files++
+		u.Bytes += size
+	}
+
+	err := forEachEntry(ctx, manifestPath, func(fileInfo FileInfo) {
+		if !inSubtree(fileInfo.Path, dir) || fileInfo.Path == dir {
+			return
+		}
+		// The file counts for the directory the report starts at and for each directory below it
+		// that contains the file, down to depth.
+		add(root, fileInfo.Size)
+		parts := strings.Split(strings.TrimPrefix(fileInfo.Path[len(dir):], "/"), "/")
+		for i := 1; i < len(parts) && i <= depth; i++ {
+			p := strings.Join(parts[:i], "/")
+			if dir != "" {
+				p = dir + "/" + p
+			}
+			add(p, fileInfo.Size)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	below := dirs[1:]
+	sort.Slice(below, func(i, j int) bool { return comparePaths(below[i], below[j]) < 0 })
+	result := make([]DirectoryUsage, len(dirs))
+	for i, p := range dirs {
+		result[i] = *usage[p]
+	}
+	return result, nil
+}
+
+func Stats(cmd *cobra.Command, args []string) error {
+	manifestPath := args[0]
+	top, err := cmd.Flags().GetInt("top")
+	if err != nil {
+		return fmt.Errorf("error retrieving top flag: %v", err)
+	}
+	jsonFlag, err := cmd.Flags().GetBool("json")
+	if err != nil {
+		return fmt.Errorf("error retrieving json flag: %v", err)
+	}
+	logrus.Debugf("Executing 'stats' command with manifest: '%s', top: %d", manifestPath, top)
+
+	stats, err := StatsForManifest(cmd.Context(), manifestPath, top)
+	if err != nil {
+		return err
+	}
+	if jsonFlag {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(stats)
+	}
+
+	fmt.Printf("Files:      %d\n", stats.Files)
+	fmt.Printf("Total size: %s (%d bytes)\n", toFriendlySize(stats.Bytes), stats.Bytes)
+	if stats.Unreadable > 0 {
+		fmt.Printf("Unreadable: %d\n", stats.Unreadable)
+	}
+	if stats.Files > 0 {
+		fmt.Printf("Oldest:     %s\n", stats.Oldest.Local().Format("2006-01-02 15:04:05"))
+		fmt.Printf("Newest:     %s\n", stats.Newest.Local().Format("2006-01-02 15:04:05"))
+	}
+	printBuckets := func(title string, buckets []StatsBucket) {
+		fmt.Printf("\n%s:\n", title)
+		for _, b := range buckets {
+			share := 0.0
+			if stats.Bytes > 0 {
+				share = float64(b.Bytes) / float64(stats.Bytes) * 100
+			}
+			fmt.Printf("  %-12s  %8d files  %10s  %5.1f%%\n", b.Label, b.Files, toFriendlySize(b.Bytes), share)
+		}
+	}
+	printBuckets("Sizes", stats.Sizes)
+	printBuckets("Extensions", stats.Extensions)
+	printBuckets("Ages", stats.Ages)
+	fmt.Printf("\nLargest files:\n")
+	for _, f := range stats.Largest {
+		fmt.Printf("  %10s  %s  %s\n", toFriendlySize(f.Size), f.ModifiedTime.Local().Format("2006-01-02"), f.Path)
+	}
+	return nil
+}
+
+// formatSizeChange formats the difference between two sizes with its sign, e.g. "+1.50 MB".
+func formatSizeChange(change int64) string {
+	switch {
+	case change > 0:
+		return "+" + toFriendlySize(change)
+	case change < 0:
+		return "-" + toFriendlySize(-change)
+	default:
+		return "0 B"
+	}
+}
+
+func Du(cmd *cobra.Command, args []string) error {
+	manifestPath := args[0]
+	dir := ""
+	if len(args) == 2 {
+		dir = args[1]
+	}
+	depth, err := cmd.Flags().GetInt("depth")
+	if err != nil {
+		return fmt.Errorf("error retrieving depth flag: %v", err)
+	}
+	oldManifestPath, err := cmd.Flags().GetString("compare")
+	if err != nil {
+		return fmt.Errorf("error retrieving compare flag: %v", err)
+	}
+	sortBy, err := cmd.Flags().GetString("sort")
+	if err != nil {
+		return fmt.Errorf("error retrieving sort flag: %v", err)
+	}
+	if sortBy != "name" && sortBy != "size" {
+		return fmt.Errorf("invalid sort flag %q: expected name or size", sortBy)
+	}
+	jsonFlag, err := cmd.Flags().GetBool("json")
+	if err != nil {
+		return fmt.Errorf("error retrieving json flag: %v", err)
+	}
+	logrus.Debugf("Executing 'du' command with manifest: '%s', directory: '%s', depth: %d, compare: '%s'", manifestPath, dir, depth, oldManifestPath)
+
+	usage, err := DiskUsage(cmd.Context(), manifestPath, dir, depth)
+	if err != nil {
+		return err
+	}
+	if oldManifestPath == "" {
+		if sortBy == "size" {
+			below := usage[1:]
+			sort.SliceStable(below, func(i, j int) bool { return below[i].Bytes > below[j].Bytes })
+		}
+		if jsonFlag {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			return encoder.Encode(usage)
+		}
+		fmt.Printf("%10s  %8s  %s\n", "Size", "Files", "Directory")
+		for _, u := range usage {
+			fmt.Printf("%10s  %8d  %s\n", toFriendlySize(u.Bytes), u.Files, u.Path)
+		}
+		return nil
+	}
+
+	// With --compare, directories are listed with their size in both manifests, if it changed.
+	oldUsage, err := DiskUsage(cmd.Context(), oldManifestPath, dir, depth)
+	if err != nil {
+		return err
+	}
+	type growth struct {
+		Path     string `json:"path"`
+		OldFiles int    `json:"oldFiles"`
+		OldBytes int64  `json:"oldBytes"`
+		NewFiles int    `json:"newFiles"`
+		NewBytes int64  `json:"newBytes"`
+		Change   int64  `json:"change"`
+	}
+	byPath := make(map[string]*growth)
+	var rows []*growth
+	row := func(p string) *growth {
+		if byPath[p] == nil {
+			byPath[p] = &growth{Path: p}
+			rows = append(rows, byPath[p])
+		}
+		return byPath[p]
+	}
+	for _, u := range oldUsage {
+		g := row(u.Path)
+		g.OldFiles, g.OldBytes = u.Files, u.Bytes
+	}
+	for _, u := range usage {
+		g := row(u.Path)
+		g.NewFiles, g.NewBytes = u.Files, u.Bytes
+	}
+	// rows starts with the directory the report starts at, which is always listed.
+	changed := []*growth{rows[0]}
+	for _, g := range rows {
+		g.Change = g.NewBytes - g.OldBytes
+		if g != rows[0] && (g.Change != 0 || g.OldFiles != g.NewFiles) {
+			changed = append(changed, g)
+		}
+	}
+	below := changed[1:]
+	sort.SliceStable(below, func(i, j int) bool {
+		a, b := below[i], below[j]
+		if sortBy == "size" {
+			return abs(a.Change) > abs(b.Change)
+		}
+		return comparePaths(a.Path, b.Path) < 0
+	})
+	if jsonFlag {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(changed)
+	}
+	fmt.Printf("%10s  %10s  %11s  %s\n", "Old", "New", "Change", "Directory")
+	for _, g := range changed {
+		fmt.Printf("%10s  %10s  %11s  %s\n", toFriendlySize(g.OldBytes), toFriendlySize(g.NewBytes), formatSizeChange(g.Change), g.Path)
+	}
+	return nil
+}
+
+func abs(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
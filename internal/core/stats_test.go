@@ -0,0 +1,49 @@
+package core
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestStatsForManifestTop(t *testing.T) {
+	manifestPath := filepath.Join(t.TempDir(), "m.csv")
+	writeTestManifest(t, manifestPath, []FileInfo{
+		{Path: "a.jpg", Size: 300, Hash: md5Hex("a")},
+		{Path: "b.txt", Size: 200, Hash: md5Hex("b")},
+		{Path: "c.go", Size: 100, Hash: md5Hex("c")},
+		{Path: "d.txt", Size: 50, Hash: md5Hex("d")},
+	})
+
+	for _, tt := range []struct {
+		top        int
+		extensions []StatsBucket
+		largest    []string
+	}{
+		{1, []StatsBucket{{".jpg", 1, 300}, {"(other)", 3, 350}}, []string{"a.jpg"}},
+		{2, []StatsBucket{{".jpg", 1, 300}, {".txt", 2, 250}, {"(other)", 1, 100}}, []string{"a.jpg", "b.txt"}},
+		{10, []StatsBucket{{".jpg", 1, 300}, {".txt", 2, 250}, {".go", 1, 100}}, []string{"a.jpg", "b.txt", "c.go", "d.txt"}},
+	} {
+		stats, err := StatsForManifest(context.Background(), manifestPath, tt.top)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(stats.Extensions, tt.extensions) {
+			t.Errorf("top %d: extensions = %v, want %v", tt.top, stats.Extensions, tt.extensions)
+		}
+		var largest []string
+		for _, f := range stats.Largest {
+			largest = append(largest, f.Path)
+		}
+		if !slices.Equal(largest, tt.largest) {
+			t.Errorf("top %d: largest = %v, want %v", tt.top, largest, tt.largest)
+		}
+	}
+
+	for _, top := range []int{0, -1} {
+		if _, err := StatsForManifest(context.Background(), manifestPath, top); err == nil {
+			t.Errorf("top %d succeeded", top)
+		}
+	}
+}
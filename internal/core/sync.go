@@ -0,0 +1,401 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// defaultBlockSize is the block size for delta transfers when none is given.
+const defaultBlockSize = 1024 * 1024
+
+// syncStats counts what a sync did.
+type syncStats struct {
+	copied, updated, deleted, failed int
+	deltaWritten, deltaTotal         int64
+}
+
+// sourceFile is a file of the source of a sync, on disk or in a remote directory.
+type sourceFile interface {
+	io.Reader
+	io.ReaderAt
+	io.Closer
+}
+
+// syncSource opens the files of the source of a sync by their relative path.
+type syncSource func(relativePath string) (sourceFile, error)
+
+// localSource opens the files below a local directory.
+func localSource(dir string) syncSource {
+	return func(relativePath string) (sourceFile, error) {
+		return os.Open(filepath.Join(dir, filepath.FromSlash(relativePath)))
+	}
+}
+
+// remoteSource opens the files of a remote directory. Block reads only fetch the block.
+func remoteSource(ctx context.Context, remote remoteDirectory) syncSource {
+	return func(relativePath string) (sourceFile, error) {
+		return remote.open(ctx, relativePath), nil
+	}
+}
+
+// Sync makes the destination directory a copy of the source directory.
+// New files are copied. Changed files larger than one block are updated in place by
+// rewriting only the blocks that differ, using block lists from manifests where possible.
+// With --content-defined, files are split into content-defined chunks instead, and changed files
+// are rebuilt from the chunks the destination already has, wherever they are, and the new ones.
+// The source may be a remote directory, see isRemote: its manifest then lists the source
+// files and provides their block lists, and only changed blocks are downloaded.
+// The destination may be a bucket, see isBackend, which is compared with its stored manifest.
+// The source directory itself must be readable; files below source directories that cannot be
+// listed are never deleted from the destination.
+func Sync(cmd *cobra.Command, args []string) error {
+	srcDir := args[0]
+	dstDir := args[1]
+	blockSize, err := getSizeFlag(cmd, "block-size")
+	if err != nil {
+		return fmt.Errorf("error retrieving block-size flag: %v", err)
+	}
+	if blockSize == 0 {
+		blockSize = defaultBlockSize
+	}
+	srcManifestPath, err := cmd.Flags().GetString("source-manifest")
+	if err != nil {
+		return fmt.Errorf("error retrieving source-manifest flag: %v", err)
+	}
+	dstManifestPath, err := cmd.Flags().GetString("destination-manifest")
+	if err != nil {
+		return fmt.Errorf("error retrieving destination-manifest flag: %v", err)
+	}
+	contentDefined, err := cmd.Flags().GetBool("content-defined")
+	if err != nil {
+		return fmt.Errorf("error retrieving content-defined flag: %v", err)
+	}
+	inPlace, err := cmd.Flags().GetBool("in-place")
+	if err != nil {
+		return fmt.Errorf("error retrieving in-place flag: %v", err)
+	}
+	if inPlace && contentDefined {
+		return fmt.Errorf("--in-place only applies to fixed-size blocks: content-defined chunks move, so files are always rebuilt in a temporary copy")
+	}
+	deleteFlag, err := cmd.Flags().GetBool("delete")
+	if err != nil {
+		return fmt.Errorf("error retrieving delete flag: %v", err)
+	}
+	policy, err := getErrorPolicyFlag(cmd)
+	if err != nil {
+		return err
+	}
+	patterns, err := getIgnoreFlag(cmd)
+	if err != nil {
+		return err
+	}
+	ignore, err := newIgnoreRules(patterns)
+	if err != nil {
+		return err
+	}
+	if isRemote(dstDir) {
+		return fmt.Errorf("the destination of a sync must be a local directory or a bucket")
+	}
+	if isBackend(dstDir) && dstManifestPath != "" {
+		return fmt.Errorf("%s keeps its own manifest, --destination-manifest does not apply", dstDir)
+	}
+	logrus.Debugf("Executing 'sync' command with source: '%s', destination: '%s', block size: %d, content-defined: %t, source manifest: '%s', destination manifest: '%s', in-place: %t, delete: %t",
+		srcDir, dstDir, blockSize, contentDefined, srcManifestPath, dstManifestPath, inPlace, deleteFlag)
+
+	// Block lists from the manifests are optional. Without them, the blocks are hashed while syncing.
+	srcCursor, closeSrc, err := openManifestCursor(srcManifestPath)
+	if err != nil {
+		return fmt.Errorf("error reading source manifest: %v", err)
+	}
+	defer closeSrc()
+	dstCursor, closeDst, err := openManifestCursor(dstManifestPath)
+	if err != nil {
+		return fmt.Errorf("error reading destination manifest: %v", err)
+	}
+	defer closeDst()
+
+	printer, err := newEventPrinter(cmd, os.Stdout)
+	if err != nil {
+		return err
+	}
+	var stats syncStats
+	// fail decides, by the error policy, whether a file that could not be synced stops the sync.
+	fail := func(path string, err error) error {
+		if err := policy.skip(printer.handle, path, err); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		stats.failed++
+		return nil
+	}
+
+	ctx := cmd.Context()
+	onError := func(path string, err error) error {
+		return policy.skip(printer.handle, path, err)
+	}
+	var srcWalker fileIterator
+	var source syncSource
+	// srcSkipped reports whether a path is in a source directory that could not be listed.
+	// Nothing below such a directory is deleted, since its files only look absent.
+	srcSkipped := func(relativePath string) bool { return false }
+	if isRemote(srcDir) {
+		remote, files, closeRemote, err := openRemoteTree(ctx, srcDir, ignore, blockSize, contentDefined)
+		if err != nil {
+			return err
+		}
+		defer closeRemote()
+		srcWalker, source = files, remoteSource(ctx, remote)
+	} else {
+		walker := newDirWalker(srcDir, ignore, onError, nil)
+		defer walker.Close()
+		srcWalker, source, srcSkipped = walker, localSource(srcDir), walker.skipped
+	}
+
+	// report finishes the output of the sync.
+	report := func(err error) error {
+		printer.done()
+		if err != nil {
+			return fmt.Errorf("error syncing %s to %s: %v", srcDir, dstDir, err)
+		}
+		fmt.Printf("Sync completed: %d copied, %d updated by delta (%s written of %s), %d deleted, %d failed\n",
+			stats.copied, stats.updated, toFriendlySize(stats.deltaWritten), toFriendlySize(stats.deltaTotal), stats.deleted, stats.failed)
+		return printer.errorReport()
+	}
+
+	progress := ProgressEvent{Stage: StageSync}
+	if isBackend(dstDir) {
+		backend, err := openBackend(dstDir)
+		if err != nil {
+			return err
+		}
+		s := &backendSync{
+			backend:    backend,
+			source:     source,
+			srcCursor:  srcCursor,
+			srcSkipped: srcSkipped,
+			delete:     deleteFlag,
+			policy:     policy,
+			fail:       fail,
+			printer:    printer,
+			stats:      &stats,
+			progress:   &progress,
+		}
+		return report(s.run(ctx, srcWalker))
+	}
+
+	dstWalker := newDirWalker(dstDir, ignore, onError, nil)
+	defer dstWalker.Close()
+	err = mergeJoin(srcWalker, dstWalker, func(srcFileInfo, dstFileInfo *FileInfo) error {
+		// Stop between files, so that no file is left half-written.
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if srcFileInfo != nil {
+			progress.Path = srcFileInfo.Path
+			progress.Files++
+			defer printer.handle(&progress)
+		}
+		switch {
+		case dstFileInfo == nil:
+			srcPath, dstPath := syncPaths(srcDir, dstDir, srcFileInfo.Path)
+			err := policy.try(ctx, srcPath, func() error {
+				return copyFile(source, srcFileInfo.Path, dstPath, srcFileInfo.ModifiedTime)
+			})
+			if err != nil {
+				return fail(srcFileInfo.Path, fmt.Errorf("error copying: %w", err))
+			}
+			printer.printf("[new] %s\n", srcFileInfo.Path)
+			stats.copied++
+			progress.Bytes += srcFileInfo.Size
+
+		case srcFileInfo == nil:
+			if !deleteFlag || srcSkipped(dstFileInfo.Path) {
+				return nil
+			}
+			dstPath := filepath.Join(dstDir, filepath.FromSlash(dstFileInfo.Path))
+			if err := policy.try(ctx, dstPath, func() error { return os.Remove(dstPath) }); err != nil {
+				return fail(dstFileInfo.Path, fmt.Errorf("error deleting: %w", err))
+			}
+			printer.printf("[deleted] %s\n", dstFileInfo.Path)
+			stats.deleted++
+
+		case sameModifiedTimeAndSize(*srcFileInfo, *dstFileInfo):
+			// Unchanged.
+
+		case srcFileInfo.Size > blockSize && dstFileInfo.Size > 0:
+			srcEntry, err := srcCursor.Find(srcFileInfo.Path)
+			if err != nil {
+				return err
+			}
+			if isRemote(srcDir) {
+				// The entries of a remote source come from its manifest and carry the block lists already.
+				srcEntry = srcFileInfo
+			}
+			dstEntry, err := dstCursor.Find(dstFileInfo.Path)
+			if err != nil {
+				return err
+			}
+			var written int64
+			err = policy.try(ctx, srcFileInfo.Path, func() error {
+				var err error
+				if contentDefined {
+					written, err = syncFileChunks(source, srcDir, dstDir, *srcFileInfo, *dstFileInfo, srcEntry, dstEntry, blockSize)
+				} else {
+					written, err = syncFileDelta(source, srcDir, dstDir, *srcFileInfo, *dstFileInfo, srcEntry, dstEntry, blockSize, inPlace)
+				}
+				// A failed attempt may have rewritten part of the destination, so its block list is hashed anew on a retry.
+				dstEntry = nil
+				return err
+			})
+			if err != nil {
+				return fail(srcFileInfo.Path, fmt.Errorf("error updating: %w", err))
+			}
+			printer.printf("[delta] %s: %s of %s written\n", srcFileInfo.Path, toFriendlySize(written), toFriendlySize(srcFileInfo.Size))
+			stats.updated++
+			stats.deltaWritten += written
+			progress.Bytes += written
+			stats.deltaTotal += srcFileInfo.Size
+
+		default:
+			srcPath, dstPath := syncPaths(srcDir, dstDir, srcFileInfo.Path)
+			err := policy.try(ctx, srcPath, func() error {
+				return copyFile(source, srcFileInfo.Path, dstPath, srcFileInfo.ModifiedTime)
+			})
+			if err != nil {
+				return fail(srcFileInfo.Path, fmt.Errorf("error copying: %w", err))
+			}
+			printer.printf("[copy] %s\n", srcFileInfo.Path)
+			stats.copied++
+			progress.Bytes += srcFileInfo.Size
+		}
+		return nil
+	})
+	return report(err)
+}
+
+func syncPaths(srcDir, dstDir, relativePath string) (string, string) {
+	return locationPath(srcDir, relativePath), filepath.Join(dstDir, filepath.FromSlash(relativePath))
+}
+
+// openManifestCursor opens a manifest for lookups. An empty path yields a cursor that finds nothing.
+func openManifestCursor(manifestPath string) (*manifestCursor, func() error, error) {
+	if manifestPath == "" {
+		return newManifestCursor(&sliceIterator{}), func() error { return nil }, nil
+	}
+	manifest, err := openSortedManifest(manifestPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	return newManifestCursor(manifest), manifest.Close, nil
+}
+
+// syncFileDelta updates a changed destination file block by block.
+// Block lists are taken from the manifest entries if they still describe the files on disk,
+// otherwise the destination is hashed first and the source is hashed while it is transferred.
+func syncFileDelta(source syncSource, srcDir, dstDir string, srcFileInfo, dstFileInfo FileInfo, srcEntry, dstEntry *FileInfo, blockSize int64, inPlace bool) (int64, error) {
+	srcPath, dstPath := syncPaths(srcDir, dstDir, srcFileInfo.Path)
+
+	var srcHash string
+	var srcBlockHashes []string
+	if usableBlockList(srcEntry, srcFileInfo, blockSize, false) {
+		srcHash = srcEntry.Hash
+		srcBlockHashes = srcEntry.BlockHashes
+	}
+
+	var dstBlockHashes []string
+	if usableBlockList(dstEntry, dstFileInfo, blockSize, false) {
+		dstBlockHashes = dstEntry.BlockHashes
+	} else {
+		var err error
+		_, dstBlockHashes, err = calculateBlockMD5(dstPath, blockSize)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	src, err := source(srcFileInfo.Path)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+	written, err := applyDelta(src, srcPath, dstPath, srcFileInfo.Size, blockSize, srcHash, srcBlockHashes, dstBlockHashes, inPlace)
+	if err != nil {
+		return written, err
+	}
+	return written, os.Chtimes(dstPath, srcFileInfo.ModifiedTime, srcFileInfo.ModifiedTime)
+}
+
+// syncFileChunks rebuilds a changed destination file from content-defined chunks, see applyChunkDelta.
+// Chunk lists are taken from the manifest entries if they still describe the files on disk,
+// otherwise the destination is split into chunks first and the source while it is transferred.
+func syncFileChunks(source syncSource, srcDir, dstDir string, srcFileInfo, dstFileInfo FileInfo, srcEntry, dstEntry *FileInfo, averageSize int64) (int64, error) {
+	srcPath, dstPath := syncPaths(srcDir, dstDir, srcFileInfo.Path)
+
+	var srcHash string
+	var srcChunkHashes []string
+	var srcChunkSizes []int64
+	if usableBlockList(srcEntry, srcFileInfo, averageSize, true) {
+		srcHash, srcChunkHashes, srcChunkSizes = srcEntry.Hash, srcEntry.BlockHashes, srcEntry.ChunkSizes
+	}
+
+	var dstChunkHashes []string
+	var dstChunkSizes []int64
+	if usableBlockList(dstEntry, dstFileInfo, averageSize, true) {
+		dstChunkHashes, dstChunkSizes = dstEntry.BlockHashes, dstEntry.ChunkSizes
+	} else {
+		var err error
+		_, dstChunkHashes, dstChunkSizes, err = calculateChunkMD5(dstPath, averageSize)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	src, err := source(srcFileInfo.Path)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+	taken, err := applyChunkDelta(src, srcPath, dstPath, srcFileInfo.Size, averageSize, srcHash, srcChunkHashes, srcChunkSizes, dstChunkHashes, dstChunkSizes)
+	if err != nil {
+		return taken, err
+	}
+	return taken, os.Chtimes(dstPath, srcFileInfo.ModifiedTime, srcFileInfo.ModifiedTime)
+}
+
+// usableBlockList reports whether a manifest entry has a block list of the requested kind
+// that can be trusted for the file on disk.
+func usableBlockList(entry *FileInfo, fileInfo FileInfo, blockSize int64, chunked bool) bool {
+	return entry != nil && entry.BlockSize == blockSize && (entry.ChunkSizes != nil) == chunked &&
+		sameModifiedTimeAndSize(*entry, fileInfo)
+}
+
+// copyFile copies a file of a sync source, creating parent directories as needed, and sets its modified time.
+func copyFile(source syncSource, relativePath, dstPath string, modifiedTime time.Time) error {
+	in, err := source(relativePath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
+		return fmt.Errorf("error creating parent directory: %v", err)
+	}
+	out, err := os.Create(dstPath)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(dstPath, modifiedTime, modifiedTime)
+}
@@ -1,146 +1,735 @@
 package core
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"io/fs"
+	"io"
+	"os"
 	"path/filepath"
-	"sort"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
-func Update(cmd *cobra.Command, args []string) {
-	// Extract arguments.
-	directoryPath := args[0]
-	oldManifestPath := args[1]
-	newManifestPath := args[2]
-	logrus.Debugf("Executing 'update' command with directory: '%s', old manifest: '%s', new manifest: '%s'", directoryPath, oldManifestPath, newManifestPath)
+// UpdateOptions configures UpdateManifest.
+type UpdateOptions struct {
+	NewManifestPath string // where to write the new manifest, "" to replace the old manifest
+	BlockSize       int64  // also record a block list with blocks of this size, 0 for none
+	ContentDefined  bool   // split files into content-defined chunks of about BlockSize instead of fixed-size blocks
+	QuickHashWindow int64  // record quick hashes with windows of this size instead of full hashes, 0 for full hashes
+	Force           bool   // overwrite NewManifestPath if it already exists
+	Resume          bool   // start from the partial manifest left by an interrupted run, if there is one, instead of the old manifest
+	Backups         int    // when replacing the old manifest, keep this many older versions of it
+	// A random sample of the unchanged files is re-hashed to detect silent corruption:
+	// either a fraction of the files (VerifyRate, 0 to 1) or as many as fit into VerifyBudget bytes.
+	VerifyRate   float64
+	VerifyBudget int64
+	Ignore       []string // leave out files and directories matching these patterns (see ignoreRules)
+	OnError      ErrorPolicy
+	Events       EventHandler
+}
+
+// UpdateResult is the outcome of UpdateManifest.
+type UpdateResult struct {
+	Manifest *Manifest
+	Summary  ChangeSummary
+}
+
+// maxMoveCandidates bounds the number of entries kept in memory to recognise moved files:
+// by their NTFS file ID in an update, and by their content in the changes of a history.
+const maxMoveCandidates = 1 << 20
 
-	isNTFS, err := isNTFS(directoryPath)
+// createTempManifest creates a temporary manifest in dir, for entries an update spills to disk.
+func createTempManifest(dir string) (*os.File, *manifestWriter, error) {
+	file, err := os.CreateTemp(dir, ".ssync-update-*.csv.zst")
 	if err != nil {
-		fmt.Printf("Error checking file system type: %v\n", err)
-		return
+		return nil, nil, fmt.Errorf("error creating temporary file: %v", err)
 	}
-	if !isNTFS {
-		fmt.Printf("The directory is not on an NTFS file system. NTFS file IDs will not be available.\n")
-		return
+	writer, err := newManifestWriter(file)
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, nil, fmt.Errorf("error writing temporary file: %v", err)
 	}
+	return file, writer, nil
+}
 
-	// Create the new manifest file.
-	file, err := createFile(newManifestPath)
+// changeSpool keeps entries together with their changes in a temporary file, in the order they are added.
+type changeSpool struct {
+	file *os.File
+	w    *bufio.Writer
+	enc  *json.Encoder
+}
+
+type spooledChange struct {
+	File   FileInfo
+	Change FileChange
+}
+
+func newChangeSpool(dir string) (*changeSpool, error) {
+	file, err := os.CreateTemp(dir, ".ssync-update-*.json")
 	if err != nil {
-		fmt.Printf("Error creating new manifest file: %v\n", err)
-		return
+		return nil, fmt.Errorf("error creating temporary file: %v", err)
 	}
-	defer file.Close()
+	w := bufio.NewWriter(file)
+	return &changeSpool{file: file, w: w, enc: json.NewEncoder(w)}, nil
+}
+
+func (s *changeSpool) add(fileInfo FileInfo, change FileChange) error {
+	return s.enc.Encode(spooledChange{File: fileInfo, Change: change})
+}
 
-	oldManifestSlice, err := readManifest(oldManifestPath)
+// open returns a reader of the entries added so far.
+func (s *changeSpool) open() (*changeSpoolReader, error) {
+	if err := s.w.Flush(); err != nil {
+		return nil, err
+	}
+	file, err := os.Open(s.file.Name())
 	if err != nil {
-		fmt.Printf("Error reading old manifest: %v\n", err)
-		return
+		return nil, err
 	}
+	return &changeSpoolReader{file: file, dec: json.NewDecoder(bufio.NewReader(file))}, nil
+}
 
-	oldManifestMapByPath := make(map[string]FileInfo)
-	oldManifestMapByFileID := make(map[uint64]FileInfo)
-	for _, fileInfo := range oldManifestSlice {
-		oldManifestMapByPath[fileInfo.Path] = fileInfo
-		oldManifestMapByFileID[fileInfo.NTFSFileID] = fileInfo
+// Close removes the spool. Its readers must have been closed.
+func (s *changeSpool) Close() error {
+	s.file.Close()
+	return os.Remove(s.file.Name())
+}
+
+// changeSpoolReader is a fileIterator over the entries of a changeSpool.
+type changeSpoolReader struct {
+	file   *os.File
+	dec    *json.Decoder
+	change FileChange // the change of the entry last returned by Next
+}
+
+func (r *changeSpoolReader) Next() (FileInfo, error) {
+	var entry spooledChange
+	if err := r.dec.Decode(&entry); err != nil {
+		return FileInfo{}, err
 	}
+	r.change = entry.Change
+	return entry.File, nil
+}
 
-	newManifestSlice := make([]FileInfo, 0)
+func (r *changeSpoolReader) Close() error {
+	return r.file.Close()
+}
 
-	err = filepath.WalkDir(directoryPath, func(path string, d fs.DirEntry, err error) error {
-		if err != nil {
-			// Log error but continue walking the directory.
-			fmt.Printf("Error accessing path %q: %v\n", path, err)
-			return nil
+// UpdateManifest writes a new manifest for root, reusing the hashes of the old manifest
+// for files whose modified time and size did not change, including files that were moved.
+// Files that cannot be read are recorded with an error, unless opts.OnError aborts.
+// The entries below directories that cannot be listed are kept from the old manifest.
+// The new manifest only replaces its path once it is complete.
+//
+// If ctx is cancelled, what is known so far is saved as a partial manifest next to the new manifest,
+// which is returned together with the context's error: the old entries, with those of the files
+// checked or hashed so far brought up to date. A later call with Resume set continues from it.
+func UpdateManifest(ctx context.Context, root, oldManifestPath string, opts UpdateOptions) (*UpdateResult, error) {
+	inPlace := opts.NewManifestPath == ""
+	newManifestPath := opts.NewManifestPath
+	if inPlace {
+		newManifestPath = oldManifestPath
+	}
+	hashOpts, err := newHashOptions(opts.BlockSize, opts.QuickHashWindow, opts.ContentDefined)
+	if err != nil {
+		return nil, err
+	}
+	sampler := newSampler(opts.VerifyRate, opts.VerifyBudget)
+	ignore, err := newIgnoreRules(opts.Ignore)
+	if err != nil {
+		return nil, err
+	}
+
+	isNTFS, err := isNTFS(root)
+	if err != nil {
+		return nil, fmt.Errorf("error checking file system type: %v", err)
+	}
+	if !isNTFS {
+		return nil, fmt.Errorf("%s is not on an NTFS file system, NTFS file IDs are not available", root)
+	}
+
+	// When resuming, the partial manifest of the interrupted run takes the place of the old manifest.
+	partialPath := partialManifestPath(newManifestPath)
+	basePath := oldManifestPath
+	if opts.Resume {
+		if _, err := os.Stat(partialPath); os.IsNotExist(err) {
+			logrus.Debugf("No partial manifest %s to resume from, starting from %s", partialPath, oldManifestPath)
+		} else {
+			basePath = partialPath
 		}
+	}
 
-		if d.IsDir() {
-			// Skip directories.
-			return nil
+	// The old manifest may be a partial one saved by an interrupted run: updating it finishes it.
+	oldManifest, err := openSortedManifestWith(basePath, openPartialManifest)
+	if err != nil {
+		return nil, fmt.Errorf("error reading old manifest: %v", err)
+	}
+	defer oldManifest.Close()
+
+	// Create the new manifest file. It only replaces newManifestPath once it is complete.
+	file, err := createManifestFile(newManifestPath, inPlace || opts.Force)
+	if err != nil {
+		return nil, fmt.Errorf("error creating new manifest file: %v", err)
+	}
+	defer file.Abort()
+
+	// Entries settled during the walk are spilled to a temporary manifest next to the new one,
+	// and so are the files that still have to be looked at, so memory use does not depend
+	// on the number of files, only on that of the candidates for moves.
+	dir := filepath.Dir(newManifestPath)
+	settledFile, settled, err := createTempManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(settledFile.Name())
+	defer settledFile.Close()
+	// missing holds old entries whose path is gone, in manifest order.
+	// Those that turn out not to be the source of a move were deleted.
+	missingFile, missing, err := createTempManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(missingFile.Name())
+	defer missingFile.Close()
+	// pending holds walked files that are not unchanged at their old path, in walk order, with their changes.
+	// They are either moved files (whose hash can be reused) or new/modified files.
+	pending, err := newChangeSpool(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer pending.Close()
+	// resolved holds the entries of the pending files once they have been matched to a move or hashed.
+	resolved, err := newChangeSpool(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer resolved.Close()
+
+	summary := newChangeSummary()
+	settledBytes := int64(0)
+	hashing := ProgressEvent{Stage: StageHash}
+	// orphans holds old entries whose path no longer holds the same file, by NTFS file ID.
+	// They are the candidates for the source of a move. Beyond maxMoveCandidates of them,
+	// moved files are hashed again like new ones.
+	orphans := make(map[uint64]FileInfo)
+	tooManyOrphans := false
+	addOrphan := func(oldFileInfo FileInfo) {
+		// Entries of unreadable files have no hash to carry over to a new path,
+		// and entries without a file ID, e.g. of a re-rooted manifest, cannot be matched.
+		if oldFileInfo.Error != "" || oldFileInfo.NTFSFileID == 0 {
+			return
+		}
+		if len(orphans) >= maxMoveCandidates {
+			if !tooManyOrphans {
+				logrus.WithField("candidates", maxMoveCandidates).Warn("Too many candidates for moved files, further moved files are hashed again")
+				tooManyOrphans = true
+			}
+			return
+		}
+		orphans[oldFileInfo.NTFSFileID] = oldFileInfo
+	}
+
+	walker := newDirWalker(root, ignore, func(path string, err error) error {
+		return opts.OnError.skip(opts.Events, path, err)
+	}, func(path string, fileInfo *FileInfo) error {
+		if err := ctx.Err(); err != nil {
+			return err
 		}
+		logrus.WithField("path", path).Debug("Processing file")
+		err := opts.OnError.try(ctx, path, func() error {
+			fileID, err := getNTFSFileID(path)
+			fileInfo.NTFSFileID = fileID
+			return err
+		})
+		switch {
+		case err == nil:
+		case ctx.Err() != nil:
+			return fmt.Errorf("error getting NTFS file ID for file %s: %v", path, err)
+		default:
+			// An unchanged file does not need to be read, so the error only counts, and only aborts,
+			// if the file has to be hashed.
+			fileInfo.Error = fmt.Sprintf("error getting NTFS file ID: %v", err)
+		}
+		return nil
+	})
+	defer walker.Close()
 
-		// Get os.FileInfo from fs.DirEntry to access ModTime and Size.
-		info, err := d.Info()
+	scanning := ProgressEvent{Stage: StageScan}
+	err = mergeJoin(oldManifest, walker, func(oldFileInfo, fileInfo *FileInfo) error {
+		if fileInfo != nil {
+			scanning.Path = fileInfo.Path
+			scanning.Files++
+			opts.Events.progress(scanning)
+		}
+		switch {
+		case fileInfo == nil && walker.skipped(oldFileInfo.Path):
+			// The file may well still be there, so its entry is kept as it is.
+			return settled.Write(*oldFileInfo)
+		case fileInfo == nil:
+			// The path is gone, but the file may have moved elsewhere.
+			addOrphan(*oldFileInfo)
+			return missing.Write(*oldFileInfo)
+		case oldFileInfo != nil && sameModifiedTimeAndSize(*oldFileInfo, *fileInfo) && !needsRehash(*oldFileInfo, hashOpts):
+			// The file is unchanged and unmoved. Its file ID is taken from disk, since the old one
+			// may be missing or stale, e.g. after the files were moved to another volume.
+			entry := *oldFileInfo
+			if fileInfo.Error == "" {
+				entry.NTFSFileID = fileInfo.NTFSFileID
+			}
+			settledBytes += entry.Size
+			return settled.Write(entry)
+		default:
+			change := FileChange{Path: fileInfo.Path, Size: fileInfo.Size}
+			switch {
+			case fileInfo.Error != "" && opts.OnError.Abort:
+				return fmt.Errorf("%s: %s", filepath.Join(root, filepath.FromSlash(fileInfo.Path)), fileInfo.Error)
+			case fileInfo.Error != "":
+				change.Change = ChangeUnreadable
+				change.Reason = "could not be read: " + fileInfo.Error
+				opts.Events.emit(&WarningEvent{Path: filepath.Join(root, filepath.FromSlash(fileInfo.Path)), Err: errors.New(fileInfo.Error)})
+			case oldFileInfo == nil:
+				change.Change = ChangeNew
+				change.Reason = "not in the old manifest, hashed"
+			case oldFileInfo.Error != "" && sameModifiedTimeAndSize(*oldFileInfo, *fileInfo):
+				change.Change = ChangeRehashed
+				change.Reason = "could not be read last time, re-hashed"
+			case sameModifiedTimeAndSize(*oldFileInfo, *fileInfo):
+				change.Change = ChangeRehashed
+				change.Reason = "hash kind or block list changed, re-hashed"
+			default:
+				change.Change = ChangeModified
+				change.Reason = describeDifference(*oldFileInfo, *fileInfo, false) + ", re-hashed"
+			}
+			if oldFileInfo != nil {
+				addOrphan(*oldFileInfo)
+			}
+			hashing.TotalFiles++
+			hashing.TotalBytes += fileInfo.Size
+			return pending.add(*fileInfo, change)
+		}
+	})
+	closeErr := settled.Close()
+	if err := missing.Close(); closeErr == nil {
+		closeErr = err
+	}
+	movedFrom := make(map[string]bool)
+	// interrupted saves the partial manifest, with the pending files resolved so far.
+	interrupted := func() (*UpdateResult, error) {
+		oldManifest.Close()
+		hashed, err := resolved.open()
 		if err != nil {
-			// Log error but continue walking if file info cannot be retrieved.
-			fmt.Printf("Error getting file info for %q: %v\n", path, err)
-			return nil
+			return nil, fmt.Errorf("interrupted, and could not read temporary file: %v", err)
+		}
+		defer hashed.Close()
+		manifest, err := savePartialUpdate(file, settledFile.Name(), hashed, basePath, movedFrom, partialPath)
+		if err != nil {
+			return nil, err
 		}
+		return &UpdateResult{Manifest: manifest, Summary: summary}, fmt.Errorf("interrupted: %w", ctx.Err())
+	}
+	if ctx.Err() != nil && closeErr == nil {
+		return interrupted()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error comparing directory with old manifest: %w", err)
+	}
+	if closeErr != nil {
+		return nil, fmt.Errorf("error writing temporary file: %v", closeErr)
+	}
 
-		// Make the path relative to the base directory and normalize slashes.
-		relativePath, err := filepath.Rel(directoryPath, path)
+	// Moved files are counted as they are found, although they need not be hashed.
+	pendingReader, err := pending.open()
+	if err != nil {
+		return nil, fmt.Errorf("error reading temporary file: %v", err)
+	}
+	defer pendingReader.Close()
+	for {
+		fileInfo, err := pendingReader.Next()
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
-			// Log error but continue walking.
-			fmt.Printf("Error processing relative path for %q: %v\n", path, err)
-			return nil
+			return nil, fmt.Errorf("error reading temporary file: %v", err)
+		}
+		change := pendingReader.change
+		hashing.Path = fileInfo.Path
+		hashing.Files++
+		hashing.Bytes += fileInfo.Size
+		if ctx.Err() != nil {
+			return interrupted()
+		}
+		if err := resolvePending(ctx, root, &fileInfo, &change, orphans, movedFrom, hashOpts, opts); err != nil {
+			if ctx.Err() != nil {
+				return interrupted()
+			}
+			return nil, err
+		}
+		summary.add(change)
+		opts.Events.progress(hashing)
+		if err := resolved.add(fileInfo, change); err != nil {
+			return nil, fmt.Errorf("error writing temporary file: %v", err)
 		}
-		relativePath = filepath.ToSlash(relativePath)
-		logrus.Debugf("Processing file: %s", path)
+	}
 
-		// Get current file's modification time and size.
-		modifiedTime := info.ModTime()
-		size := info.Size()
-		var currentHash string
+	// Merge the settled entries with the resolved pending ones into the new manifest.
+	// Both are in manifest order and never share a path.
+	settledReader, err := openManifest(settledFile.Name())
+	if err != nil {
+		return nil, fmt.Errorf("error reading temporary file: %v", err)
+	}
+	defer settledReader.Close()
+	resolvedReader, err := resolved.open()
+	if err != nil {
+		return nil, fmt.Errorf("error reading temporary file: %v", err)
+	}
+	defer resolvedReader.Close()
+	missingReader, err := openManifest(missingFile.Name())
+	if err != nil {
+		return nil, fmt.Errorf("error reading temporary file: %v", err)
+	}
+	defer missingReader.Close()
 
-		fileID, err := getNTFSFileID(path)
-		if err != nil {
-			panic(fmt.Sprintf("Error getting NTFS file ID for file %s: %v", path, err))
-		}
-
-		var fileInfo FileInfo
-		oldFileInfo1, exists := oldManifestMapByPath[relativePath]
-		// condition1: The file is unchanged and unmoved.
-		condition1 := exists && modifiedTime.Unix() == oldFileInfo1.ModifiedTime.Unix() && size == oldFileInfo1.Size
-		oldFileInfo2, exists := oldManifestMapByFileID[fileID]
-		// condition2: The file is unchanged but moved.
-		condition2 := exists && modifiedTime.Unix() == oldFileInfo2.ModifiedTime.Unix() && size == oldFileInfo2.Size
-		if condition1 {
-			fileInfo = oldFileInfo1
-		} else if condition2 {
-			fileInfo = oldFileInfo2
-			fileInfo.Path = relativePath // Update path to the new relative path.
-		} else {
-			// File is new, calculate its MD5 hash.
-			hash, err := calculateMD5(path)
-			if err != nil {
-				panic(fmt.Sprintf("Error calculating MD5 for new file %s: %v", path, err))
+	writer, err := newManifestWriter(file.File)
+	if err != nil {
+		return nil, fmt.Errorf("error writing new manifest file: %v", err)
+	}
+	if sampler != nil {
+		sampler.prepare(settledBytes)
+	}
+	// Changes are reported in path order, with deleted paths slotted in between.
+	// Missing files that are not the source of a move were deleted.
+	missingFileInfo, missingErr := missingReader.Next()
+	reportDeletedBefore := func(path string) error {
+		for ; missingErr == nil && (path == "" || comparePaths(missingFileInfo.Path, path) < 0); missingFileInfo, missingErr = missingReader.Next() {
+			if movedFrom[missingFileInfo.Path] {
+				continue
+			}
+			change := FileChange{Path: missingFileInfo.Path, Change: ChangeDeleted, Size: missingFileInfo.Size, Reason: "no longer on disk"}
+			summary.add(change)
+			opts.Events.emit(&ChangeEvent{change})
+		}
+		if missingErr != nil && missingErr != io.EOF {
+			return fmt.Errorf("error reading temporary file: %v", missingErr)
+		}
+		return nil
+	}
+	verifying := ProgressEvent{Stage: StageVerify}
+	err = mergeJoin(settledReader, resolvedReader, func(settledFileInfo, pendingFileInfo *FileInfo) error {
+		if settledFileInfo != nil {
+			if err := reportDeletedBefore(settledFileInfo.Path); err != nil {
+				return err
 			}
-			currentHash = hash
-			fileInfo = FileInfo{
-				Path:         relativePath,
-				ModifiedTime: modifiedTime,
-				Size:         size,
-				Hash:         currentHash,
-				NTFSFileID:   fileID,
+			change := FileChange{Path: settledFileInfo.Path, Change: ChangeUnchanged, Size: settledFileInfo.Size, Reason: "modified time and size match the old manifest, hash reused"}
+			if walker.skipped(settledFileInfo.Path) {
+				change.Reason = "in a directory that could not be listed, old entry kept"
+			} else if sampler != nil && sampler.pick(settledFileInfo.Size) {
+				// Re-hash the file to catch content that changed behind an unchanged modified time and size.
+				// A mismatch is only reported: the old entry is kept, since the old hash may be the good one.
+				path := filepath.Join(root, filepath.FromSlash(settledFileInfo.Path))
+				hash, err := rehash(path, *settledFileInfo)
+				switch {
+				case err != nil:
+					opts.Events.emit(&WarningEvent{Path: path, Err: fmt.Errorf("could not verify: %w", err)})
+				case hash == settledFileInfo.Hash:
+					change.Change = ChangeVerified
+					change.Reason = "modified time and size match the old manifest, hash re-checked and matches"
+				default:
+					change.Change = ChangeSuspect
+					change.Reason = fmt.Sprintf("modified time and size match the old manifest, but the hash is now %s instead of %s: suspected corruption, old entry kept", hash, settledFileInfo.Hash)
+					opts.Events.emit(&WarningEvent{Path: path, Err: fmt.Errorf("suspected corruption: %s", change.Reason)})
+				}
+				verifying.Path = settledFileInfo.Path
+				verifying.Files++
+				verifying.Bytes += settledFileInfo.Size
+				opts.Events.progress(verifying)
 			}
+			summary.add(change)
+			opts.Events.emit(&ChangeEvent{change})
+			return writer.Write(*settledFileInfo)
 		}
+		if err := reportDeletedBefore(pendingFileInfo.Path); err != nil {
+			return err
+		}
+		opts.Events.emit(&ChangeEvent{resolvedReader.change})
+		return writer.Write(*pendingFileInfo)
+	})
+	if err == nil {
+		err = reportDeletedBefore("")
+	}
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error writing new manifest file: %v", err)
+	}
 
-		newManifestSlice = append(newManifestSlice, fileInfo)
+	// The old manifest must be closed before it can be replaced on Windows.
+	oldManifest.Close()
+	if inPlace {
+		if err := rotateBackups(oldManifestPath, opts.Backups); err != nil {
+			return nil, fmt.Errorf("error backing up old manifest: %v", err)
+		}
+	}
+	if err := file.Commit(); err != nil {
+		return nil, fmt.Errorf("error writing new manifest file: %v", err)
+	}
+	// A partial manifest of an earlier run is obsolete once the new manifest is complete.
+	if err := os.Remove(partialPath); err != nil && !os.IsNotExist(err) {
+		opts.Events.emit(&WarningEvent{Path: partialPath, Err: fmt.Errorf("error removing partial manifest: %w", err)})
+	}
+	return &UpdateResult{Manifest: writer.manifest(newManifestPath), Summary: summary}, nil
+}
 
+// resolvePending brings the entry of a pending file up to date and sets its change: a moved file
+// takes the entry of its old path, if it is among the orphans and its hash can be reused, and any other
+// file is hashed. It returns an error if the file cannot be read and opts.OnError aborts.
+func resolvePending(ctx context.Context, root string, fileInfo *FileInfo, change *FileChange, orphans map[uint64]FileInfo, movedFrom map[string]bool, hashOpts hashOptions, opts UpdateOptions) error {
+	if fileInfo.Error != "" {
+		// Without its NTFS file ID, the file can neither be matched to a move nor hashed.
 		return nil
-	})
+	}
+	oldFileInfo, exists := orphans[fileInfo.NTFSFileID]
+	if exists && sameModifiedTimeAndSize(oldFileInfo, *fileInfo) && oldFileInfo.Path != fileInfo.Path {
+		movedFrom[oldFileInfo.Path] = true
+		change.OldPath = oldFileInfo.Path
+		if !needsRehash(oldFileInfo, hashOpts) {
+			// The file is unchanged but moved.
+			change.Change = ChangeMoved
+			change.Reason = fmt.Sprintf("same NTFS file ID, modified time and size as %s, hash reused", oldFileInfo.Path)
+			oldFileInfo.Path = fileInfo.Path // Update path to the new relative path.
+			*fileInfo = oldFileInfo
+			return nil
+		}
+		// The file is unchanged but moved, and its hash has to be recalculated anyway.
+		change.Change = ChangeRehashed
+		change.Reason = fmt.Sprintf("moved from %s, hash kind or block list changed, re-hashed", oldFileInfo.Path)
+	}
 
+	// File is new or modified (or its hash is not of the requested kind), calculate its hash.
+	path := filepath.Join(root, filepath.FromSlash(fileInfo.Path))
+	err := opts.OnError.try(ctx, path, func() error {
+		return hashFileInfo(path, fileInfo, hashOpts)
+	})
 	if err != nil {
-		fmt.Printf("Error traversing directory: %v\n", err)
-		return // Exit if directory traversal failed.
+		if err := unreadable(ctx, opts.OnError, opts.Events, path, fileInfo, fmt.Errorf("error calculating hash: %w", err)); err != nil {
+			return err
+		}
+		change.Change = ChangeUnreadable
+		change.Reason = "could not be read: " + fileInfo.Error
 	}
+	return nil
+}
 
-	fmt.Println("All files processed successfully.")
+// savePartialUpdate saves what an interrupted update knows as a partial manifest at partialPath:
+// the entries settled during the walk and the hashed entries of pending files, and the entries of the
+// old manifest for every other path except those of files found to have moved. Files the update did
+// not reach keep their old entries, so updating the partial manifest only checks and hashes them.
+func savePartialUpdate(file *atomicFile, settledPath string, hashed fileIterator, oldManifestPath string, movedFrom map[string]bool, partialPath string) (*Manifest, error) {
+	settledReader, err := openManifest(settledPath)
+	if err != nil {
+		return nil, fmt.Errorf("interrupted, and could not read temporary file: %v", err)
+	}
+	defer settledReader.Close()
+	oldManifest, err := openSortedManifestWith(oldManifestPath, openPartialManifest)
+	if err != nil {
+		return nil, fmt.Errorf("interrupted, and could not read old manifest: %v", err)
+	}
+	defer oldManifest.Close()
+	writer, err := newManifestWriter(file.File)
+	if err != nil {
+		return nil, fmt.Errorf("interrupted, and could not save partial manifest: %v", err)
+	}
 
-	// Sort the new manifest slice by Path for consistent manifest generation.
-	sort.Slice(newManifestSlice, func(i, j int) bool {
-		return newManifestSlice[i].Path < newManifestSlice[j].Path
+	// writeOldBefore writes the old entries before path ("" for all the rest), leaving out path itself.
+	oldFileInfo, oldErr := oldManifest.Next()
+	writeOldBefore := func(path string) error {
+		for ; oldErr == nil && (path == "" || comparePaths(oldFileInfo.Path, path) <= 0); oldFileInfo, oldErr = oldManifest.Next() {
+			if oldFileInfo.Path == path || movedFrom[oldFileInfo.Path] {
+				continue
+			}
+			if err := writer.Write(oldFileInfo); err != nil {
+				return err
+			}
+		}
+		if oldErr != io.EOF {
+			return oldErr
+		}
+		return nil
+	}
+	err = mergeJoin(settledReader, hashed, func(settledFileInfo, hashedFileInfo *FileInfo) error {
+		fileInfo := settledFileInfo
+		if fileInfo == nil {
+			fileInfo = hashedFileInfo
+		}
+		if err := writeOldBefore(fileInfo.Path); err != nil {
+			return err
+		}
+		return writer.Write(*fileInfo)
 	})
+	if err == nil {
+		err = writeOldBefore("")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("interrupted, and could not save partial manifest: %v", err)
+	}
 
-	// Write the collected file information to the new manifest file.
-	err = writeManifest(file, newManifestSlice) // Assumes writeManifest is defined elsewhere.
+	// The old manifest may be the partial manifest being replaced, which must be closed on Windows.
+	oldManifest.Close()
+	writer.partial = true
+	err = writer.Close()
+	if err == nil {
+		err = file.CommitAs(partialPath)
+	}
 	if err != nil {
-		fmt.Printf("Error writing new manifest file: %v\n", err)
-		return
+		return nil, fmt.Errorf("interrupted, and could not save partial manifest: %v", err)
 	}
+	return writer.manifest(partialPath), nil
+}
+
+func Update(cmd *cobra.Command, args []string) error {
+	// Extract arguments.
+	directoryPath := args[0]
+	oldManifestPath := args[1]
+	// Without a new manifest path, the old manifest is replaced.
+	newManifestPath := ""
+	if len(args) == 3 {
+		newManifestPath = args[2]
+	}
+	blockSize, quickWindow, contentDefined, err := getHashFlags(cmd)
+	if err != nil {
+		return err
+	}
+	force, err := cmd.Flags().GetBool("force")
+	if err != nil {
+		return fmt.Errorf("error retrieving force flag: %v", err)
+	}
+	resume, err := cmd.Flags().GetBool("resume")
+	if err != nil {
+		return fmt.Errorf("error retrieving resume flag: %v", err)
+	}
+	backups, err := cmd.Flags().GetInt("backups")
+	if err != nil {
+		return fmt.Errorf("error retrieving backups flag: %v", err)
+	}
+	explainFlag, err := cmd.Flags().GetBool("explain")
+	if err != nil {
+		return fmt.Errorf("error retrieving explain flag: %v", err)
+	}
+	jsonFlag, err := cmd.Flags().GetBool("json")
+	if err != nil {
+		return fmt.Errorf("error retrieving json flag: %v", err)
+	}
+	verifySample, err := cmd.Flags().GetString("verify-sample")
+	if err != nil {
+		return fmt.Errorf("error retrieving verify-sample flag: %v", err)
+	}
+	verifyRate, verifyBudget, err := parseVerifySample(verifySample)
+	if err != nil {
+		return fmt.Errorf("invalid verify-sample flag: %v", err)
+	}
+	ignore, err := getIgnoreFlag(cmd)
+	if err != nil {
+		return err
+	}
+	policy, err := getErrorPolicyFlag(cmd)
+	if err != nil {
+		return err
+	}
+	historyDir, err := cmd.Flags().GetString("history")
+	if err != nil {
+		return fmt.Errorf("error retrieving history flag: %v", err)
+	}
+	// With --json, stdout carries only the JSON report and progress messages go to stderr.
+	var info io.Writer = os.Stdout
+	if jsonFlag {
+		info = os.Stderr
+	}
+	logrus.Debugf("Executing 'update' command with directory: '%s', old manifest: '%s', new manifest: '%s', block size: %d, quick hash window: %d", directoryPath, oldManifestPath, newManifestPath, blockSize, quickWindow)
+	if quickWindow > 0 {
+		fmt.Fprint(os.Stderr, quickHashWarning(quickWindow))
+	}
+
+	// A new history starts with the old manifest, so that the first update already shows up as changes.
+	if historyDir != "" {
+		generations, err := ListGenerations(historyDir)
+		if err != nil {
+			return err
+		}
+		if len(generations) == 0 {
+			if _, err := RecordGeneration(historyDir, oldManifestPath); err != nil {
+				return fmt.Errorf("error recording the old manifest in the history: %v", err)
+			}
+		}
+	}
+
+	report := &changeReport{w: os.Stdout, explain: explainFlag, json: jsonFlag}
+	printer, err := newEventPrinter(cmd, info)
+	if err != nil {
+		return err
+	}
+	var reportErr error
+	result, err := UpdateManifest(cmd.Context(), directoryPath, oldManifestPath, UpdateOptions{
+		NewManifestPath: newManifestPath,
+		BlockSize:       blockSize,
+		ContentDefined:  contentDefined,
+		QuickHashWindow: quickWindow,
+		Force:           force,
+		Resume:          resume,
+		Backups:         backups,
+		VerifyRate:      verifyRate,
+		VerifyBudget:    verifyBudget,
+		Ignore:          ignore,
+		OnError:         policy,
+		Events: func(e Event) {
+			if change, ok := e.(*ChangeEvent); ok {
+				if explainFlag {
+					printer.clearLine()
+				}
+				if err := report.file(change.FileChange); err != nil && reportErr == nil {
+					reportErr = err
+				}
+				return
+			}
+			printer.handle(e)
+		},
+	})
+	printer.done()
+	if result != nil && result.Manifest.Partial {
+		fmt.Fprintf(info, "Interrupted. What was found so far was saved to %s; run the same command with --resume to continue.\n", result.Manifest.Path)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(printer.warnings) == 0 {
+		fmt.Fprintln(info, "All files processed successfully.")
+	}
+	if reportErr == nil {
+		reportErr = report.end(result.Summary)
+	}
+	if reportErr != nil {
+		return fmt.Errorf("error writing report: %v", reportErr)
+	}
+	fmt.Fprintf(info, "New manifest written to %s\n", result.Manifest.Path)
+	if historyDir != "" {
+		// The new manifest is in place by now, so failing to record it only warrants a warning.
+		generation, err := RecordGeneration(historyDir, result.Manifest.Path)
+		if err != nil {
+			printer.handle(&WarningEvent{Path: historyDir, Err: fmt.Errorf("the new manifest could not be recorded in the history: %w", err)})
+		} else {
+			fmt.Fprintf(info, "Recorded as generation %d of %s\n", generation.Number, historyDir)
+		}
+	}
+	return printer.errorReport()
+}
 
-	fmt.Printf("New manifest written to %s\n", newManifestPath)
+// sameModifiedTimeAndSize reports whether a file looks unchanged, comparing modified time at second precision.
+func sameModifiedTimeAndSize(fi1, fi2 FileInfo) bool {
+	return fi1.ModifiedTime.Unix() == fi2.ModifiedTime.Unix() && fi1.Size == fi2.Size
 }
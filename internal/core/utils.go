@@ -2,7 +2,6 @@ package core
 
 import (
 	"crypto/md5"
-	"encoding/csv"
 	"encoding/hex"
 	"fmt"
 	"io"
@@ -13,6 +12,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/spf13/cobra"
 	"golang.org/x/sys/windows"
 )
 
@@ -23,92 +23,10 @@ type FileInfo struct {
 	Size         int64     // in bytes
 	Hash         string    // MD5 hash
 	NTFSFileID   uint64
-}
-
-// readManifest reads a manifest CSV file and returns a slice of FileInfo.
-func readManifest(manifestPath string) ([]FileInfo, error) {
-	file, err := os.Open(manifestPath)
-	if err != nil {
-		return nil, fmt.Errorf("error opening manifest file: %v", err)
-	}
-	defer file.Close()
-
-	r := csv.NewReader(file)
-	r.FieldsPerRecord = 5
-
-	var fileInfoSlice []FileInfo
-
-	// Read and skip the header
-	header, err := r.Read()
-	if err != nil {
-		return nil, fmt.Errorf("error reading manifest header: %v", err)
-	}
-	if len(header) != 5 {
-		return nil, fmt.Errorf("invalid manifest header: %v", header)
-	}
-
-	for {
-		fields, err := r.Read()
-		if err != nil {
-			if err.Error() == "EOF" {
-				break
-			}
-			return nil, fmt.Errorf("error reading manifest line: %v", err)
-		}
-		if len(fields) != 5 {
-			return nil, fmt.Errorf("invalid manifest line (field count): %v", fields)
-		}
-
-		unixTime, err := strconv.ParseInt(fields[1], 10, 64)
-		if err != nil {
-			return nil, fmt.Errorf("error parsing ModifiedTime in line %v: %v", fields, err)
-		}
-		size, err := strconv.ParseInt(fields[2], 10, 64)
-		if err != nil {
-			return nil, fmt.Errorf("error parsing Size in line %v: %v", fields, err)
-		}
-		fileID, err := strconv.ParseUint(fields[4], 10, 64)
-		if err != nil {
-			return nil, fmt.Errorf("error parsing NTFSFileID in line %v: %v", fields, err)
-		}
-
-		fileInfoSlice = append(fileInfoSlice, FileInfo{
-			Path:         fields[0],
-			ModifiedTime: time.Unix(unixTime, 0),
-			Size:         size,
-			Hash:         fields[3],
-			NTFSFileID:   fileID,
-		})
-	}
-
-	return fileInfoSlice, nil
-}
-
-// writeManifest writes a slice of FileInfo to a CSV manifest file.
-func writeManifest(file *os.File, fileInfoSlice []FileInfo) error {
-	writer := csv.NewWriter(file)
-	defer writer.Flush()
-
-	// Write the header line.
-	header := []string{"Path", "ModifiedTime", "Size", "Hash", "NtfsFileId"}
-	if err := writer.Write(header); err != nil {
-		return fmt.Errorf("error writing header to manifest file: %v", err)
-	}
-
-	for _, fileInfo := range fileInfoSlice {
-		line := []string{
-			fileInfo.Path,
-			strconv.FormatInt(fileInfo.ModifiedTime.Unix(), 10),
-			strconv.FormatInt(fileInfo.Size, 10),
-			fileInfo.Hash,
-			strconv.FormatUint(fileInfo.NTFSFileID, 10),
-		}
-		if err := writer.Write(line); err != nil {
-			return fmt.Errorf("error writing line to manifest file: %v", err)
-		}
-	}
-
-	return nil
+	BlockSize    int64    // size of the blocks in BlockHashes, or their average size if ChunkSizes is set; 0 if there is no block list
+	BlockHashes  []string // MD5 hash of each block, the last block may be shorter
+	ChunkSizes   []int64  // size of each block if the file was split into content-defined chunks, nil for fixed-size blocks
+	Error        string   // why the file could not be read, in which case Hash is empty; "" if it was read
 }
 
 func createFile(path string) (*os.File, error) {
@@ -158,6 +76,42 @@ func calculateMD5(filePath string) (string, error) {
 	return md5String, nil
 }
 
+// parseSize parses a byte count with an optional binary unit suffix, e.g. "512", "64K", "4M" or "1.5G".
+func parseSize(size string) (int64, error) {
+	s := strings.TrimSpace(strings.ToUpper(size))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I")
+	multiplier := int64(1)
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'K':
+			multiplier = 1024
+		case 'M':
+			multiplier = 1024 * 1024
+		case 'G':
+			multiplier = 1024 * 1024 * 1024
+		case 'T':
+			multiplier = 1024 * 1024 * 1024 * 1024
+		}
+		if multiplier > 1 {
+			s = s[:len(s)-1]
+		}
+	}
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	return int64(value * float64(multiplier)), nil
+}
+
+// getSizeFlag reads a size flag such as "4M". An empty flag is returned as 0.
+func getSizeFlag(cmd *cobra.Command, name string) (int64, error) {
+	value, err := cmd.Flags().GetString(name)
+	if err != nil || value == "" {
+		return 0, err
+	}
+	return parseSize(value)
+}
+
 func toFriendlySize(size int64) string {
 	if size < 1024 {
 		return fmt.Sprintf("%d B", size)
@@ -253,3 +207,9 @@ func isNTFS(dirPath string) (bool, error) {
 	// Compare the obtained file system name with "NTFS".
 	return fileSystemName == "NTFS", nil
 }
+
+// isTerminal reports whether a file is a console, as opposed to a pipe or a regular file.
+func isTerminal(file *os.File) bool {
+	var mode uint32
+	return windows.GetConsoleMode(windows.Handle(file.Fd()), &mode) == nil
+}
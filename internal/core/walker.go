@@ -0,0 +1,180 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"sync"
+)
+
+var errWalkStopped = errors.New("walk stopped")
+
+type walkResult struct {
+	fileInfo FileInfo
+	err      error
+	path     string // the path that could not be read, if err can be skipped
+	dir      string // the path relative to the walked directory, if it is a directory that could not be listed
+}
+
+// dirWalker is a fileIterator over the regular files below a directory.
+// The walk runs in its own goroutine and stays a few entries ahead of the consumer,
+// so work done in the visit callback (e.g. hashing) overlaps with the consumer.
+type dirWalker struct {
+	results  <-chan walkResult
+	done     chan struct{}
+	stopOnce sync.Once
+	onError  func(path string, err error) error
+	// skippedDirs are the directories that could not be listed and were skipped, relative to the walked directory.
+	skippedDirs []string
+}
+
+// newDirWalker starts walking dir.
+// onError is called for paths that cannot be read; returning nil skips the path,
+// returning an error aborts the walk. A nil onError aborts on the first error.
+// dir itself must be readable: otherwise Next fails, whatever onError says, since every file
+// would look deleted.
+// onError is called from Next, so it runs in the consumer's goroutine, in walk order.
+// Files and directories matched by ignore are left out.
+// visit, if not nil, is called for every file before it is handed to the consumer
+// and may fill in further fields of fileInfo. path is the file's path on disk.
+// An error returned by visit aborts the walk.
+func newDirWalker(dir string, ignore *ignoreRules, onError func(path string, err error) error, visit func(path string, fileInfo *FileInfo) error) *dirWalker {
+	if onError == nil {
+		onError = func(path string, err error) error { return err }
+	}
+
+	results := make(chan walkResult, 64)
+	w := &dirWalker{results: results, done: make(chan struct{}), onError: onError}
+
+	// send hands a result to the consumer, or stops the walk if the walker was closed.
+	send := func(res walkResult) error {
+		select {
+		case results <- res:
+			return nil
+		case <-w.done:
+			return errWalkStopped
+		}
+	}
+
+	go func() {
+		defer close(results)
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			// Paths that cannot be read are skipped here; the consumer decides whether that aborts the walk.
+			if err != nil {
+				if path == dir {
+					return fmt.Errorf("error reading directory %s: %w", dir, err)
+				}
+				res := walkResult{path: path, err: err}
+				if d != nil && d.IsDir() {
+					if relativePath, relErr := filepath.Rel(dir, path); relErr == nil {
+						res.dir = filepath.ToSlash(relativePath)
+					}
+				}
+				return send(res)
+			}
+			if ignored, err := ignore.skipWalk(dir, path, d); ignored {
+				return err
+			}
+			if d.IsDir() {
+				return nil // Skip directories
+			}
+
+			info, err := d.Info()
+			if err != nil {
+				return send(walkResult{path: path, err: err})
+			}
+
+			relativePath, err := filepath.Rel(dir, path) // Make the path relative to the directory.
+			if err != nil {
+				return send(walkResult{path: path, err: fmt.Errorf("error getting relative path for %s: %w", path, err)})
+			}
+
+			fileInfo := FileInfo{
+				Path:         filepath.ToSlash(relativePath), // Convert to forward slashes for consistency.
+				ModifiedTime: info.ModTime(),
+				Size:         info.Size(),
+			}
+			if visit != nil {
+				if err := visit(path, &fileInfo); err != nil {
+					return err
+				}
+			}
+
+			return send(walkResult{fileInfo: fileInfo})
+		})
+		if err != nil && err != errWalkStopped {
+			send(walkResult{err: err})
+		}
+	}()
+
+	return w
+}
+
+// Next returns the next file of the walk, or io.EOF once the walk is complete.
+func (w *dirWalker) Next() (FileInfo, error) {
+	for {
+		res, ok := <-w.results
+		if !ok {
+			return FileInfo{}, io.EOF
+		}
+		switch {
+		case res.err == nil:
+			return res.fileInfo, nil
+		case res.path == "":
+			return FileInfo{}, res.err
+		}
+		if err := w.onError(res.path, res.err); err != nil {
+			return FileInfo{}, err
+		}
+		if res.dir != "" {
+			w.skippedDirs = append(w.skippedDirs, res.dir)
+		}
+	}
+}
+
+// skipped reports whether a path relative to the walked directory lies in a directory that
+// could not be listed, so that its absence from the walk does not mean it is gone.
+// Only the directories the walk has passed are known: in a merge-join, those before the
+// entry Next returned last, which covers every path that sorts before that entry.
+func (w *dirWalker) skipped(relativePath string) bool {
+	for _, dir := range w.skippedDirs {
+		if inSubtree(relativePath, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// Close stops the walk if it is still running and waits for its goroutine to finish.
+func (w *dirWalker) Close() {
+	w.stopOnce.Do(func() { close(w.done) })
+	for range w.results {
+	}
+}
+
+// measureTree counts the regular files below dir and their total size, for progress reporting.
+// Paths that cannot be read are skipped; they are reported by the walk that does the work.
+func measureTree(ctx context.Context, dir string, ignore *ignoreRules) (files int, bytes int64) {
+	_ = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if ignored, err := ignore.skipWalk(dir, path, d); ignored {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		files++
+		bytes += info.Size()
+		return ctx.Err()
+	})
+	return files, bytes
+}
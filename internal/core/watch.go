@@ -0,0 +1,602 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// Defaults for WatchOptions.
+const (
+	defaultDebounce      = 2 * time.Second
+	defaultFlushInterval = time.Minute
+)
+
+// WatchOptions configures WatchManifest.
+type WatchOptions struct {
+	Debounce        time.Duration // re-hash a file once it has not changed for this long, defaultDebounce if 0
+	FlushInterval   time.Duration // write the manifest at most this often while it has changes, defaultFlushInterval if 0
+	BlockSize       int64         // also record a block list with blocks of this size, 0 for none
+	ContentDefined  bool          // split files into content-defined chunks of about BlockSize instead of fixed-size blocks
+	QuickHashWindow int64         // record quick hashes with windows of this size instead of full hashes, 0 for full hashes
+	Ignore          []string      // leave out files and directories matching these patterns (see ignoreRules)
+	OnError         ErrorPolicy
+	Events          EventHandler
+}
+
+// manifestWatch is the state of WatchManifest. Only the changes since the manifest was last
+// written are kept in memory; the entries of the files that had events are looked up in the
+// manifest on disk, once for all the files that became quiet together.
+type manifestWatch struct {
+	root         string
+	manifestPath string
+	opts         WatchOptions
+	hashOpts     hashOptions
+	ignore       *ignoreRules
+	watcher      *fsnotify.Watcher
+	changes      map[string]*FileInfo // entries changed since the manifest was written, by path; nil for removed ones
+	dirty        map[string]time.Time // paths with events since they were last looked at, and when the last event came
+}
+
+// WatchManifest keeps the manifest of root up to date until ctx is cancelled.
+// It first brings the manifest up to date like UpdateManifest (or creates it like CreateManifest),
+// then watches the tree for changes and re-hashes the files that changed once they have been
+// quiet for opts.Debounce. The manifest is replaced atomically every opts.FlushInterval while
+// it has changes, and when WatchManifest returns. If the operating system drops change
+// notifications, the whole tree is scanned again.
+//
+// Each change is reported with a ChangeEvent and each write of the manifest with a FlushEvent.
+// WatchManifest returns nil once ctx is cancelled and the manifest has been written.
+func WatchManifest(ctx context.Context, root, manifestPath string, opts WatchOptions) error {
+	if opts.Debounce <= 0 {
+		opts.Debounce = defaultDebounce
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = defaultFlushInterval
+	}
+	hashOpts, err := newHashOptions(opts.BlockSize, opts.QuickHashWindow, opts.ContentDefined)
+	if err != nil {
+		return err
+	}
+	// The manifest's own files are left out of the scans as well as the events.
+	opts.Ignore = append(slices.Clip(opts.Ignore), manifestIgnorePatterns(root, manifestPath)...)
+	ignore, err := newIgnoreRules(opts.Ignore)
+	if err != nil {
+		return err
+	}
+	isNTFS, err := isNTFS(root)
+	if err != nil {
+		return fmt.Errorf("error checking file system type: %v", err)
+	}
+	if !isNTFS {
+		return fmt.Errorf("%s is not on an NTFS file system, NTFS file IDs are not available", root)
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("error watching %s: %v", root, err)
+	}
+	defer watcher.Close()
+
+	w := &manifestWatch{
+		root:         root,
+		manifestPath: manifestPath,
+		opts:         opts,
+		hashOpts:     hashOpts,
+		ignore:       ignore,
+		watcher:      watcher,
+		changes:      make(map[string]*FileInfo),
+		dirty:        make(map[string]time.Time),
+	}
+
+	// Watch before scanning, so that changes made during the scan are picked up afterwards.
+	if err := w.watchTree(root, false); err != nil {
+		return err
+	}
+	if err := w.rescan(ctx); err != nil {
+		return err
+	}
+
+	check := time.NewTicker(opts.Debounce)
+	defer check.Stop()
+	flush := time.NewTicker(opts.FlushInterval)
+	defer flush.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			// Files still waiting for their debounce period are left to the initial scan of the next run.
+			return w.flush()
+
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return errors.New("file system watcher stopped")
+			}
+			if err := w.noteEvent(event); err != nil {
+				return err
+			}
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return errors.New("file system watcher stopped")
+			}
+			if !errors.Is(err, fsnotify.ErrEventOverflow) {
+				opts.Events.emit(&WarningEvent{Path: root, Err: err})
+				continue
+			}
+			// Changes were lost, so only a full scan can tell what changed.
+			opts.Events.emit(&WarningEvent{Path: root, Err: errors.New("too many changes to track, scanning the whole directory again")})
+			if err := w.flush(); err != nil {
+				return err
+			}
+			clear(w.dirty)
+			if err := w.rescan(ctx); err != nil {
+				return err
+			}
+
+		case now := <-check.C:
+			if err := w.processQuiet(ctx, now); err != nil {
+				return err
+			}
+
+		case <-flush.C:
+			if err := w.flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// manifestIgnorePatterns returns ignore patterns for the files of a manifest inside root:
+// the manifest, its backups and partial manifest, and the temporary files it is written through.
+func manifestIgnorePatterns(root, manifestPath string) []string {
+	rel, err := filepath.Rel(root, manifestPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil
+	}
+	// A leading slash makes a pattern match the whole path rather than a name at any depth.
+	rel = filepath.ToSlash(rel)
+	dir := path.Dir(rel)
+	temporary := "/.ssync-*"
+	if dir != "." {
+		temporary = "/" + escapePattern(dir) + temporary
+	}
+	return []string{"/" + escapePattern(rel) + "*", temporary}
+}
+
+// escapePattern escapes the characters of a name that path.Match would take for wildcards.
+func escapePattern(name string) string {
+	var b strings.Builder
+	for _, c := range name {
+		if strings.ContainsRune(`*?[]\`, c) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// rescan brings the manifest on disk up to date with a full scan.
+func (w *manifestWatch) rescan(ctx context.Context) error {
+	// Unchanged files are not worth an event each.
+	events := func(e Event) {
+		if change, ok := e.(*ChangeEvent); ok && change.Change == ChangeUnchanged {
+			return
+		}
+		w.opts.Events.emit(e)
+	}
+	if _, err := os.Stat(w.manifestPath); err == nil {
+		_, err := UpdateManifest(ctx, w.root, w.manifestPath, UpdateOptions{
+			BlockSize:       w.opts.BlockSize,
+			ContentDefined:  w.opts.ContentDefined,
+			QuickHashWindow: w.opts.QuickHashWindow,
+			Ignore:          w.opts.Ignore,
+			OnError:         w.opts.OnError,
+			Events:          events,
+		})
+		if err != nil {
+			return err
+		}
+	} else {
+		_, err := CreateManifest(ctx, w.root, w.manifestPath, CreateOptions{
+			BlockSize:       w.opts.BlockSize,
+			ContentDefined:  w.opts.ContentDefined,
+			QuickHashWindow: w.opts.QuickHashWindow,
+			Ignore:          w.opts.Ignore,
+			OnError:         w.opts.OnError,
+			Events:          events,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	clear(w.changes)
+	return nil
+}
+
+// watchTree watches dir and the directories below it. With markFiles, the files found
+// are marked dirty, for directories that appeared after the watch started.
+func (w *manifestWatch) watchTree(dir string, markFiles bool) error {
+	now := time.Now()
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return w.opts.OnError.skip(w.opts.Events, path, err)
+		}
+		if ignored, err := w.ignore.skipWalk(w.root, path, d); ignored {
+			return err
+		}
+		if !d.IsDir() {
+			if markFiles {
+				if rel, ok := w.relativePath(path); ok {
+					w.dirty[rel] = now
+				}
+			}
+			return nil
+		}
+		if err := w.watcher.Add(path); err != nil {
+			return w.opts.OnError.skip(w.opts.Events, path, fmt.Errorf("error watching directory: %w", err))
+		}
+		return nil
+	})
+}
+
+// relativePath returns the manifest path of a path on disk, and false for paths
+// that are not tracked: the root itself and ignored paths, which include the manifest's own files.
+func (w *manifestWatch) relativePath(path string) (string, bool) {
+	rel, err := filepath.Rel(w.root, path)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return "", false
+	}
+	rel = filepath.ToSlash(rel)
+	if w.ignore.match(rel) {
+		return "", false
+	}
+	return rel, true
+}
+
+// noteEvent marks the path of a change notification dirty. New directories are watched at once,
+// so that files created in them right away are not missed.
+func (w *manifestWatch) noteEvent(event fsnotify.Event) error {
+	rel, ok := w.relativePath(event.Name)
+	if !ok {
+		return nil
+	}
+	logrus.WithFields(logrus.Fields{"path": rel, "event": event.Op.String()}).Debug("File system event")
+	w.dirty[rel] = time.Now()
+	if event.Has(fsnotify.Create) {
+		if info, err := os.Lstat(event.Name); err == nil && info.IsDir() {
+			return w.watchTree(event.Name, true)
+		}
+	}
+	return nil
+}
+
+// processQuiet looks at the dirty paths that have had no events for the debounce period.
+// Paths that disappeared are removed from the manifest, along with everything below them,
+// and files that changed are re-hashed, unless they turn out to be moved files whose hash can be reused.
+func (w *manifestWatch) processQuiet(ctx context.Context, now time.Time) error {
+	var quiet []string
+	for rel, last := range w.dirty {
+		if now.Sub(last) >= w.opts.Debounce {
+			quiet = append(quiet, rel)
+		}
+	}
+	if len(quiet) == 0 {
+		return nil
+	}
+	sort.Slice(quiet, func(i, j int) bool { return comparePaths(quiet[i], quiet[j]) < 0 })
+	current, err := w.lookup(quiet)
+	if err != nil {
+		return err
+	}
+
+	// Removals come first, so that the files they leave behind can be matched with moved files.
+	var changes []FileChange
+	var files []string
+	removed := make(map[uint64]FileInfo)
+	var removedPaths []string
+	for _, rel := range quiet {
+		delete(w.dirty, rel)
+		path := filepath.Join(w.root, filepath.FromSlash(rel))
+		info, err := os.Lstat(path)
+		switch {
+		case os.IsNotExist(err):
+			w.watcher.Remove(path) // In case it was a directory; the watch may already be gone.
+			for _, old := range w.remove(rel, current) {
+				if old.Error == "" {
+					removed[old.NTFSFileID] = old
+				}
+				removedPaths = append(removedPaths, old.Path)
+			}
+		case err != nil:
+			if err := w.opts.OnError.skip(w.opts.Events, path, err); err != nil {
+				return err
+			}
+		case info.IsDir():
+			// Its files are marked dirty on their own.
+		default:
+			files = append(files, rel)
+		}
+	}
+
+	movedFrom := make(map[string]bool)
+	for _, rel := range files {
+		if err := ctx.Err(); err != nil {
+			return nil // The caller writes the manifest and returns.
+		}
+		change, err := w.refresh(ctx, rel, current, removed)
+		if err != nil {
+			return err
+		}
+		if change == nil {
+			continue
+		}
+		if change.Change == ChangeMoved {
+			movedFrom[change.OldPath] = true
+		}
+		changes = append(changes, *change)
+	}
+	for _, rel := range removedPaths {
+		if !movedFrom[rel] {
+			changes = append(changes, FileChange{Path: rel, Change: ChangeDeleted, Reason: "no longer on disk"})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool { return comparePaths(changes[i].Path, changes[j].Path) < 0 })
+	for _, change := range changes {
+		w.opts.Events.emit(&ChangeEvent{change})
+	}
+	return nil
+}
+
+// lookup returns the current entries for paths, and for the files below those that are directories:
+// the entries of the manifest on disk, with the changes since it was written applied.
+func (w *manifestWatch) lookup(paths []string) (map[string]FileInfo, error) {
+	wanted := make(map[string]bool, len(paths))
+	for _, rel := range paths {
+		wanted[rel] = true
+	}
+	isWanted := func(rel string) bool {
+		for {
+			if wanted[rel] {
+				return true
+			}
+			i := strings.LastIndexByte(rel, '/')
+			if i < 0 {
+				return false
+			}
+			rel = rel[:i]
+		}
+	}
+
+	manifest, err := openManifest(w.manifestPath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest: %v", err)
+	}
+	defer manifest.Close()
+	entries := make(map[string]FileInfo)
+	for {
+		fileInfo, err := manifest.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading manifest: %v", err)
+		}
+		if isWanted(fileInfo.Path) {
+			entries[fileInfo.Path] = fileInfo
+		}
+	}
+	for rel, fileInfo := range w.changes {
+		switch {
+		case !isWanted(rel):
+		case fileInfo == nil:
+			delete(entries, rel)
+		default:
+			entries[rel] = *fileInfo
+		}
+	}
+	return entries, nil
+}
+
+// remove deletes the entry for rel and those below it, if rel was a directory, from current
+// and the manifest, and returns them.
+func (w *manifestWatch) remove(rel string, current map[string]FileInfo) []FileInfo {
+	var removed []FileInfo
+	for path, fileInfo := range current {
+		if path == rel || strings.HasPrefix(path, rel+"/") {
+			removed = append(removed, fileInfo)
+			delete(current, path)
+			w.changes[path] = nil
+		}
+	}
+	return removed
+}
+
+// refresh brings the entry of a file that had events up to date. It returns nil if the file is unchanged.
+func (w *manifestWatch) refresh(ctx context.Context, rel string, current map[string]FileInfo, removed map[uint64]FileInfo) (*FileChange, error) {
+	path := filepath.Join(w.root, filepath.FromSlash(rel))
+	info, err := os.Lstat(path)
+	if err != nil {
+		// Gone again since it was looked at; the next event for it sorts that out.
+		return nil, nil
+	}
+	fileInfo := FileInfo{Path: rel, ModifiedTime: info.ModTime(), Size: info.Size()}
+	old, exists := current[rel]
+	change := FileChange{Path: rel, Size: fileInfo.Size}
+
+	err = w.opts.OnError.try(ctx, path, func() error {
+		fileID, err := getNTFSFileID(path)
+		fileInfo.NTFSFileID = fileID
+		return err
+	})
+	if err != nil {
+		if err := unreadable(ctx, w.opts.OnError, w.opts.Events, path, &fileInfo, fmt.Errorf("error getting NTFS file ID: %w", err)); err != nil {
+			return nil, err
+		}
+		change.Change, change.Reason = ChangeUnreadable, "could not be read: "+fileInfo.Error
+		w.set(fileInfo)
+		return &change, nil
+	}
+
+	moved, isMove := removed[fileInfo.NTFSFileID]
+	switch {
+	case exists && sameModifiedTimeAndSize(old, fileInfo) && !needsRehash(old, w.hashOpts):
+		// Touched, but not changed, e.g. only opened for writing.
+		return nil, nil
+	case isMove && sameModifiedTimeAndSize(moved, fileInfo) && !needsRehash(moved, w.hashOpts):
+		delete(removed, fileInfo.NTFSFileID)
+		fileInfo.Hash, fileInfo.BlockSize, fileInfo.BlockHashes, fileInfo.ChunkSizes = moved.Hash, moved.BlockSize, moved.BlockHashes, moved.ChunkSizes
+		change.Change, change.OldPath = ChangeMoved, moved.Path
+		change.Reason = fmt.Sprintf("same NTFS file ID, modified time and size as %s, hash reused", moved.Path)
+		w.set(fileInfo)
+		return &change, nil
+	case exists:
+		change.Change = ChangeModified
+		change.Reason = describeDifference(old, fileInfo, false)
+		if change.Reason == "" {
+			change.Reason = "hash kind or block list changed"
+		}
+		change.Reason += ", re-hashed"
+	default:
+		change.Change, change.Reason = ChangeNew, "created, hashed"
+	}
+
+	err = w.opts.OnError.try(ctx, path, func() error {
+		return hashFileInfo(path, &fileInfo, w.hashOpts)
+	})
+	if err != nil {
+		if err := unreadable(ctx, w.opts.OnError, w.opts.Events, path, &fileInfo, fmt.Errorf("error calculating hash: %w", err)); err != nil {
+			return nil, err
+		}
+		change.Change, change.Reason = ChangeUnreadable, "could not be read: "+fileInfo.Error
+	}
+	w.set(fileInfo)
+	return &change, nil
+}
+
+func (w *manifestWatch) set(fileInfo FileInfo) {
+	w.changes[fileInfo.Path] = &fileInfo
+}
+
+// flush replaces the manifest on disk with one that has the changes applied, if there are any.
+func (w *manifestWatch) flush() error {
+	if len(w.changes) == 0 {
+		return nil
+	}
+	changed := make([]FileInfo, 0, len(w.changes))
+	for path := range w.changes {
+		changed = append(changed, FileInfo{Path: path})
+	}
+	sortFileInfoSlice(changed)
+
+	manifest, err := openManifest(w.manifestPath)
+	if err != nil {
+		return fmt.Errorf("error reading manifest: %v", err)
+	}
+	defer manifest.Close()
+	file, err := createManifestFile(w.manifestPath, true)
+	if err != nil {
+		return fmt.Errorf("error creating manifest file: %v", err)
+	}
+	defer file.Abort()
+	writer, err := newManifestWriter(file.File)
+	if err != nil {
+		return fmt.Errorf("error writing manifest file: %v", err)
+	}
+	err = mergeJoin(manifest, &sliceIterator{fileInfoSlice: changed}, func(old, change *FileInfo) error {
+		if change == nil {
+			return writer.Write(*old)
+		}
+		if fileInfo := w.changes[change.Path]; fileInfo != nil {
+			return writer.Write(*fileInfo)
+		}
+		return nil
+	})
+	if err == nil {
+		err = writer.Close()
+	}
+	// The manifest must be closed before it can be replaced on Windows.
+	manifest.Close()
+	if err == nil {
+		err = file.Commit()
+	}
+	if err != nil {
+		return fmt.Errorf("error writing manifest file: %v", err)
+	}
+	clear(w.changes)
+	w.opts.Events.emit(&FlushEvent{*writer.manifest(w.manifestPath)})
+	return nil
+}
+
+func Watch(cmd *cobra.Command, args []string) error {
+	directoryPath := args[0]
+	manifestPath := args[1]
+	blockSize, quickWindow, contentDefined, err := getHashFlags(cmd)
+	if err != nil {
+		return err
+	}
+	debounce, err := cmd.Flags().GetDuration("debounce")
+	if err != nil {
+		return fmt.Errorf("error retrieving debounce flag: %v", err)
+	}
+	flushInterval, err := cmd.Flags().GetDuration("flush-interval")
+	if err != nil {
+		return fmt.Errorf("error retrieving flush-interval flag: %v", err)
+	}
+	ignore, err := getIgnoreFlag(cmd)
+	if err != nil {
+		return err
+	}
+	policy, err := getErrorPolicyFlag(cmd)
+	if err != nil {
+		return err
+	}
+	logrus.Debugf("Executing 'watch' command with directory: '%s', manifest: '%s', debounce: %v, flush interval: %v", directoryPath, manifestPath, debounce, flushInterval)
+	if quickWindow > 0 {
+		fmt.Fprint(os.Stderr, quickHashWarning(quickWindow))
+	}
+
+	printer, err := newEventPrinter(cmd, os.Stdout)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Watching %s, press Ctrl-C to stop.\n", directoryPath)
+	err = WatchManifest(cmd.Context(), directoryPath, manifestPath, WatchOptions{
+		Debounce:        debounce,
+		FlushInterval:   flushInterval,
+		BlockSize:       blockSize,
+		ContentDefined:  contentDefined,
+		QuickHashWindow: quickWindow,
+		Ignore:          ignore,
+		OnError:         policy,
+		Events: func(e Event) {
+			switch e := e.(type) {
+			case *ChangeEvent:
+				printer.printf("[%s] %s: %s\n", e.Change, e.Path, e.Reason)
+			case *FlushEvent:
+				printer.printf("Manifest written to %s (%d files)\n", e.Path, e.Files)
+			default:
+				printer.handle(e)
+			}
+		},
+	})
+	printer.done()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Stopped watching %s; manifest written to %s\n", directoryPath, manifestPath)
+	return printer.errorReport()
+}
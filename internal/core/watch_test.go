@@ -0,0 +1,123 @@
+package core
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestManifestIgnorePatterns(t *testing.T) {
+	root := t.TempDir()
+	for _, tt := range []struct {
+		manifestPath string
+		ignored      []string
+		tracked      []string
+	}{
+		{
+			filepath.Join(root, "m.csv"),
+			[]string{"m.csv", "m.csv.1", "m.csv.partial", ".ssync-123-m.csv", ".ssync-update-1.json"},
+			[]string{"dir/m.csv", "dir/.ssync-1.tmp", "n.csv"},
+		},
+		{
+			filepath.Join(root, "meta", "[x] m.csv"),
+			[]string{"meta/[x] m.csv", "meta/[x] m.csv.2", "meta/.ssync-1-[x] m.csv"},
+			[]string{"meta/x m.csv", "[x] m.csv", ".ssync-1.tmp", "meta/sub/.ssync-1.tmp"},
+		},
+		{filepath.Join(filepath.Dir(root), "m.csv"), nil, []string{"m.csv", ".ssync-1.tmp"}},
+	} {
+		patterns := manifestIgnorePatterns(root, tt.manifestPath)
+		ignore, err := newIgnoreRules(patterns)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, rel := range tt.ignored {
+			if !ignore.match(rel) {
+				t.Errorf("manifest %s: %s is not ignored by %q", tt.manifestPath, rel, patterns)
+			}
+		}
+		for _, rel := range tt.tracked {
+			if ignore.match(rel) {
+				t.Errorf("manifest %s: %s is ignored by %q", tt.manifestPath, rel, patterns)
+			}
+		}
+	}
+}
+
+func TestManifestWatch(t *testing.T) {
+	root := t.TempDir()
+	writeTestFiles(t, root, map[string]string{"a.txt": "alpha", "dir/b.txt": "bravo", "dir/c.txt": "charlie", "d.txt": "delta"})
+	manifestPath := filepath.Join(root, "m.csv")
+	opts := WatchOptions{Debounce: time.Second}
+	opts.Ignore = manifestIgnorePatterns(root, manifestPath)
+	ignore, err := newIgnoreRules(opts.Ignore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+	w := &manifestWatch{root: root, manifestPath: manifestPath, opts: opts, ignore: ignore, watcher: watcher, changes: map[string]*FileInfo{}, dirty: map[string]time.Time{}}
+
+	// The initial scan creates the manifest without listing it.
+	if err := w.rescan(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	paths := func() []string {
+		entries, err := readManifest(manifestPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var paths []string
+		for _, entry := range entries {
+			paths = append(paths, entry.Path)
+		}
+		return paths
+	}
+	if got := paths(); !slices.Equal(got, []string{"a.txt", "d.txt", "dir/b.txt", "dir/c.txt"}) {
+		t.Fatalf("manifest = %v", got)
+	}
+
+	writeTestFiles(t, root, map[string]string{"a.txt": "alpha, changed", "e.txt": "echo"})
+	if err := os.RemoveAll(filepath.Join(root, "dir")); err != nil {
+		t.Fatal(err)
+	}
+	events := time.Now()
+	for _, rel := range []string{"a.txt", "e.txt", "dir"} {
+		w.dirty[rel] = events
+	}
+	if err := w.processQuiet(context.Background(), events.Add(opts.Debounce)); err != nil {
+		t.Fatal(err)
+	}
+	if len(w.dirty) != 0 || len(w.changes) != 4 {
+		t.Errorf("%d dirty paths and %d changes, want 0 and 4", len(w.dirty), len(w.changes))
+	}
+	if err := w.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(w.changes) != 0 {
+		t.Errorf("%d changes after the flush", len(w.changes))
+	}
+	entries, err := readManifest(manifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 || entries[0].Path != "a.txt" || entries[0].Hash != md5Hex("alpha, changed") || entries[1].Path != "d.txt" || entries[2].Path != "e.txt" {
+		t.Errorf("manifest after the changes = %v", entries)
+	}
+
+	// A rescan does not pick up the manifest's backups or temporary files either.
+	writeTestFiles(t, root, map[string]string{"m.csv.1": "old manifest", ".ssync-1-m.csv": "temporary"})
+	if err := w.rescan(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := paths(); !slices.Equal(got, []string{"a.txt", "d.txt", "e.txt"}) {
+		t.Errorf("manifest after a rescan = %v", got)
+	}
+}
@@ -0,0 +1,213 @@
+// Package ssync creates, updates and compares manifests of directory trees.
+// It is the library behind the ssync command line tool.
+//
+// The functions take an option struct, report what happens along the way through
+// an optional EventHandler and return a typed result. They stop and return the
+// context's error when ctx is cancelled.
+//
+// A manifest is a CSV file listing every regular file below a directory with its
+// modified time, size, hash and NTFS file ID, in manifest order. Files that could
+// not be read are listed with an error instead of a hash. Manifests whose
+// name ends with ".gz" or ".zst" are compressed.
+package ssync
+
+import (
+	"context"
+	"io"
+	"net"
+
+	"github.com/shi0rik0/ssync/internal/core"
+)
+
+type (
+	// FileInfo is one entry of a manifest.
+	FileInfo = core.FileInfo
+	// Manifest describes a manifest file that has been written.
+	Manifest = core.Manifest
+
+	// Event is one of *ProgressEvent, *WarningEvent, *ChangeEvent, *DifferenceEvent or *FlushEvent.
+	Event = core.Event
+	// EventHandler receives the events of an operation, in order, from the goroutine running it.
+	EventHandler    = core.EventHandler
+	ProgressEvent   = core.ProgressEvent
+	WarningEvent    = core.WarningEvent
+	ChangeEvent     = core.ChangeEvent
+	DifferenceEvent = core.DifferenceEvent
+	FlushEvent      = core.FlushEvent
+
+	// ChangeKind classifies what UpdateManifest did with a path.
+	ChangeKind    = core.ChangeKind
+	FileChange    = core.FileChange
+	ChangeCount   = core.ChangeCount
+	ChangeSummary = core.ChangeSummary
+
+	// Difference is a path that differs between the two sides of a comparison.
+	Difference = core.Difference
+
+	// ErrorPolicy decides what happens when a file cannot be read. The zero value skips such files.
+	ErrorPolicy = core.ErrorPolicy
+
+	CreateOptions  = core.CreateOptions
+	UpdateOptions  = core.UpdateOptions
+	UpdateResult   = core.UpdateResult
+	CompareOptions = core.CompareOptions
+	CompareResult  = core.CompareResult
+	WatchOptions   = core.WatchOptions
+	ServeOptions   = core.ServeOptions
+	BackupOptions  = core.BackupOptions
+	RestoreOptions = core.RestoreOptions
+	Snapshot       = core.Snapshot
+	Generation     = core.Generation
+	HistoryEvent   = core.HistoryEvent
+	DupesOptions   = core.DupesOptions
+	DuplicateGroup = core.DuplicateGroup
+	DuplicateFile  = core.DuplicateFile
+	ManifestStats  = core.ManifestStats
+	StatsBucket    = core.StatsBucket
+	StatsFile      = core.StatsFile
+	DirectoryUsage = core.DirectoryUsage
+	FindOptions    = core.FindOptions
+	DirectoryEntry = core.DirectoryEntry
+	RerootOptions  = core.RerootOptions
+	MergeInput     = core.MergeInput
+)
+
+// Stages reported by ProgressEvent.
+const (
+	StageScan    = core.StageScan
+	StageHash    = core.StageHash
+	StageVerify  = core.StageVerify
+	StageCompare = core.StageCompare
+	StageSync    = core.StageSync
+	StageBackup  = core.StageBackup
+	StageRestore = core.StageRestore
+)
+
+const (
+	ChangeUnchanged  = core.ChangeUnchanged
+	ChangeMoved      = core.ChangeMoved
+	ChangeModified   = core.ChangeModified
+	ChangeNew        = core.ChangeNew
+	ChangeRehashed   = core.ChangeRehashed
+	ChangeDeleted    = core.ChangeDeleted
+	ChangeVerified   = core.ChangeVerified
+	ChangeSuspect    = core.ChangeSuspect
+	ChangeUnreadable = core.ChangeUnreadable
+)
+
+// CreateManifest hashes every file below root and writes a manifest of them to manifestPath.
+// The manifest only replaces manifestPath once it is complete.
+//
+// If ctx is cancelled, the files hashed so far are saved as a partial manifest, which is
+// returned together with the context's error. CreateOptions.Resume continues from it.
+func CreateManifest(ctx context.Context, root, manifestPath string, opts CreateOptions) (*Manifest, error) {
+	return core.CreateManifest(ctx, root, manifestPath, opts)
+}
+
+// UpdateManifest writes a new manifest for root, reusing the hashes of the old manifest
+// for files whose modified time and size did not change, including files that were moved.
+// Each path is explained by a ChangeEvent.
+//
+// If ctx is cancelled, what is known so far is saved as a partial manifest, which is
+// returned together with the context's error. UpdateOptions.Resume continues from it.
+func UpdateManifest(ctx context.Context, root, oldManifestPath string, opts UpdateOptions) (*UpdateResult, error) {
+	return core.UpdateManifest(ctx, root, oldManifestPath, opts)
+}
+
+// Compare compares the files below two directories and reports each difference as a DifferenceEvent.
+func Compare(ctx context.Context, left, right string, opts CompareOptions) (*CompareResult, error) {
+	return core.CompareDirectories(ctx, left, right, opts)
+}
+
+// WatchManifest keeps the manifest of root up to date until ctx is cancelled, re-hashing only
+// the files that change. The manifest is written atomically every WatchOptions.FlushInterval
+// while it has changes, and before WatchManifest returns.
+func WatchManifest(ctx context.Context, root, manifestPath string, opts WatchOptions) error {
+	return core.WatchManifest(ctx, root, manifestPath, opts)
+}
+
+// Serve exposes root over HTTP on listener until ctx is cancelled: its manifest, brought up to
+// date on every request, and the content of its files, with range requests. The URL of the
+// server can be used in place of a directory by Compare and by the ssync command line tool.
+func Serve(ctx context.Context, root, manifestPath string, listener net.Listener, opts ServeOptions) error {
+	return core.ServeDirectory(ctx, root, manifestPath, listener, opts)
+}
+
+// RunAgent answers the requests of a client of the agent protocol on rw until the client closes
+// the stream. This is what 'ssync agent' runs on its standard input and output.
+func RunAgent(ctx context.Context, rw io.ReadWriter) error {
+	return core.RunAgent(ctx, rw)
+}
+
+// Backup stores the files below root in the backup repository at repoPath, creating it if needed,
+// and records them as a new snapshot. Each content is stored once, however many files and snapshots share it.
+func Backup(ctx context.Context, root, repoPath string, opts BackupOptions) (*Snapshot, error) {
+	return core.BackupDirectory(ctx, root, repoPath, opts)
+}
+
+// Restore rebuilds the files of a snapshot below target. id may be "latest".
+func Restore(ctx context.Context, repoPath, id, target string, opts RestoreOptions) (*Snapshot, error) {
+	return core.RestoreSnapshot(ctx, repoPath, id, target, opts)
+}
+
+// ListSnapshots returns the snapshots of the backup repository at repoPath, oldest first.
+func ListSnapshots(repoPath string) ([]Snapshot, error) {
+	return core.ListSnapshots(repoPath)
+}
+
+// RecordGeneration adds the manifest at manifestPath to the manifest history in historyDir as its
+// newest generation. Generations are mostly stored as the changes from the previous one.
+func RecordGeneration(historyDir, manifestPath string) (*Generation, error) {
+	return core.RecordGeneration(historyDir, manifestPath)
+}
+
+// ListGenerations returns the generations of the manifest history in historyDir, oldest first.
+func ListGenerations(historyDir string) ([]Generation, error) {
+	return core.ListGenerations(historyDir)
+}
+
+// FileHistory returns how the files at or below path changed across the generations of the
+// manifest history in historyDir: when they appeared, changed, moved or disappeared.
+func FileHistory(historyDir, path string) ([]HistoryEvent, error) {
+	return core.FileHistory(historyDir, path)
+}
+
+// FindDuplicates groups the files of one or more manifests by size and hash and returns the
+// groups of identical files, most wasted bytes first. Only DupesOptions.Verify reads the files.
+func FindDuplicates(ctx context.Context, manifestPaths []string, opts DupesOptions) ([]DuplicateGroup, error) {
+	return core.FindDuplicates(ctx, manifestPaths, opts)
+}
+
+// Stats summarizes the files of a manifest: their size, extension and age distribution
+// and the top largest files.
+func Stats(ctx context.Context, manifestPath string, top int) (*ManifestStats, error) {
+	return core.StatsForManifest(ctx, manifestPath, top)
+}
+
+// DiskUsage adds up the files of a manifest per directory, for dir ("" for the root)
+// and the directories below it down to depth levels.
+func DiskUsage(ctx context.Context, manifestPath, dir string, depth int) ([]DirectoryUsage, error) {
+	return core.DiskUsage(ctx, manifestPath, dir, depth)
+}
+
+// Find calls fn for every entry of a manifest selected by opts, in the order of the manifest.
+func Find(ctx context.Context, manifestPath string, opts FindOptions, fn func(fileInfo FileInfo) error) error {
+	return core.FindInManifest(ctx, manifestPath, opts, fn)
+}
+
+// ListDirectory returns the files and directories directly below dir ("" for the root) in a manifest.
+func ListDirectory(ctx context.Context, manifestPath, dir string) ([]DirectoryEntry, error) {
+	return core.ListDirectory(ctx, manifestPath, dir)
+}
+
+// SplitManifest writes a manifest of the files below dir with paths relative to dir,
+// so that it describes dir as a root of its own.
+func SplitManifest(ctx context.Context, manifestPath, dir, outputPath string, opts RerootOptions) (*Manifest, error) {
+	return core.SplitManifest(ctx, manifestPath, dir, outputPath, opts)
+}
+
+// MergeManifests combines manifests into one, putting the files of each below its prefix.
+// It fails without writing anything if two files end up at the same path.
+func MergeManifests(ctx context.Context, inputs []MergeInput, outputPath string, opts RerootOptions) (*Manifest, error) {
+	return core.MergeManifests(ctx, inputs, outputPath, opts)
+}